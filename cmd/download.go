@@ -15,6 +15,7 @@ type downloadFlags struct {
 	forUpdate  bool
 	skipVerify bool
 	cosignKey  string
+	platform   string
 }
 
 var dlFlags downloadFlags
@@ -37,6 +38,11 @@ for later use. The image can be used for:
 Multiple installation images can be staged (e.g., different editions),
 but only one update image at a time.
 
+Use --platform to download an image for another machine from a
+multi-platform image, e.g. linux/arm64 when building an arm64 ISO on amd64.
+Update images are downloaded for the platform the system was installed for,
+and --for-update refuses any other.
+
 Examples:
   # Download image for embedding in an ISO
   nbc download --image quay.io/example/myimage:latest --for-install
@@ -47,6 +53,9 @@ Examples:
   # Download specific update image
   nbc download --image quay.io/example/myimage:v2.0 --for-update
 
+  # Download an arm64 image for an ISO built on another machine
+  nbc download --image quay.io/example/myimage:latest --for-install --platform linux/arm64
+
   # JSON output for scripting
   nbc download --image quay.io/example/myimage:latest --for-install --json`,
 	RunE: runDownload,
@@ -60,6 +69,7 @@ func init() {
 	downloadCmd.Flags().BoolVar(&dlFlags.forUpdate, "for-update", false, "Save to staged-update cache (for offline updates)")
 	downloadCmd.Flags().BoolVar(&dlFlags.skipVerify, "insecure-skip-verify", false, "Skip cosign signature verification of the image (not recommended)")
 	downloadCmd.Flags().StringVar(&dlFlags.cosignKey, "cosign-key", "", "Path to a cosign public key to verify the image against (default: embedded frostyard key)")
+	downloadCmd.Flags().StringVar(&dlFlags.platform, "platform", "", "Image platform to download, e.g. linux/arm64 (default: this machine's, or the installed one with --for-update)")
 }
 
 func runDownload(cmd *cobra.Command, args []string) error {
@@ -76,6 +86,11 @@ func runDownload(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("--image is required when using --for-install")
 	}
 
+	platform, err := pkg.ParsePlatform(dlFlags.platform)
+	if err != nil {
+		return err
+	}
+
 	// For --for-update, use system config if --image not specified
 	if dlFlags.forUpdate && dlFlags.image == "" {
 		config, err := pkg.ReadSystemConfig()
@@ -110,6 +125,15 @@ func runDownload(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("failed to read system config: %w\n\nIs this system installed with nbc?", err)
 		}
 
+		// Updates must be for the platform the system was installed for
+		platform, err = pkg.UpdatePlatform(config.Platform, platform)
+		if err != nil {
+			if clix.JSONOutput {
+				return clix.OutputJSONError("platform mismatch", err)
+			}
+			return err
+		}
+
 		// Get remote digest of new image
 		remoteDigest, err := pkg.GetRemoteImageDigest(cmd.Context(), dlFlags.image)
 		if err != nil {
@@ -156,6 +180,7 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	cache.SetVerbose(clix.Verbose)
 	cache.SkipVerify = dlFlags.skipVerify
 	cache.CosignKeyPath = dlFlags.cosignKey
+	cache.Platform = platform
 
 	if !clix.JSONOutput {
 		if dlFlags.forInstall {
@@ -200,6 +225,7 @@ func runDownload(cmd *cobra.Command, args []string) error {
 			CacheDir:     cacheDir,
 			SizeBytes:    metadata.SizeBytes,
 			Architecture: metadata.Architecture,
+			Platform:     metadata.Platform,
 			OSName:       metadata.OSReleasePrettyName,
 		}
 		clix.OutputJSON(output)
@@ -211,6 +237,9 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	fmt.Printf("  Image:        %s\n", metadata.ImageRef)
 	fmt.Printf("  Digest:       %s\n", metadata.ImageDigest)
 	fmt.Printf("  Architecture: %s\n", metadata.Architecture)
+	if metadata.Platform != "" {
+		fmt.Printf("  Platform:     %s\n", metadata.Platform)
+	}
 	if metadata.OSReleasePrettyName != "" {
 		fmt.Printf("  OS:           %s\n", metadata.OSReleasePrettyName)
 	}
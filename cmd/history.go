@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/frostyard/clix"
+	"github.com/frostyard/nbc/pkg"
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+type historyFlags struct {
+	limit int
+}
+
+var histFlags historyFlags
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the deployment history",
+	Long: `Show every install and update performed on this system, oldest first.
+
+Each entry is read from the append-only journal at
+/var/lib/nbc/state/history.jsonl on the shared /var partition and records:
+  - When the deployment finished and how long it took
+  - Image reference, digest and kernel version
+  - Target slot and partition
+  - Outcome (success, failed or cancelled) and the error, if any
+  - Version of nbc that performed it
+
+Example:
+  nbc history
+  nbc history --limit 5  # Only the five most recent entries
+  nbc history --json     # Machine-readable output`,
+	RunE: runHistory,
+}
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+
+	historyCmd.Flags().IntVar(&histFlags.limit, "limit", 0, "Show only the N most recent entries (0 shows all)")
+}
+
+func runHistory(cmd *cobra.Command, args []string) error {
+	if histFlags.limit < 0 {
+		err := fmt.Errorf("--limit must not be negative")
+		if clix.JSONOutput {
+			return clix.OutputJSONError("invalid flags", err)
+		}
+		return err
+	}
+
+	records, err := pkg.ReadDeploymentHistory()
+	if err != nil {
+		if clix.JSONOutput {
+			return clix.OutputJSONError("failed to read deployment history", err)
+		}
+		return fmt.Errorf("failed to read deployment history: %w", err)
+	}
+
+	if histFlags.limit > 0 && len(records) > histFlags.limit {
+		records = records[len(records)-histFlags.limit:]
+	}
+
+	if clix.JSONOutput {
+		clix.OutputJSON(types.HistoryOutput{Records: records})
+		return nil
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No deployments recorded.")
+		return nil
+	}
+
+	for _, r := range records {
+		fmt.Printf("%s  %s  %s\n", r.Timestamp, r.Operation, r.Outcome)
+		fmt.Printf("   Image:    %s\n", r.ImageRef)
+		if r.ImageDigest != "" {
+			fmt.Printf("   Digest:   %s\n", r.ImageDigest)
+		}
+		if r.KernelVersion != "" {
+			fmt.Printf("   Kernel:   %s\n", r.KernelVersion)
+		}
+		if r.TargetPartition != "" {
+			fmt.Printf("   Slot:     %s (%s)\n", r.TargetSlot, r.TargetPartition)
+		} else {
+			fmt.Printf("   Slot:     %s\n", r.TargetSlot)
+		}
+		fmt.Printf("   Duration: %.1fs\n", r.DurationSeconds)
+		fmt.Printf("   nbc:      %s\n", r.NBCVersion)
+		if r.Error != "" {
+			fmt.Printf("   Error:    %s\n", r.Error)
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
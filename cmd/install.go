@@ -4,17 +4,20 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/frostyard/clix"
 	"github.com/frostyard/nbc/pkg"
 	"github.com/frostyard/std/reporter"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type installFlags struct {
 	image            string
 	device           string
+	deviceSelector   string
 	skipPull         bool
 	kernelArgs       []string
 	filesystem       string
@@ -29,6 +32,34 @@ type installFlags struct {
 	force            bool
 	skipVerify       bool
 	cosignKey        string
+	bootSize         string
+	rootSize         string
+	varSize          string
+	discoverable     bool
+	uki              bool
+	rootSubvolumes   bool
+	keepDeployments  int
+	tpm2PCRs         string
+	tpm2SigningKey   string
+	flatten          bool
+	selinuxRelabel   bool
+	composefs        bool
+	platform         string
+	bootMode         string
+	configFile       string
+	hostname         string
+	locale           string
+	timezone         string
+	sshKeyFiles      []string
+	groups           []string
+	user             string
+	userGroups       []string
+	userPasswordFile string
+	userSSHKeyFiles  []string
+	userData         string
+	metaData         string
+	networkConfig    string
+	ignition         string
 }
 
 var instFlags installFlags
@@ -43,7 +74,7 @@ This command will:
   1. Validate the target disk
   2. Pull the container image (unless --skip-pull is specified)
   3. Wipe the disk (prompts for confirmation unless --yes/--force is set)
-  4. Create partitions (EFI: 2GB, boot: 1GB, root1: 12GB, root2: 12GB, var: remaining)
+  4. Create partitions (boot/EFI: 2GB, root1: 12GB, root2: 12GB, var: remaining)
   5. Extract container filesystem
   6. Configure system and install bootloader
   7. Verify the installation
@@ -52,6 +83,106 @@ The dual root partitions enable A/B updates for system resilience.
 
 Supported filesystems: btrfs (default), ext4
 
+Partition sizes can be changed with --boot-size, --root-size (each of the two
+root slots) and --var-size, using M, G or T units. --var-size also accepts a
+percentage of the space left after the boot and root partitions. The chosen
+layout is recorded in the system config; updates find the partitions by their
+GPT names.
+
+--discoverable tags the root and var partitions with Discoverable Partitions
+Specification types (the inactive root slot is marked "no-auto") so that
+systemd-gpt-auto-generator mounts /var, and with systemd-boot also /boot,
+leaving a shorter kernel command line. Updates and rollbacks move the
+"no-auto" flag to the slot that is not booted by default. It cannot be
+combined with --encrypt.
+
+--uki (systemd-boot images only) boots a unified kernel image from
+EFI/Linux/ instead of a separate kernel and initramfs. The UKI is built with
+ukify, from the image's prebuilt /usr/lib/modules/$KVER/*.efi when present,
+and embeds the slot's kernel command line. Updates keep the previous slot's
+UKI for rollback.
+
+--root-subvolumes (btrfs only) creates a single root partition (24G by
+default, see --root-size) instead of the two root slots. Every deployment is a
+btrfs subvolume on it: updates snapshot the running deployment, apply the new
+image to the snapshot and boot it with rootflags=subvol=. Updates keep the
+newest --keep-deployments deployments (default 3) in the boot menu. It cannot
+be combined with --encrypt, --discoverable or --uki.
+
+--tpm2 enrolls a TPM2 key without PCR binding by default. --tpm2-pcrs seals it
+to PCRs that updates don't change (e.g. 7, the Secure Boot state); updates
+re-seal keys that stopped unsealing, e.g. after a firmware update, reusing or
+asking for the passphrase. --tpm2-pcr-signing-key (with --uki) binds the key to
+a signed PCR 11 policy instead: every UKI nbc builds has its PCR 11 values
+signed with the key, which is kept in /var/lib/nbc/state for updates. Root on
+the running system can therefore sign UKIs that unseal the disk; the policy
+only keeps out kernels booted from elsewhere.
+
+--flatten downloads and decompresses the image layers concurrently and writes
+every path of the final filesystem once, instead of writing files that later
+layers replace or delete. Images whose layers cannot be merged, such as files
+below a symlink from an earlier layer, are extracted layer by layer.
+
+Extended attributes in the image, such as file capabilities and SELinux
+labels, are kept. --selinux-relabel additionally labels every file with the
+file contexts of the image's SELinux policy, as podman does for containers of
+the image; updates then relabel each new root too. It needs setfiles
+(policycoreutils) on the host.
+
+--composefs stores each root slot as a content-addressed object store with
+fs-verity enabled and boots a composefs image of it, mounted by the initramfs
+by the fs-verity digest on the kernel command line. Changes to the files or
+metadata of a slot then fail the boot or the read instead of going unnoticed.
+It needs mkcomposefs on the host, composefs (mount.composefs) in the image and
+a kernel with EROFS and overlayfs verity support (6.6 or newer). Not supported
+with --root-subvolumes.
+
+--platform installs for another machine: it selects the image pulled from a
+multi-platform image and the architecture the bootloader is installed for,
+e.g. linux/arm64 to install to an arm64 board's disk from an amd64 host. The
+platform is recorded in the system config, and updates refuse images for any
+other platform.
+
+--boot-mode selects how the installed system boots: uefi, or bios for legacy
+BIOS firmware such as SeaBIOS. By default it is the mode this machine booted
+with (bios when /sys/firmware/efi is missing). BIOS mode adds a 1M BIOS boot
+partition (type EF02) and installs GRUB2 (i386-pc) to the disk's MBR; the
+grub.cfg and A/B updates are the same as with UEFI. It needs an amd64 image
+using GRUB2 and GRUB's i386-pc modules on the host, and cannot be combined
+with --uki.
+
+--device-selector picks the target disk by its properties instead of its
+device name, which can change between boots: a comma separated list of terms
+that must all match, out of model=, serial=, id= (a /dev/disk/by-id name),
+their case-insensitive substring forms model~=, serial~= and id~=,
+transport= (nvme, sata, usb, virtio, scsi or mmc), minsize=, maxsize=,
+removable=true|false, and largest or smallest to pick one of several matches.
+The install fails unless exactly one disk is picked; --dry-run shows which.
+"nbc list" shows the properties of each disk.
+
+--hostname, --locale, --timezone, --ssh-key-file (root's authorized_keys),
+--group and --user with its --user-* options provision the installed system.
+They are written to the upper layer of the /etc overlay
+(/var/lib/nbc/etc-overlay/upper) rather than the image's /etc, so they survive
+A/B updates, and the user's home directory is created on /var. --user creates
+one user, or updates a user the image already has; groups given to --group are
+created unless the image has them. Use --config for more users.
+
+--cloud-init-user-data places a cloud-init user-data file, with the optional
+--cloud-init-meta-data and --cloud-init-network-config, in the NoCloud seed
+directory /var/lib/cloud/seed/nocloud for cloud-init in the image to apply on
+first boot. --ignition instead applies an Ignition config (spec 3.x) at
+install time: its users and groups, its files, directories and links below
+/etc (to the /etc overlay) and /var, and its systemd units. Configs using
+anything else, such as remote sources or storage.disks, are refused.
+
+--config installs from a declarative install spec, a YAML (or JSON) file, or
+TOML for a file ending in .toml, covering the options above as well as the
+hostname, root password hash, SSH keys and users of the installed system,
+which are written to the /etc overlay so they survive updates. It cannot be
+combined with the other install options except --yes. Errors name the field of the spec at fault. interactive-install
+--export writes such a file from its answers. See the README for the format.
+
 With --json flag, outputs streaming JSON Lines for progress updates.
 
 Loopback Installation:
@@ -67,6 +198,22 @@ Example:
   nbc install --image localhost/myimage --device /dev/sda --yes  # Skip confirmation for automation
   nbc install --local-image sha256:abc123 --device /dev/sda  # Use staged image
   nbc install --device /dev/sda  # Auto-detect staged image on ISO
+  nbc install --image localhost/myimage --device /dev/sda --root-size 20G --var-size 50%
+  nbc install --image localhost/myimage --device /dev/mmcblk0 --boot-size 1G --root-size 6G
+  nbc install --image localhost/myimage --device-selector 'transport=nvme,removable=false,largest'
+  nbc install --image localhost/myimage --device-selector 'model~=Samsung,minsize=64G' --dry-run
+  nbc install --image localhost/myimage --device /dev/sda --discoverable
+  nbc install --image localhost/myimage --device /dev/sda --uki
+  nbc install --image localhost/myimage --device /dev/sda --root-subvolumes --keep-deployments 5
+  nbc install --image quay.io/example/myimage:latest --device /dev/sdb --platform linux/arm64
+  nbc install --image localhost/myimage --device /dev/sda --boot-mode bios
+  nbc install --image localhost/myimage --device /dev/sda --encrypt --keyfile ./pass --tpm2 --tpm2-pcrs 7
+  nbc install --config install.yaml --yes
+  nbc install --image localhost/myimage --device /dev/sda --hostname kiosk-01 --timezone Europe/Berlin --locale en_US.UTF-8
+  nbc install --image localhost/myimage --device /dev/sda --user admin --user-groups wheel --user-ssh-key-file ~/.ssh/id_ed25519.pub
+  nbc install --image localhost/myimage --device /dev/sda --cloud-init-user-data ./user-data.yaml
+  nbc install --image localhost/myimage --device /dev/sda --ignition ./config.ign
+  nbc install --image localhost/myimage --device /dev/sda --uki --encrypt --keyfile ./pass --tpm2 --tpm2-pcr-signing-key ./pcr-key.pem
 
   # Loopback installation
   nbc install --image quay.io/example/myimage:latest --via-loopback ./disk.img
@@ -80,17 +227,46 @@ func init() {
 
 	installCmd.Flags().StringVarP(&instFlags.image, "image", "i", "", "Container image reference (required unless --local-image or staged image exists)")
 	installCmd.Flags().StringVarP(&instFlags.device, "device", "d", "", "Target disk device (required)")
+	installCmd.Flags().StringVar(&instFlags.deviceSelector, "device-selector", "", "Pick the target disk by its properties, e.g. 'model~=Samsung,minsize=64G' (instead of --device)")
 	installCmd.Flags().BoolVar(&instFlags.skipPull, "skip-pull", false, "Skip pulling the image (use already pulled image)")
 	installCmd.Flags().BoolVar(&instFlags.skipVerify, "insecure-skip-verify", false, "Skip cosign signature verification of the image (not recommended)")
 	installCmd.Flags().StringVar(&instFlags.cosignKey, "cosign-key", "", "Path to a cosign public key to verify the image against (default: embedded frostyard key)")
+	installCmd.Flags().BoolVar(&instFlags.flatten, "flatten", false, "Read image layers concurrently and write each path of the flattened image once")
+	installCmd.Flags().BoolVar(&instFlags.selinuxRelabel, "selinux-relabel", false, "Label files with the image's SELinux policy, on install and every update (requires setfiles)")
+	installCmd.Flags().BoolVar(&instFlags.composefs, "composefs", false, "Boot fs-verity protected composefs images of the root slots (requires mkcomposefs)")
+	installCmd.Flags().StringVar(&instFlags.platform, "platform", "", "Image platform to install, e.g. linux/arm64 (default: this machine's)")
+	installCmd.Flags().StringVar(&instFlags.bootMode, "boot-mode", "auto", "Firmware interface to boot with: auto, uefi or bios (auto uses this machine's)")
+	installCmd.Flags().StringVar(&instFlags.configFile, "config", "", "Install from a YAML, JSON or TOML install spec instead of the other install options")
 	installCmd.Flags().StringArrayVarP(&instFlags.kernelArgs, "karg", "k", []string{}, "Kernel argument to pass (can be specified multiple times)")
 	installCmd.Flags().StringVarP(&instFlags.filesystem, "filesystem", "f", "btrfs", "Filesystem type for root and var partitions (ext4, btrfs)")
+	installCmd.Flags().StringVar(&instFlags.bootSize, "boot-size", "", "Boot/EFI partition size, e.g. 1G (default 2G)")
+	installCmd.Flags().StringVar(&instFlags.rootSize, "root-size", "", "Size of each root partition, e.g. 20G (default 12G)")
+	installCmd.Flags().StringVar(&instFlags.varSize, "var-size", "", "Var partition size (e.g. 100G) or percentage of remaining space (e.g. 50%) (default: all remaining space)")
+	installCmd.Flags().BoolVar(&instFlags.discoverable, "discoverable", false, "Tag partitions with Discoverable Partitions Specification types for systemd-gpt-auto-generator")
+	installCmd.Flags().BoolVar(&instFlags.uki, "uki", false, "Boot a unified kernel image with the kernel command line embedded (systemd-boot only, requires ukify)")
+	installCmd.Flags().BoolVar(&instFlags.rootSubvolumes, "root-subvolumes", false, "Use a single btrfs root partition with a subvolume per deployment instead of two root slots")
+	installCmd.Flags().IntVar(&instFlags.keepDeployments, "keep-deployments", 0, "Number of deployments updates keep with --root-subvolumes (default 3, minimum 2)")
 	installCmd.Flags().BoolVar(&instFlags.encrypt, "encrypt", false, "Enable LUKS full disk encryption for root and var partitions")
 	installCmd.Flags().StringVar(&instFlags.passphrase, "passphrase", "", "LUKS passphrase (required when --encrypt is set, unless --keyfile is provided)")
 	installCmd.Flags().StringVar(&instFlags.keyfile, "keyfile", "", "Path to file containing LUKS passphrase (alternative to --passphrase)")
-	installCmd.Flags().BoolVar(&instFlags.tpm2, "tpm2", false, "Enroll TPM2 for automatic LUKS unlock (no PCR binding)")
+	installCmd.Flags().BoolVar(&instFlags.tpm2, "tpm2", false, "Enroll TPM2 for automatic LUKS unlock (no PCR binding unless --tpm2-pcrs or --tpm2-pcr-signing-key is set)")
+	installCmd.Flags().StringVar(&instFlags.tpm2PCRs, "tpm2-pcrs", "", "Seal the TPM2 key to these PCRs, e.g. 7 or 7+14 (only PCRs that updates don't change)")
+	installCmd.Flags().StringVar(&instFlags.tpm2SigningKey, "tpm2-pcr-signing-key", "", "PEM private key to bind the TPM2 key to a signed PCR 11 policy (requires --uki)")
 	installCmd.Flags().StringVar(&instFlags.localImage, "local-image", "", "Use staged local image by digest (auto-detects from /var/cache/nbc/staged-install/ if not specified)")
 	installCmd.Flags().StringVar(&instFlags.rootPasswordFile, "root-password-file", "", "Path to file containing root password to set during installation")
+	installCmd.Flags().StringVar(&instFlags.hostname, "hostname", "", "Hostname of the installed system")
+	installCmd.Flags().StringVar(&instFlags.locale, "locale", "", "Locale of the installed system, e.g. en_US.UTF-8")
+	installCmd.Flags().StringVar(&instFlags.timezone, "timezone", "", "Timezone of the installed system, e.g. Europe/Berlin")
+	installCmd.Flags().StringArrayVar(&instFlags.sshKeyFiles, "ssh-key-file", []string{}, "authorized_keys file with SSH keys to install for root (can be specified multiple times)")
+	installCmd.Flags().StringArrayVar(&instFlags.groups, "group", []string{}, "Group to create unless the image has it (can be specified multiple times)")
+	installCmd.Flags().StringVar(&instFlags.user, "user", "", "User to create, or to update when the image has it")
+	installCmd.Flags().StringSliceVar(&instFlags.userGroups, "user-groups", []string{}, "Supplementary groups of --user, e.g. wheel")
+	installCmd.Flags().StringVar(&instFlags.userPasswordFile, "user-password-file", "", "Path to file containing the password of --user")
+	installCmd.Flags().StringArrayVar(&instFlags.userSSHKeyFiles, "user-ssh-key-file", []string{}, "authorized_keys file with SSH keys to install for --user (can be specified multiple times)")
+	installCmd.Flags().StringVar(&instFlags.userData, "cloud-init-user-data", "", "cloud-init user-data file to seed for first boot (NoCloud)")
+	installCmd.Flags().StringVar(&instFlags.metaData, "cloud-init-meta-data", "", "cloud-init meta-data file to seed with --cloud-init-user-data")
+	installCmd.Flags().StringVar(&instFlags.networkConfig, "cloud-init-network-config", "", "cloud-init network-config file to seed with --cloud-init-user-data")
+	installCmd.Flags().StringVar(&instFlags.ignition, "ignition", "", "Ignition config file (spec 3.x) to apply at install time")
 	installCmd.Flags().StringVar(&instFlags.viaLoopback, "via-loopback", "", "Path to create a loopback disk image file for installation (instead of --device)")
 	installCmd.Flags().IntVar(&instFlags.imageSize, "image-size", pkg.DefaultLoopbackSizeGB, "Size of loopback image in GB (minimum 35GB, default 35GB)")
 	installCmd.Flags().BoolVar(&instFlags.force, "force", false, "Skip destructive-action confirmation and overwrite existing loopback image file")
@@ -101,14 +277,30 @@ func init() {
 }
 
 func runInstall(cmd *cobra.Command, args []string) error {
-	// Build configuration from flags
-	cfg, err := buildInstallConfig(cmd.Context())
+	// Build configuration from the install spec or the flags
+	var cfg *pkg.InstallConfig
+	var err error
+	if instFlags.configFile != "" {
+		cfg, err = buildInstallConfigFromSpec(cmd, instFlags.configFile)
+	} else {
+		cfg, err = buildInstallConfig(cmd.Context())
+	}
 	if err != nil {
 		return err
 	}
 
 	if installNeedsConfirmation(cfg, instFlags.force, clix.DryRun, clix.JSONOutput) {
-		if err := confirmInstall(cfg.Device); err != nil {
+		target := cfg.Device
+		if cfg.DeviceSelector != "" {
+			disk, err := pkg.ResolveDiskSelector(cfg.DeviceSelector)
+			if err != nil {
+				return fmt.Errorf("failed to select device: %w", err)
+			}
+			// Install to the disk that was confirmed
+			cfg.Device, cfg.DeviceSelector = disk.Device, ""
+			target = disk.Describe()
+		}
+		if err := confirmInstall(target); err != nil {
 			return err
 		}
 	}
@@ -155,7 +347,11 @@ func runInstall(cmd *cobra.Command, args []string) error {
 		fmt.Println("Loopback image created successfully!")
 		fmt.Println()
 		fmt.Println("To boot the image with QEMU:")
-		fmt.Printf("  qemu-system-x86_64 -enable-kvm -m 2048 -drive file=%s,format=raw -bios /usr/share/ovmf/OVMF.fd\n", result.LoopbackPath)
+		if cfg.BootMode == pkg.BootModeBIOS {
+			fmt.Printf("  qemu-system-x86_64 -enable-kvm -m 2048 -drive file=%s,format=raw\n", result.LoopbackPath)
+		} else {
+			fmt.Printf("  qemu-system-x86_64 -enable-kvm -m 2048 -drive file=%s,format=raw -bios /usr/share/ovmf/OVMF.fd\n", result.LoopbackPath)
+		}
 		fmt.Println()
 		fmt.Println("To convert to other formats:")
 		fmt.Printf("  qemu-img convert -f raw -O qcow2 %s disk.qcow2\n", result.LoopbackPath)
@@ -169,7 +365,7 @@ func installNeedsConfirmation(cfg *pkg.InstallConfig, force, dryRun, jsonOutput
 	if cfg == nil {
 		return false
 	}
-	return cfg.Device != "" && cfg.Loopback == nil && !dryRun && !jsonOutput && !force
+	return (cfg.Device != "" || cfg.DeviceSelector != "") && cfg.Loopback == nil && !dryRun && !jsonOutput && !force
 }
 
 func confirmInstall(device string) error {
@@ -201,6 +397,7 @@ func buildInstallConfig(ctx context.Context) (*pkg.InstallConfig, error) {
 	cfg := &pkg.InstallConfig{
 		ImageRef:       instFlags.image,
 		Device:         instFlags.device,
+		DeviceSelector: instFlags.deviceSelector,
 		FilesystemType: instFlags.filesystem,
 		KernelArgs:     instFlags.kernelArgs,
 		RootPassword:   "",
@@ -210,7 +407,22 @@ func buildInstallConfig(ctx context.Context) (*pkg.InstallConfig, error) {
 		SkipPull:       instFlags.skipPull,
 		SkipVerify:     instFlags.skipVerify,
 		CosignKeyPath:  instFlags.cosignKey,
+		Flatten:        instFlags.flatten,
+		SELinuxRelabel: instFlags.selinuxRelabel,
+		Composefs:      instFlags.composefs,
+	}
+
+	platform, err := pkg.ParsePlatform(instFlags.platform)
+	if err != nil {
+		return nil, reportError(err, "Invalid platform")
+	}
+	cfg.Platform = platform
+
+	bootMode, err := pkg.ParseBootMode(instFlags.bootMode)
+	if err != nil {
+		return nil, reportError(err, "Invalid boot mode")
 	}
+	cfg.BootMode = bootMode
 
 	// Resolve image source: --image, --local-image, or auto-detect from staged-install
 	if instFlags.image != "" && instFlags.localImage != "" {
@@ -236,40 +448,23 @@ func buildInstallConfig(ctx context.Context) (*pkg.InstallConfig, error) {
 			fmt.Printf("  Digest: %s\n", metadata.ImageDigest)
 		}
 	} else if instFlags.image == "" {
-		// Try to auto-detect from staged-install cache
-		cache := pkg.NewStagedInstallCache()
-		images, err := cache.List()
-		if err != nil {
-			return nil, reportError(fmt.Errorf("failed to check staged images: %w", err), "Failed to check staged images")
+		if err := useStagedImage(cfg, "--image", "--local-image", reportError); err != nil {
+			return nil, err
 		}
+	}
 
-		if len(images) == 0 {
-			err := fmt.Errorf("no --image specified and no staged images found in %s", pkg.StagedInstallDir)
-			return nil, reportError(err, "No image specified")
+	// Handle partition layout options
+	if instFlags.bootSize != "" || instFlags.rootSize != "" || instFlags.varSize != "" {
+		layout, err := pkg.ParsePartitionLayout(instFlags.bootSize, instFlags.rootSize, instFlags.varSize)
+		if err != nil {
+			return nil, reportError(err, "Invalid partition layout")
 		}
-
-		if len(images) == 1 {
-			// Auto-select the only staged image
-			localMetadata := &images[0]
-			cfg.LocalImage = &pkg.LocalImageSource{
-				LayoutPath: cache.GetLayoutPath(localMetadata.ImageDigest),
-				Metadata:   localMetadata,
-			}
-			cfg.SkipPull = true
-			if !clix.JSONOutput {
-				fmt.Printf("Auto-detected staged image: %s\n", localMetadata.ImageRef)
-				fmt.Printf("  Digest: %s\n", localMetadata.ImageDigest)
-			}
-		} else {
-			// Multiple staged images - user must choose
-			var b strings.Builder
-			b.WriteString("multiple staged images found, use --local-image to select one:\n")
-			for _, img := range images {
-				fmt.Fprintf(&b, "  %s (%s)\n", img.ImageDigest, img.ImageRef)
-			}
-			err := fmt.Errorf("%s", b.String())
-			return nil, reportError(err, "Multiple staged images found")
+		// --root-size sizes the single root partition of a subvolume layout,
+		// which holds the space of both root slots by default
+		if instFlags.rootSubvolumes && instFlags.rootSize == "" {
+			layout.RootSizeMiB = pkg.DefaultSubvolumeRootSizeMiB
 		}
+		cfg.Layout = layout
 	}
 
 	// Handle encryption options
@@ -297,9 +492,16 @@ func buildInstallConfig(ctx context.Context) (*pkg.InstallConfig, error) {
 			passphrase = strings.TrimRight(string(keyData), "\n\r")
 		}
 
+		pcrs, err := pkg.ParseTPM2PCRs(instFlags.tpm2PCRs)
+		if err != nil {
+			return nil, reportError(fmt.Errorf("invalid --tpm2-pcrs: %w", err), "Invalid encryption options")
+		}
+
 		cfg.Encryption = &pkg.EncryptionOptions{
-			Passphrase: passphrase,
-			TPM2:       instFlags.tpm2,
+			Passphrase:        passphrase,
+			TPM2:              instFlags.tpm2,
+			TPM2PCRs:          pcrs,
+			TPM2PCRSigningKey: instFlags.tpm2SigningKey,
 		}
 	}
 
@@ -308,14 +510,41 @@ func buildInstallConfig(ctx context.Context) (*pkg.InstallConfig, error) {
 		return nil, reportError(err, "Invalid encryption options")
 	}
 
+	if (instFlags.tpm2PCRs != "" || instFlags.tpm2SigningKey != "") && !instFlags.tpm2 {
+		err := fmt.Errorf("--tpm2-pcrs and --tpm2-pcr-signing-key require --tpm2 to be set")
+		return nil, reportError(err, "Invalid encryption options")
+	}
+
+	if instFlags.discoverable {
+		if instFlags.encrypt {
+			err := fmt.Errorf("--discoverable and --encrypt are mutually exclusive")
+			return nil, reportError(err, "Invalid options")
+		}
+		cfg.Discoverable = true
+	}
+	cfg.UKI = instFlags.uki
+
+	if instFlags.keepDeployments != 0 && !instFlags.rootSubvolumes {
+		err := fmt.Errorf("--keep-deployments requires --root-subvolumes to be set")
+		return nil, reportError(err, "Invalid options")
+	}
+	cfg.Subvolumes = instFlags.rootSubvolumes
+	cfg.KeepDeployments = instFlags.keepDeployments
+
 	// Handle device/loopback options
-	if instFlags.device != "" && instFlags.viaLoopback != "" {
-		err := fmt.Errorf("--device and --via-loopback are mutually exclusive")
+	targets := 0
+	for _, target := range []string{instFlags.device, instFlags.deviceSelector, instFlags.viaLoopback} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets > 1 {
+		err := fmt.Errorf("--device, --device-selector and --via-loopback are mutually exclusive")
 		return nil, reportError(err, "Invalid options")
 	}
 
-	if instFlags.device == "" && instFlags.viaLoopback == "" {
-		err := fmt.Errorf("either --device or --via-loopback is required")
+	if targets == 0 {
+		err := fmt.Errorf("either --device, --device-selector or --via-loopback is required")
 		return nil, reportError(err, "Missing target")
 	}
 
@@ -341,5 +570,222 @@ func buildInstallConfig(ctx context.Context) (*pkg.InstallConfig, error) {
 		cfg.RootPassword = strings.TrimRight(string(passwordData), "\n\r")
 	}
 
+	// Provision the hostname, locale, timezone, groups and users
+	provision, err := buildProvisionOptions(ctx)
+	if err != nil {
+		return nil, reportError(err, "Invalid provisioning options")
+	}
+	cfg.Provision = provision
+
+	// Apply cloud-init or Ignition user-data
+	if err := ctx.Err(); err != nil {
+		return nil, reportError(err, "Operation cancelled")
+	}
+	if err := buildUserData(cfg); err != nil {
+		return nil, reportError(err, "Invalid user-data")
+	}
+
+	return cfg, nil
+}
+
+// buildUserData sets the cloud-init seed or Ignition config of cfg from the
+// user-data flags
+func buildUserData(cfg *pkg.InstallConfig) error {
+	if instFlags.userData != "" && instFlags.ignition != "" {
+		return fmt.Errorf("--cloud-init-user-data and --ignition are mutually exclusive")
+	}
+	if instFlags.userData == "" && (instFlags.metaData != "" || instFlags.networkConfig != "") {
+		return fmt.Errorf("--cloud-init-meta-data and --cloud-init-network-config require --cloud-init-user-data")
+	}
+
+	if instFlags.userData != "" {
+		seed := &pkg.CloudInitSeed{}
+		files := []struct {
+			flag, path string
+			data       *[]byte
+		}{
+			{"--cloud-init-user-data", instFlags.userData, &seed.UserData},
+			{"--cloud-init-meta-data", instFlags.metaData, &seed.MetaData},
+			{"--cloud-init-network-config", instFlags.networkConfig, &seed.NetworkConfig},
+		}
+		for _, f := range files {
+			if f.path == "" {
+				continue
+			}
+			data, err := os.ReadFile(f.path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", f.flag, err)
+			}
+			*f.data = data
+		}
+		if err := seed.Validate(); err != nil {
+			return fmt.Errorf("invalid --cloud-init-user-data: %w", err)
+		}
+		cfg.CloudInit = seed
+	}
+
+	if instFlags.ignition != "" {
+		data, err := os.ReadFile(instFlags.ignition)
+		if err != nil {
+			return fmt.Errorf("failed to read Ignition config: %w", err)
+		}
+		ignition, err := pkg.ParseIgnitionConfig(data)
+		if err != nil {
+			return fmt.Errorf("invalid --ignition: %w", err)
+		}
+		cfg.Ignition = ignition
+	}
+	return nil
+}
+
+// buildProvisionOptions constructs the ProvisionOptions of the provisioning
+// flags, or nil when none is given
+func buildProvisionOptions(ctx context.Context) (*pkg.ProvisionOptions, error) {
+	if instFlags.user == "" && (len(instFlags.userGroups) > 0 || instFlags.userPasswordFile != "" || len(instFlags.userSSHKeyFiles) > 0) {
+		return nil, fmt.Errorf("--user-groups, --user-password-file and --user-ssh-key-file require --user")
+	}
+
+	opts := &pkg.ProvisionOptions{
+		Hostname: instFlags.hostname,
+		Locale:   instFlags.locale,
+		Timezone: instFlags.timezone,
+		Groups:   instFlags.groups,
+	}
+	keys, err := readSSHKeyFiles(ctx, instFlags.sshKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	opts.SSHAuthorizedKeys = keys
+
+	if instFlags.user != "" {
+		user := pkg.UserOptions{Name: instFlags.user, Groups: instFlags.userGroups}
+		if instFlags.userPasswordFile != "" {
+			passwordData, err := os.ReadFile(instFlags.userPasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read user password file: %w", err)
+			}
+			if password := strings.TrimRight(string(passwordData), "\n\r"); password != "" {
+				if user.PasswordHash, err = pkg.HashPassword(password); err != nil {
+					return nil, fmt.Errorf("failed to hash user password: %w", err)
+				}
+			}
+		}
+		if user.SSHAuthorizedKeys, err = readSSHKeyFiles(ctx, instFlags.userSSHKeyFiles); err != nil {
+			return nil, err
+		}
+		opts.Users = []pkg.UserOptions{user}
+	}
+
+	if opts.Empty() {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// readSSHKeyFiles reads the keys of authorized_keys files, skipping blank
+// lines and comments
+func readSSHKeyFiles(ctx context.Context, paths []string) ([]string, error) {
+	var keys []string
+	for _, path := range paths {
+		// Check for cancellation before file I/O
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key file: %w", err)
+		}
+		for line := range strings.Lines(string(data)) {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// useStagedImage sets cfg to install the image staged in the staged-install
+// cache when no image is given, as long as there is exactly one. imageOpt and
+// localImageOpt name the options giving the image in errors.
+func useStagedImage(cfg *pkg.InstallConfig, imageOpt, localImageOpt string, reportError func(error, string) error) error {
+	cache := pkg.NewStagedInstallCache()
+	images, err := cache.List()
+	if err != nil {
+		return reportError(fmt.Errorf("failed to check staged images: %w", err), "Failed to check staged images")
+	}
+
+	if len(images) == 0 {
+		err := fmt.Errorf("no %s specified and no staged images found in %s", imageOpt, pkg.StagedInstallDir)
+		return reportError(err, "No image specified")
+	}
+
+	if len(images) > 1 {
+		// Multiple staged images - user must choose
+		var b strings.Builder
+		fmt.Fprintf(&b, "multiple staged images found, use %s to select one:\n", localImageOpt)
+		for _, img := range images {
+			fmt.Fprintf(&b, "  %s (%s)\n", img.ImageDigest, img.ImageRef)
+		}
+		err := fmt.Errorf("%s", b.String())
+		return reportError(err, "Multiple staged images found")
+	}
+
+	// Auto-select the only staged image
+	localMetadata := &images[0]
+	cfg.LocalImage = &pkg.LocalImageSource{
+		LayoutPath: cache.GetLayoutPath(localMetadata.ImageDigest),
+		Metadata:   localMetadata,
+	}
+	cfg.SkipPull = true
+	if !clix.JSONOutput {
+		fmt.Printf("Auto-detected staged image: %s\n", localMetadata.ImageRef)
+		fmt.Printf("  Digest: %s\n", localMetadata.ImageDigest)
+	}
+	return nil
+}
+
+// buildInstallConfigFromSpec constructs an InstallConfig from the install
+// spec file at path. The spec replaces the install options, so only --config
+// and --yes/--force may be given.
+func buildInstallConfigFromSpec(cmd *cobra.Command, path string) (*pkg.InstallConfig, error) {
+	progress := clix.NewReporter()
+	reportError := func(err error, msg string) error {
+		progress.Error(err, msg)
+		return err
+	}
+
+	var conflicting []string
+	cmd.LocalNonPersistentFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed && f.Name != "config" && f.Name != "force" && f.Name != "yes" {
+			conflicting = append(conflicting, "--"+f.Name)
+		}
+	})
+	if len(conflicting) > 0 {
+		err := fmt.Errorf("--config cannot be combined with %s, set them in the install spec", strings.Join(conflicting, ", "))
+		return nil, reportError(err, "Invalid options")
+	}
+
+	spec, err := pkg.LoadInstallSpec(path)
+	if err != nil {
+		return nil, reportError(err, "Invalid install spec")
+	}
+	cfg, err := spec.InstallConfig(filepath.Dir(path))
+	if err != nil {
+		return nil, reportError(fmt.Errorf("%s: %w", path, err), "Invalid install spec")
+	}
+	cfg.Verbose = clix.Verbose
+	cfg.DryRun = clix.DryRun
+	cfg.JSONOutput = clix.JSONOutput
+
+	if cfg.ImageRef == "" && cfg.LocalImage == nil {
+		if err := useStagedImage(cfg, "image", "local_image", reportError); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, reportError(fmt.Errorf("%s: %w", path, err), "Invalid install spec")
+	}
 	return cfg, nil
 }
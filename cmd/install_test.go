@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/frostyard/nbc/pkg"
@@ -54,6 +57,13 @@ func TestInstallNeedsConfirmation(t *testing.T) {
 			jsonOutput: true,
 			want:       false,
 		},
+		{
+			name: "device selector without force",
+			cfg: &pkg.InstallConfig{
+				DeviceSelector: "transport=nvme",
+			},
+			want: true,
+		},
 		{
 			name: "loopback skips confirmation",
 			cfg: &pkg.InstallConfig{
@@ -79,3 +89,28 @@ func TestInstallNeedsConfirmation(t *testing.T) {
 		})
 	}
 }
+
+func TestReadSSHKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(first, []byte("# admins\nssh-ed25519 AAAAone one@example.com\n\n  ssh-rsa AAAAtwo two@example.com  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	second := filepath.Join(dir, "id_ed25519.pub")
+	if err := os.WriteFile(second, []byte("ssh-ed25519 AAAAthree three@example.com"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := readSSHKeyFiles(t.Context(), []string{first, second})
+	if err != nil {
+		t.Fatalf("readSSHKeyFiles() error = %v", err)
+	}
+	want := []string{"ssh-ed25519 AAAAone one@example.com", "ssh-rsa AAAAtwo two@example.com", "ssh-ed25519 AAAAthree three@example.com"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("readSSHKeyFiles() = %q, want %q", keys, want)
+	}
+
+	if _, err := readSSHKeyFiles(t.Context(), []string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("readSSHKeyFiles() should fail on a missing file")
+	}
+}
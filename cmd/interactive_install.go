@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/charmbracelet/huh"
@@ -28,6 +30,14 @@ type interactiveInstallOptions struct {
 	kernelArgs       string
 	rootPassword     string
 	rootPasswordConf string
+	hostname         string
+	timezone         string
+	locale           string
+	userName         string
+	userGroups       string
+	userPassword     string
+	userPasswordConf string
+	sshKey           string
 }
 
 var interactiveInstallCmd = &cobra.Command{
@@ -38,13 +48,23 @@ var interactiveInstallCmd = &cobra.Command{
 This command provides a user-friendly interactive form to configure the installation.
 It prompts for all the options that the regular 'install' command accepts via flags.
 
+--export writes the answers as an install spec for 'nbc install --config',
+in TOML for a .toml file and YAML otherwise, before the final confirmation, so the file is kept even when the installation
+is declined. The root password is written as a SHA-512 crypt hash, and the
+encryption passphrase to a separate .passphrase file next to the spec.
+
 Example:
-  nbc interactive-install`,
+  nbc interactive-install
+  nbc interactive-install --export install.yaml`,
 	RunE: runInteractiveInstall,
 }
 
+var interactiveExportPath string
+
 func init() {
 	RootCmd.AddCommand(interactiveInstallCmd)
+
+	interactiveInstallCmd.Flags().StringVar(&interactiveExportPath, "export", "", "Write the answers as an install spec for 'nbc install --config' to this file")
 }
 
 func runInteractiveInstall(cmd *cobra.Command, args []string) error {
@@ -349,6 +369,124 @@ func runInteractiveInstall(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// Sixth form: System identity, written to the /etc overlay
+	validateProvision := func(p pkg.ProvisionOptions) error {
+		// The field is the input itself, only show what is wrong with it
+		var fieldErr *pkg.FieldError
+		if err := p.Validate(); errors.As(err, &fieldErr) {
+			return fieldErr.Err
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	identityForm := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Hostname").
+				Description("Hostname of the installed system (optional)").
+				Placeholder("kiosk-01").
+				Value(&opts.hostname).
+				Validate(func(s string) error {
+					return validateProvision(pkg.ProvisionOptions{Hostname: s})
+				}),
+
+			huh.NewInput().
+				Title("Timezone").
+				Description("Timezone, e.g. Europe/Berlin (optional, leave empty to keep the image's)").
+				Placeholder("UTC").
+				Value(&opts.timezone).
+				Validate(func(s string) error {
+					return validateProvision(pkg.ProvisionOptions{Timezone: s})
+				}),
+
+			huh.NewInput().
+				Title("Locale").
+				Description("Locale, e.g. en_US.UTF-8 (optional, leave empty to keep the image's)").
+				Placeholder("en_US.UTF-8").
+				Value(&opts.locale).
+				Validate(func(s string) error {
+					return validateProvision(pkg.ProvisionOptions{Locale: s})
+				}),
+		),
+		huh.NewGroup(
+			huh.NewInput().
+				Title("User").
+				Description("Create a user (optional, leave empty to skip)").
+				Placeholder("admin").
+				Value(&opts.userName).
+				Validate(func(s string) error {
+					if s == "" {
+						return nil
+					}
+					return validateProvision(pkg.ProvisionOptions{Users: []pkg.UserOptions{{Name: s}}})
+				}),
+
+			huh.NewInput().
+				Title("User Groups").
+				Description("Comma-separated supplementary groups of the user, which must exist in the image").
+				Placeholder("wheel").
+				Value(&opts.userGroups),
+
+			huh.NewInput().
+				Title("User Password").
+				Description("Password of the user (optional, leave empty to disable password login)").
+				EchoMode(huh.EchoModePassword).
+				Value(&opts.userPassword),
+
+			huh.NewInput().
+				Title("SSH Public Key").
+				Description("authorized_keys line for the user, or root without a user (optional)").
+				Placeholder("ssh-ed25519 AAAA... user@example.com").
+				Value(&opts.sshKey).
+				Validate(func(s string) error {
+					if s == "" {
+						return nil
+					}
+					return validateProvision(pkg.ProvisionOptions{SSHAuthorizedKeys: []string{s}})
+				}),
+		),
+	)
+
+	if err := identityForm.Run(); err != nil {
+		return err
+	}
+
+	// Confirm user password if provided
+	if opts.userName != "" && opts.userPassword != "" {
+		confirmUserPassForm := huh.NewForm(
+			huh.NewGroup(
+				huh.NewInput().
+					Title("Confirm User Password").
+					EchoMode(huh.EchoModePassword).
+					Value(&opts.userPasswordConf).
+					Validate(func(s string) error {
+						if s != opts.userPassword {
+							return fmt.Errorf("passwords do not match")
+						}
+						return nil
+					}),
+			),
+		)
+
+		if err := confirmUserPassForm.Run(); err != nil {
+			return err
+		}
+	}
+
+	// Build InstallConfig from interactive options
+	cfg, err := opts.installConfig()
+	if err != nil {
+		return err
+	}
+
+	if interactiveExportPath != "" {
+		if err := exportInstallSpec(interactiveExportPath, cfg); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote install spec to %s\n", interactiveExportPath)
+	}
+
 	// Final confirmation
 	var confirm bool
 	summaryLines := []string{
@@ -390,6 +528,21 @@ func runInteractiveInstall(cmd *cobra.Command, args []string) error {
 	if opts.rootPassword != "" {
 		summaryLines = append(summaryLines, "  Root Password: [set]")
 	}
+	if opts.hostname != "" {
+		summaryLines = append(summaryLines, fmt.Sprintf("  Hostname: %s", opts.hostname))
+	}
+	if opts.timezone != "" {
+		summaryLines = append(summaryLines, fmt.Sprintf("  Timezone: %s", opts.timezone))
+	}
+	if opts.locale != "" {
+		summaryLines = append(summaryLines, fmt.Sprintf("  Locale: %s", opts.locale))
+	}
+	if opts.userName != "" {
+		summaryLines = append(summaryLines, fmt.Sprintf("  User: %s", opts.userName))
+	}
+	if opts.sshKey != "" {
+		summaryLines = append(summaryLines, "  SSH Key: [set]")
+	}
 
 	// Add appropriate warning based on install target
 	if opts.installTarget == "loopback" {
@@ -426,7 +579,51 @@ func runInteractiveInstall(cmd *cobra.Command, args []string) error {
 	fmt.Println("Starting installation...")
 	fmt.Println()
 
-	// Build InstallConfig from interactive options
+	if cfg.LocalImage != nil {
+		fmt.Printf("Using staged image: %s\n", cfg.LocalImage.Metadata.ImageRef)
+		fmt.Printf("  Digest: %s\n", cfg.LocalImage.Metadata.ImageDigest)
+	}
+
+	// Create installer
+	installer, err := pkg.NewInstaller(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create installer: %w", err)
+	}
+
+	// Run installation
+	result, err := installer.Install(cmd.Context())
+
+	// Always call cleanup if available (handles both success and error cases)
+	if result != nil && result.Cleanup != nil {
+		defer func() {
+			if cleanupErr := result.Cleanup(); cleanupErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to cleanup: %v\n", cleanupErr)
+			}
+		}()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Print loopback usage instructions
+	if result.LoopbackPath != "" {
+		fmt.Println()
+		fmt.Println("Loopback image created successfully!")
+		fmt.Println()
+		fmt.Println("To boot the image with QEMU:")
+		fmt.Printf("  qemu-system-x86_64 -enable-kvm -m 2048 -drive file=%s,format=raw -bios /usr/share/ovmf/OVMF.fd\n", result.LoopbackPath)
+		fmt.Println()
+		fmt.Println("To convert to other formats:")
+		fmt.Printf("  qemu-img convert -f raw -O qcow2 %s disk.qcow2\n", result.LoopbackPath)
+		fmt.Printf("  qemu-img convert -f raw -O vmdk %s disk.vmdk\n", result.LoopbackPath)
+	}
+
+	return nil
+}
+
+// installConfig builds the InstallConfig of the interactive answers
+func (opts *interactiveInstallOptions) installConfig() (*pkg.InstallConfig, error) {
 	cfg := &pkg.InstallConfig{
 		FilesystemType: opts.filesystem,
 		Verbose:        clix.Verbose,
@@ -444,15 +641,13 @@ func runInteractiveInstall(cmd *cobra.Command, args []string) error {
 		cache := pkg.NewStagedInstallCache()
 		_, metadata, err := cache.GetImage(opts.stagedImage)
 		if err != nil {
-			return fmt.Errorf("failed to load staged image: %w", err)
+			return nil, fmt.Errorf("failed to load staged image: %w", err)
 		}
 		cfg.LocalImage = &pkg.LocalImageSource{
 			LayoutPath: cache.GetLayoutPath(metadata.ImageDigest),
 			Metadata:   metadata,
 		}
 		cfg.SkipPull = true
-		fmt.Printf("Using staged image: %s\n", metadata.ImageRef)
-		fmt.Printf("  Digest: %s\n", metadata.ImageDigest)
 	} else {
 		cfg.ImageRef = opts.image
 	}
@@ -462,7 +657,7 @@ func runInteractiveInstall(cmd *cobra.Command, args []string) error {
 		// Parse loopback size
 		loopbackSize, err := pkg.ParseSizeGB(opts.loopbackSizeStr)
 		if err != nil {
-			return fmt.Errorf("invalid loopback size: %w", err)
+			return nil, fmt.Errorf("invalid loopback size: %w", err)
 		}
 
 		cfg.Loopback = &pkg.LoopbackOptions{
@@ -482,40 +677,59 @@ func runInteractiveInstall(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	// Create installer
-	installer, err := pkg.NewInstaller(cfg)
-	if err != nil {
-		return fmt.Errorf("failed to create installer: %w", err)
+	// Set the system identity
+	provision := &pkg.ProvisionOptions{
+		Hostname: opts.hostname,
+		Timezone: opts.timezone,
+		Locale:   opts.locale,
 	}
-
-	// Run installation
-	result, err := installer.Install(cmd.Context())
-
-	// Always call cleanup if available (handles both success and error cases)
-	if result != nil && result.Cleanup != nil {
-		defer func() {
-			if cleanupErr := result.Cleanup(); cleanupErr != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to cleanup: %v\n", cleanupErr)
+	var sshKeys []string
+	if opts.sshKey != "" {
+		sshKeys = []string{strings.TrimSpace(opts.sshKey)}
+	}
+	if opts.userName != "" {
+		user := pkg.UserOptions{Name: opts.userName, SSHAuthorizedKeys: sshKeys}
+		for group := range strings.SplitSeq(opts.userGroups, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				user.Groups = append(user.Groups, group)
 			}
-		}()
+		}
+		if opts.userPassword != "" {
+			hash, err := pkg.HashPassword(opts.userPassword)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash user password: %w", err)
+			}
+			user.PasswordHash = hash
+		}
+		provision.Users = []pkg.UserOptions{user}
+	} else {
+		provision.SSHAuthorizedKeys = sshKeys
 	}
-
-	if err != nil {
-		return err
+	if !provision.Empty() {
+		cfg.Provision = provision
 	}
 
-	// Print loopback usage instructions
-	if result.LoopbackPath != "" {
-		fmt.Println()
-		fmt.Println("Loopback image created successfully!")
-		fmt.Println()
-		fmt.Println("To boot the image with QEMU:")
-		fmt.Printf("  qemu-system-x86_64 -enable-kvm -m 2048 -drive file=%s,format=raw -bios /usr/share/ovmf/OVMF.fd\n", result.LoopbackPath)
-		fmt.Println()
-		fmt.Println("To convert to other formats:")
-		fmt.Printf("  qemu-img convert -f raw -O qcow2 %s disk.qcow2\n", result.LoopbackPath)
-		fmt.Printf("  qemu-img convert -f raw -O vmdk %s disk.vmdk\n", result.LoopbackPath)
-	}
+	return cfg, nil
+}
 
-	return nil
+// exportInstallSpec writes the install spec of cfg to path. The root
+// password is hashed, and the encryption passphrase goes to a .passphrase
+// file next to the spec that the spec refers to.
+func exportInstallSpec(path string, cfg *pkg.InstallConfig) error {
+	spec := pkg.NewInstallSpec(cfg)
+	if cfg.RootPassword != "" {
+		hash, err := pkg.HashPassword(cfg.RootPassword)
+		if err != nil {
+			return fmt.Errorf("failed to hash root password: %w", err)
+		}
+		spec.RootPasswordHash = hash
+	}
+	if cfg.Encryption != nil {
+		passphraseFile := strings.TrimSuffix(path, filepath.Ext(path)) + ".passphrase"
+		if err := os.WriteFile(passphraseFile, []byte(cfg.Encryption.Passphrase+"\n"), 0600); err != nil {
+			return fmt.Errorf("failed to write passphrase file: %w", err)
+		}
+		spec.Encryption.PassphraseFile = filepath.Base(passphraseFile)
+	}
+	return pkg.WriteInstallSpec(path, spec)
 }
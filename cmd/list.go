@@ -40,6 +40,9 @@ func runList(cmd *cobra.Command, args []string) error {
 				Size:        disk.Size,
 				SizeHuman:   pkg.FormatSize(disk.Size),
 				Model:       disk.Model,
+				Serial:      disk.Serial,
+				Transport:   disk.Transport,
+				IDs:         disk.IDs,
 				IsRemovable: disk.IsRemovable,
 				Partitions:  make([]types.PartitionOutput, 0, len(disk.Partitions)),
 			}
@@ -72,6 +75,15 @@ func runList(cmd *cobra.Command, args []string) error {
 		if disk.Model != "" {
 			fmt.Printf("  Model:     %s\n", disk.Model)
 		}
+		if disk.Serial != "" {
+			fmt.Printf("  Serial:    %s\n", disk.Serial)
+		}
+		if disk.Transport != "" {
+			fmt.Printf("  Transport: %s\n", disk.Transport)
+		}
+		for _, id := range disk.IDs {
+			fmt.Printf("  ID:        %s\n", id)
+		}
 		fmt.Printf("  Removable: %v\n", disk.IsRemovable)
 
 		if len(disk.Partitions) > 0 {
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/frostyard/clix"
+	"github.com/frostyard/nbc/pkg"
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+	"github.com/spf13/cobra"
+)
+
+type luksFlags struct {
+	keyFile    string
+	newKeyFile string
+	tpm2PCRs   string
+}
+
+var luksF luksFlags
+
+var luksCmd = &cobra.Command{
+	Use:   "luks",
+	Short: "Manage LUKS keys of an encrypted installation",
+	Long: `Manage the LUKS keys of an encrypted nbc installation.
+
+Every subcommand acts on all encrypted partitions recorded in the system
+config (root1, root2 and var), so they always share the same keys. Before
+anything is changed, the current passphrase is checked against every
+partition.
+
+Subcommands:
+  passphrase add     - Add a passphrase
+  passphrase remove  - Remove a passphrase
+  recovery-key       - Generate and add a recovery key
+  tpm2 wipe          - Remove the TPM2 keys
+  tpm2 enroll        - Enroll fresh TPM2 keys
+
+The current passphrase (or a recovery key) is prompted for, or read from
+--key-file.
+
+Examples:
+  nbc luks passphrase add
+  nbc luks passphrase remove --key-file ./old-pass
+  nbc luks recovery-key
+  nbc luks tpm2 enroll --tpm2-pcrs 7
+  nbc luks tpm2 wipe`,
+}
+
+var luksPassphraseCmd = &cobra.Command{
+	Use:   "passphrase",
+	Short: "Add or remove LUKS passphrases",
+}
+
+var luksPassphraseAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a passphrase to all encrypted partitions",
+	Long: `Add a passphrase to all encrypted partitions.
+
+To rotate the passphrase, add the new one and then remove the old one.
+
+Examples:
+  nbc luks passphrase add
+  nbc luks passphrase add --key-file ./current --new-key-file ./new`,
+	Args: cobra.NoArgs,
+	RunE: runLUKSPassphraseAdd,
+}
+
+var luksPassphraseRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove a passphrase from all encrypted partitions",
+	Long: `Remove the given passphrase from all encrypted partitions.
+
+The last passphrase (or recovery key) of a partition cannot be removed, since
+the TPM2 key alone gives no way in when the TPM refuses to unseal.
+
+Examples:
+  nbc luks passphrase remove
+  nbc luks passphrase remove --key-file ./old-pass`,
+	Args: cobra.NoArgs,
+	RunE: runLUKSPassphraseRemove,
+}
+
+var luksRecoveryKeyCmd = &cobra.Command{
+	Use:   "recovery-key",
+	Short: "Generate a recovery key for all encrypted partitions",
+	Long: `Generate a recovery key and add it to all encrypted partitions.
+
+The key has the same format as keys from systemd-cryptenroll --recovery-key
+and can be typed at the passphrase prompt. It is printed once and not stored
+anywhere, so write it down or print it.
+
+Examples:
+  nbc luks recovery-key
+  nbc luks recovery-key --json`,
+	Args: cobra.NoArgs,
+	RunE: runLUKSRecoveryKey,
+}
+
+var luksTPM2Cmd = &cobra.Command{
+	Use:   "tpm2",
+	Short: "Wipe or re-enroll TPM2 keys",
+}
+
+var luksTPM2WipeCmd = &cobra.Command{
+	Use:   "wipe",
+	Short: "Remove the TPM2 keys from all encrypted partitions",
+	Long: `Remove the TPM2 keys from all encrypted partitions.
+
+The partitions then unlock with a passphrase or recovery key only, and
+updates stop trying TPM2 unlock. The current boot entries and /etc/crypttab
+are not rewritten: until the next update, boot looks for a TPM2 key before
+asking for the passphrase.
+
+Examples:
+  nbc luks tpm2 wipe`,
+	Args: cobra.NoArgs,
+	RunE: runLUKSTPM2Wipe,
+}
+
+var luksTPM2EnrollCmd = &cobra.Command{
+	Use:   "enroll",
+	Short: "Enroll fresh TPM2 keys on all encrypted partitions",
+	Long: `Replace the TPM2 keys of all encrypted partitions with fresh ones.
+
+The keys are sealed with the recorded PCR policy, or to the PCRs given with
+--tpm2-pcrs (an empty value removes the PCR binding). A signed PCR 11 policy
+is kept. Use this after firmware or Secure Boot changes, or to enable TPM2
+unlock on an installation without it.
+
+The boot entries and /etc/crypttab are not rewritten. On an installation
+without TPM2 unlock, boot keeps asking for the passphrase until the next
+update writes entries that use the TPM2 keys.
+
+Examples:
+  nbc luks tpm2 enroll
+  nbc luks tpm2 enroll --tpm2-pcrs 7`,
+	Args: cobra.NoArgs,
+	RunE: runLUKSTPM2Enroll,
+}
+
+func init() {
+	RootCmd.AddCommand(luksCmd)
+	luksCmd.AddCommand(luksPassphraseCmd)
+	luksCmd.AddCommand(luksRecoveryKeyCmd)
+	luksCmd.AddCommand(luksTPM2Cmd)
+	luksPassphraseCmd.AddCommand(luksPassphraseAddCmd)
+	luksPassphraseCmd.AddCommand(luksPassphraseRemoveCmd)
+	luksTPM2Cmd.AddCommand(luksTPM2WipeCmd)
+	luksTPM2Cmd.AddCommand(luksTPM2EnrollCmd)
+
+	for _, c := range []*cobra.Command{luksPassphraseAddCmd, luksPassphraseRemoveCmd, luksRecoveryKeyCmd, luksTPM2EnrollCmd} {
+		c.Flags().StringVar(&luksF.keyFile, "key-file", "", "Path to file containing the current LUKS passphrase or recovery key (prompted for if not set)")
+	}
+	luksPassphraseAddCmd.Flags().StringVar(&luksF.newKeyFile, "new-key-file", "", "Path to file containing the passphrase to add (prompted for if not set)")
+	luksTPM2EnrollCmd.Flags().StringVar(&luksF.tpm2PCRs, "tpm2-pcrs", "", "Seal the TPM2 keys to these PCRs instead of the recorded ones, e.g. 7 or 7+14")
+}
+
+// luksProgress returns the reporter for luks subcommands. With --json only the
+// final LUKSKeyOutput object is emitted.
+func luksProgress() reporter.Reporter {
+	if clix.JSONOutput {
+		return reporter.NoopReporter{}
+	}
+	return clix.NewReporter()
+}
+
+// readLUKSKey reads a key from path, or prompts for it when path is empty
+func readLUKSKey(path, prompt string) (string, error) {
+	if path == "" {
+		return pkg.ReadPassphrase(prompt)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\n\r"), nil
+}
+
+// luksKeyOptions builds the options of a luks subcommand, reading the current
+// passphrase unless this is a dry run
+func luksKeyOptions() (pkg.LUKSKeyOptions, error) {
+	opts := pkg.LUKSKeyOptions{DryRun: clix.DryRun}
+	if clix.DryRun {
+		return opts, nil
+	}
+	passphrase, err := readLUKSKey(luksF.keyFile, "Enter current LUKS passphrase: ")
+	if err != nil {
+		return opts, err
+	}
+	opts.Passphrase = passphrase
+	return opts, nil
+}
+
+// runLUKSAction runs a luks key operation and prints its result
+func runLUKSAction(ctx context.Context, action func(context.Context, reporter.Reporter) (*types.LUKSKeyOutput, error)) error {
+	output, err := action(ctx, luksProgress())
+	if err != nil {
+		if clix.JSONOutput {
+			return clix.OutputJSONError("LUKS key operation failed", err)
+		}
+		return err
+	}
+
+	if clix.JSONOutput {
+		clix.OutputJSON(output)
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Println(output.Message)
+	if output.RecoveryKey != "" {
+		fmt.Println()
+		fmt.Println("Recovery key (write it down, it is not stored anywhere):")
+		fmt.Println()
+		fmt.Printf("    %s\n", output.RecoveryKey)
+		fmt.Println()
+	}
+	return nil
+}
+
+func runLUKSPassphraseAdd(cmd *cobra.Command, args []string) error {
+	opts, err := luksKeyOptions()
+	if err != nil {
+		return err
+	}
+
+	var newPassphrase string
+	if !opts.DryRun {
+		newPassphrase, err = readLUKSKey(luksF.newKeyFile, "Enter new LUKS passphrase: ")
+		if err != nil {
+			return err
+		}
+		if luksF.newKeyFile == "" {
+			confirm, err := pkg.ReadPassphrase("Confirm new LUKS passphrase: ")
+			if err != nil {
+				return err
+			}
+			if confirm != newPassphrase {
+				return errors.New("passphrases do not match")
+			}
+		}
+	}
+
+	return runLUKSAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.LUKSKeyOutput, error) {
+		return pkg.AddLUKSPassphrase(ctx, opts, newPassphrase, p)
+	})
+}
+
+func runLUKSPassphraseRemove(cmd *cobra.Command, args []string) error {
+	opts, err := luksKeyOptions()
+	if err != nil {
+		return err
+	}
+	return runLUKSAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.LUKSKeyOutput, error) {
+		return pkg.RemoveLUKSPassphrase(ctx, opts, p)
+	})
+}
+
+func runLUKSRecoveryKey(cmd *cobra.Command, args []string) error {
+	opts, err := luksKeyOptions()
+	if err != nil {
+		return err
+	}
+	return runLUKSAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.LUKSKeyOutput, error) {
+		return pkg.AddLUKSRecoveryKey(ctx, opts, p)
+	})
+}
+
+func runLUKSTPM2Wipe(cmd *cobra.Command, args []string) error {
+	opts := pkg.LUKSKeyOptions{DryRun: clix.DryRun}
+	return runLUKSAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.LUKSKeyOutput, error) {
+		return pkg.WipeLUKSTPM2(ctx, opts, p)
+	})
+}
+
+func runLUKSTPM2Enroll(cmd *cobra.Command, args []string) error {
+	var pcrs []int
+	if cmd.Flags().Changed("tpm2-pcrs") {
+		parsed, err := pkg.ParseTPM2PCRs(luksF.tpm2PCRs)
+		if err != nil {
+			return fmt.Errorf("invalid --tpm2-pcrs: %w", err)
+		}
+		pcrs = parsed
+		if pcrs == nil {
+			pcrs = []int{}
+		}
+	}
+
+	opts, err := luksKeyOptions()
+	if err != nil {
+		return err
+	}
+	return runLUKSAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.LUKSKeyOutput, error) {
+		return pkg.EnrollLUKSTPM2(ctx, opts, pcrs, p)
+	})
+}
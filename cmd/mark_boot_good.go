@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/frostyard/clix"
+	"github.com/frostyard/nbc/pkg"
+	"github.com/frostyard/std/reporter"
+	"github.com/spf13/cobra"
+)
+
+type markBootGoodFlags struct {
+	bootDir string
+}
+
+var mbgFlags markBootGoodFlags
+
+var markBootGoodCmd = &cobra.Command{
+	Use:   "mark-boot-good",
+	Short: "Mark the current boot as successful for boot counting",
+	Long: `Mark the running boot entry as good so the bootloader stops counting
+boot attempts for it.
+
+After an update, the new default entry gets a limited number of boot attempts
+(systemd-boot "+N" entry counters, or a grubenv counter for GRUB). If the
+system never marks the boot good, the bootloader falls back to the
+"(Previous)" entry automatically.
+
+This command is normally run by the nbc-mark-boot-good.service unit once
+boot-complete.target is reached. Health checks that must pass first can be
+ordered Before=boot-complete.target.
+
+Only the entry that actually booted is marked: after a fallback to the
+previous slot, the failed entry stays marked bad.
+
+Example:
+  nbc mark-boot-good
+  nbc mark-boot-good --dry-run
+  nbc mark-boot-good --json`,
+	RunE: runMarkBootGood,
+}
+
+func init() {
+	RootCmd.AddCommand(markBootGoodCmd)
+
+	markBootGoodCmd.Flags().StringVar(&mbgFlags.bootDir, "boot-dir", "/boot", "Mount point of the boot partition")
+}
+
+func runMarkBootGood(cmd *cobra.Command, args []string) error {
+	// With --json, suppress streaming progress so only the final
+	// MarkBootGoodOutput JSON object is emitted.
+	var progress reporter.Reporter
+	if clix.JSONOutput {
+		progress = reporter.NoopReporter{}
+	} else {
+		progress = clix.NewReporter()
+	}
+
+	output, err := pkg.MarkBootGood(cmd.Context(), mbgFlags.bootDir, clix.DryRun, progress)
+	if err != nil {
+		if clix.JSONOutput {
+			return clix.OutputJSONError("failed to mark boot as good", err)
+		}
+		return fmt.Errorf("failed to mark boot as good: %w", err)
+	}
+
+	if clix.JSONOutput {
+		clix.OutputJSON(output)
+		return nil
+	}
+
+	fmt.Println(output.Message)
+	return nil
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/frostyard/clix"
+	"github.com/frostyard/nbc/pkg"
+	"github.com/frostyard/std/reporter"
+	"github.com/spf13/cobra"
+)
+
+type rollbackFlags struct {
+	device      string
+	restoreVar  bool
+	varSnapshot string
+}
+
+var rbFlags rollbackFlags
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Make the previous A/B slot the default boot entry",
+	Long: `Switch the default boot entry to the other A/B root partition.
+
+After an update, the bootloader keeps a "(Previous)" entry for the slot that
+was running before. This command rewrites the bootloader configuration
+(grub.cfg for GRUB, loader.conf for systemd-boot) on the boot partition so
+that slot boots by default on the next boot, without needing console access
+to pick it from the boot menu.
+
+The image reference and digest in the system config are swapped with the
+previous image so 'nbc status' and later updates describe the slot that will
+boot. Running rollback again switches back.
+
+Works for both GRUB and systemd-boot, and for encrypted installs.
+
+/var is shared by both slots and is not rolled back by default. When /var is
+on btrfs, --restore-var also restores the snapshot of /var taken before the
+update from the previous image, or --var-snapshot the named snapshot (see
+'nbc snapshot list'). The restored /var is mounted from the next boot on; the
+nbc state in /var/lib/nbc/state is kept as it is now. The /var it replaces is
+kept as a "replaced" snapshot until snapshot retention removes it.
+
+Example:
+  nbc rollback
+  nbc rollback --dry-run          # Show which entry would become the default
+  nbc rollback --device /dev/sda  # Override auto-detection
+  nbc rollback --restore-var      # Also restore /var from before the update
+  nbc rollback --json             # Machine-readable output`,
+	RunE: runRollback,
+}
+
+func init() {
+	RootCmd.AddCommand(rollbackCmd)
+
+	rollbackCmd.Flags().StringVarP(&rbFlags.device, "device", "d", "", "Target disk device (auto-detected if not specified)")
+	rollbackCmd.Flags().BoolVar(&rbFlags.restoreVar, "restore-var", false, "Also restore /var from the snapshot taken before the update (btrfs only)")
+	rollbackCmd.Flags().StringVar(&rbFlags.varSnapshot, "var-snapshot", "", "Restore /var from the named snapshot (implies --restore-var)")
+}
+
+func runRollback(cmd *cobra.Command, args []string) error {
+	// With --json, suppress streaming progress so only the final
+	// RollbackOutput JSON object is emitted.
+	var progress reporter.Reporter
+	if clix.JSONOutput {
+		progress = reporter.NoopReporter{}
+	} else {
+		progress = clix.NewReporter()
+	}
+
+	var device string
+	var err error
+
+	// Resolve device path - auto-detect if not specified
+	if rbFlags.device != "" {
+		device, err = pkg.GetDiskByPath(rbFlags.device)
+		if err != nil {
+			if clix.JSONOutput {
+				return clix.OutputJSONError("invalid device", err)
+			}
+			return fmt.Errorf("invalid device: %w", err)
+		}
+	} else {
+		device, err = pkg.GetCurrentBootDeviceInfo(cmd.Context(), clix.Verbose, progress)
+		if err != nil {
+			if clix.JSONOutput {
+				return clix.OutputJSONError("failed to auto-detect boot device", err)
+			}
+			return fmt.Errorf("failed to auto-detect boot device: %w (use --device to specify manually)", err)
+		}
+	}
+
+	output, err := pkg.Rollback(cmd.Context(), pkg.RollbackOptions{
+		Device:      device,
+		DryRun:      clix.DryRun,
+		RestoreVar:  rbFlags.restoreVar,
+		VarSnapshot: rbFlags.varSnapshot,
+	}, progress)
+	if err != nil {
+		if clix.JSONOutput {
+			return clix.OutputJSONError("rollback failed", err)
+		}
+		return fmt.Errorf("rollback failed: %w", err)
+	}
+
+	if clix.JSONOutput {
+		clix.OutputJSON(output)
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Println(output.Message)
+	fmt.Printf("  Default entry: %s (%s)\n", output.DefaultEntry, output.TargetPartition)
+	if output.ImageRef != "" {
+		fmt.Printf("  Image:         %s\n", output.ImageRef)
+	}
+	if output.ImageDigest != "" {
+		fmt.Printf("  Digest:        %s\n", output.ImageDigest)
+	}
+	if output.RestoredVar != "" {
+		fmt.Printf("  /var snapshot: %s\n", output.RestoredVar)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/frostyard/clix"
+	"github.com/frostyard/nbc/pkg"
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+	"github.com/spf13/cobra"
+)
+
+type snapshotFlags struct {
+	scheduled     bool
+	keepUpdate    int
+	keepScheduled int
+}
+
+var snapF snapshotFlags
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage btrfs snapshots of /var",
+	Long: `Manage the read-only snapshots of /var on btrfs installations.
+
+/var is shared by both A/B slots, so rolling back the root does not undo what
+an update changed in /var. Before every update, nbc takes a read-only
+snapshot of /var that 'nbc rollback --restore-var' can restore.
+
+Snapshots come in these kinds, each with its own retention:
+  update     - Taken before an update (default: keep 3)
+  scheduled  - Taken daily by nbc-var-snapshot.timer (default: keep 0, off)
+  manual     - Taken with 'nbc snapshot create', kept until deleted
+  replaced   - The /var a restore replaced, kept as many as update snapshots;
+               restore it with 'nbc rollback --var-snapshot' to undo a restore
+
+Subcommands:
+  list       - List the snapshots
+  create     - Take a snapshot now
+  delete     - Delete a snapshot
+  retention  - Set how many update and scheduled snapshots are kept
+
+Examples:
+  nbc snapshot list
+  nbc snapshot create
+  nbc snapshot delete manual-20260101T120000Z
+  nbc snapshot delete var-restored-update-20260101T120000Z
+  nbc snapshot retention --update 5 --scheduled 7`,
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the snapshots of /var",
+	Args:  cobra.NoArgs,
+	RunE:  runSnapshotList,
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Take a snapshot of /var",
+	Long: `Take a read-only snapshot of /var.
+
+The snapshot is manual and kept until deleted. With --scheduled it counts as
+a scheduled snapshot instead, and is skipped while scheduled snapshots are
+disabled; this is what nbc-var-snapshot.timer runs.
+
+Examples:
+  nbc snapshot create
+  nbc snapshot create --scheduled`,
+	Args: cobra.NoArgs,
+	RunE: runSnapshotCreate,
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete NAME",
+	Short: "Delete a snapshot of /var",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runSnapshotDelete,
+}
+
+var snapshotRetentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Set how many snapshots of /var are kept",
+	Long: `Set how many pre-update and scheduled snapshots of /var are kept.
+
+Older snapshots beyond the new counts are deleted right away. A count of 0
+stops taking snapshots of that kind. Without flags, the current counts are
+shown.
+
+Examples:
+  nbc snapshot retention
+  nbc snapshot retention --update 5
+  nbc snapshot retention --scheduled 7   # Enable daily snapshots`,
+	Args: cobra.NoArgs,
+	RunE: runSnapshotRetention,
+}
+
+func init() {
+	RootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotCreateCmd)
+	snapshotCmd.AddCommand(snapshotDeleteCmd)
+	snapshotCmd.AddCommand(snapshotRetentionCmd)
+
+	snapshotCreateCmd.Flags().BoolVar(&snapF.scheduled, "scheduled", false, "Take a scheduled snapshot (skipped while scheduled snapshots are disabled)")
+	snapshotRetentionCmd.Flags().IntVar(&snapF.keepUpdate, "update", pkg.DefaultVarSnapshotKeep, "Number of pre-update snapshots to keep (0 disables them)")
+	snapshotRetentionCmd.Flags().IntVar(&snapF.keepScheduled, "scheduled", 0, "Number of scheduled snapshots to keep (0 disables them)")
+}
+
+// runSnapshotAction runs a snapshot operation and prints its result
+func runSnapshotAction(ctx context.Context, action func(context.Context, reporter.Reporter) (*types.VarSnapshotOutput, error)) error {
+	// With --json only the final VarSnapshotOutput object is emitted
+	var progress reporter.Reporter
+	if clix.JSONOutput {
+		progress = reporter.NoopReporter{}
+	} else {
+		progress = clix.NewReporter()
+	}
+
+	output, err := action(ctx, progress)
+	if err != nil {
+		if clix.JSONOutput {
+			return clix.OutputJSONError("snapshot operation failed", err)
+		}
+		return err
+	}
+
+	if clix.JSONOutput {
+		clix.OutputJSON(output)
+		return nil
+	}
+
+	if output.Action != "list" {
+		fmt.Println()
+		fmt.Println(output.Message)
+	}
+	if output.Action == "list" || output.Action == "retention" {
+		fmt.Printf("Keeping %d pre-update and %d scheduled snapshots\n", output.KeepUpdate, output.KeepScheduled)
+	}
+	if output.Action == "list" {
+		if len(output.Snapshots) == 0 {
+			fmt.Println("No snapshots of /var")
+			return nil
+		}
+		fmt.Println()
+		fmt.Printf("%-40s %-10s %-21s %s\n", "NAME", "KIND", "CREATED", "IMAGE")
+		for _, s := range output.Snapshots {
+			fmt.Printf("%-40s %-10s %-21s %s\n", s.Name, s.Kind, s.Created, s.ImageRef)
+		}
+	}
+	return nil
+}
+
+func runSnapshotList(cmd *cobra.Command, args []string) error {
+	return runSnapshotAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.VarSnapshotOutput, error) {
+		return pkg.ListVarSnapshots()
+	})
+}
+
+func runSnapshotCreate(cmd *cobra.Command, args []string) error {
+	opts := pkg.VarSnapshotOptions{DryRun: clix.DryRun}
+	return runSnapshotAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.VarSnapshotOutput, error) {
+		return pkg.CreateVarSnapshot(ctx, opts, snapF.scheduled, p)
+	})
+}
+
+func runSnapshotDelete(cmd *cobra.Command, args []string) error {
+	opts := pkg.VarSnapshotOptions{DryRun: clix.DryRun}
+	return runSnapshotAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.VarSnapshotOutput, error) {
+		return pkg.DeleteVarSnapshot(ctx, opts, args[0], p)
+	})
+}
+
+func runSnapshotRetention(cmd *cobra.Command, args []string) error {
+	var keepUpdate, keepScheduled *int
+	if cmd.Flags().Changed("update") {
+		keepUpdate = &snapF.keepUpdate
+	}
+	if cmd.Flags().Changed("scheduled") {
+		keepScheduled = &snapF.keepScheduled
+	}
+
+	if keepUpdate == nil && keepScheduled == nil {
+		return runSnapshotAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.VarSnapshotOutput, error) {
+			output, err := pkg.ListVarSnapshots()
+			if err != nil {
+				return nil, err
+			}
+			output.Action = "retention"
+			output.Message = "Snapshot retention of /var"
+			return output, nil
+		})
+	}
+
+	opts := pkg.VarSnapshotOptions{DryRun: clix.DryRun}
+	return runSnapshotAction(cmd.Context(), func(ctx context.Context, p reporter.Reporter) (*types.VarSnapshotOutput, error) {
+		return pkg.SetVarSnapshotRetention(ctx, opts, keepUpdate, keepScheduled, p)
+	})
+}
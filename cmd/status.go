@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 
 	"github.com/frostyard/clix"
@@ -17,12 +20,18 @@ var statusCmd = &cobra.Command{
 	Long: `Display the current nbc system status including:
   - Installed container image reference and digest
   - Boot device and active root partition (slot A or B)
+  - Deployments of a btrfs subvolume installation, newest first
   - Root filesystem mount mode (read-only or read-write)
-  - Bootloader type and filesystem type
+  - Bootloader type, boot mode (UEFI or BIOS) and filesystem type
   - Staged update status (if any downloaded update is ready)
+  - Encryption state of LUKS partitions (cipher, keyslots, TPM2 token),
+    read directly from their LUKS2 headers
 
 With -v (verbose), also displays:
   - Installation date and kernel arguments
+  - PBKDF parameters of each LUKS keyslot
+  - Image labels, build date and OS version of each root slot, from
+    the records saved on install and update (no network needed)
   - Remote update availability check
 
 With --json flag, outputs structured JSON including update check results.
@@ -54,20 +63,30 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		fmt.Printf("Warning: could not determine active root partition: %v\n", err)
 	}
 
-	// Determine which root slot is active (root1 or root2)
-	var activeSlot string
-	if activeRoot != "" {
+	// Determine which root slot is active (root1 or root2), or which
+	// deployment of a subvolume installation
+	deployments := pkg.GetDeploymentStatus(config)
+	var activeSlot, bootedSlot string
+	if config.Subvolumes != nil {
+		for _, d := range deployments {
+			if d.Booted {
+				activeSlot = fmt.Sprintf("deployment %d", d.ID)
+			}
+		}
+	} else if activeRoot != "" {
 		// Try to detect the partition scheme to determine slot
 		device := config.Device
 		if device != "" {
-			scheme, schemeErr := pkg.DetectExistingPartitionScheme(device)
+			scheme, schemeErr := pkg.DetectInstalledPartitionScheme(device, config)
 			if schemeErr == nil {
 				if strings.HasSuffix(activeRoot, strings.TrimPrefix(scheme.Root1Partition, "/dev/")) ||
 					activeRoot == scheme.Root1Partition {
 					activeSlot = "A (root1)"
+					bootedSlot = "root1"
 				} else if strings.HasSuffix(activeRoot, strings.TrimPrefix(scheme.Root2Partition, "/dev/")) ||
 					activeRoot == scheme.Root2Partition {
 					activeSlot = "B (root2)"
+					bootedSlot = "root2"
 				}
 			}
 		}
@@ -85,15 +104,21 @@ func runStatus(cmd *cobra.Command, args []string) error {
 			ActiveSlot:     activeSlot,
 			RootMountMode:  rootMountMode,
 			BootloaderType: config.BootloaderType,
+			BootMode:       cmp.Or(config.BootMode, string(pkg.BootModeUEFI)),
 			FilesystemType: config.FilesystemType,
 			InstallDate:    config.InstallDate,
 			KernelArgs:     config.KernelArgs,
+			Deployments:    deployments,
 		}
 
 		if output.FilesystemType == "" {
 			output.FilesystemType = "ext4"
 		}
 
+		output.Encryption = pkg.GetEncryptionStatus(config)
+		output.Composefs = pkg.GetComposefsStatus(config)
+		output.Images = pkg.GetSlotImages(config, bootedSlot)
+
 		// Check for updates if verbose or always for JSON
 		if config.ImageRef != "" {
 			updateCheck := &types.UpdateCheck{}
@@ -162,7 +187,9 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Device:      %s\n", config.Device)
 	if activeRoot != "" {
 		fmt.Printf("Active Root: %s", activeRoot)
-		if activeSlot != "" {
+		if config.Subvolumes != nil && activeSlot != "" {
+			fmt.Printf(" [%s]", activeSlot)
+		} else if activeSlot != "" {
 			fmt.Printf(" [Slot %s]", activeSlot)
 		}
 		fmt.Println()
@@ -175,11 +202,38 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		fmt.Printf("Root Mount:  %s\n", mountModeDesc)
 	}
 	fmt.Printf("Bootloader:  %s\n", config.BootloaderType)
+	fmt.Printf("Boot Mode:   %s\n", cmp.Or(config.BootMode, string(pkg.BootModeUEFI)))
 	if config.FilesystemType != "" {
 		fmt.Printf("Filesystem:  %s\n", config.FilesystemType)
 	} else {
 		fmt.Printf("Filesystem:  ext4 (default)\n")
 	}
+	if status := pkg.GetComposefsStatus(config); status != nil {
+		switch {
+		case status.BootedDigest == "":
+			fmt.Printf("Composefs:   enabled, booted without an image\n")
+		case clix.Verbose:
+			fmt.Printf("Composefs:   %s\n", status.BootedDigest)
+		default:
+			fmt.Printf("Composefs:   %s...\n", status.BootedDigest[:min(12, len(status.BootedDigest))])
+		}
+	}
+
+	if len(deployments) > 0 {
+		fmt.Println()
+		fmt.Printf("Deployments: (keeping %d)\n", config.Subvolumes.KeepCount())
+		for _, d := range deployments {
+			printDeployment(d)
+		}
+	}
+
+	if volumes := pkg.GetEncryptionStatus(config); len(volumes) > 0 {
+		fmt.Println()
+		fmt.Println("Encryption:")
+		for _, vol := range volumes {
+			printLUKSVolume(vol)
+		}
+	}
 
 	// Check for pending reboot and show warning
 	if rebootInfo, err := pkg.ReadRebootRequiredMarker(); err == nil && rebootInfo != nil {
@@ -196,6 +250,12 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		if len(config.KernelArgs) > 0 {
 			fmt.Printf("Kernel Args: %s\n", strings.Join(config.KernelArgs, " "))
 		}
+
+		fmt.Println()
+		fmt.Println("Images:")
+		for _, image := range pkg.GetSlotImages(config, bootedSlot) {
+			printSlotImage(image)
+		}
 	}
 
 	// Check for available updates if verbose
@@ -235,3 +295,109 @@ func runStatus(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// printDeployment prints one subvolume deployment, with its details in verbose mode
+func printDeployment(d types.DeploymentStatus) {
+	marker := " "
+	if d.Booted {
+		marker = "*"
+	}
+	var notes []string
+	if d.Booted {
+		notes = append(notes, "booted")
+	}
+	if d.Default {
+		notes = append(notes, "default")
+	}
+	note := ""
+	if len(notes) > 0 {
+		note = " (" + strings.Join(notes, ", ") + ")"
+	}
+	fmt.Printf("  %s %-4d %s%s\n", marker, d.ID, d.ImageRef, note)
+
+	if !clix.Verbose {
+		return
+	}
+	fmt.Printf("         Subvolume: %s\n", d.Subvolume)
+	if d.ImageDigest != "" {
+		fmt.Printf("         Digest:    %s\n", d.ImageDigest)
+	}
+	if d.KernelVersion != "" {
+		fmt.Printf("         Kernel:    %s\n", d.KernelVersion)
+	}
+	if d.Created != "" {
+		fmt.Printf("         Created:   %s\n", d.Created)
+	}
+}
+
+// printSlotImage prints the image recorded for a root slot or deployment
+func printSlotImage(image types.SlotImage) {
+	marker := " "
+	note := ""
+	if image.Booted {
+		marker = "*"
+		note = " (booted)"
+	}
+	fmt.Printf("  %s %s%s\n", marker, image.Slot, note)
+
+	switch {
+	case image.Error != "":
+		fmt.Printf("      %s\n", image.Error)
+		return
+	case image.Digest == "":
+		fmt.Println("      (not recorded)")
+		return
+	}
+	fmt.Printf("      Digest:   %s\n", image.Digest)
+	if image.Created != "" {
+		fmt.Printf("      Built:    %s\n", image.Created)
+	}
+	if image.Version != "" {
+		fmt.Printf("      Version:  %s\n", image.Version)
+	}
+	fmt.Printf("      Platform: %s/%s\n", image.OS, image.Architecture)
+	fmt.Printf("      Layers:   %d\n", len(image.Layers))
+	if len(image.Labels) > 0 {
+		fmt.Println("      Labels:")
+		for _, key := range slices.Sorted(maps.Keys(image.Labels)) {
+			fmt.Printf("        %s=%s\n", key, image.Labels[key])
+		}
+	}
+}
+
+// printLUKSVolume prints one encrypted partition, with its keyslots in verbose mode
+func printLUKSVolume(vol types.LUKSVolumeStatus) {
+	if vol.Error != "" {
+		fmt.Printf("  %-6s %s\n", vol.Name+":", vol.Error)
+		return
+	}
+
+	tpm2 := "no TPM2 token"
+	if vol.TPM2 {
+		tpm2 = "TPM2 token (no PCRs)"
+		if len(vol.TPM2PCRs) > 0 {
+			pcrs := make([]string, len(vol.TPM2PCRs))
+			for i, pcr := range vol.TPM2PCRs {
+				pcrs[i] = fmt.Sprint(pcr)
+			}
+			tpm2 = fmt.Sprintf("TPM2 token (PCRs %s)", strings.Join(pcrs, "+"))
+		}
+	}
+	fmt.Printf("  %-6s %s, %s, %d keyslot(s), %s\n", vol.Name+":", vol.Partition, vol.Cipher, len(vol.Keyslots), tpm2)
+
+	if !clix.Verbose {
+		return
+	}
+	for _, ks := range vol.Keyslots {
+		var kdf string
+		if ks.KDF == "pbkdf2" {
+			kdf = fmt.Sprintf("pbkdf2 (%s, %d iterations)", ks.Hash, ks.Iterations)
+		} else {
+			kdf = fmt.Sprintf("%s (time %d, memory %d KiB, %d CPUs)", ks.KDF, ks.Time, ks.MemoryKiB, ks.CPUs)
+		}
+		if ks.Token != "" {
+			kdf += " [" + ks.Token + "]"
+		}
+		fmt.Printf("           keyslot %d: %s\n", ks.ID, kdf)
+	}
+}
@@ -21,6 +21,11 @@ type updateFlags struct {
 	auto         bool
 	skipVerify   bool
 	cosignKey    string
+	delta        bool
+	noVarSnap    bool
+	flatten      bool
+	relabel      bool
+	platform     string
 }
 
 var updFlags updateFlags
@@ -45,6 +50,30 @@ Use --check to only check if an update is available without installing.
 After update, reboot to activate the new system. The previous system remains
 available in the boot menu for rollback if needed.
 
+Use --delta to only write the files that changed since the inactive partition
+was last updated. It falls back to a full update when nbc has no trusted record
+of the partition's contents, such as on its first update.
+
+On an installation with subvolume deployments (nbc install --root-subvolumes)
+the update instead snapshots the running deployment into a new btrfs
+subvolume and applies the new image to the snapshot as a delta, so --delta is
+implied. Deployments beyond the count set at install time are removed.
+
+When /var is on btrfs, a read-only snapshot of it is taken before the update,
+so "nbc rollback --restore-var" can undo changes the new image makes to /var.
+Use --no-var-snapshot to skip it; see "nbc snapshot" for retention.
+
+Use --flatten to read the image layers concurrently and write every path of
+the new image once on a full update, instead of once per layer providing it.
+
+Use --selinux-relabel to label the new root with the file contexts of the
+image's SELinux policy. Installations made with --selinux-relabel do this on
+every update.
+
+Updates pull the image platform the system was installed for (see
+"nbc install --platform"). --platform names it explicitly; an update to an
+image for any other platform is refused.
+
 Use --download-only to download an update without applying it. The update
 will be staged in /var/cache/nbc/staged-update/ and can be applied later
 with --local-image or --auto.
@@ -59,6 +88,7 @@ Example:
   nbc update --auto               # Use staged update if available, else pull
   nbc update --image quay.io/example/myimage:v2.0
   nbc update --skip-pull
+  nbc update --delta              # Only write changed files
   nbc update --device /dev/sda    # Override auto-detection
   nbc update --force              # Reinstall even if up-to-date
   nbc update --json               # Machine-readable streaming output`,
@@ -81,6 +111,11 @@ func init() {
 	updateCmd.Flags().BoolVar(&updFlags.downloadOnly, "download-only", false, "Download update to cache without applying")
 	updateCmd.Flags().BoolVar(&updFlags.localImage, "local-image", false, "Apply update from staged cache (/var/cache/nbc/staged-update/)")
 	updateCmd.Flags().BoolVar(&updFlags.auto, "auto", false, "Automatically use staged update if available, otherwise pull from registry")
+	updateCmd.Flags().BoolVar(&updFlags.delta, "delta", false, "Only write files that changed on the inactive partition (full update if its contents are not recorded)")
+	updateCmd.Flags().BoolVar(&updFlags.flatten, "flatten", false, "Read image layers concurrently and write each path of the flattened image once")
+	updateCmd.Flags().BoolVar(&updFlags.relabel, "selinux-relabel", false, "Label the new root with the image's SELinux policy (requires setfiles)")
+	updateCmd.Flags().BoolVar(&updFlags.noVarSnap, "no-var-snapshot", false, "Skip the snapshot of /var taken before updating btrfs systems")
+	updateCmd.Flags().StringVar(&updFlags.platform, "platform", "", "Image platform to pull, e.g. linux/arm64 (default: the installed one, which it must match)")
 }
 
 func runUpdate(cmd *cobra.Command, args []string) error {
@@ -132,8 +167,15 @@ func runUpdate(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	platform, err := pkg.ParsePlatform(updFlags.platform)
+	if err != nil {
+		if clix.JSONOutput {
+			progress.Error(err, "Invalid options")
+		}
+		return err
+	}
+
 	var device string
-	var err error
 
 	// Resolve device path - auto-detect if not specified
 	if updFlags.device != "" {
@@ -211,6 +253,15 @@ func runUpdate(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("failed to read system config: %w", err)
 		}
 
+		// Updates must be for the platform the system was installed for
+		platform, err = pkg.UpdatePlatform(config.Platform, platform)
+		if err != nil {
+			if clix.JSONOutput {
+				progress.Error(err, "Platform mismatch")
+			}
+			return err
+		}
+
 		// Get remote digest of new image
 		remoteDigest, err := pkg.GetRemoteImageDigest(cmd.Context(), imageRef)
 		if err != nil {
@@ -259,6 +310,7 @@ func runUpdate(cmd *cobra.Command, args []string) error {
 		updateCache.SetVerbose(clix.Verbose)
 		updateCache.SkipVerify = updFlags.skipVerify
 		updateCache.CosignKeyPath = updFlags.cosignKey
+		updateCache.Platform = platform
 		metadata, err := updateCache.Download(cmd.Context(), imageRef, progress)
 		if err != nil {
 			if clix.JSONOutput {
@@ -350,6 +402,11 @@ func runUpdate(cmd *cobra.Command, args []string) error {
 	updater.SetJSONOutput(clix.JSONOutput)
 	updater.Config.SkipVerify = updFlags.skipVerify
 	updater.Config.CosignKeyPath = updFlags.cosignKey
+	updater.Config.Delta = updFlags.delta
+	updater.Config.NoVarSnapshot = updFlags.noVarSnap
+	updater.Config.Flatten = updFlags.flatten
+	updater.Config.SELinuxRelabel = updFlags.relabel
+	updater.Config.Platform = platform
 
 	// For --check --json, override the updater's reporter with NoopReporter
 	// so IsUpdateNeeded doesn't emit streaming JSON — only the final
@@ -6,6 +6,7 @@ import (
 
 	"github.com/frostyard/clix"
 	"github.com/frostyard/nbc/cmd"
+	"github.com/frostyard/nbc/pkg"
 )
 
 var version = "dev"
@@ -14,6 +15,7 @@ var date = "unknown"
 var builtBy = "local"
 
 func main() {
+	pkg.Version = version
 	app := clix.App{
 		Version: version,
 		Commit:  commit,
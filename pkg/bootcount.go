@@ -0,0 +1,435 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+)
+
+const (
+	// DefaultBootTries is how many times a freshly updated slot may fail to
+	// reach boot-complete.target before the bootloader falls back to the
+	// "(Previous)" entry.
+	DefaultBootTries = 3
+	// BootCompleteUnit is the systemd unit that marks a boot as good
+	BootCompleteUnit = "nbc-mark-boot-good.service"
+	// targetNBCBinary is where the marking unit expects nbc inside the image
+	targetNBCBinary = "/usr/bin/nbc"
+	// systemdBootDefaultPattern is the loader.conf default after an update. As
+	// a glob it matches both "bootc" and "bootc-previous"; systemd-boot picks
+	// the first match in menu order, which is "bootc" unless its boot counter
+	// has run out and sorted it last.
+	systemdBootDefaultPattern = "bootc*"
+	// grubEnvBlockSize is the fixed size of a GRUB environment block
+	grubEnvBlockSize = 1024
+	// grubEnvHeader starts every GRUB environment block
+	grubEnvHeader = "# GRUB Environment Block\n"
+)
+
+// bootCompleteUnitContent runs "nbc mark-boot-good" once the boot is
+// considered successful. Health checks can order themselves
+// Before=boot-complete.target to delay (or prevent) marking the boot good.
+const bootCompleteUnitContent = `[Unit]
+Description=Mark the current nbc boot entry as good
+Documentation=https://github.com/frostyard/nbc
+Requires=boot-complete.target
+After=local-fs.target boot-complete.target
+ConditionPathExists=/run/nbc-booted
+ConditionFileIsExecutable=/usr/bin/nbc
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/bin/nbc mark-boot-good
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// systemdBootCounterPattern matches the "+LEFT[-DONE]" boot counter systemd-boot
+// keeps in entry file names, e.g. "bootc+2-1.conf" or, for a UKI, "bootc+2-1.efi".
+var systemdBootCounterPattern = regexp.MustCompile(`^(.+?)\+(\d+)(?:-(\d+))?(\.conf|\.efi)$`)
+
+// bootCountingSupported reports whether a boot of targetDir can ever be marked
+// good. Without nbc in the image nothing would mark the boot, and the fallback
+// would fire on every update, so counting is only armed when it is present.
+func bootCountingSupported(targetDir string) bool {
+	info, err := os.Stat(filepath.Join(targetDir, targetNBCBinary))
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// InstallBootCompleteUnit installs and enables the systemd unit that marks a
+// boot as good once boot-complete.target is reached.
+func InstallBootCompleteUnit(ctx context.Context, targetDir string, dryRun bool, progress reporter.Reporter) error {
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would install %s", BootCompleteUnit)
+		return nil
+	}
+
+	unitDir := filepath.Join(targetDir, "usr", "lib", "systemd", "system")
+	wantsDir := filepath.Join(unitDir, "multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create systemd unit directory: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(unitDir, BootCompleteUnit), []byte(bootCompleteUnitContent), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", BootCompleteUnit, err)
+	}
+
+	link := filepath.Join(wantsDir, BootCompleteUnit)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace %s: %w", link, err)
+	}
+	if err := os.Symlink(filepath.Join("..", BootCompleteUnit), link); err != nil {
+		return fmt.Errorf("failed to enable %s: %w", BootCompleteUnit, err)
+	}
+
+	progress.Message("Installed %s", BootCompleteUnit)
+	return nil
+}
+
+// parseSystemdBootCounter splits an entry file name into its entry ID and
+// boot counter. counted is false for entries without a counter. As in
+// systemd-boot, the ID of a Type #1 entry drops ".conf" while the ID of a
+// UKI keeps ".efi".
+func parseSystemdBootCounter(fileName string) (id string, triesLeft, triesDone int, counted bool) {
+	m := systemdBootCounterPattern.FindStringSubmatch(fileName)
+	if m == nil {
+		return strings.TrimSuffix(fileName, ".conf"), 0, 0, false
+	}
+	triesLeft, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		triesDone, _ = strconv.Atoi(m[3])
+	}
+	id = m[1]
+	if m[4] == ".efi" {
+		id += ".efi"
+	}
+	return id, triesLeft, triesDone, true
+}
+
+// systemdBootEntryFileName returns the entry file name for id, carrying a
+// fresh "+TRIES" counter when tries is positive.
+func systemdBootEntryFileName(id string, tries int) string {
+	base, ext := id, ".conf"
+	if strings.HasSuffix(id, ".efi") {
+		base, ext = strings.TrimSuffix(id, ".efi"), ".efi"
+	}
+	if tries > 0 {
+		return fmt.Sprintf("%s+%d%s", base, tries, ext)
+	}
+	return base + ext
+}
+
+// writeSystemdBootEntry writes the entry for id and removes any other file for
+// the same ID (with or without a counter), so exactly one file remains.
+func writeSystemdBootEntry(entriesDir, id string, tries int, content string) error {
+	name := systemdBootEntryFileName(id, tries)
+	if err := atomicWriteFile(filepath.Join(entriesDir, name), []byte(content), 0644); err != nil {
+		return err
+	}
+	return removeStaleSystemdBootEntries(entriesDir, id, name)
+}
+
+// removeStaleSystemdBootEntries removes every file in dir belonging to entry
+// id except keep.
+func removeStaleSystemdBootEntries(dir, id, keep string) error {
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list boot entries: %w", err)
+	}
+	for _, file := range existing {
+		base := file.Name()
+		if entryID, _, _, _ := parseSystemdBootCounter(base); entryID == id && base != keep {
+			if err := os.Remove(filepath.Join(dir, base)); err != nil {
+				return fmt.Errorf("failed to remove stale boot entry %s: %w", base, err)
+			}
+		}
+	}
+	return nil
+}
+
+// systemdBootEntryFile is a boot entry systemd-boot discovers on the ESP:
+// a Type #1 entry in loader/entries/ or a UKI in EFI/Linux/.
+type systemdBootEntryFile struct {
+	Path      string
+	ID        string
+	TriesLeft int
+	Counted   bool
+	Cmdline   []string // Kernel command line (options line or embedded .cmdline)
+}
+
+// listSystemdBootEntries returns the boot entries on the ESP mounted at
+// bootDir. A UKI whose command line cannot be read is listed without one.
+func listSystemdBootEntries(bootDir string) ([]systemdBootEntryFile, error) {
+	confs, err := filepath.Glob(filepath.Join(bootDir, "loader", "entries", "*.conf"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot entries: %w", err)
+	}
+	ukis, err := filepath.Glob(filepath.Join(bootDir, ukiDir, "*.efi"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UKIs: %w", err)
+	}
+
+	var entries []systemdBootEntryFile
+	for _, path := range append(confs, ukis...) {
+		entry := systemdBootEntryFile{Path: path}
+		entry.ID, entry.TriesLeft, _, entry.Counted = parseSystemdBootCounter(filepath.Base(path))
+
+		if strings.HasSuffix(path, ".efi") {
+			entry.Cmdline, _ = ukiCmdline(path)
+		} else {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read boot entry %s: %w", filepath.Base(path), err)
+			}
+			for line := range strings.SplitSeq(string(data), "\n") {
+				if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "options" {
+					entry.Cmdline = fields[1:]
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// grubBootCountingScript returns the grub.cfg fragment that counts down
+// boot_counter in grubenv while boot_success is 0, and boots the previous
+// entry (index 1) once no tries are left. The counter is armed by the update
+// and cleared by "nbc mark-boot-good".
+func grubBootCountingScript(tries int) string {
+	var b strings.Builder
+	b.WriteString(`
+# Boot counting: until "nbc mark-boot-good" runs, every boot of the default
+# entry uses one try. Once none are left, boot the previous entry instead.
+if [ -f "${config_directory}/grubenv" ]; then
+    load_env -f "${config_directory}/grubenv"
+fi
+if [ "${boot_success}" = "0" ]; then
+    if [ "${boot_counter}" = "0" ]; then
+        set default=1
+`)
+	for n := tries; n > 0; n-- {
+		fmt.Fprintf(&b, `    elif [ "${boot_counter}" = "%d" ]; then
+        set boot_counter=%d
+        save_env -f "${config_directory}/grubenv" boot_counter
+`, n, n-1)
+	}
+	b.WriteString("    fi\nfi\n")
+	return b.String()
+}
+
+// parseGRUBEnv parses a GRUB environment block into its variables
+func parseGRUBEnv(data []byte) map[string]string {
+	env := make(map[string]string)
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// formatGRUBEnv renders variables as a GRUB environment block, padded with '#'
+// to the fixed 1024 bytes GRUB's save_env requires.
+func formatGRUBEnv(env map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(grubEnvHeader)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", key, env[key])
+	}
+	if b.Len() > grubEnvBlockSize {
+		return nil, fmt.Errorf("grubenv content exceeds %d bytes", grubEnvBlockSize)
+	}
+	b.WriteString(strings.Repeat("#", grubEnvBlockSize-b.Len()))
+	return []byte(b.String()), nil
+}
+
+// readGRUBEnv reads grubenv, returning an empty environment if it is missing
+func readGRUBEnv(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, fmt.Errorf("failed to read grubenv: %w", err)
+	}
+	return parseGRUBEnv(data), nil
+}
+
+// writeGRUBEnv writes grubenv atomically
+func writeGRUBEnv(path string, env map[string]string) error {
+	data, err := formatGRUBEnv(env)
+	if err != nil {
+		return err
+	}
+	if err := atomicWriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write grubenv: %w", err)
+	}
+	return nil
+}
+
+// setGRUBBootCounter arms (tries > 0) or clears (tries == 0) the boot counter
+// in grubenv, preserving unrelated variables.
+func setGRUBBootCounter(grubDir string, tries int) error {
+	path := filepath.Join(grubDir, "grubenv")
+	env, err := readGRUBEnv(path)
+	if err != nil {
+		return err
+	}
+	if tries > 0 {
+		env["boot_counter"] = strconv.Itoa(tries)
+		env["boot_success"] = "0"
+	} else {
+		delete(env, "boot_counter")
+		env["boot_success"] = "1"
+	}
+	return writeGRUBEnv(path, env)
+}
+
+// cmdlineRootArg returns the argument of a kernel command line that selects
+// the root: root=, or the rootflags= selecting a subvolume when there is one,
+// since all deployments of a subvolume layout share the root partition
+func cmdlineRootArg(cmdline string) string {
+	rootArg := ""
+	for field := range strings.FieldsSeq(cmdline) {
+		switch {
+		case strings.HasPrefix(field, "rootflags=") && strings.Contains(field, "subvol="):
+			return field
+		case strings.HasPrefix(field, "root=") && rootArg == "":
+			rootArg = field
+		}
+	}
+	return rootArg
+}
+
+// MarkBootGood records that the running boot succeeded so the bootloader stops
+// counting down towards a fallback. bootDir is the mounted boot partition
+// (normally /boot). Only the entry that actually booted is marked: after a
+// fallback to the previous slot the failed entry stays marked bad.
+func MarkBootGood(ctx context.Context, bootDir string, dryRun bool, progress reporter.Reporter) (*types.MarkBootGoodOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	procCmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /proc/cmdline: %w", err)
+	}
+	rootArg := cmdlineRootArg(string(procCmdline))
+	if rootArg == "" {
+		return nil, fmt.Errorf("could not determine root= from kernel command line")
+	}
+
+	return markBootGood(bootDir, rootArg, dryRun, progress)
+}
+
+// markBootGood implements MarkBootGood for the booted root= argument rootArg
+func markBootGood(bootDir, rootArg string, dryRun bool, progress reporter.Reporter) (*types.MarkBootGoodOutput, error) {
+	bootloaderType := detectBootloaderTypeAt(bootDir)
+	output := &types.MarkBootGoodOutput{BootloaderType: string(bootloaderType), DryRun: dryRun}
+
+	switch bootloaderType {
+	case BootloaderSystemdBoot:
+		entries, err := listSystemdBootEntries(bootDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.Counted || !slices.Contains(entry.Cmdline, rootArg) {
+				continue
+			}
+
+			id := entry.ID
+			output.Entry = id
+			if dryRun {
+				progress.MessagePlain("[DRY RUN] Would mark boot entry %s as good", id)
+			} else {
+				if err := os.Rename(entry.Path, filepath.Join(filepath.Dir(entry.Path), systemdBootEntryFileName(id, 0))); err != nil {
+					return nil, fmt.Errorf("failed to mark boot entry %s as good: %w", id, err)
+				}
+				progress.Message("Marked boot entry %s as good", id)
+			}
+			output.Marked = true
+		}
+
+	case BootloaderGRUB2:
+		var grubDir string
+		for _, dir := range []string{"grub", "grub2"} {
+			if _, err := os.Stat(filepath.Join(bootDir, dir, "grub.cfg")); err == nil {
+				grubDir = filepath.Join(bootDir, dir)
+				break
+			}
+		}
+		if grubDir == "" {
+			return nil, fmt.Errorf("could not find grub.cfg on boot partition")
+		}
+
+		env, err := readGRUBEnv(filepath.Join(grubDir, "grubenv"))
+		if err != nil {
+			return nil, err
+		}
+		if env["boot_success"] != "0" {
+			break
+		}
+
+		cfg, err := os.ReadFile(filepath.Join(grubDir, "grub.cfg"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read grub.cfg: %w", err)
+		}
+		entries, defaultIndex, err := parseGRUBConfig(string(cfg))
+		if err != nil {
+			return nil, err
+		}
+		// Boot counting only protects the default entry. If it is not what
+		// booted, the fallback fired (or the previous entry was picked by
+		// hand) and the default must stay unconfirmed.
+		if defaultIndex < 0 || defaultIndex >= len(entries) || !slices.Contains(entries[defaultIndex].Cmdline, rootArg) {
+			progress.Warning("running system was not booted from the default GRUB entry; leaving boot counter unchanged")
+			break
+		}
+
+		output.Entry = entries[defaultIndex].Title
+		if dryRun {
+			progress.MessagePlain("[DRY RUN] Would mark GRUB entry %q as good", output.Entry)
+		} else {
+			if err := setGRUBBootCounter(grubDir, 0); err != nil {
+				return nil, err
+			}
+			progress.Message("Marked GRUB entry %q as good", output.Entry)
+		}
+		output.Marked = true
+
+	default:
+		return nil, fmt.Errorf("unsupported bootloader type: %s", bootloaderType)
+	}
+
+	switch {
+	case output.Marked && dryRun:
+		output.Message = "Would mark the current boot as good"
+	case output.Marked:
+		output.Message = "Marked the current boot as good"
+	default:
+		output.Message = "No pending boot assessment for the running entry"
+	}
+	return output, nil
+}
@@ -0,0 +1,268 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/frostyard/std/reporter"
+)
+
+func TestParseSystemdBootCounter(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantID    string
+		wantLeft  int
+		wantDone  int
+		wantCount bool
+	}{
+		{"bootc.conf", "bootc", 0, 0, false},
+		{"bootc+3.conf", "bootc", 3, 0, true},
+		{"bootc+2-1.conf", "bootc", 2, 1, true},
+		{"bootc+0-3.conf", "bootc", 0, 3, true},
+		{"bootc-previous.conf", "bootc-previous", 0, 0, false},
+		{"bootc+2-1.efi", "bootc.efi", 2, 1, true},
+		{"bootc-previous.efi", "bootc-previous.efi", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		id, left, done, counted := parseSystemdBootCounter(tt.name)
+		if id != tt.wantID || left != tt.wantLeft || done != tt.wantDone || counted != tt.wantCount {
+			t.Errorf("parseSystemdBootCounter(%q) = (%q, %d, %d, %v), want (%q, %d, %d, %v)",
+				tt.name, id, left, done, counted, tt.wantID, tt.wantLeft, tt.wantDone, tt.wantCount)
+		}
+	}
+}
+
+func TestWriteSystemdBootEntryReplacesCountedVariants(t *testing.T) {
+	entriesDir := t.TempDir()
+	writeTestFile(t, filepath.Join(entriesDir, "bootc+0-3.conf"), "old")
+	writeTestFile(t, filepath.Join(entriesDir, "bootc-previous.conf"), "previous")
+
+	if err := writeSystemdBootEntry(entriesDir, "bootc", DefaultBootTries, "new"); err != nil {
+		t.Fatalf("writeSystemdBootEntry() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(entriesDir, "bootc+0-3.conf")); !os.IsNotExist(err) {
+		t.Error("stale counted entry should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(entriesDir, "bootc-previous.conf")); err != nil {
+		t.Errorf("previous entry should be kept: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(entriesDir, "bootc+3.conf"))
+	if err != nil || string(data) != "new" {
+		t.Errorf("bootc+3.conf = %q, %v; want \"new\"", data, err)
+	}
+}
+
+func TestGRUBEnvRoundTrip(t *testing.T) {
+	data, err := formatGRUBEnv(map[string]string{"boot_counter": "3", "boot_success": "0"})
+	if err != nil {
+		t.Fatalf("formatGRUBEnv() error = %v", err)
+	}
+	if len(data) != grubEnvBlockSize {
+		t.Errorf("grubenv size = %d, want %d", len(data), grubEnvBlockSize)
+	}
+	if !strings.HasPrefix(string(data), grubEnvHeader+"boot_counter=3\nboot_success=0\n#") {
+		t.Errorf("unexpected grubenv content:\n%s", data)
+	}
+
+	env := parseGRUBEnv(data)
+	if env["boot_counter"] != "3" || env["boot_success"] != "0" || len(env) != 2 {
+		t.Errorf("parseGRUBEnv() = %v", env)
+	}
+}
+
+func TestGRUBBootCountingScript(t *testing.T) {
+	script := grubBootCountingScript(3)
+
+	for _, want := range []string{
+		`load_env -f "${config_directory}/grubenv"`,
+		`if [ "${boot_counter}" = "0" ]; then` + "\n        set default=1\n",
+		`elif [ "${boot_counter}" = "3" ]; then` + "\n        set boot_counter=2\n",
+		`elif [ "${boot_counter}" = "1" ]; then` + "\n        set boot_counter=0\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q, got:\n%s", want, script)
+		}
+	}
+	depth := 0
+	for line := range strings.SplitSeq(script, "\n") {
+		switch line = strings.TrimSpace(line); {
+		case strings.HasPrefix(line, "if "):
+			depth++
+		case line == "fi":
+			depth--
+		}
+	}
+	if depth != 0 {
+		t.Errorf("unbalanced if/fi in script:\n%s", script)
+	}
+}
+
+func TestBootCountingSupported(t *testing.T) {
+	root := t.TempDir()
+	if bootCountingSupported(root) {
+		t.Error("bootCountingSupported() should be false without nbc in the image")
+	}
+
+	nbcPath := filepath.Join(root, targetNBCBinary)
+	if err := os.MkdirAll(filepath.Dir(nbcPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(nbcPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !bootCountingSupported(root) {
+		t.Error("bootCountingSupported() should be true with an executable nbc")
+	}
+}
+
+func TestInstallBootCompleteUnit(t *testing.T) {
+	root := t.TempDir()
+	if err := InstallBootCompleteUnit(t.Context(), root, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("InstallBootCompleteUnit() error = %v", err)
+	}
+
+	unitPath := filepath.Join(root, "usr", "lib", "systemd", "system", BootCompleteUnit)
+	data, err := os.ReadFile(unitPath)
+	if err != nil {
+		t.Fatalf("unit not written: %v", err)
+	}
+	if !strings.Contains(string(data), "After=local-fs.target boot-complete.target") {
+		t.Errorf("unit should be ordered after boot-complete.target, got:\n%s", data)
+	}
+
+	link := filepath.Join(root, "usr", "lib", "systemd", "system", "multi-user.target.wants", BootCompleteUnit)
+	target, err := os.Readlink(link)
+	if err != nil {
+		t.Fatalf("unit not enabled: %v", err)
+	}
+	if target != "../"+BootCompleteUnit {
+		t.Errorf("wants symlink = %q, want %q", target, "../"+BootCompleteUnit)
+	}
+
+	// Installing again (update) must not fail on the existing symlink
+	if err := InstallBootCompleteUnit(t.Context(), root, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("second InstallBootCompleteUnit() error = %v", err)
+	}
+}
+
+func TestMarkBootGoodSystemdBoot(t *testing.T) {
+	bootDir := t.TempDir()
+	entriesDir := filepath.Join(bootDir, "loader", "entries")
+	writeTestFile(t, filepath.Join(bootDir, "loader", "loader.conf"), "default bootc*\n")
+	writeTestFile(t, filepath.Join(entriesDir, "bootc+1-2.conf"),
+		buildSystemdBootEntry("Test Linux", "6.18.3", "initramfs-6.18.3.img", []string{"root=UUID=uuid-root2", "ro"}))
+	writeTestFile(t, filepath.Join(entriesDir, "bootc-previous.conf"),
+		buildSystemdBootEntry("Test Linux (Previous)", "6.18.2", "initramfs-6.18.2.img", []string{"root=UUID=uuid-root1", "ro"}))
+
+	// Booted from the previous slot (fallback): the new entry stays counted
+	output, err := markBootGood(bootDir, "root=UUID=uuid-root1", false, reporter.NoopReporter{})
+	if err != nil {
+		t.Fatalf("markBootGood() error = %v", err)
+	}
+	if output.Marked {
+		t.Error("fallback boot should not mark the counted entry good")
+	}
+	if _, err := os.Stat(filepath.Join(entriesDir, "bootc+1-2.conf")); err != nil {
+		t.Errorf("counted entry should be untouched: %v", err)
+	}
+
+	// Booted from the new slot: the counter is dropped
+	output, err = markBootGood(bootDir, "root=UUID=uuid-root2", false, reporter.NoopReporter{})
+	if err != nil {
+		t.Fatalf("markBootGood() error = %v", err)
+	}
+	if !output.Marked || output.Entry != "bootc" {
+		t.Errorf("output = %+v, want bootc marked", output)
+	}
+	if _, err := os.Stat(filepath.Join(entriesDir, "bootc.conf")); err != nil {
+		t.Errorf("entry should be renamed to bootc.conf: %v", err)
+	}
+}
+
+func TestMarkBootGoodGRUB(t *testing.T) {
+	bootDir := t.TempDir()
+	grubDir := filepath.Join(bootDir, "grub2")
+	writeTestFile(t, filepath.Join(grubDir, "grub.cfg"), buildGRUBConfig(
+		"Test Linux",
+		"6.18.3",
+		"initramfs-6.18.3.img",
+		[]string{"root=UUID=uuid-root2", "ro"},
+		"6.18.2",
+		"initramfs-6.18.2.img",
+		[]string{"root=UUID=uuid-root1", "ro"},
+		DefaultBootTries,
+	))
+	if err := setGRUBBootCounter(grubDir, DefaultBootTries); err != nil {
+		t.Fatalf("setGRUBBootCounter() error = %v", err)
+	}
+
+	// Booted from the previous slot (fallback): the counter is kept
+	output, err := markBootGood(bootDir, "root=UUID=uuid-root1", false, reporter.NoopReporter{})
+	if err != nil {
+		t.Fatalf("markBootGood() error = %v", err)
+	}
+	if output.Marked {
+		t.Error("fallback boot should not mark the default entry good")
+	}
+
+	// Booted from the default entry: the counter is cleared
+	output, err = markBootGood(bootDir, "root=UUID=uuid-root2", false, reporter.NoopReporter{})
+	if err != nil {
+		t.Fatalf("markBootGood() error = %v", err)
+	}
+	if !output.Marked || output.Entry != "Test Linux" {
+		t.Errorf("output = %+v, want default entry marked", output)
+	}
+
+	env, err := readGRUBEnv(filepath.Join(grubDir, "grubenv"))
+	if err != nil {
+		t.Fatalf("readGRUBEnv() error = %v", err)
+	}
+	if env["boot_success"] != "1" {
+		t.Errorf("boot_success = %q, want 1", env["boot_success"])
+	}
+	if _, ok := env["boot_counter"]; ok {
+		t.Errorf("boot_counter should be cleared, got %q", env["boot_counter"])
+	}
+}
+
+func TestPlanSystemdBootRollbackAfterUpdate(t *testing.T) {
+	bootDir := t.TempDir()
+	writeTestFile(t, filepath.Join(bootDir, "loader", "loader.conf"), "default "+systemdBootDefaultPattern+"\n")
+	writeTestFile(t, filepath.Join(bootDir, "loader", "entries", "bootc+3.conf"),
+		buildSystemdBootEntry("Test Linux", "6.18.3", "initramfs-6.18.3.img", []string{"root=UUID=uuid-root2", "ro"}))
+	writeTestFile(t, filepath.Join(bootDir, "loader", "entries", "bootc-previous.conf"),
+		buildSystemdBootEntry("Test Linux (Previous)", "6.18.2", "initramfs-6.18.2.img", []string{"root=UUID=uuid-root1", "ro"}))
+
+	// Right after an update the glob default resolves to the new entry, as
+	// systemd-boot sorts "bootc.conf" before "bootc-previous.conf"
+	plan, err := planSystemdBootRollback(bootDir, testRootArgs)
+	if err != nil {
+		t.Fatalf("planSystemdBootRollback() error = %v", err)
+	}
+	if plan.FromSlot != "root2" || plan.ToSlot != "root1" || plan.ToEntry != "bootc-previous" {
+		t.Errorf("plan = %s -> %s (%s), want root2 -> root1 (bootc-previous)", plan.FromSlot, plan.ToSlot, plan.ToEntry)
+	}
+}
+
+func TestPlanSystemdBootRollbackAfterFallback(t *testing.T) {
+	bootDir := t.TempDir()
+	writeTestFile(t, filepath.Join(bootDir, "loader", "loader.conf"), "default "+systemdBootDefaultPattern+"\n")
+	writeTestFile(t, filepath.Join(bootDir, "loader", "entries", "bootc+0-3.conf"),
+		buildSystemdBootEntry("Test Linux", "6.18.3", "initramfs-6.18.3.img", []string{"root=UUID=uuid-root2", "ro"}))
+	writeTestFile(t, filepath.Join(bootDir, "loader", "entries", "bootc-previous.conf"),
+		buildSystemdBootEntry("Test Linux (Previous)", "6.18.2", "initramfs-6.18.2.img", []string{"root=UUID=uuid-root1", "ro"}))
+
+	// With no tries left, the glob default resolves to the previous entry
+	plan, err := planSystemdBootRollback(bootDir, testRootArgs)
+	if err != nil {
+		t.Fatalf("planSystemdBootRollback() error = %v", err)
+	}
+	if plan.FromSlot != "root1" || plan.ToSlot != "root2" || plan.ToEntry != "bootc" {
+		t.Errorf("plan = %s -> %s (%s), want root1 -> root2 (bootc)", plan.FromSlot, plan.ToSlot, plan.ToEntry)
+	}
+}
@@ -22,15 +22,21 @@ const (
 
 // BootloaderInstaller handles bootloader installation
 type BootloaderInstaller struct {
-	Type       BootloaderType
-	TargetDir  string
-	Device     string
-	Scheme     *PartitionScheme
-	KernelArgs []string
-	OSName     string
-	Verbose    bool
-	Encryption *LUKSConfig       // Encryption configuration
-	Progress   reporter.Reporter // Progress reporter for output
+	Type         BootloaderType
+	TargetDir    string
+	Device       string
+	Scheme       *PartitionScheme
+	KernelArgs   []string
+	OSName       string
+	Verbose      bool
+	Encryption   *LUKSConfig         // Encryption configuration
+	Discoverable *DiscoverableConfig // Discoverable partition settings (nil if not enabled)
+	UKI          bool                // Boot systemd-boot from unified kernel images
+	Arch         string              // CPU architecture to boot, in GOARCH naming (empty = this machine's)
+	BootMode     BootMode            // Firmware interface to boot with (empty = UEFI)
+	Progress     reporter.Reporter   // Progress reporter for output
+
+	ComposefsDigest string // fs-verity digest of the root's composefs image ("" boots the root as is)
 }
 
 // NewBootloaderInstaller creates a new BootloaderInstaller
@@ -71,6 +77,28 @@ func (b *BootloaderInstaller) SetEncryption(config *LUKSConfig) {
 	b.Encryption = config
 }
 
+// SetDiscoverable sets the discoverable partition settings
+func (b *BootloaderInstaller) SetDiscoverable(config *DiscoverableConfig) {
+	b.Discoverable = config
+}
+
+// SetComposefsDigest boots the composefs image with the given fs-verity digest
+// instead of the root filesystem as is
+func (b *BootloaderInstaller) SetComposefsDigest(digest string) {
+	b.ComposefsDigest = digest
+}
+
+// SetBootMode sets the firmware interface the bootloader is installed for
+func (b *BootloaderInstaller) SetBootMode(mode BootMode) {
+	b.BootMode = mode
+}
+
+// SetUKI makes systemd-boot boot a unified kernel image instead of a Type #1
+// entry with a separate kernel and initramfs
+func (b *BootloaderInstaller) SetUKI(uki bool) {
+	b.UKI = uki
+}
+
 // buildKernelCmdline builds the kernel command line with LUKS support if
 // encrypted. It gathers the install-specific inputs and delegates the actual
 // assembly to assembleKernelCmdline, which the update flow also uses so the two
@@ -82,9 +110,10 @@ func (b *BootloaderInstaller) buildKernelCmdline(ctx context.Context) ([]string,
 	}
 
 	params := kernelCmdlineParams{
-		FilesystemType: b.Scheme.FilesystemType,
-		BootUUID:       bootUUID,
-		ExtraArgs:      b.KernelArgs,
+		FilesystemType:  b.Scheme.FilesystemType,
+		BootUUID:        bootUUID,
+		ExtraArgs:       b.KernelArgs,
+		ComposefsDigest: b.ComposefsDigest,
 	}
 
 	if b.Scheme.Encrypted {
@@ -118,6 +147,15 @@ func (b *BootloaderInstaller) buildKernelCmdline(ctx context.Context) ([]string,
 		}
 		params.RootUUID = rootUUID
 		params.VarUUID = varUUID
+		params.RootSubvolume = b.Scheme.RootSubvolume
+
+		if b.Discoverable != nil {
+			params.MachineID = b.Discoverable.MachineID
+			params.GPTAutoMount = b.Type == BootloaderSystemdBoot
+			if !params.GPTAutoMount {
+				b.Progress.Warning("GRUB does not report the ESP to systemd-gpt-auto-generator; keeping explicit /boot and /var mounts")
+			}
+		}
 	}
 
 	return assembleKernelCmdline(params), nil
@@ -308,6 +346,15 @@ func (b *BootloaderInstaller) Install(ctx context.Context) error {
 
 	b.Progress.MessagePlain("Installing %s bootloader...", b.Type)
 
+	if b.BootMode == BootModeBIOS {
+		return b.installBIOS(ctx)
+	}
+
+	arch, err := efiArchFor(b.Arch)
+	if err != nil {
+		return err
+	}
+
 	// Ensure EFI directory structure uses proper uppercase naming (UEFI spec requirement)
 	espPath := filepath.Join(b.TargetDir, "boot")
 	if err := ensureUppercaseEFIDirectory(espPath, b.Progress); err != nil {
@@ -326,12 +373,11 @@ func (b *BootloaderInstaller) Install(ctx context.Context) error {
 	default:
 	}
 
-	var err error
 	switch b.Type {
 	case BootloaderGRUB2:
-		err = b.installGRUB2(ctx)
+		err = b.installGRUB2(ctx, arch)
 	case BootloaderSystemdBoot:
-		err = b.installSystemdBoot(ctx)
+		err = b.installSystemdBoot(ctx, arch)
 	default:
 		return fmt.Errorf("unsupported bootloader type: %s", b.Type)
 	}
@@ -341,7 +387,7 @@ func (b *BootloaderInstaller) Install(ctx context.Context) error {
 	}
 
 	// Register EFI boot entry using efibootmgr if available
-	if regErr := b.registerEFIBootEntry(ctx); regErr != nil {
+	if regErr := b.registerEFIBootEntry(ctx, arch); regErr != nil {
 		// Not fatal - the removable media fallback path should still work
 		b.Progress.Warning("failed to register EFI boot entry: %v", regErr)
 	}
@@ -349,22 +395,75 @@ func (b *BootloaderInstaller) Install(ctx context.Context) error {
 	return nil
 }
 
-// installGRUB2 installs GRUB2 bootloader
-func (b *BootloaderInstaller) installGRUB2(ctx context.Context) error {
-	b.Progress.Message("Installing GRUB2...")
+// installBIOS installs GRUB2 for legacy BIOS boot. Only GRUB2 boots from
+// BIOS; the grub.cfg is the same as with UEFI.
+func (b *BootloaderInstaller) installBIOS(ctx context.Context) error {
+	if b.Type != BootloaderGRUB2 {
+		return fmt.Errorf("%s cannot boot from BIOS, BIOS installs need an image using GRUB2", b.Type)
+	}
+
+	if err := b.copyKernelFromModules(); err != nil {
+		return fmt.Errorf("failed to copy kernel from modules: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Check if grub-install is available
-	grubInstallCmd := "grub-install"
+	return b.installGRUB2BIOS(ctx)
+}
+
+// grubInstallCommand returns the name of the host's grub-install
+func grubInstallCommand() string {
 	if _, err := exec.LookPath("grub2-install"); err == nil {
-		grubInstallCmd = "grub2-install"
+		return "grub2-install"
 	}
+	return "grub-install"
+}
+
+// installGRUB2BIOS installs GRUB2 for legacy BIOS boot: the boot code goes to
+// the disk's MBR and GRUB's core image to the BIOS boot partition, while the
+// modules and grub.cfg go to the boot partition as with UEFI
+func (b *BootloaderInstaller) installGRUB2BIOS(ctx context.Context) error {
+	b.Progress.Message("Installing GRUB2 for BIOS boot...")
+
+	args := []string{
+		"--target=" + grubBIOSTarget,
+		"--boot-directory=" + filepath.Join(b.TargetDir, "boot"),
+	}
+	if b.Verbose {
+		args = append(args, "--verbose")
+	}
+	args = append(args, b.Device)
+
+	cmd := exec.CommandContext(ctx, grubInstallCommand(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to install GRUB: %w", err)
+	}
+
+	if err := b.generateGRUBConfig(ctx); err != nil {
+		return fmt.Errorf("failed to generate GRUB config: %w", err)
+	}
+
+	b.Progress.Message("GRUB2 installation complete")
+	return nil
+}
+
+// installGRUB2 installs GRUB2 bootloader
+func (b *BootloaderInstaller) installGRUB2(ctx context.Context, arch efiArch) error {
+	b.Progress.Message("Installing GRUB2...")
+
+	grubInstallCmd := grubInstallCommand()
 
 	espPath := filepath.Join(b.TargetDir, "boot")
 	efiBootDir := filepath.Join(espPath, "EFI", "BOOT")
 
 	// Install GRUB to the disk
 	args := []string{
-		"--target=x86_64-efi",
+		"--target=" + arch.grubTarget,
 		"--efi-directory=" + espPath,
 		"--boot-directory=" + espPath,
 		"--bootloader-id=BOOT",
@@ -384,18 +483,12 @@ func (b *BootloaderInstaller) installGRUB2(ctx context.Context) error {
 	}
 
 	// Find the GRUB EFI that was just installed
-	grubEFI := filepath.Join(efiBootDir, "BOOTX64.EFI")
+	grubEFI := filepath.Join(efiBootDir, arch.removableBootFile())
 	if _, err := os.Stat(grubEFI); os.IsNotExist(err) {
-		// Try alternate names
-		alternates := []string{
-			filepath.Join(efiBootDir, "grubx64.efi"),
-			filepath.Join(espPath, "EFI", "BOOT", "grubx64.efi"),
-		}
-		for _, alt := range alternates {
-			if _, err := os.Stat(alt); err == nil {
-				grubEFI = alt
-				break
-			}
+		// Try the alternate name
+		alt := filepath.Join(efiBootDir, arch.binary("grub"))
+		if _, err := os.Stat(alt); err == nil {
+			grubEFI = alt
 		}
 	}
 
@@ -512,7 +605,7 @@ menuentry '%s' {
 }
 
 // installSystemdBoot installs systemd-boot bootloader
-func (b *BootloaderInstaller) installSystemdBoot(ctx context.Context) error {
+func (b *BootloaderInstaller) installSystemdBoot(ctx context.Context, arch efiArch) error {
 	// Check for cancellation
 	select {
 	case <-ctx.Done():
@@ -536,11 +629,12 @@ func (b *BootloaderInstaller) installSystemdBoot(ctx context.Context) error {
 
 	// Find systemd-boot EFI binary in the container image
 	// Check both signed and unsigned variants
+	systemdBoot := arch.binary("systemd-boot")
 	efiSourcePaths := []string{
-		filepath.Join(b.TargetDir, "usr", "lib", "systemd", "boot", "efi", "systemd-bootx64.efi.signed"),
-		filepath.Join(b.TargetDir, "usr", "lib", "systemd", "boot", "efi", "systemd-bootx64.efi"),
-		filepath.Join(b.TargetDir, "usr", "lib64", "systemd", "boot", "efi", "systemd-bootx64.efi.signed"),
-		filepath.Join(b.TargetDir, "usr", "lib64", "systemd", "boot", "efi", "systemd-bootx64.efi"),
+		filepath.Join(b.TargetDir, "usr", "lib", "systemd", "boot", "efi", systemdBoot+".signed"),
+		filepath.Join(b.TargetDir, "usr", "lib", "systemd", "boot", "efi", systemdBoot),
+		filepath.Join(b.TargetDir, "usr", "lib64", "systemd", "boot", "efi", systemdBoot+".signed"),
+		filepath.Join(b.TargetDir, "usr", "lib64", "systemd", "boot", "efi", systemdBoot),
 	}
 
 	var efiSource string
@@ -555,8 +649,8 @@ func (b *BootloaderInstaller) installSystemdBoot(ctx context.Context) error {
 		return fmt.Errorf("systemd-boot EFI binary not found in container image")
 	}
 
-	// Copy to EFI/systemd/systemd-bootx64.efi
-	if err := copyEFIFile(efiSource, filepath.Join(efiSystemdDir, "systemd-bootx64.efi")); err != nil {
+	// Copy to EFI/systemd/systemd-boot<arch>.efi
+	if err := copyEFIFile(efiSource, filepath.Join(efiSystemdDir, systemdBoot)); err != nil {
 		return fmt.Errorf("failed to copy systemd-boot EFI: %w", err)
 	}
 
@@ -567,8 +661,8 @@ func (b *BootloaderInstaller) installSystemdBoot(ctx context.Context) error {
 	}
 
 	if !secureBootEnabled {
-		// No shim available, copy directly to EFI/BOOT/BOOTX64.EFI for removable media boot
-		if err := copyEFIFile(efiSource, filepath.Join(efiBootDir, "BOOTX64.EFI")); err != nil {
+		// No shim available, copy directly to EFI/BOOT/BOOT<arch>.EFI for removable media boot
+		if err := copyEFIFile(efiSource, filepath.Join(efiBootDir, arch.removableBootFile())); err != nil {
 			return fmt.Errorf("failed to copy fallback EFI: %w", err)
 		}
 		b.Progress.Message("Installed systemd-boot EFI binaries (no Secure Boot shim found)")
@@ -668,7 +762,11 @@ func (b *BootloaderInstaller) generateSystemdBootConfig(ctx context.Context) err
 		return fmt.Errorf("failed to create loader directory: %w", err)
 	}
 
-	loaderConf := `default bootc
+	defaultEntry := "bootc"
+	if b.UKI {
+		defaultEntry = "bootc.efi"
+	}
+	loaderConf := `default ` + defaultEntry + `
 timeout 5
 console-mode max
 editor yes
@@ -678,6 +776,12 @@ editor yes
 		return fmt.Errorf("failed to write loader.conf: %w", err)
 	}
 
+	// A UKI embeds the kernel, initramfs and command line in one EFI binary
+	// in EFI/Linux/, replacing the Type #1 entry below
+	if b.UKI {
+		return installSystemdBootUKI(ctx, bootDir, b.TargetDir, kernelVersion, kernelCmdline, b.tpm2Policy(), b.Progress)
+	}
+
 	entriesDir := filepath.Join(loaderDir, "entries")
 	if err := os.MkdirAll(entriesDir, 0755); err != nil {
 		return fmt.Errorf("failed to create entries directory: %w", err)
@@ -713,23 +817,24 @@ options %s
 
 // findShimEFI looks for shim EFI binary in the container image for Secure Boot support
 // Returns the path to the shim if found, empty string otherwise
-func findShimEFI(targetDir string) string {
+func findShimEFI(targetDir string, arch efiArch) string {
+	shim := arch.binary("shim")
 	// Common locations for shim EFI binary
 	shimPaths := []string{
 		// Fedora/RHEL/CentOS locations
-		filepath.Join(targetDir, "boot", "efi", "EFI", "fedora", "shimx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "centos", "shimx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "redhat", "shimx64.efi"),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "fedora", shim),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "centos", shim),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "redhat", shim),
 		// Debian/Ubuntu locations
-		filepath.Join(targetDir, "boot", "efi", "EFI", "debian", "shimx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "ubuntu", "shimx64.efi"),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "debian", shim),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "ubuntu", shim),
 		// Signed shim from shim-signed package
-		filepath.Join(targetDir, "usr", "lib", "shim", "shimx64.efi.signed"),
-		filepath.Join(targetDir, "usr", "lib64", "shim", "shimx64.efi.signed"),
-		filepath.Join(targetDir, "usr", "share", "shim", "shimx64.efi.signed"),
+		filepath.Join(targetDir, "usr", "lib", "shim", shim+".signed"),
+		filepath.Join(targetDir, "usr", "lib64", "shim", shim+".signed"),
+		filepath.Join(targetDir, "usr", "share", "shim", shim+".signed"),
 		// Unsigned shim (less common)
-		filepath.Join(targetDir, "usr", "lib", "shim", "shimx64.efi"),
-		filepath.Join(targetDir, "usr", "lib64", "shim", "shimx64.efi"),
+		filepath.Join(targetDir, "usr", "lib", "shim", shim),
+		filepath.Join(targetDir, "usr", "lib64", "shim", shim),
 	}
 
 	for _, path := range shimPaths {
@@ -742,21 +847,22 @@ func findShimEFI(targetDir string) string {
 
 // findMokManager looks for the MOK (Machine Owner Key) manager EFI binary
 // This is needed for Secure Boot key enrollment
-func findMokManager(targetDir string) string {
+func findMokManager(targetDir string, arch efiArch) string {
+	mm := arch.binary("mm")
 	mokPaths := []string{
 		// Fedora/RHEL/CentOS locations
-		filepath.Join(targetDir, "boot", "efi", "EFI", "fedora", "mmx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "centos", "mmx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "redhat", "mmx64.efi"),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "fedora", mm),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "centos", mm),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "redhat", mm),
 		// Debian/Ubuntu locations
-		filepath.Join(targetDir, "boot", "efi", "EFI", "debian", "mmx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "ubuntu", "mmx64.efi"),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "debian", mm),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "ubuntu", mm),
 		// From shim package
-		filepath.Join(targetDir, "usr", "lib", "shim", "mmx64.efi.signed"),
-		filepath.Join(targetDir, "usr", "lib64", "shim", "mmx64.efi.signed"),
-		filepath.Join(targetDir, "usr", "share", "shim", "mmx64.efi.signed"),
-		filepath.Join(targetDir, "usr", "lib", "shim", "mmx64.efi"),
-		filepath.Join(targetDir, "usr", "lib64", "shim", "mmx64.efi"),
+		filepath.Join(targetDir, "usr", "lib", "shim", mm+".signed"),
+		filepath.Join(targetDir, "usr", "lib64", "shim", mm+".signed"),
+		filepath.Join(targetDir, "usr", "share", "shim", mm+".signed"),
+		filepath.Join(targetDir, "usr", "lib", "shim", mm),
+		filepath.Join(targetDir, "usr", "lib64", "shim", mm),
 	}
 
 	for _, path := range mokPaths {
@@ -767,21 +873,22 @@ func findMokManager(targetDir string) string {
 	return ""
 }
 
-// findSignedGrubEFI looks for the signed grubx64.efi binary in the container image
+// findSignedGrubEFI looks for the signed grub<arch>.efi binary in the container image
 // This is essential for Secure Boot - shim will only chain-load a properly signed GRUB
-func findSignedGrubEFI(targetDir string) string {
+func findSignedGrubEFI(targetDir string, arch efiArch) string {
+	grub := arch.binary("grub")
 	// Common locations for signed GRUB EFI binary
 	grubPaths := []string{
 		// Fedora/RHEL/CentOS locations
-		filepath.Join(targetDir, "boot", "efi", "EFI", "fedora", "grubx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "centos", "grubx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "redhat", "grubx64.efi"),
-		// From grub2-efi-x64 package
-		filepath.Join(targetDir, "usr", "lib", "grub", "x86_64-efi-signed", "grubx64.efi.signed"),
-		filepath.Join(targetDir, "usr", "lib64", "grub", "x86_64-efi-signed", "grubx64.efi.signed"),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "fedora", grub),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "centos", grub),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "redhat", grub),
+		// From grub2-efi-x64 / grub2-efi-aa64 package
+		filepath.Join(targetDir, "usr", "lib", "grub", arch.grubSignedDir(), grub+".signed"),
+		filepath.Join(targetDir, "usr", "lib64", "grub", arch.grubSignedDir(), grub+".signed"),
 		// Debian/Ubuntu locations
-		filepath.Join(targetDir, "usr", "lib", "grub", "x86_64-efi-signed", "grubx64.efi"),
-		filepath.Join(targetDir, "usr", "share", "grub", "x86_64-efi-signed", "grubx64.efi"),
+		filepath.Join(targetDir, "usr", "lib", "grub", arch.grubSignedDir(), grub),
+		filepath.Join(targetDir, "usr", "share", "grub", arch.grubSignedDir(), grub),
 	}
 
 	for _, path := range grubPaths {
@@ -794,15 +901,16 @@ func findSignedGrubEFI(targetDir string) string {
 
 // findSignedSystemdBootEFI looks for a signed systemd-boot binary in the container
 // On Debian/Ubuntu, systemd-boot is signed and can be chain-loaded via shim's fallback
-func findSignedSystemdBootEFI(targetDir string) string {
+func findSignedSystemdBootEFI(targetDir string, arch efiArch) string {
+	systemdBoot := arch.binary("systemd-boot")
 	paths := []string{
 		// Debian/Ubuntu signed systemd-boot
-		filepath.Join(targetDir, "usr", "lib", "systemd", "boot", "efi", "systemd-bootx64.efi.signed"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "systemd", "systemd-bootx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "debian", "systemd-bootx64.efi"),
-		filepath.Join(targetDir, "boot", "efi", "EFI", "ubuntu", "systemd-bootx64.efi"),
+		filepath.Join(targetDir, "usr", "lib", "systemd", "boot", "efi", systemdBoot+".signed"),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "systemd", systemdBoot),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "debian", systemdBoot),
+		filepath.Join(targetDir, "boot", "efi", "EFI", "ubuntu", systemdBoot),
 		// Fedora locations (though Fedora typically uses GRUB)
-		filepath.Join(targetDir, "usr", "lib64", "systemd", "boot", "efi", "systemd-bootx64.efi.signed"),
+		filepath.Join(targetDir, "usr", "lib64", "systemd", "boot", "efi", systemdBoot+".signed"),
 	}
 
 	for _, path := range paths {
@@ -818,8 +926,15 @@ func findSignedSystemdBootEFI(targetDir string) string {
 //
 // For GRUB2: shimx64.efi → grubx64.efi (signed)
 // For systemd-boot: shimx64.efi → grubx64.efi (actually signed systemd-boot)
+//
+// The names are those of the target architecture (shimaa64.efi, grubaa64.efi
+// and BOOTAA64.EFI on arm64).
 func (b *BootloaderInstaller) setupSecureBootChain(bootloaderEFI string) (bool, error) {
-	shimPath := findShimEFI(b.TargetDir)
+	arch, err := efiArchFor(b.Arch)
+	if err != nil {
+		return false, err
+	}
+	shimPath := findShimEFI(b.TargetDir, arch)
 	if shimPath == "" {
 		return false, nil // No shim available, will use direct boot
 	}
@@ -833,14 +948,15 @@ func (b *BootloaderInstaller) setupSecureBootChain(bootloaderEFI string) (bool,
 
 	// For systemd-boot, use the fallback mechanism
 	if b.Type == BootloaderSystemdBoot {
-		return b.setupSystemdBootSecureBootChain(shimPath, efiBootDir)
+		return b.setupSystemdBootSecureBootChain(shimPath, efiBootDir, arch)
 	}
 
-	// For GRUB2, find the signed grubx64.efi from the container image
+	// For GRUB2, find the signed grub<arch>.efi from the container image
 	// We must use the signed binary, not the output from grub-install
-	signedGrubPath := findSignedGrubEFI(b.TargetDir)
+	grub := arch.binary("grub")
+	signedGrubPath := findSignedGrubEFI(b.TargetDir, arch)
 	if signedGrubPath == "" {
-		b.Progress.Warning("No signed grubx64.efi found in container image")
+		b.Progress.Warning("No signed %s found in container image", grub)
 		b.Progress.Warning("Secure Boot may fail - using unsigned GRUB from grub-install")
 		// Fall back to the provided bootloaderEFI (likely unsigned)
 		signedGrubPath = bootloaderEFI
@@ -851,29 +967,30 @@ func (b *BootloaderInstaller) setupSecureBootChain(bootloaderEFI string) (bool,
 	b.Progress.Message("Setting up Secure Boot chain with shim...")
 
 	// Copy shim as BOOTX64.EFI (the UEFI default bootloader path)
-	shimDest := filepath.Join(efiBootDir, "BOOTX64.EFI")
+	bootFile := arch.removableBootFile()
+	shimDest := filepath.Join(efiBootDir, bootFile)
 	if err := copyEFIFile(shimPath, shimDest); err != nil {
-		return false, fmt.Errorf("failed to copy shim to BOOTX64.EFI: %w", err)
+		return false, fmt.Errorf("failed to copy shim to %s: %w", bootFile, err)
 	}
-	b.Progress.Message("Installed shim as BOOTX64.EFI (Secure Boot entry point)")
+	b.Progress.Message("Installed shim as %s (Secure Boot entry point)", bootFile)
 
 	// Copy the signed grubx64.efi (what shim expects to chain-load)
 	// Shim is compiled to look for grubx64.efi in the same directory
-	bootloaderDest := filepath.Join(efiBootDir, "grubx64.efi")
+	bootloaderDest := filepath.Join(efiBootDir, grub)
 	if err := copyEFIFile(signedGrubPath, bootloaderDest); err != nil {
-		return false, fmt.Errorf("failed to copy signed grubx64.efi: %w", err)
+		return false, fmt.Errorf("failed to copy signed %s: %w", grub, err)
 	}
-	b.Progress.Message("Installed signed grubx64.efi (chain-loaded by shim)")
+	b.Progress.Message("Installed signed %s (chain-loaded by shim)", grub)
 
 	// Copy MOK manager if available (for key enrollment)
-	mokPath := findMokManager(b.TargetDir)
+	mokPath := findMokManager(b.TargetDir, arch)
 	if mokPath != "" {
-		mokDest := filepath.Join(efiBootDir, "mmx64.efi")
-		if err := copyEFIFile(mokPath, mokDest); err != nil {
+		mm := arch.binary("mm")
+		if err := copyEFIFile(mokPath, filepath.Join(efiBootDir, mm)); err != nil {
 			// MOK manager is optional, just warn
 			b.Progress.Warning("failed to copy MOK manager: %v", err)
 		} else {
-			b.Progress.Message("Installed MOK manager (mmx64.efi)")
+			b.Progress.Message("Installed MOK manager (%s)", mm)
 		}
 	}
 
@@ -897,9 +1014,9 @@ func (b *BootloaderInstaller) setupSecureBootChain(bootloaderEFI string) (bool,
 // expected distro-specific location.
 //
 // Boot chain: shimx64.efi (BOOTX64.EFI) → grubx64.efi (actually signed systemd-boot)
-func (b *BootloaderInstaller) setupSystemdBootSecureBootChain(shimPath, efiBootDir string) (bool, error) {
+func (b *BootloaderInstaller) setupSystemdBootSecureBootChain(shimPath, efiBootDir string, arch efiArch) (bool, error) {
 	// Find signed systemd-boot
-	signedSystemdBoot := findSignedSystemdBootEFI(b.TargetDir)
+	signedSystemdBoot := findSignedSystemdBootEFI(b.TargetDir, arch)
 	if signedSystemdBoot == "" {
 		b.Progress.Warning("No signed systemd-boot found in container image")
 		b.Progress.Warning("Secure Boot may fail with systemd-boot")
@@ -910,28 +1027,30 @@ func (b *BootloaderInstaller) setupSystemdBootSecureBootChain(shimPath, efiBootD
 	b.Progress.Message("Setting up Secure Boot chain for systemd-boot...")
 
 	// Copy shim as BOOTX64.EFI (the UEFI default bootloader path)
-	shimDest := filepath.Join(efiBootDir, "BOOTX64.EFI")
+	bootFile := arch.removableBootFile()
+	shimDest := filepath.Join(efiBootDir, bootFile)
 	if err := copyEFIFile(shimPath, shimDest); err != nil {
-		return false, fmt.Errorf("failed to copy shim to BOOTX64.EFI: %w", err)
+		return false, fmt.Errorf("failed to copy shim to %s: %w", bootFile, err)
 	}
-	b.Progress.Message("Installed shim as BOOTX64.EFI (Secure Boot entry point)")
+	b.Progress.Message("Installed shim as %s (Secure Boot entry point)", bootFile)
 
 	// Copy signed systemd-boot as grubx64.efi - shim will load it
 	// Shim is compiled to look for grubx64.efi, but it only verifies the signature.
 	// Since systemd-boot is signed by the same distro key that shim trusts,
 	// shim will load it successfully.
-	bootloaderDest := filepath.Join(efiBootDir, "grubx64.efi")
+	grub := arch.binary("grub")
+	bootloaderDest := filepath.Join(efiBootDir, grub)
 	if err := copyEFIFile(signedSystemdBoot, bootloaderDest); err != nil {
-		return false, fmt.Errorf("failed to copy signed systemd-boot as grubx64.efi: %w", err)
+		return false, fmt.Errorf("failed to copy signed systemd-boot as %s: %w", grub, err)
 	}
-	b.Progress.Message("Installed signed systemd-boot as grubx64.efi (chain-loaded by shim)")
+	b.Progress.Message("Installed signed systemd-boot as %s (chain-loaded by shim)", grub)
 
 	// Copy MOK manager if available (for key enrollment if needed)
-	mokPath := findMokManager(b.TargetDir)
+	mokPath := findMokManager(b.TargetDir, arch)
 	if mokPath != "" {
-		mokDest := filepath.Join(efiBootDir, "mmx64.efi")
-		if err := copyEFIFile(mokPath, mokDest); err == nil {
-			b.Progress.Message("Installed MOK manager (mmx64.efi)")
+		mm := arch.binary("mm")
+		if err := copyEFIFile(mokPath, filepath.Join(efiBootDir, mm)); err == nil {
+			b.Progress.Message("Installed MOK manager (%s)", mm)
 		}
 	}
 
@@ -944,7 +1063,7 @@ func (b *BootloaderInstaller) setupSystemdBootSecureBootChain(shimPath, efiBootD
 	espPath := filepath.Join(b.TargetDir, "boot")
 	efiSystemdDir := filepath.Join(espPath, "EFI", "systemd")
 	if err := os.MkdirAll(efiSystemdDir, 0755); err == nil {
-		systemdBootDest := filepath.Join(efiSystemdDir, "systemd-bootx64.efi")
+		systemdBootDest := filepath.Join(efiSystemdDir, arch.binary("systemd-boot"))
 		_ = copyEFIFile(signedSystemdBoot, systemdBootDest)
 	}
 
@@ -964,7 +1083,7 @@ func DetectBootloader(targetDir string) BootloaderType {
 
 // registerEFIBootEntry uses efibootmgr to register a boot entry in UEFI firmware
 // This ensures the system is bootable even if the firmware doesn't auto-detect the bootloader
-func (b *BootloaderInstaller) registerEFIBootEntry(ctx context.Context) error {
+func (b *BootloaderInstaller) registerEFIBootEntry(ctx context.Context, arch efiArch) error {
 	// Check if efibootmgr is available
 	efibootmgrPath, err := exec.LookPath("efibootmgr")
 	if err != nil {
@@ -992,14 +1111,9 @@ func (b *BootloaderInstaller) registerEFIBootEntry(ctx context.Context) error {
 		return fmt.Errorf("failed to parse ESP partition device: %w", err)
 	}
 
-	// Determine the EFI bootloader path (relative to ESP root, using backslashes)
-	var efiPath string
-	switch b.Type {
-	case BootloaderGRUB2:
-		efiPath = "\\EFI\\BOOT\\BOOTX64.EFI"
-	case BootloaderSystemdBoot:
-		efiPath = "\\EFI\\BOOT\\BOOTX64.EFI"
-	}
+	// The EFI bootloader path (relative to ESP root, using backslashes). Both
+	// bootloaders, or shim in front of them, boot from the removable media path.
+	efiPath := "\\EFI\\BOOT\\" + arch.removableBootFile()
 
 	// Create the boot entry
 	// Use the OS name as the label
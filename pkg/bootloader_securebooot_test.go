@@ -34,6 +34,7 @@ func TestSetupSecureBootChain_GRUB2_DoesNotInstallFbx64(t *testing.T) {
 	b := &BootloaderInstaller{
 		Type:      BootloaderGRUB2,
 		TargetDir: targetDir,
+		Arch:      "amd64",
 		Progress:  reporter.NoopReporter{},
 	}
 
@@ -59,3 +60,58 @@ func TestSetupSecureBootChain_GRUB2_DoesNotInstallFbx64(t *testing.T) {
 		t.Errorf("fbx64.efi must not be installed on the GRUB2 Secure Boot path (causes Restore Boot Option blue screen)")
 	}
 }
+
+// TestSetupSecureBootChain_GRUB2_ARM64 checks that arm64 installs boot shim and
+// GRUB under their aa64 names, from the arm64 packages of the image
+func TestSetupSecureBootChain_GRUB2_ARM64(t *testing.T) {
+	targetDir := t.TempDir()
+	for _, rel := range []string{
+		filepath.Join("usr", "lib", "shim", "shimaa64.efi.signed"),
+		filepath.Join("usr", "lib", "grub", "arm64-efi-signed", "grubaa64.efi.signed"),
+		filepath.Join("usr", "lib", "shim", "mmaa64.efi"),
+		// x64 binaries must not be picked up
+		filepath.Join("usr", "lib", "shim", "shimx64.efi.signed"),
+	} {
+		p := filepath.Join(targetDir, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("EFI-BINARY:"+rel), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &BootloaderInstaller{
+		Type:      BootloaderGRUB2,
+		TargetDir: targetDir,
+		Arch:      "arm64",
+		Progress:  reporter.NoopReporter{},
+	}
+	ok, err := b.setupSecureBootChain(filepath.Join(targetDir, "unused-grub.efi"))
+	if err != nil {
+		t.Fatalf("setupSecureBootChain: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected Secure Boot chain to be set up (shim present)")
+	}
+
+	efiBootDir := filepath.Join(targetDir, "boot", "EFI", "BOOT")
+	want := map[string]string{
+		"BOOTAA64.EFI": "shimaa64.efi.signed",
+		"grubaa64.efi": "grubaa64.efi.signed",
+		"mmaa64.efi":   "mmaa64.efi",
+	}
+	for name, source := range want {
+		data, err := os.ReadFile(filepath.Join(efiBootDir, name))
+		if err != nil {
+			t.Errorf("expected %s in EFI/BOOT: %v", name, err)
+			continue
+		}
+		if filepath.Base(string(data)) != source {
+			t.Errorf("%s = %s, want a copy of %s", name, data, source)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(efiBootDir, "BOOTX64.EFI")); !os.IsNotExist(err) {
+		t.Error("BOOTX64.EFI must not be installed on arm64")
+	}
+}
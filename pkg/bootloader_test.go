@@ -157,7 +157,7 @@ func TestBuildKernelCmdline_BootloaderWithBootMount(t *testing.T) {
 	}
 
 	// Create partitions
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("Failed to create partitions: %v", err)
 	}
@@ -394,3 +394,15 @@ func TestEnsureUppercaseBOOTDirectory(t *testing.T) {
 		}
 	})
 }
+
+func TestBootloaderInstall_BIOSNeedsGRUB2(t *testing.T) {
+	installer := NewBootloaderInstaller(t.TempDir(), "/dev/sda", nil, "Test")
+	installer.SetProgress(reporter.NoopReporter{})
+	installer.SetType(BootloaderSystemdBoot)
+	installer.SetBootMode(BootModeBIOS)
+
+	err := installer.Install(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "cannot boot from BIOS") {
+		t.Errorf("Install() error = %v, want systemd-boot refused for BIOS boot", err)
+	}
+}
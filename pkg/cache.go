@@ -38,8 +38,9 @@ type ImageCache struct {
 	CacheDir      string
 	Verbose       bool
 	Progress      reporter.Reporter
-	SkipVerify    bool   // Skip cosign signature verification of downloaded images
-	CosignKeyPath string // Override trusted cosign public key (empty = embedded)
+	SkipVerify    bool         // Skip cosign signature verification of downloaded images
+	CosignKeyPath string       // Override trusted cosign public key (empty = embedded)
+	Platform      *v1.Platform // Image platform to download (nil = this machine's)
 }
 
 // NewImageCache creates a new ImageCache for the specified directory
@@ -100,10 +101,13 @@ func (c *ImageCache) Download(ctx context.Context, imageRef string, progress rep
 	progress.Message("Downloading image...")
 
 	// Pull image from registry
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithPlatform(targetPlatform(c.Platform)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to pull image: %w", err)
 	}
+	if err := checkImagePlatform(img, targetPlatform(c.Platform)); err != nil {
+		return nil, err
+	}
 
 	// Get image digest
 	digest, err := img.Digest()
@@ -155,6 +159,7 @@ func (c *ImageCache) Download(ctx context.Context, imageRef string, progress rep
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract metadata: %w", err)
 	}
+	metadata.Platform = targetPlatform(c.Platform).String()
 
 	// Write metadata file
 	if err := c.writeMetadata(stagingDir, metadata); err != nil {
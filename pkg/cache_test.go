@@ -16,6 +16,7 @@ func testCachedImageMetadata(imageRef, digest string) *CachedImageMetadata {
 		ImageDigest:         digest,
 		DownloadDate:        "2024-01-01T00:00:00Z",
 		Architecture:        "amd64",
+		Platform:            "linux/amd64",
 		Labels:              map[string]string{"version": "1.0"},
 		OSReleasePrettyName: "Test OS",
 		OSReleaseVersionID:  "1.0",
@@ -51,6 +52,9 @@ func assertMetadataEqual(t *testing.T, got, want *CachedImageMetadata) {
 	if got.Architecture != want.Architecture {
 		t.Errorf("Architecture = %q, want %q", got.Architecture, want.Architecture)
 	}
+	if got.Platform != want.Platform {
+		t.Errorf("Platform = %q, want %q", got.Platform, want.Platform)
+	}
 	if got.SizeBytes != want.SizeBytes {
 		t.Errorf("SizeBytes = %d, want %d", got.SizeBytes, want.SizeBytes)
 	}
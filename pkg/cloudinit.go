@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/frostyard/std/reporter"
+)
+
+// CloudInitSeedDir is where cloud-init's NoCloud datasource looks for a seed
+// on the installed system, on the /var partition
+const CloudInitSeedDir = "/var/lib/cloud/seed/nocloud"
+
+// CloudInitSeed is a cloud-init NoCloud seed, placed on the installed system
+// for cloud-init in the image to apply on first boot.
+type CloudInitSeed struct {
+	// UserData is the user-data: a #cloud-config document, a script or a
+	// MIME multipart archive. Required.
+	UserData []byte
+
+	// MetaData is the meta-data. Optional; if empty, one with an instance-id
+	// derived from UserData is written.
+	MetaData []byte
+
+	// NetworkConfig is the network-config. Optional.
+	NetworkConfig []byte
+}
+
+// userDataPrefixes are the starts of the user-data formats cloud-init
+// recognizes; it ignores anything else
+var userDataPrefixes = []string{
+	"#cloud-config",
+	"#!",
+	"#include",
+	"#cloud-boothook",
+	"#part-handler",
+	"## template: jinja",
+	"Content-Type:",
+}
+
+// Validate checks the seed for errors
+func (s *CloudInitSeed) Validate() error {
+	if len(s.UserData) == 0 {
+		return errors.New("cloud-init user-data is empty")
+	}
+	recognized := false
+	for _, prefix := range userDataPrefixes {
+		if strings.HasPrefix(string(s.UserData), prefix) {
+			recognized = true
+			break
+		}
+	}
+	if !recognized {
+		return errors.New("cloud-init user-data must start with #cloud-config, a #! script or a MIME multipart header")
+	}
+	return nil
+}
+
+// metaData returns the meta-data of the seed
+func (s *CloudInitSeed) metaData() []byte {
+	if len(s.MetaData) > 0 {
+		return s.MetaData
+	}
+	sum := sha256.Sum256(s.UserData)
+	return []byte("instance-id: nbc-" + hex.EncodeToString(sum[:8]) + "\n")
+}
+
+// WriteCloudInitSeed places seed in the NoCloud seed directory of the system
+// installed at targetDir, whose /var must be mounted.
+func WriteCloudInitSeed(targetDir string, seed *CloudInitSeed, dryRun bool, progress reporter.Reporter) error {
+	if seed == nil {
+		return nil
+	}
+	if err := seed.Validate(); err != nil {
+		return err
+	}
+
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would write cloud-init NoCloud seed to %s", CloudInitSeedDir)
+		return nil
+	}
+
+	progress.Message("Writing cloud-init NoCloud seed to %s...", CloudInitSeedDir)
+	if _, err := os.Stat(filepath.Join(targetDir, "usr", "bin", "cloud-init")); err != nil {
+		progress.Warning("image has no cloud-init, the seed will not be applied on first boot")
+	}
+
+	seedDir := filepath.Join(targetDir, CloudInitSeedDir)
+	if err := os.MkdirAll(seedDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", CloudInitSeedDir, err)
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"user-data", seed.UserData},
+		{"meta-data", seed.metaData()},
+		{"network-config", seed.NetworkConfig},
+	}
+	for _, f := range files {
+		if len(f.data) == 0 {
+			continue
+		}
+		// user-data often carries secrets
+		if err := os.WriteFile(filepath.Join(seedDir, f.name), f.data, 0600); err != nil {
+			return fmt.Errorf("failed to write cloud-init %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
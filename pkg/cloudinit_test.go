@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/frostyard/std/reporter"
+)
+
+func TestWriteCloudInitSeed(t *testing.T) {
+	root := t.TempDir()
+	seed := &CloudInitSeed{
+		UserData:      []byte("#cloud-config\nhostname: kiosk-01\n"),
+		NetworkConfig: []byte("version: 2\n"),
+	}
+	if err := WriteCloudInitSeed(root, seed, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("WriteCloudInitSeed() error = %v", err)
+	}
+
+	seedDir := filepath.Join(root, CloudInitSeedDir)
+	if info, err := os.Stat(seedDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("seed directory mode = %v, %v; want 0700", info.Mode().Perm(), err)
+	}
+	for name, want := range map[string]string{
+		"user-data":      "#cloud-config\nhostname: kiosk-01\n",
+		"network-config": "version: 2\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(seedDir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	info, err := os.Stat(filepath.Join(seedDir, "user-data"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("user-data mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	// Without meta-data one is made up from the user-data, so that the
+	// instance-id only changes with it
+	metaData, err := os.ReadFile(filepath.Join(seedDir, "meta-data"))
+	if err != nil || !strings.HasPrefix(string(metaData), "instance-id: nbc-") {
+		t.Errorf("meta-data = %q, %v; want a generated instance-id", metaData, err)
+	}
+	if string(seed.metaData()) != string(metaData) {
+		t.Error("the generated meta-data should not change between runs")
+	}
+}
+
+func TestWriteCloudInitSeed_DryRun(t *testing.T) {
+	root := t.TempDir()
+	seed := &CloudInitSeed{UserData: []byte("#!/bin/sh\necho hello\n")}
+	if err := WriteCloudInitSeed(root, seed, true, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("WriteCloudInitSeed() dry run error = %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Error("dry run should not write anything")
+	}
+}
+
+func TestCloudInitSeed_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData string
+		wantErr  bool
+	}{
+		{"cloud-config", "#cloud-config\nusers: []\n", false},
+		{"script", "#!/bin/bash\ntrue\n", false},
+		{"multipart", "Content-Type: multipart/mixed; boundary=\"==BOUNDARY==\"\n", false},
+		{"jinja template", "## template: jinja\n#cloud-config\n", false},
+		{"empty", "", true},
+		{"plain YAML", "hostname: kiosk-01\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seed := &CloudInitSeed{UserData: []byte(tt.userData)}
+			if err := seed.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package pkg
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+	"golang.org/x/sys/unix"
+)
+
+// Composefs root deployments
+//
+// With composefs, every regular file of a root slot is also linked into a
+// content-addressed object store on the slot, named by its fs-verity digest,
+// with fs-verity enabled. A composefs image (an EROFS metadata image) of the
+// slot's tree references the objects by digest. The dracut module mounts the
+// image over the root by the fs-verity digest recorded on the kernel command
+// line, so changed metadata fails to mount and changed file contents fail to
+// read.
+//
+// Layout on each root slot:
+//
+//	/.nbc-composefs/objects/ab/cdef...   - Files of the tree, by fs-verity digest
+//	/.nbc-composefs/images/<digest>      - Composefs image, by fs-verity digest
+
+// composefsDir is the directory at the top of a root slot holding its
+// composefs object store and images. The images leave it out.
+const composefsDir = ".nbc-composefs"
+
+// ComposefsCmdlineArg is the kernel command line parameter holding the
+// fs-verity digest of the composefs image the dracut module mounts as root
+const ComposefsCmdlineArg = "nbc.composefs"
+
+// composefsVerityBlockSize is the fs-verity block size composefs computes
+// digests with
+const composefsVerityBlockSize = 4096
+
+// ComposefsConfig records the composefs images of the root slots
+type ComposefsConfig struct {
+	// Digests maps a root slot ("root1" or "root2") to the fs-verity digest
+	// of its composefs image
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// setDigest records the digest of the composefs image of slot. An empty
+// digest removes the slot's image.
+func (c *ComposefsConfig) setDigest(slot, digest string) {
+	if digest == "" {
+		delete(c.Digests, slot)
+		return
+	}
+	if c.Digests == nil {
+		c.Digests = make(map[string]string)
+	}
+	c.Digests[slot] = digest
+}
+
+// cmdlineComposefsDigest returns the composefs image digest a kernel command
+// line boots, or "" if it boots no composefs image
+func cmdlineComposefsDigest(cmdline []string) string {
+	for _, arg := range cmdline {
+		if digest, ok := strings.CutPrefix(arg, ComposefsCmdlineArg+"="); ok {
+			return digest
+		}
+	}
+	return ""
+}
+
+// BootedComposefsDigest returns the digest of the composefs image the running
+// system was booted from, or "" if its root is not a composefs image
+func BootedComposefsDigest() string {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return ""
+	}
+	return cmdlineComposefsDigest(strings.Fields(string(cmdline)))
+}
+
+// GetComposefsStatus reports the composefs images recorded in config, and
+// the one the running system was booted from
+func GetComposefsStatus(config *SystemConfig) *types.ComposefsStatus {
+	if config.Composefs == nil {
+		return nil
+	}
+	return &types.ComposefsStatus{
+		Digests:      config.Composefs.Digests,
+		BootedDigest: BootedComposefsDigest(),
+	}
+}
+
+// enableVerity enables fs-verity on the file at path with the parameters
+// composefs computes digests with. Files that already have it are left alone.
+func enableVerity(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: unix.FS_VERITY_HASH_ALG_SHA256,
+		Block_size:     composefsVerityBlockSize,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 && errno != unix.EEXIST {
+		return errno
+	}
+	return nil
+}
+
+// measureVerity returns the hex fs-verity digest of the file at path
+func measureVerity(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	var measured struct {
+		unix.FsverityDigest
+		digest [64]byte
+	}
+	measured.Size = uint16(len(measured.digest))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&measured)))
+	if errno != 0 {
+		return "", errno
+	}
+	return hex.EncodeToString(measured.digest[:measured.Size]), nil
+}
+
+// verityError explains the errors of filesystems without fs-verity support
+func verityError(path string, err error) error {
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) {
+		return fmt.Errorf("filesystem of %s does not support fs-verity (ext4 needs the verity feature): %w", path, err)
+	}
+	return fmt.Errorf("failed to enable fs-verity on %s: %w", path, err)
+}
+
+// composefsObjectPath returns the path of the object with digest in the
+// object store objects
+func composefsObjectPath(objects, digest string) string {
+	return filepath.Join(objects, digest[:2], digest[2:])
+}
+
+// populateComposefsObjects enables fs-verity on every regular file of the
+// tree at root and hard links it into the object store at objects, so the
+// store takes no extra space. Mounts below root (/boot, /var) and the
+// composefs directory are skipped. It returns the number of files linked.
+func populateComposefsObjects(ctx context.Context, root, objects string) (int, error) {
+	var rootStat unix.Stat_t
+	if err := unix.Lstat(root, &rootStat); err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", root, err)
+	}
+
+	count := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(root, composefsDir) {
+				return filepath.SkipDir
+			}
+			var st unix.Stat_t
+			if err := unix.Lstat(path, &st); err != nil {
+				return fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+			if st.Dev != rootStat.Dev {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if err := enableVerity(path); err != nil {
+			return verityError(path, err)
+		}
+		digest, err := measureVerity(path)
+		if err != nil {
+			return fmt.Errorf("failed to measure fs-verity digest of %s: %w", path, err)
+		}
+		object := composefsObjectPath(objects, digest)
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return fmt.Errorf("failed to create object directory: %w", err)
+		}
+		// Files with the same contents share one object
+		if err := os.Link(path, object); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to link %s into the object store: %w", path, err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// buildComposefsImage writes the composefs image of the tree at root to
+// image, referencing the objects in objects. mkcomposefs copies the files it
+// does not find in the store there.
+func buildComposefsImage(ctx context.Context, root, objects, image string) error {
+	// A non-recursive bind mount leaves out the mounts below the root, and
+	// an empty tmpfs hides the composefs directory
+	src, err := os.MkdirTemp("", "nbc-composefs-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() { _ = os.Remove(src) }()
+
+	if output, err := exec.CommandContext(ctx, "mount", "--bind", root, src).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %w\nOutput: %s", root, err, string(output))
+	}
+	defer func() { _ = exec.Command("umount", src).Run() }()
+
+	hidden := filepath.Join(src, composefsDir)
+	if output, err := exec.CommandContext(ctx, "mount", "-t", "tmpfs", "-o", "ro,mode=0700", "tmpfs", hidden).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to hide %s: %w\nOutput: %s", composefsDir, err, string(output))
+	}
+	defer func() { _ = exec.Command("umount", hidden).Run() }()
+
+	cmd := exec.CommandContext(ctx, "mkcomposefs", "--digest-store="+objects, src, image)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mkcomposefs failed: %w\nOutput: %s", err, string(out))
+	}
+	return nil
+}
+
+// hasComposefsMount reports whether the image at root ships mount.composefs,
+// which the initramfs needs to mount the root image
+func hasComposefsMount(root string) bool {
+	for _, dir := range []string{"usr/sbin", "usr/bin", "sbin"} {
+		if _, err := os.Stat(filepath.Join(root, dir, "mount.composefs")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureComposefsInitramfs makes sure the initramfs of the image at root can
+// mount composefs images, installing nbc's dracut module and regenerating the
+// initramfs when the image's module predates composefs
+func ensureComposefsInitramfs(ctx context.Context, root string, dryRun, verbose bool, progress reporter.Reporter) error {
+	hook := filepath.Join(root, "usr", "lib", "dracut", "modules.d", "95etc-overlay", "composefs-mount.sh")
+	if _, err := os.Stat(hook); err == nil {
+		return nil
+	}
+	progress.Message("Image's etc-overlay dracut module cannot mount composefs, replacing it")
+	if err := InstallDracutEtcOverlay(ctx, root, dryRun, progress); err != nil {
+		return fmt.Errorf("failed to install dracut etc-overlay module: %w", err)
+	}
+	if err := RegenerateInitramfs(ctx, root, dryRun, verbose, progress); err != nil {
+		return fmt.Errorf("failed to regenerate initramfs: %w", err)
+	}
+	return nil
+}
+
+// SetupComposefs turns the root slot mounted at root into a composefs
+// deployment: it makes sure the initramfs can mount composefs, moves the files
+// into a fs-verity object store and builds the composefs image of the tree. It
+// returns the fs-verity digest of the image, to boot with ComposefsCmdlineArg.
+// It must run once nothing else writes to the root.
+func SetupComposefs(ctx context.Context, root string, dryRun, verbose bool, progress reporter.Reporter) (string, error) {
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would build a fs-verity protected composefs image of the root")
+		return "", nil
+	}
+
+	if _, err := exec.LookPath("mkcomposefs"); err != nil {
+		return "", fmt.Errorf("mkcomposefs not found - install the composefs package")
+	}
+	if !hasComposefsMount(root) {
+		return "", fmt.Errorf("image has no mount.composefs - install composefs in the image")
+	}
+	if err := ensureComposefsInitramfs(ctx, root, dryRun, verbose, progress); err != nil {
+		return "", err
+	}
+
+	// An earlier image of the slot is rebuilt from scratch
+	dir := filepath.Join(root, composefsDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to remove old composefs store: %w", err)
+	}
+	objects := filepath.Join(dir, "objects")
+	images := filepath.Join(dir, "images")
+	for _, d := range []string{objects, images} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return "", fmt.Errorf("failed to create %s: %w", d, err)
+		}
+	}
+
+	progress.Message("Enabling fs-verity on the root files...")
+	count, err := populateComposefsObjects(ctx, root, objects)
+	if err != nil {
+		return "", err
+	}
+	if verbose {
+		progress.Message("Linked %d files into the composefs object store", count)
+	}
+
+	progress.Message("Building composefs image...")
+	tmpImage := filepath.Join(images, "image.tmp")
+	if err := buildComposefsImage(ctx, root, objects, tmpImage); err != nil {
+		return "", err
+	}
+	if err := enableVerity(tmpImage); err != nil {
+		return "", verityError(tmpImage, err)
+	}
+	digest, err := measureVerity(tmpImage)
+	if err != nil {
+		return "", fmt.Errorf("failed to measure fs-verity digest of the composefs image: %w", err)
+	}
+	if err := os.Rename(tmpImage, filepath.Join(images, digest)); err != nil {
+		return "", fmt.Errorf("failed to name composefs image: %w", err)
+	}
+
+	progress.Message("✓ Composefs image %s", digest)
+	return digest, nil
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// requireVerity skips the test unless dir supports fs-verity
+func requireVerity(t *testing.T, dir string) {
+	t.Helper()
+	probe := filepath.Join(dir, ".verity-probe")
+	if err := os.WriteFile(probe, []byte("probe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(probe) }()
+	if err := enableVerity(probe); err != nil {
+		t.Skipf("filesystem does not support fs-verity: %v", err)
+	}
+}
+
+func TestComposefsConfigSetDigest(t *testing.T) {
+	config := &ComposefsConfig{}
+	config.setDigest("root1", "aaaa")
+	config.setDigest("root2", "bbbb")
+	config.setDigest("root2", "cccc")
+	if config.Digests["root1"] != "aaaa" || config.Digests["root2"] != "cccc" {
+		t.Errorf("Digests = %v, want root1=aaaa root2=cccc", config.Digests)
+	}
+
+	// A dry run builds no image, leaving the slot without one
+	config.setDigest("root1", "")
+	if _, ok := config.Digests["root1"]; ok {
+		t.Errorf("Digests = %v, root1 should have no image", config.Digests)
+	}
+}
+
+func TestCmdlineComposefsDigest(t *testing.T) {
+	tests := []struct {
+		cmdline []string
+		want    string
+	}{
+		{[]string{"root=UUID=x", "ro", "nbc.composefs=abc123", "quiet"}, "abc123"},
+		{[]string{"root=UUID=x", "ro", "quiet"}, ""},
+		{[]string{"nbc.composefs.debug=1"}, ""},
+	}
+	for _, tt := range tests {
+		if got := cmdlineComposefsDigest(tt.cmdline); got != tt.want {
+			t.Errorf("cmdlineComposefsDigest(%v) = %q, want %q", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestGetComposefsStatus(t *testing.T) {
+	if status := GetComposefsStatus(&SystemConfig{}); status != nil {
+		t.Errorf("GetComposefsStatus() without composefs = %+v, want nil", status)
+	}
+	config := &SystemConfig{Composefs: &ComposefsConfig{Digests: map[string]string{"root1": "aaaa"}}}
+	status := GetComposefsStatus(config)
+	if status == nil || status.Digests["root1"] != "aaaa" {
+		t.Errorf("GetComposefsStatus() = %+v, want the recorded digests", status)
+	}
+}
+
+func TestHasComposefsMount(t *testing.T) {
+	root := t.TempDir()
+	if hasComposefsMount(root) {
+		t.Error("hasComposefsMount() = true for an image without mount.composefs")
+	}
+	if err := os.MkdirAll(filepath.Join(root, "usr", "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr", "sbin", "mount.composefs"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !hasComposefsMount(root) {
+		t.Error("hasComposefsMount() = false for an image with /usr/sbin/mount.composefs")
+	}
+}
+
+func TestPopulateComposefsObjects(t *testing.T) {
+	root := t.TempDir()
+	requireVerity(t, root)
+
+	files := map[string]string{
+		"usr/bin/tool":       "tool",
+		"usr/share/a":        "same contents",
+		"usr/share/b":        "same contents",
+		composefsDir + "/ok": "not part of the tree",
+	}
+	for path, content := range files {
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("tool", filepath.Join(root, "usr/bin/alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	objects := filepath.Join(root, composefsDir, "objects")
+	count, err := populateComposefsObjects(t.Context(), root, objects)
+	if err != nil {
+		t.Fatalf("populateComposefsObjects() error = %v", err)
+	}
+	if count != 3 {
+		t.Errorf("populateComposefsObjects() linked %d files, want 3", count)
+	}
+
+	digest, err := measureVerity(filepath.Join(root, "usr/share/a"))
+	if err != nil {
+		t.Fatalf("fs-verity not enabled on the tree's files: %v", err)
+	}
+	var object, file unix.Stat_t
+	if err := unix.Stat(composefsObjectPath(objects, digest), &object); err != nil {
+		t.Fatalf("object for usr/share/a missing: %v", err)
+	}
+	if err := unix.Stat(filepath.Join(root, "usr/share/a"), &file); err != nil {
+		t.Fatal(err)
+	}
+	if object.Ino != file.Ino {
+		t.Error("object should be a hard link of the tree's file")
+	}
+
+	// fs-verity files cannot be opened for writing
+	if _, err := os.OpenFile(filepath.Join(root, "usr/bin/tool"), os.O_WRONLY, 0); err == nil {
+		t.Error("file with fs-verity should not be writable")
+	}
+	if _, err := measureVerity(filepath.Join(root, composefsDir, "ok")); !errors.Is(err, unix.ENODATA) {
+		t.Errorf("the composefs directory should be skipped, measure err = %v", err)
+	}
+}
@@ -83,24 +83,83 @@ const (
 
 // EncryptionConfig stores LUKS encryption configuration for A/B updates
 type EncryptionConfig struct {
-	Enabled       bool   `json:"enabled"`         // Whether LUKS encryption is enabled
-	TPM2          bool   `json:"tpm2"`            // Whether TPM2 auto-unlock is enabled
-	Root1LUKSUUID string `json:"root1_luks_uuid"` // LUKS UUID for root1 partition
-	Root2LUKSUUID string `json:"root2_luks_uuid"` // LUKS UUID for root2 partition
-	VarLUKSUUID   string `json:"var_luks_uuid"`   // LUKS UUID for var partition
+	Enabled       bool        `json:"enabled"`               // Whether LUKS encryption is enabled
+	TPM2          bool        `json:"tpm2"`                  // Whether TPM2 auto-unlock is enabled
+	Root1LUKSUUID string      `json:"root1_luks_uuid"`       // LUKS UUID for root1 partition
+	Root2LUKSUUID string      `json:"root2_luks_uuid"`       // LUKS UUID for root2 partition
+	VarLUKSUUID   string      `json:"var_luks_uuid"`         // LUKS UUID for var partition
+	TPM2Policy    *TPM2Policy `json:"tpm2_policy,omitempty"` // What the TPM2 key is bound to (nil = no PCR binding)
+}
+
+// TPM2Policy describes the PCR policy a TPM2-sealed LUKS key is enrolled with
+type TPM2Policy struct {
+	PCRs       []int  `json:"pcrs,omitempty"`        // PCRs whose values the key is sealed to (e.g. 7)
+	PublicKey  string `json:"public_key,omitempty"`  // PEM public key of a signed PCR 11 policy
+	PrivateKey string `json:"private_key,omitempty"` // PEM private key that signs the PCR 11 values of new UKIs
+}
+
+// DiscoverableConfig stores the Discoverable Partitions Specification settings
+// of an installation whose partitions carry DPS type GUIDs
+type DiscoverableConfig struct {
+	MachineID string `json:"machine_id"` // Machine ID passed on the kernel cmdline; the var PARTUUID is derived from it
+}
+
+// SubvolumeConfig stores the deployments of an installation whose single root
+// partition holds one btrfs subvolume per deployment
+type SubvolumeConfig struct {
+	Keep        int                   `json:"keep"`        // Number of deployments kept by updates (0 = DefaultKeepDeployments)
+	Deployments []SubvolumeDeployment `json:"deployments"` // Deployments on the root partition, newest first
+}
+
+// SubvolumeDeployment describes a deployment in the subvolume deployments/<ID>
+type SubvolumeDeployment struct {
+	ID            int    `json:"id"`
+	ImageRef      string `json:"image_ref"`
+	ImageDigest   string `json:"image_digest,omitempty"`
+	KernelVersion string `json:"kernel_version,omitempty"` // Kernel its boot entry uses
+	Created       string `json:"created"`                  // Creation timestamp (RFC 3339)
+}
+
+// VarSnapshotConfig stores the retention of the btrfs snapshots of /var and
+// the snapshots taken. Without it the defaults apply.
+type VarSnapshotConfig struct {
+	KeepUpdate    int           `json:"keep_update"`         // Pre-update snapshots kept (0 = none taken)
+	KeepScheduled int           `json:"keep_scheduled"`      // Scheduled snapshots kept (0 = none taken)
+	Snapshots     []VarSnapshot `json:"snapshots,omitempty"` // Snapshots taken, newest first
+}
+
+// VarSnapshot describes a read-only snapshot of /var
+type VarSnapshot struct {
+	Name        string `json:"name"`                   // Subvolume name below .nbc-snapshots (top level for replaced) on the var partition
+	Kind        string `json:"kind"`                   // update, scheduled, manual or replaced
+	Created     string `json:"created"`                // Creation timestamp (RFC 3339)
+	ImageRef    string `json:"image_ref,omitempty"`    // Image running when the snapshot was taken
+	ImageDigest string `json:"image_digest,omitempty"` // Digest of that image
 }
 
 // SystemConfig represents the system configuration stored in /var/lib/nbc/state/
 type SystemConfig struct {
-	ImageRef       string            `json:"image_ref"`            // Container image reference
-	ImageDigest    string            `json:"image_digest"`         // Container image digest (sha256:...)
-	Device         string            `json:"device"`               // Installation device (e.g. /dev/sda, /dev/nvme0n1)
-	DiskID         string            `json:"disk_id,omitempty"`    // Stable disk identifier from /dev/disk/by-id
-	InstallDate    string            `json:"install_date"`         // Installation timestamp
-	KernelArgs     []string          `json:"kernel_args"`          // Custom kernel arguments
-	BootloaderType string            `json:"bootloader_type"`      // Bootloader type (grub2, systemd-boot)
-	FilesystemType string            `json:"filesystem_type"`      // Filesystem type (ext4, btrfs)
-	Encryption     *EncryptionConfig `json:"encryption,omitempty"` // Encryption configuration (nil if not encrypted)
+	ImageRef            string              `json:"image_ref"`                       // Container image reference
+	ImageDigest         string              `json:"image_digest"`                    // Container image digest (sha256:...)
+	PreviousImageRef    string              `json:"previous_image_ref,omitempty"`    // Image reference in the other (rollback) slot
+	PreviousImageDigest string              `json:"previous_image_digest,omitempty"` // Image digest in the other (rollback) slot
+	Device              string              `json:"device"`                          // Installation device (e.g. /dev/sda, /dev/nvme0n1)
+	DiskID              string              `json:"disk_id,omitempty"`               // Stable disk identifier from /dev/disk/by-id
+	InstallDate         string              `json:"install_date"`                    // Installation timestamp
+	KernelArgs          []string            `json:"kernel_args"`                     // Custom kernel arguments
+	BootloaderType      string              `json:"bootloader_type"`                 // Bootloader type (grub2, systemd-boot)
+	FilesystemType      string              `json:"filesystem_type"`                 // Filesystem type (ext4, btrfs)
+	Layout              *PartitionLayout    `json:"partition_layout,omitempty"`      // Partition sizes chosen at install (nil for older installs)
+	PartitionUUIDs      *PartitionUUIDs     `json:"partition_uuids,omitempty"`       // GPT PARTUUIDs of the partitions (nil for older installs)
+	Encryption          *EncryptionConfig   `json:"encryption,omitempty"`            // Encryption configuration (nil if not encrypted)
+	Discoverable        *DiscoverableConfig `json:"discoverable,omitempty"`          // Discoverable partition settings (nil if not enabled)
+	UKI                 bool                `json:"uki,omitempty"`                   // systemd-boot boots unified kernel images from EFI/Linux
+	Subvolumes          *SubvolumeConfig    `json:"subvolumes,omitempty"`            // Subvolume deployments (nil for root1/root2 installs)
+	VarSnapshots        *VarSnapshotConfig  `json:"var_snapshots,omitempty"`         // Snapshots of /var on btrfs (nil until configured or first taken)
+	SELinuxRelabel      bool                `json:"selinux_relabel,omitempty"`       // Relabel every installed image with its SELinux policy
+	Composefs           *ComposefsConfig    `json:"composefs,omitempty"`             // Composefs root images of the slots (nil if not enabled)
+	Platform            string              `json:"platform,omitempty"`              // Image platform installed (os/arch[/variant], empty = the machine's)
+	BootMode            string              `json:"boot_mode,omitempty"`             // Firmware interface booted (uefi, bios; empty = uefi)
 }
 
 // WriteSystemConfig writes system configuration to /var/lib/nbc/state/config.json
@@ -307,6 +366,15 @@ func ReadRebootRequiredMarker() (*types.RebootPendingInfo, error) {
 	return &info, nil
 }
 
+// ClearRebootRequiredMarker removes the marker, e.g. when a rollback makes the
+// running slot the default again. A missing marker is not an error.
+func ClearRebootRequiredMarker() error {
+	if err := os.Remove(RebootRequiredMarker); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove reboot marker: %w", err)
+	}
+	return nil
+}
+
 // IsRebootRequired checks if a reboot is pending (marker exists)
 func IsRebootRequired() bool {
 	_, err := os.Stat(RebootRequiredMarker)
@@ -3,12 +3,16 @@ package pkg
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
 	securejoin "github.com/cyphar/filepath-securejoin"
@@ -20,17 +24,25 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"golang.org/x/sys/unix"
 )
 
+// xattrPAXPrefix starts the PAX records that carry extended attributes, such
+// as SCHILY.xattr.security.capability
+const xattrPAXPrefix = "SCHILY.xattr."
+
 // ContainerExtractor handles extracting container images to disk
 type ContainerExtractor struct {
 	ImageRef        string
 	TargetDir       string
 	Verbose         bool
 	JSONOutput      bool
-	LocalLayoutPath string // Path to OCI layout directory for local image
-	SkipVerify      bool   // Skip cosign signature verification of registry pulls
-	CosignKeyPath   string // Override public key path (empty = embedded key)
+	LocalLayoutPath string       // Path to OCI layout directory for local image
+	SkipVerify      bool         // Skip cosign signature verification of registry pulls
+	CosignKeyPath   string       // Override public key path (empty = embedded key)
+	Flatten         bool         // Write each path of the flattened image once, reading layers concurrently
+	RecordDir       string       // Directory to save the image's manifest and config to once extracted (empty = not saved)
+	Platform        *v1.Platform // Image platform to pull and accept (nil = this machine's)
 	Progress        reporter.Reporter
 }
 
@@ -74,10 +86,59 @@ func (c *ContainerExtractor) SetProgress(p reporter.Reporter) {
 
 // Extract extracts the container filesystem to the target directory using go-containerregistry
 func (c *ContainerExtractor) Extract(ctx context.Context) error {
-	if err := ctx.Err(); err != nil {
+	img, cleanup, err := c.loadImage(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	skipped := skippedSELinuxLabels.Load()
+	if err := c.extractImage(ctx, img, nil); err != nil {
 		return err
 	}
 
+	c.Progress.MessagePlain("Container filesystem extracted successfully")
+	c.warnSkippedLabels(skipped)
+	c.recordImage(img)
+	return nil
+}
+
+// warnSkippedLabels warns about the SELinux labels skipped since
+// skippedSELinuxLabels was at before
+func (c *ContainerExtractor) warnSkippedLabels(before int64) {
+	if skipped := skippedSELinuxLabels.Load() - before; skipped > 0 {
+		c.Progress.Warning("%d SELinux labels are unknown to the host's policy and were not set; use --selinux-relabel to label the files", skipped)
+	}
+}
+
+// recordImage saves the manifest and config of img to the record directory,
+// if one is set. Without a record the slot only lacks offline details, so a
+// failure is not fatal.
+func (c *ContainerExtractor) recordImage(img v1.Image) {
+	if c.RecordDir == "" {
+		return
+	}
+	if err := writeImageRecord(c.RecordDir, img); err != nil {
+		c.Progress.Warning("failed to record image details: %v", err)
+	}
+}
+
+// loadImage loads the image from the local OCI layout, the local podman or
+// docker daemon, or the registry, verifying registry pulls. The returned
+// cleanup function removes temporary files the image is read from and must be
+// called once the image is no longer needed.
+func (c *ContainerExtractor) loadImage(ctx context.Context) (v1.Image, func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, cleanup, err
+	}
+
 	var img v1.Image
 	var err error
 
@@ -86,7 +147,7 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 		c.Progress.MessagePlain("Extracting container image from local cache...")
 		img, err = LoadImageFromOCILayout(c.LocalLayoutPath)
 		if err != nil {
-			return fmt.Errorf("failed to load image from local cache: %w", err)
+			return nil, cleanup, fmt.Errorf("failed to load image from local cache: %w", err)
 		}
 	} else {
 		c.Progress.MessagePlain("Extracting container image %s...", c.ImageRef)
@@ -94,7 +155,7 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 		// Parse image reference
 		ref, err := name.ParseReference(c.ImageRef)
 		if err != nil {
-			return fmt.Errorf("failed to parse image reference: %w", err)
+			return nil, cleanup, fmt.Errorf("failed to parse image reference: %w", err)
 		}
 
 		// For localhost images, try local daemon first (podman/docker)
@@ -108,11 +169,11 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 				// Image exists in podman, save it to OCI layout directory for extraction
 				c.Progress.Message("Found image in podman, using local copy")
 				tmpLayout := filepath.Join(os.TempDir(), fmt.Sprintf("nbc-oci-%d", os.Getpid()))
-				defer func() {
+				cleanups = append(cleanups, func() {
 					if err := os.RemoveAll(tmpLayout); err != nil {
 						c.Progress.Warning("failed to remove temporary OCI layout: %v", err)
 					}
-				}()
+				})
 
 				// Create the layout directory
 				if err := os.MkdirAll(tmpLayout, 0755); err == nil {
@@ -158,20 +219,33 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 		// If not found locally or not a localhost image, pull from registry
 		if img == nil {
 			c.Progress.Message("Pulling image...")
-			img, err = remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+			img, err = remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithPlatform(targetPlatform(c.Platform)))
 			if err != nil {
-				return fmt.Errorf("failed to pull image: %w", err)
+				return nil, cleanup, fmt.Errorf("failed to pull image: %w", err)
 			}
 
 			// Verify the image's cosign signature before extracting it as root.
 			// Only registry pulls are verified: signatures live in the registry,
 			// not in a local OCI layout or a locally-built daemon image.
 			if err := c.verifyRegistryImage(ctx, ref, img); err != nil {
-				return err
+				return nil, cleanup, err
 			}
 		}
 	}
 
+	// A multi-platform image resolves to the target platform when pulled, but
+	// local and single-platform images may be built for another one
+	if err := checkImagePlatform(img, targetPlatform(c.Platform)); err != nil {
+		return nil, cleanup, err
+	}
+
+	return img, cleanup, nil
+}
+
+// extractLayers extracts the layers of img to the target directory in order.
+// When files is not nil, the entries of each layer are recorded in it for
+// delta updates.
+func (c *ContainerExtractor) extractLayers(ctx context.Context, img v1.Image, files *slotFiles) error {
 	// Check for cancellation before layer extraction
 	if err := ctx.Err(); err != nil {
 		return err
@@ -191,8 +265,11 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 			return err
 		}
 
+		digest, err := layer.Digest()
+		if err != nil {
+			return fmt.Errorf("failed to get digest of layer %d: %w", i, err)
+		}
 		if c.Verbose {
-			digest, _ := layer.Digest()
 			c.Progress.Message("Extracting layer %d/%d (%s)...", i+1, len(layers), digest)
 		}
 
@@ -203,7 +280,12 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 		}
 
 		// Extract tar contents to target directory
-		if err := extractTar(ctx, rc, c.TargetDir); err != nil {
+		var record *layerFiles
+		if files != nil {
+			files.Layers = append(files.Layers, layerFiles{Digest: digest.String()})
+			record = &files.Layers[len(files.Layers)-1]
+		}
+		if err := extractLayerTar(ctx, rc, c.TargetDir, record); err != nil {
 			_ = rc.Close()
 			return fmt.Errorf("failed to extract layer %d: %w", i, err)
 		}
@@ -212,7 +294,6 @@ func (c *ContainerExtractor) Extract(ctx context.Context) error {
 		}
 	}
 
-	c.Progress.MessagePlain("Container filesystem extracted successfully")
 	return nil
 }
 
@@ -296,9 +377,19 @@ func removeExistingLeaf(path string) error {
 
 // extractTar extracts a tar stream to a target directory
 func extractTar(ctx context.Context, r io.Reader, targetDir string) error {
+	return extractLayerTar(ctx, r, targetDir, nil)
+}
+
+// extractLayerTar extracts a layer tar stream to a target directory like
+// extractTar and, when record is not nil, appends every entry to it.
+func extractLayerTar(ctx context.Context, r io.Reader, targetDir string, record *layerFiles) error {
 	tr := tar.NewReader(r)
 	fileCount := 0
 
+	// Writing into a directory changes its modification time, so the times
+	// of directories are set once the whole layer is written
+	var dirs []extractedDir
+
 	for {
 		// Check for cancellation every 1000 files
 		if fileCount%1000 == 0 {
@@ -340,6 +431,9 @@ func extractTar(ctx context.Context, r io.Reader, targetDir string) error {
 			if err != nil {
 				return fmt.Errorf("failed to resolve opaque whiteout path for %q: %w", header.Name, err)
 			}
+			if record != nil {
+				record.Entries = append(record.Entries, fileEntry{Path: entryPath(dir), Type: typeOpaque})
+			}
 			// if the directory is "efi"/"boot" just skip it to avoid deleting boot contents
 			if filepath.Base(opaqueDir) == "efi" {
 				continue
@@ -371,147 +465,270 @@ func extractTar(ctx context.Context, r io.Reader, targetDir string) error {
 			if err := os.RemoveAll(whiteoutTarget); err != nil && !os.IsNotExist(err) {
 				return fmt.Errorf("failed to remove whiteout target %s: %w", whiteoutTarget, err)
 			}
+			if record != nil {
+				record.Entries = append(record.Entries, fileEntry{Path: entryPath(filepath.Join(dir, originalName)), Type: typeWhiteout})
+			}
 			continue
 		}
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// If a symlink from an earlier layer already occupies this path,
-			// remove it so MkdirAll creates a real directory rather than
-			// following the link.
-			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
-				if err := os.Remove(target); err != nil {
-					return fmt.Errorf("failed to replace symlink with directory %s: %w", target, err)
-				}
-			}
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", target, err)
+		var digest hash.Hash
+		if record != nil && header.Typeflag == tar.TypeReg {
+			digest = sha256.New()
+		}
+		if err := extractEntry(tr, header, target, targetDir, digest); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, extractedDir{target, header})
+		}
+		if record != nil {
+			if entry, ok := newFileEntry(header, digest); ok {
+				record.Entries = append(record.Entries, entry)
 			}
+		}
+	}
 
-			// Set ownership first
-			_ = os.Chown(target, header.Uid, header.Gid)
+	for _, dir := range dirs {
+		if err := applyTimes(dir.target, dir.header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			// Set mode including special bits (SUID/SGID/sticky)
-			// Convert from Unix format to Go's FileMode format
-			mode := os.FileMode(header.Mode & 0777)
-			if header.Mode&04000 != 0 {
-				mode |= os.ModeSetuid
-			}
-			if header.Mode&02000 != 0 {
-				mode |= os.ModeSetgid
-			}
-			if header.Mode&01000 != 0 {
-				mode |= os.ModeSticky
-			}
+// extractedDir is a directory entry of a layer, whose times are set once the
+// layer is extracted
+type extractedDir struct {
+	target string
+	header *tar.Header
+}
 
-			if err := os.Chmod(target, mode); err != nil {
-				return fmt.Errorf("failed to set mode on directory %s: %w", target, err)
+// extractEntry creates the directory, file, symlink or hard link described by
+// header at target, reading file contents from r. When digest is not nil, the
+// contents of a regular file are also written to it. Other entry types are
+// ignored. The times of a directory are left to the caller with applyTimes,
+// once nothing more is written into it.
+func extractEntry(r io.Reader, header *tar.Header, target, targetDir string, digest hash.Hash) error {
+	hardLinked := false
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// If a symlink or file from an earlier layer already occupies this
+		// path, remove it so MkdirAll creates a real directory rather than
+		// following the link or failing.
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return fmt.Errorf("failed to replace %s with directory: %w", target, err)
 			}
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", target, err)
+		}
 
-		case tar.TypeReg:
-			// Create parent directory if it doesn't exist
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("failed to create parent directory: %w", err)
-			}
+		// Set ownership first
+		_ = os.Chown(target, header.Uid, header.Gid)
 
-			// Replace any existing entry (e.g. a symlink from an earlier layer)
-			// so the file is written at this leaf rather than through a symlink.
-			if err := removeExistingLeaf(target); err != nil {
-				return fmt.Errorf("failed to replace existing path %s: %w", target, err)
-			}
+		// Set mode including special bits (SUID/SGID/sticky)
+		// Convert from Unix format to Go's FileMode format
+		mode := os.FileMode(header.Mode & 0777)
+		if header.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if header.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if header.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
 
-			// Create and write file with basic permissions first. O_NOFOLLOW is
-			// defense-in-depth: never follow a symlink at the final component.
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to create file %s: %w", target, err)
-			}
+		if err := os.Chmod(target, mode); err != nil {
+			return fmt.Errorf("failed to set mode on directory %s: %w", target, err)
+		}
 
-			if _, err := io.Copy(f, tr); err != nil {
-				_ = f.Close()
-				return fmt.Errorf("failed to write file %s: %w", target, err)
-			}
-			if err := f.Close(); err != nil {
-				return fmt.Errorf("failed to close file %s: %w", target, err)
-			}
+	case tar.TypeReg:
+		// Create parent directory if it doesn't exist
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to create parent directory: %w", err)
+		}
 
-			// Set ownership first (this will clear SUID/SGID on Linux for security)
-			// Ignoring error - ownership change may fail if not root or UIDs don't exist
-			// We'll still try to set permissions below
-			_ = os.Chown(target, header.Uid, header.Gid)
+		// Replace any existing entry (e.g. a symlink from an earlier layer)
+		// so the file is written at this leaf rather than through a symlink.
+		if err := removeExistingLeaf(target); err != nil {
+			return fmt.Errorf("failed to replace existing path %s: %w", target, err)
+		}
+
+		// Create and write file with basic permissions first. O_NOFOLLOW is
+		// defense-in-depth: never follow a symlink at the final component.
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %w", target, err)
+		}
+
+		var w io.Writer = f
+		if digest != nil {
+			w = io.MultiWriter(f, digest)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("failed to write file %s: %w", target, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to close file %s: %w", target, err)
+		}
 
-			// Set the mode AFTER ownership to restore SUID/SGID/sticky bits
-			// The tar header.Mode is int64 in Unix format (low 12 bits: permissions + special bits)
-			// Need to convert to Go's os.FileMode which uses different bit positions for special bits
-			mode := os.FileMode(header.Mode & 0777) // rwxrwxrwx
+		// Set ownership first (this will clear SUID/SGID on Linux for security)
+		// Ignoring error - ownership change may fail if not root or UIDs don't exist
+		// We'll still try to set permissions below
+		_ = os.Chown(target, header.Uid, header.Gid)
+
+		// Set the mode AFTER ownership to restore SUID/SGID/sticky bits
+		// The tar header.Mode is int64 in Unix format (low 12 bits: permissions + special bits)
+		// Need to convert to Go's os.FileMode which uses different bit positions for special bits
+		mode := os.FileMode(header.Mode & 0777) // rwxrwxrwx
+
+		// Add special bits if present in tar header
+		if header.Mode&04000 != 0 { // SUID in Unix format
+			mode |= os.ModeSetuid
+		}
+		if header.Mode&02000 != 0 { // SGID in Unix format
+			mode |= os.ModeSetgid
+		}
+		if header.Mode&01000 != 0 { // Sticky in Unix format
+			mode |= os.ModeSticky
+		}
+
+		if err := os.Chmod(target, mode); err != nil {
+			return fmt.Errorf("failed to set mode on file %s: %w", target, err)
+		}
+
+	case tar.TypeSymlink:
+		// Replace any existing entry at the leaf (without following it).
+		if err := removeExistingLeaf(target); err != nil {
+			return fmt.Errorf("failed to replace existing path %s: %w", target, err)
+		}
 
-			// Add special bits if present in tar header
-			if header.Mode&04000 != 0 { // SUID in Unix format
+		// Create symlink
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", target, err)
+		}
+		// Set ownership on symlink (may fail without root, but that's okay)
+		_ = os.Lchown(target, header.Uid, header.Gid)
+
+	case tar.TypeLink:
+		// Hard link. Resolve the link source safely within targetDir so a
+		// hostile ".." link name cannot reference a file outside the
+		// extraction root (which would otherwise be copied into the image).
+		linkTarget, err := securejoin.SecureJoin(targetDir, header.Linkname)
+		if err != nil {
+			return fmt.Errorf("failed to resolve safe hard link source for %q: %w", header.Linkname, err)
+		}
+		// Replace any existing entry at the destination leaf.
+		if err := removeExistingLeaf(target); err != nil {
+			return fmt.Errorf("failed to replace existing path %s: %w", target, err)
+		}
+		if err := os.Link(linkTarget, target); err == nil {
+			hardLinked = true
+		} else {
+			// If hard link fails, try copying the file
+			if err := copyFile(linkTarget, target); err != nil {
+				return fmt.Errorf("failed to create hard link or copy %s: %w", target, err)
+			}
+			// For copied files, set ownership and mode
+			_ = os.Chown(target, header.Uid, header.Gid)
+
+			mode := os.FileMode(header.Mode & 0777)
+			if header.Mode&04000 != 0 {
 				mode |= os.ModeSetuid
 			}
-			if header.Mode&02000 != 0 { // SGID in Unix format
+			if header.Mode&02000 != 0 {
 				mode |= os.ModeSetgid
 			}
-			if header.Mode&01000 != 0 { // Sticky in Unix format
+			if header.Mode&01000 != 0 {
 				mode |= os.ModeSticky
 			}
 
 			if err := os.Chmod(target, mode); err != nil {
-				return fmt.Errorf("failed to set mode on file %s: %w", target, err)
+				return fmt.Errorf("failed to set mode on copied hard link %s: %w", target, err)
 			}
+		}
+		// Note: For actual hard links, ownership/mode and times are shared
+		// with the target
 
-		case tar.TypeSymlink:
-			// Replace any existing entry at the leaf (without following it).
-			if err := removeExistingLeaf(target); err != nil {
-				return fmt.Errorf("failed to replace existing path %s: %w", target, err)
-			}
+	default:
+		return nil
+	}
 
-			// Create symlink
-			if err := os.Symlink(header.Linkname, target); err != nil {
-				return fmt.Errorf("failed to create symlink %s: %w", target, err)
-			}
-			// Set ownership on symlink (may fail without root, but that's okay)
-			_ = os.Lchown(target, header.Uid, header.Gid)
-
-		case tar.TypeLink:
-			// Hard link. Resolve the link source safely within targetDir so a
-			// hostile ".." link name cannot reference a file outside the
-			// extraction root (which would otherwise be copied into the image).
-			linkTarget, err := securejoin.SecureJoin(targetDir, header.Linkname)
-			if err != nil {
-				return fmt.Errorf("failed to resolve safe hard link source for %q: %w", header.Linkname, err)
-			}
-			// Replace any existing entry at the destination leaf.
-			if err := removeExistingLeaf(target); err != nil {
-				return fmt.Errorf("failed to replace existing path %s: %w", target, err)
-			}
-			if err := os.Link(linkTarget, target); err != nil {
-				// If hard link fails, try copying the file
-				if err := copyFile(linkTarget, target); err != nil {
-					return fmt.Errorf("failed to create hard link or copy %s: %w", target, err)
-				}
-				// For copied files, set ownership and mode
-				_ = os.Chown(target, header.Uid, header.Gid)
+	// Extended attributes go last: chown clears security.capability
+	if err := applyXattrs(target, header); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeDir || hardLinked {
+		return nil
+	}
+	return applyTimes(target, header)
+}
 
-				mode := os.FileMode(header.Mode & 0777)
-				if header.Mode&04000 != 0 {
-					mode |= os.ModeSetuid
-				}
-				if header.Mode&02000 != 0 {
-					mode |= os.ModeSetgid
-				}
-				if header.Mode&01000 != 0 {
-					mode |= os.ModeSticky
-				}
+// headerXattrs returns the extended attributes recorded in the PAX records of
+// header, or nil when there are none
+func headerXattrs(header *tar.Header) map[string]string {
+	var xattrs map[string]string
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrPAXPrefix); ok {
+			if xattrs == nil {
+				xattrs = make(map[string]string)
+			}
+			xattrs[name] = value
+		}
+	}
+	return xattrs
+}
 
-				if err := os.Chmod(target, mode); err != nil {
-					return fmt.Errorf("failed to set mode on copied hard link %s: %w", target, err)
-				}
+// skippedSELinuxLabels counts the SELinux labels applyXattrs skipped because
+// the host's policy does not know them
+var skippedSELinuxLabels atomic.Int64
+
+// applyXattrs sets the extended attributes recorded in header on target,
+// without following a symlink at target. Attributes the filesystem does not
+// support or the process may not set are skipped, like ownership is. So are
+// SELinux labels an enforcing host rejects as unknown to its own policy;
+// they are counted in skippedSELinuxLabels, and a relabel sets them later.
+func applyXattrs(target string, header *tar.Header) error {
+	for name, value := range headerXattrs(header) {
+		if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+				continue
+			}
+			if name == selinuxXattr && errors.Is(err, unix.EINVAL) {
+				skippedSELinuxLabels.Add(1)
+				continue
 			}
-			// Note: For actual hard links, ownership/mode are shared with the target
+			return fmt.Errorf("failed to set %s on %s: %w", name, target, err)
 		}
 	}
+	return nil
+}
 
+// applyTimes sets the modification and access times recorded in header on
+// target, without following a symlink at target. Without an access time the
+// modification time is used; without either target is left alone. A target
+// removed since, e.g. by a whiteout later in the layer, is skipped.
+func applyTimes(target string, header *tar.Header) error {
+	if header.ModTime.IsZero() {
+		return nil
+	}
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return fmt.Errorf("failed to set times on %s: %w", target, err)
+	}
 	return nil
 }
 
@@ -521,6 +738,20 @@ func CreateFstab(ctx context.Context, targetDir string, scheme *PartitionScheme,
 		progress.Message("Creating /etc/fstab...")
 	}
 
+	if scheme.Subvolumes {
+		return writeFstab(targetDir, `# /etc/fstab
+# Created by nbc
+#
+# Most mounts are handled automatically:
+# - Root: a subvolume under deployments/ on the root partition, specified via
+#   kernel cmdline root=UUID and rootflags=subvol= parameters
+# - /boot: auto-mounted by systemd (ESP partition type, labeled UEFI)
+# - /var: mounted via kernel cmdline systemd.mount-extra parameter
+#
+# This file is kept minimal and can be empty.
+`, progress)
+	}
+
 	// Only need root2 UUID for the commented-out alternate root entry
 	root2UUID, err := GetPartitionUUID(ctx, scheme.Root2Partition)
 	if err != nil {
@@ -544,7 +775,11 @@ func CreateFstab(ctx context.Context, targetDir string, scheme *PartitionScheme,
 # UUID=%s	/		ext4	defaults	0 1
 `, root2UUID)
 
-	// Write fstab
+	return writeFstab(targetDir, fstabContent, progress)
+}
+
+// writeFstab writes the fstab content to the target's /etc/fstab
+func writeFstab(targetDir, fstabContent string, progress reporter.Reporter) error {
 	fstabPath := filepath.Join(targetDir, "etc", "fstab")
 	if err := os.WriteFile(fstabPath, []byte(fstabContent), 0644); err != nil {
 		return fmt.Errorf("failed to write fstab: %w", err)
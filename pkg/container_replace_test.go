@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // tarEntry is a small helper describing one archive entry for these tests.
@@ -15,6 +16,9 @@ type tarEntry struct {
 	linkname string
 	content  string
 	mode     int64
+	xattrs   map[string]string
+	modTime  time.Time
+	atime    time.Time // written as a PAX record
 }
 
 func buildTar(t *testing.T, entries []tarEntry) []byte {
@@ -31,6 +35,18 @@ func buildTar(t *testing.T, entries []tarEntry) []byte {
 			Typeflag: e.typeflag,
 			Linkname: e.linkname,
 			Mode:     mode,
+			ModTime:  e.modTime,
+		}
+		if !e.atime.IsZero() {
+			h.AccessTime = e.atime
+			h.Format = tar.FormatPAX
+		}
+		for name, value := range e.xattrs {
+			if h.PAXRecords == nil {
+				h.PAXRecords = make(map[string]string)
+				h.Format = tar.FormatPAX
+			}
+			h.PAXRecords[xattrPAXPrefix+name] = value
 		}
 		if e.typeflag == tar.TypeReg {
 			h.Size = int64(len(e.content))
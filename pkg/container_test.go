@@ -3,11 +3,19 @@ package pkg
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/frostyard/nbc/pkg/testutil"
 	"github.com/frostyard/std/reporter"
+	"golang.org/x/sys/unix"
 )
 
 func TestExtractTar_PreservesSpecialBits(t *testing.T) {
@@ -535,3 +543,134 @@ func TestPrepareMachineID(t *testing.T) {
 		}
 	})
 }
+
+// requireUserXattrs skips the test unless dir supports user extended attributes
+func requireUserXattrs(t *testing.T, dir string) {
+	t.Helper()
+	probe := filepath.Join(dir, ".xattr-probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(probe) }()
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); err != nil {
+		t.Skipf("filesystem does not support user extended attributes: %v", err)
+	}
+}
+
+func TestHeaderXattrs(t *testing.T) {
+	header := &tar.Header{PAXRecords: map[string]string{
+		"SCHILY.xattr.security.capability": "caps",
+		"SCHILY.xattr.user.comment":        "hello",
+		"path":                             "usr/bin/ping",
+	}}
+	want := map[string]string{"security.capability": "caps", "user.comment": "hello"}
+	if got := headerXattrs(header); !reflect.DeepEqual(got, want) {
+		t.Errorf("headerXattrs() = %v, want %v", got, want)
+	}
+	if got := headerXattrs(&tar.Header{}); got != nil {
+		t.Errorf("headerXattrs() without records = %v, want nil", got)
+	}
+}
+
+func TestExtract_AppliesXattrs(t *testing.T) {
+	requireUserXattrs(t, t.TempDir())
+
+	layout := writeTestLayout(t, buildTar(t, []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir, mode: 0755, xattrs: map[string]string{"user.label": "dir"}},
+		{name: "usr/bin/ping", typeflag: tar.TypeReg, content: "ping", mode: 0755, xattrs: map[string]string{"user.label": "file"}},
+		{name: "usr/bin/plain", typeflag: tar.TypeReg, content: "plain"},
+	}))
+
+	for _, flatten := range []bool{false, true} {
+		c := testExtractor(layout, t.TempDir())
+		c.Flatten = flatten
+		if err := c.Extract(t.Context()); err != nil {
+			t.Fatalf("Extract(flatten=%v): %v", flatten, err)
+		}
+
+		for path, want := range map[string]string{"usr": "dir", "usr/bin/ping": "file"} {
+			got, err := lgetxattr(filepath.Join(c.TargetDir, path), "user.label")
+			if err != nil || string(got) != want {
+				t.Errorf("flatten=%v: %s user.label = %q, %v; want %q", flatten, path, got, err, want)
+			}
+		}
+		if _, err := lgetxattr(filepath.Join(c.TargetDir, "usr/bin/plain"), "user.label"); !errors.Is(err, unix.ENODATA) {
+			t.Errorf("flatten=%v: usr/bin/plain should have no user.label, got err %v", flatten, err)
+		}
+	}
+}
+
+// treeTimes lists the modification and access times of every path under
+// root, in Unix seconds to stay clear of golden file normalization
+func treeTimes(t *testing.T, root string) string {
+	t.Helper()
+	var b strings.Builder
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		st := info.Sys().(*syscall.Stat_t)
+		fmt.Fprintf(&b, "%-18s %s mtime=%d.%09d atime=%d.%09d\n", rel, info.Mode().Type(),
+			st.Mtim.Sec, st.Mtim.Nsec, st.Atim.Sec, st.Atim.Nsec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestExtract_PreservesTimes(t *testing.T) {
+	// baseLayer builds the base layer with all times shifted by sec seconds
+	baseLayer := func(sec int64) []byte {
+		at := func(s, ns int64) time.Time { return time.Unix(s+sec, ns) }
+		return buildTar(t, []tarEntry{
+			{name: "usr/", typeflag: tar.TypeDir, mode: 0755, modTime: at(1700000000, 0)},
+			{name: "usr/bin/", typeflag: tar.TypeDir, mode: 0755, modTime: at(1700000100, 0)},
+			{name: "usr/bin/app", typeflag: tar.TypeReg, content: "app", mode: 0755, modTime: at(1700000200, 123456789), atime: at(1700000300, 0)},
+			{name: "usr/bin/app-link", typeflag: tar.TypeLink, linkname: "usr/bin/app", modTime: at(1700000200, 123456789)},
+			{name: "usr/bin/sh", typeflag: tar.TypeSymlink, linkname: "app", modTime: at(1700000400, 0)},
+			{name: "usr/lib/", typeflag: tar.TypeDir, mode: 0755, modTime: at(1700000500, 0)},
+			{name: "usr/lib/os-release", typeflag: tar.TypeReg, content: "ID=test\n", modTime: at(1700000600, 0)},
+		})
+	}
+	at := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	base := baseLayer(0)
+	// A later layer writing into a directory restores its time as well
+	top := buildTar(t, []tarEntry{
+		{name: "usr/bin/", typeflag: tar.TypeDir, mode: 0755, modTime: at(1700001000)},
+		{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "tool", mode: 0755, modTime: at(1700001100)},
+	})
+	layout := writeTestLayout(t, base, top)
+
+	for _, flatten := range []bool{false, true} {
+		t.Run(fmt.Sprintf("flatten=%v", flatten), func(t *testing.T) {
+			c := testExtractor(layout, t.TempDir())
+			c.Flatten = flatten
+			if err := c.Extract(t.Context()); err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			testutil.AssertGolden(t, "extract-times", []byte(treeTimes(t, c.TargetDir)))
+		})
+	}
+
+	// A delta update ends up the same, whether it comes from the base layer
+	// alone or from a rebuild of it that only differs in times
+	for name, previousBase := range map[string][]byte{
+		"base layer":  base,
+		"other times": baseLayer(-86400),
+	} {
+		t.Run("delta/"+name, func(t *testing.T) {
+			slot := t.TempDir()
+			previous, err := testExtractor(writeTestLayout(t, previousBase), slot).extractRecorded(t.Context())
+			if err != nil || previous == nil {
+				t.Fatalf("extractRecorded: %v", err)
+			}
+			if _, err := testExtractor(layout, slot).extractDelta(t.Context(), previous); err != nil {
+				t.Fatalf("extractDelta: %v", err)
+			}
+			testutil.AssertGolden(t, "extract-times", []byte(treeTimes(t, slot)))
+		})
+	}
+}
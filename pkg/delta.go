@@ -0,0 +1,900 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/frostyard/std/reporter"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// DeploymentsDir holds per-slot deployment state. It lives on the shared /var
+// partition so the record of a slot survives booting the other slot.
+const DeploymentsDir = "/var/lib/nbc/state/deployments"
+
+// slotFilesVersion is the format version of slot file records. Records of any
+// other version are treated as unknown.
+const slotFilesVersion = 1
+
+// Entry types recorded for whiteouts, next to the tar type flags of regular
+// entries
+const (
+	typeWhiteout byte = 'W' // .wh.<name>: the named path is removed
+	typeOpaque   byte = 'O' // .wh..wh..opq: the contents of the directory are removed
+)
+
+// errMergeUnsupported means the layers of an image cannot be merged into one
+// view of its filesystem. The image must be extracted layer by layer instead,
+// and a slot updated as a delta must be wiped first.
+var errMergeUnsupported = errors.New("image layout cannot be merged")
+
+// slotFiles records what nbc extracted to a root slot: the image's layers with
+// their entries, and the on-disk state of every path right after extraction.
+// Delta updates compare a new image against it.
+type slotFiles struct {
+	Version     int                  `json:"version"`
+	ImageDigest string               `json:"image_digest"`
+	Layers      []layerFiles         `json:"layers"`
+	Disk        map[string]diskStamp `json:"disk"`
+}
+
+// layerFiles is the list of entries in one image layer
+type layerFiles struct {
+	Digest  string      `json:"digest"`
+	Entries []fileEntry `json:"entries"`
+}
+
+// fileEntry is one layer entry. Regular files carry the size and SHA-256 of
+// their contents; hard links carry those of their source once merged.
+type fileEntry struct {
+	Path     string `json:"path"`
+	Type     byte   `json:"type"`
+	Mode     int64  `json:"mode,omitempty"`
+	UID      int    `json:"uid,omitempty"`
+	GID      int    `json:"gid,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+	ModTime  int64  `json:"mtime,omitempty"` // Unix nanoseconds, restored on extraction but not compared
+	ATime    int64  `json:"atime,omitempty"` // Unix nanoseconds, like ModTime
+
+	Xattrs map[string]string `json:"xattrs,omitempty"` // Extended attributes from SCHILY.xattr PAX records
+}
+
+// equal reports whether e and other describe the same entry. Times are left
+// out: images rebuilt without SOURCE_DATE_EPOCH change all of them, which
+// would have delta updates rewrite every path. See sameTimes.
+func (e fileEntry) equal(other fileEntry) bool {
+	return e.Path == other.Path && e.Type == other.Type && e.Mode == other.Mode &&
+		e.UID == other.UID && e.GID == other.GID && e.Size == other.Size &&
+		e.SHA256 == other.SHA256 && e.Linkname == other.Linkname &&
+		maps.Equal(e.Xattrs, other.Xattrs)
+}
+
+// sameTimes reports whether e and other carry the same times
+func (e fileEntry) sameTimes(other fileEntry) bool {
+	return e.ModTime == other.ModTime && e.ATime == other.ATime
+}
+
+// diskStamp is the lstat result of an extracted path. Size and modification
+// time are only recorded for non-directories.
+type diskStamp struct {
+	Mode  uint32 `json:"mode"`
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	Size  int64  `json:"size,omitempty"`
+	MTime int64  `json:"mtime,omitempty"`
+}
+
+// slotFilesPath returns the path of the file record of a root slot
+func slotFilesPath(slot string) string {
+	return filepath.Join(DeploymentsDir, slot, "files.json.gz")
+}
+
+// readSlotFiles reads a slot file record written by writeSlotFiles
+func readSlotFiles(path string) (*slotFiles, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var files slotFiles
+	if err := json.NewDecoder(zr).Decode(&files); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if files.Version != slotFilesVersion {
+		return nil, fmt.Errorf("unsupported record version %d in %s", files.Version, path)
+	}
+	return &files, nil
+}
+
+// writeSlotFiles writes a gzip-compressed slot file record to path
+func writeSlotFiles(path string, files *slotFiles) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(files); err != nil {
+		return fmt.Errorf("failed to encode slot file record: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress slot file record: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create deployment state directory: %w", err)
+	}
+	return atomicWriteFile(path, buf.Bytes(), 0644)
+}
+
+// entryPath normalizes a tar entry name to the absolute path it is extracted
+// to within the root
+func entryPath(name string) string {
+	return filepath.Clean("/" + name)
+}
+
+// newFileEntry returns the record of a directory, file, symlink or hard link
+// entry. digest holds the contents of a regular file. Other entry types are
+// not extracted and not recorded.
+func newFileEntry(header *tar.Header, digest hash.Hash) (fileEntry, bool) {
+	entry := fileEntry{
+		Path: entryPath(header.Name),
+		Type: header.Typeflag,
+		Mode: header.Mode & 07777,
+		UID:  header.Uid,
+		GID:  header.Gid,
+
+		Xattrs: headerXattrs(header),
+	}
+	if !header.ModTime.IsZero() {
+		entry.ModTime = header.ModTime.UnixNano()
+	}
+	if !header.AccessTime.IsZero() {
+		entry.ATime = header.AccessTime.UnixNano()
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+	case tar.TypeReg:
+		entry.Size = header.Size
+		if digest != nil {
+			entry.SHA256 = hex.EncodeToString(digest.Sum(nil))
+		}
+	case tar.TypeSymlink:
+		entry.Linkname = header.Linkname
+	case tar.TypeLink:
+		entry.Linkname = entryPath(header.Linkname)
+	default:
+		return fileEntry{}, false
+	}
+	return entry, true
+}
+
+// header returns the tar header that extracts the entry with extractEntry
+func (e fileEntry) header() *tar.Header {
+	header := &tar.Header{
+		Name:     e.Path,
+		Typeflag: e.Type,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Size:     e.Size,
+		Linkname: e.Linkname,
+	}
+	if e.ModTime != 0 {
+		header.ModTime = time.Unix(0, e.ModTime)
+	}
+	if e.ATime != 0 {
+		header.AccessTime = time.Unix(0, e.ATime)
+	}
+	if len(e.Xattrs) > 0 {
+		header.PAXRecords = make(map[string]string, len(e.Xattrs))
+		for name, value := range e.Xattrs {
+			header.PAXRecords[xattrPAXPrefix+name] = value
+		}
+	}
+	return header
+}
+
+// scanLayer records the entries of a layer without extracting it
+func scanLayer(ctx context.Context, layer v1.Layer) ([]fileEntry, error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress layer: %w", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	var entries []fileEntry
+	tr := tar.NewReader(rc)
+	for count := 0; ; count++ {
+		if count%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		base := filepath.Base(header.Name)
+		dir := filepath.Dir(header.Name)
+		if base == ".wh..wh..opq" {
+			entries = append(entries, fileEntry{Path: entryPath(dir), Type: typeOpaque})
+			continue
+		}
+		if len(base) > 4 && base[:4] == ".wh." {
+			entries = append(entries, fileEntry{Path: entryPath(filepath.Join(dir, base[4:])), Type: typeWhiteout})
+			continue
+		}
+
+		var digest hash.Hash
+		if header.Typeflag == tar.TypeReg {
+			digest = sha256.New()
+			if _, err := io.Copy(digest, tr); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+			}
+		}
+		if entry, ok := newFileEntry(header, digest); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// fileNode is a path in the merged filesystem of an image's layers
+type fileNode struct {
+	entry    fileEntry
+	layer    int // index of the layer providing the entry, -1 for directories created implicitly
+	children map[string]*fileNode
+}
+
+// newDirNode returns a directory node as created implicitly by MkdirAll
+// during extraction
+func newDirNode(path string) *fileNode {
+	return &fileNode{
+		entry:    fileEntry{Path: path, Type: tar.TypeDir, Mode: 0755},
+		layer:    -1,
+		children: map[string]*fileNode{},
+	}
+}
+
+// parent returns the directory node containing path and path's base name.
+// With create, missing directories are added as extraction would create them;
+// otherwise a missing directory returns a nil node. Paths below a symlink or a
+// file are rejected: extraction resolves them on disk, which the merged view
+// does not model.
+func (n *fileNode) parent(path string, create bool) (*fileNode, string, error) {
+	dir, base := filepath.Split(path)
+	node := n
+	current := "/"
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		current = filepath.Join(current, name)
+		child := node.children[name]
+		if child == nil {
+			if !create {
+				return nil, base, nil
+			}
+			child = newDirNode(current)
+			node.children[name] = child
+		}
+		if child.entry.Type != tar.TypeDir {
+			return nil, base, fmt.Errorf("%w: %s is below non-directory %s", errMergeUnsupported, path, current)
+		}
+		node = child
+	}
+	return node, base, nil
+}
+
+// lookup returns the node at path, or nil
+func (n *fileNode) lookup(path string) *fileNode {
+	parent, base, err := n.parent(path, false)
+	if err != nil || parent == nil {
+		return nil
+	}
+	return parent.children[base]
+}
+
+// apply applies an entry of layer to the merged filesystem rooted at n, the
+// way extractLayerTar applies it to disk
+func (n *fileNode) apply(e fileEntry, layer int) error {
+	if e.Path == "/" {
+		switch e.Type {
+		case tar.TypeDir:
+			n.entry, n.layer = e, layer
+		case typeOpaque:
+			n.children = map[string]*fileNode{}
+		}
+		return nil
+	}
+
+	parent, base, err := n.parent(e.Path, e.Type != typeWhiteout)
+	if err != nil || parent == nil {
+		return err
+	}
+
+	switch e.Type {
+	case typeWhiteout:
+		delete(parent.children, base)
+	case typeOpaque:
+		// Extraction leaves opaque efi and boot directories alone
+		if base == "efi" || base == "boot" {
+			return nil
+		}
+		parent.children[base] = newDirNode(e.Path)
+	case tar.TypeDir:
+		// A directory over an existing directory keeps its contents
+		if existing := parent.children[base]; existing != nil && existing.entry.Type == tar.TypeDir {
+			existing.entry, existing.layer = e, layer
+			return nil
+		}
+		node := newDirNode(e.Path)
+		node.entry, node.layer = e, layer
+		parent.children[base] = node
+	case tar.TypeLink:
+		source := n.lookup(e.Linkname)
+		if source == nil || source.entry.Type != tar.TypeReg {
+			return fmt.Errorf("%w: hard link %s has no regular file source %s", errMergeUnsupported, e.Path, e.Linkname)
+		}
+		e.Size, e.SHA256 = source.entry.Size, source.entry.SHA256
+		parent.children[base] = &fileNode{entry: e, layer: layer}
+	default:
+		parent.children[base] = &fileNode{entry: e, layer: layer}
+	}
+	return nil
+}
+
+// mergeLayers returns every path of the filesystem that extracting layers in
+// order produces, keyed by path
+func mergeLayers(layers []layerFiles) (map[string]*fileNode, error) {
+	root := newDirNode("/")
+	for i, layer := range layers {
+		for _, entry := range layer.Entries {
+			if err := root.apply(entry, i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	files := make(map[string]*fileNode)
+	var walk func(*fileNode)
+	walk = func(node *fileNode) {
+		files[node.entry.Path] = node
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(root)
+	return files, nil
+}
+
+// statDisk returns the disk stamp of path without following a symlink
+func statDisk(path string) (diskStamp, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return diskStamp{}, err
+	}
+	stamp := diskStamp{Mode: uint32(info.Mode())}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		stamp.UID, stamp.GID = int(st.Uid), int(st.Gid)
+	}
+	if !info.IsDir() {
+		stamp.Size = info.Size()
+		stamp.MTime = info.ModTime().UnixNano()
+	}
+	return stamp, nil
+}
+
+// stampDisk records the disk stamp of every merged path under root. Paths
+// that cannot be stat'ed are left out, so a later delta rewrites them.
+func stampDisk(root string, files map[string]*fileNode) map[string]diskStamp {
+	stamps := make(map[string]diskStamp, len(files))
+	for path := range files {
+		if stamp, err := statDisk(filepath.Join(root, path)); err == nil {
+			stamps[path] = stamp
+		}
+	}
+	return stamps
+}
+
+// deltaPlan is what a delta update does to the merged paths of a slot
+type deltaPlan struct {
+	write     []*fileNode // Paths to write, sorted so directories come before their contents
+	retime    []*fileNode // Unchanged paths that only take the new image's times
+	unchanged int         // Paths left as they are, including retime
+}
+
+// planDelta plans a delta update of the slot at root. The merged paths whose
+// entry differs from the previous record, or whose disk stamp no longer
+// matches the recorded one, are written. Of the others, non-directories
+// whose times changed are retimed; directories get their times from
+// restoreDirTimes, and hard links share them with their source. A hard link
+// whose source is written is written too, unless a later layer replaced the
+// source: the source is a new inode, and the link would keep the mode and
+// owner of the old one.
+func planDelta(root string, files map[string]*fileNode, previous *slotFiles) (*deltaPlan, error) {
+	old, err := mergeLayers(previous.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &deltaPlan{}
+	written := make(map[string]bool)
+	var links []*fileNode
+	for path, node := range files {
+		if prev := old[path]; prev != nil && prev.entry.equal(node.entry) {
+			if stamp, ok := previous.Disk[path]; ok {
+				if current, err := statDisk(filepath.Join(root, path)); err == nil && current == stamp {
+					if node.entry.Type == tar.TypeLink {
+						links = append(links, node)
+						continue
+					}
+					plan.unchanged++
+					if node.entry.Type != tar.TypeDir && !prev.entry.sameTimes(node.entry) {
+						plan.retime = append(plan.retime, node)
+					}
+					continue
+				}
+			}
+		}
+		plan.write = append(plan.write, node)
+		written[path] = true
+	}
+	for _, node := range links {
+		if source := files[node.entry.Linkname]; written[node.entry.Linkname] && source.layer <= node.layer {
+			plan.write = append(plan.write, node)
+		} else {
+			plan.unchanged++
+		}
+	}
+	slices.SortFunc(plan.write, func(a, b *fileNode) int { return strings.Compare(a.entry.Path, b.entry.Path) })
+	return plan, nil
+}
+
+// sweepSlot removes everything under root that is not in files, and
+// directories where files has a non-directory. It returns the number of
+// removed paths.
+func sweepSlot(root string, files map[string]*fileNode) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if node := files[entryPath(rel)]; node != nil && (node.entry.Type == tar.TypeDir || !d.IsDir()) {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		removed++
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// writeDeltaFiles writes the regular files in write from the layers that
+// provide them, reading only the layers that do
+func writeDeltaFiles(ctx context.Context, layers []v1.Layer, root string, write []*fileNode) error {
+	wanted := make(map[string]int)
+	needed := make(map[int]bool)
+	for _, node := range write {
+		if node.entry.Type == tar.TypeReg {
+			wanted[node.entry.Path] = node.layer
+			needed[node.layer] = true
+		}
+	}
+
+	for i, layer := range layers {
+		if !needed[i] {
+			continue
+		}
+
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return fmt.Errorf("failed to decompress layer %d: %w", i, err)
+		}
+		err = writeLayerFiles(ctx, tar.NewReader(rc), root, i, wanted)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract layer %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// writeLayerFiles extracts the regular files of layer i that wanted maps to i
+func writeLayerFiles(ctx context.Context, tr *tar.Reader, root string, i int, wanted map[string]int) error {
+	for count := 0; ; count++ {
+		if count%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if layer, ok := wanted[entryPath(header.Name)]; !ok || layer != i {
+			continue
+		}
+
+		target, err := secureLeafPath(root, header.Name)
+		if err != nil {
+			return fmt.Errorf("failed to resolve safe extraction path for %q: %w", header.Name, err)
+		}
+		if err := extractEntry(tr, header, target, root, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// extractImageDelta updates the filesystem at root, which holds the image
+// recorded in previous, to img. Layers whose digest is recorded are not read
+// to find changes. Unless spoolDir is empty, new layers are first copied there
+// so they are downloaded only once. Only paths whose entry or disk state
+// changed are written, and paths no longer in the image are removed. It
+// returns errMergeUnsupported, before touching root, when the new image
+// cannot be applied as a delta.
+func extractImageDelta(ctx context.Context, img v1.Image, root string, previous *slotFiles, spoolDir string, verbose bool, progress reporter.Reporter) (*slotFiles, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image digest: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image layers: %w", err)
+	}
+
+	known := make(map[string][]fileEntry, len(previous.Layers))
+	for _, layer := range previous.Layers {
+		known[layer.Digest] = layer.Entries
+	}
+
+	// Find the entries of every layer, reading only new ones
+	progress.Message("Comparing image layers...")
+	files := &slotFiles{Version: slotFilesVersion, ImageDigest: digest.String()}
+	for i, layer := range layers {
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get digest of layer %d: %w", i, err)
+		}
+		entries, ok := known[layerDigest.String()]
+		if !ok {
+			if verbose {
+				progress.Message("Scanning new layer %d/%d (%s)...", i+1, len(layers), layerDigest)
+			}
+			if spoolDir != "" {
+				if layer, err = spoolLayer(layer, spoolDir); err != nil {
+					return nil, fmt.Errorf("failed to download layer %d: %w", i, err)
+				}
+				layers[i] = layer
+			}
+			if entries, err = scanLayer(ctx, layer); err != nil {
+				return nil, fmt.Errorf("failed to scan layer %d: %w", i, err)
+			}
+		} else if verbose {
+			progress.Message("Layer %d/%d (%s) is unchanged", i+1, len(layers), layerDigest)
+		}
+		files.Layers = append(files.Layers, layerFiles{Digest: layerDigest.String(), Entries: entries})
+	}
+
+	merged, err := mergeLayers(files.Layers)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planDelta(root, merged, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove what the new image no longer has, then write what changed:
+	// directories first, then files, then links to them
+	removed, err := sweepSlot(root, merged)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range plan.write {
+		if node.entry.Type != tar.TypeDir {
+			continue
+		}
+		if err := extractDeltaEntry(root, node.entry); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeDeltaFiles(ctx, layers, root, plan.write); err != nil {
+		return nil, err
+	}
+	for _, node := range plan.write {
+		if node.entry.Type != tar.TypeSymlink && node.entry.Type != tar.TypeLink {
+			continue
+		}
+		if err := extractDeltaEntry(root, node.entry); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, node := range plan.retime {
+		target, err := secureLeafPath(root, node.entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve safe extraction path for %q: %w", node.entry.Path, err)
+		}
+		if err := applyTimes(target, node.entry.header()); err != nil {
+			return nil, err
+		}
+	}
+	if err := restoreDirTimes(root, merged); err != nil {
+		return nil, err
+	}
+
+	progress.Message("Delta update: %d paths written, %d removed, %d unchanged", len(plan.write), removed, plan.unchanged)
+	files.Disk = stampDisk(root, merged)
+	return files, nil
+}
+
+// restoreDirTimes sets the times of the directories of merged that a layer
+// has an entry for, once everything is written into them
+func restoreDirTimes(root string, merged map[string]*fileNode) error {
+	for _, node := range merged {
+		if node.entry.Type != tar.TypeDir || node.layer < 0 {
+			continue
+		}
+		target, err := secureLeafPath(root, node.entry.Path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve safe extraction path for %q: %w", node.entry.Path, err)
+		}
+		if err := applyTimes(target, node.entry.header()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractDeltaEntry creates a directory, symlink or hard link from its record
+func extractDeltaEntry(root string, entry fileEntry) error {
+	target, err := secureLeafPath(root, entry.Path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve safe extraction path for %q: %w", entry.Path, err)
+	}
+	return extractEntry(nil, entry.header(), target, root, nil)
+}
+
+// spoolLayer copies the compressed contents of layer to a file in dir and
+// returns a layer read from that file
+func spoolLayer(layer v1.Layer, dir string) (v1.Layer, error) {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	f, err := os.CreateTemp(dir, "layer-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return tarball.LayerFromFile(f.Name())
+}
+
+// extractRecorded extracts the image to the target directory like Extract and
+// returns the record of what was extracted. The record is nil when the image
+// cannot be applied as a delta later.
+func (c *ContainerExtractor) extractRecorded(ctx context.Context) (*slotFiles, error) {
+	img, cleanup, err := c.loadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image digest: %w", err)
+	}
+	files := &slotFiles{Version: slotFilesVersion, ImageDigest: digest.String()}
+	skipped := skippedSELinuxLabels.Load()
+	if err := c.extractImage(ctx, img, files); err != nil {
+		return nil, err
+	}
+	c.Progress.MessagePlain("Container filesystem extracted successfully")
+	c.warnSkippedLabels(skipped)
+	c.recordImage(img)
+
+	merged, err := mergeLayers(files.Layers)
+	if err != nil {
+		c.Progress.Warning("the next update of this slot cannot be a delta update: %v", err)
+		return nil, nil
+	}
+	files.Disk = stampDisk(c.TargetDir, merged)
+	return files, nil
+}
+
+// layerSpoolDir returns a new directory to download layers to, so changed
+// layers can be read twice. Layers of a local OCI layout are files already,
+// so it returns "" for them. The caller removes the directory.
+func (c *ContainerExtractor) layerSpoolDir(prefix string) (string, error) {
+	if c.LocalLayoutPath != "" {
+		return "", nil
+	}
+	cacheDir := filepath.Dir(StagedUpdateDir)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	spoolDir, err := os.MkdirTemp(cacheDir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer spool directory: %w", err)
+	}
+	return spoolDir, nil
+}
+
+// extractDelta updates the target directory, which holds the image recorded in
+// previous, to the extractor's image. See extractImageDelta.
+func (c *ContainerExtractor) extractDelta(ctx context.Context, previous *slotFiles) (*slotFiles, error) {
+	img, cleanup, err := c.loadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	spoolDir, err := c.layerSpoolDir("delta-layers-")
+	if err != nil {
+		return nil, err
+	}
+	if spoolDir != "" {
+		defer func() { _ = os.RemoveAll(spoolDir) }()
+	}
+
+	c.Progress.MessagePlain("Applying container image as a delta update...")
+	skipped := skippedSELinuxLabels.Load()
+	files, err := extractImageDelta(ctx, img, c.TargetDir, previous, spoolDir, c.Verbose, c.Progress)
+	if err != nil {
+		return nil, err
+	}
+	c.Progress.MessagePlain("Container filesystem updated successfully")
+	c.warnSkippedLabels(skipped)
+	c.recordImage(img)
+	return files, nil
+}
+
+// targetSlot returns the name of the slot the update is written to
+func (u *SystemUpdater) targetSlot() string {
+	if u.Subvolumes != nil {
+		return deploymentSlot(u.TargetDeployment)
+	}
+	if u.Active {
+		return "root2"
+	}
+	return "root1"
+}
+
+// previousSlotFiles returns the file record of the target slot when delta
+// updates are enabled and the record is readable, or nil for a full update.
+// A new deployment is a snapshot of the running one, so with subvolume
+// deployments this is the running deployment's record, and always used.
+func (u *SystemUpdater) previousSlotFiles() *slotFiles {
+	slot := u.targetSlot()
+	if u.Subvolumes != nil {
+		slot = deploymentSlot(u.ActiveDeployment)
+	} else if !u.Config.Delta {
+		return nil
+	} else if u.Composefs != nil {
+		// fs-verity makes the files read-only, so they cannot be updated in place
+		u.Progress.Message("Files of composefs slots cannot be updated in place, doing a full update")
+		return nil
+	}
+	files, err := readSlotFiles(slotFilesPath(slot))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			u.Progress.Message("No record of the contents of %s, doing a full update", slot)
+		} else {
+			u.Progress.Warning("Ignoring record of %s, doing a full update: %v", slot, err)
+		}
+		return nil
+	}
+	return files
+}
+
+// clearTarget removes all content from the mounted target partition
+func (u *SystemUpdater) clearTarget() error {
+	entries, err := os.ReadDir(u.Config.MountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to read target directory: %w", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(u.Config.MountPoint, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// extractTarget extracts the new image to the mounted target partition and
+// records what was extracted for the next delta update of the slot, and the
+// image's manifest and config. With a
+// previous record the image is applied as a delta; when that is not possible
+// the partition is cleared and fully extracted instead.
+func (u *SystemUpdater) extractTarget(ctx context.Context, previous *slotFiles) error {
+	p := u.Progress
+	extractor := newContainerExtractor(u.Config.ImageRef, u.LocalLayoutPath, u.Config.MountPoint, u.Config.Verbose, u.Config.SkipVerify, u.Config.CosignKeyPath, u.Config.Flatten, u.Config.Platform, p)
+	extractor.RecordDir = imageRecordDir(u.targetSlot())
+
+	var files *slotFiles
+	var err error
+	if previous != nil {
+		files, err = extractor.extractDelta(ctx, previous)
+		if errors.Is(err, errMergeUnsupported) {
+			p.Warning("Delta update not possible, doing a full update: %v", err)
+			if err := u.clearTarget(); err != nil {
+				return err
+			}
+			previous = nil
+		} else if err != nil {
+			return fmt.Errorf("failed to extract container: %w", err)
+		}
+	}
+	if previous == nil {
+		if files, err = extractor.extractRecorded(ctx); err != nil {
+			return fmt.Errorf("failed to extract container: %w", err)
+		}
+	}
+
+	p.Message("Verifying extraction...")
+	if err := VerifyExtraction(u.Config.MountPoint); err != nil {
+		return fmt.Errorf("container extraction verification failed: %w", err)
+	}
+
+	if files != nil {
+		if err := writeSlotFiles(slotFilesPath(u.targetSlot()), files); err != nil {
+			p.Warning("failed to record contents of %s, its next update will be a full update: %v", u.targetSlot(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/frostyard/std/reporter"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// writeTestLayout writes an image built from the given layer tars to an OCI
+// layout directory and returns its path
+func writeTestLayout(t *testing.T, layerTars ...[]byte) string {
+	t.Helper()
+	var layers []v1.Layer
+	for _, data := range layerTars {
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, layer)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(img); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testExtractor(layoutPath, target string) *ContainerExtractor {
+	c := NewContainerExtractorFromLocal(layoutPath, target)
+	c.SetProgress(reporter.NoopReporter{})
+	return c
+}
+
+func inode(t *testing.T, path string) uint64 {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+// snapshotTree describes every path under root by type, permissions and
+// contents or link target
+func snapshotTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		desc := info.Mode().String()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc += " -> " + target
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += " " + string(data)
+		}
+		tree[rel] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestMergeLayers(t *testing.T) {
+	layers := []layerFiles{
+		{Entries: []fileEntry{
+			{Path: "/usr", Type: tar.TypeDir, Mode: 0755},
+			{Path: "/usr/bin/tool", Type: tar.TypeReg, Mode: 0755, Size: 3, SHA256: "aaa"},
+			{Path: "/usr/bin/tool-link", Type: tar.TypeLink, Linkname: "/usr/bin/tool"},
+			{Path: "/opt/old/file", Type: tar.TypeReg, Size: 1, SHA256: "bbb"},
+			{Path: "/boot/efi/keep", Type: tar.TypeReg, Size: 1, SHA256: "ccc"},
+			{Path: "/etc/gone", Type: tar.TypeReg, Size: 1, SHA256: "ddd"},
+			{Path: "/lib", Type: tar.TypeSymlink, Linkname: "usr/lib"},
+		}},
+		{Entries: []fileEntry{
+			{Path: "/usr", Type: tar.TypeDir, Mode: 0700},
+			{Path: "/opt/old", Type: typeOpaque},
+			{Path: "/boot/efi", Type: typeOpaque},
+			{Path: "/etc/gone", Type: typeWhiteout},
+			{Path: "/etc/missing", Type: typeWhiteout},
+		}},
+	}
+
+	files, err := mergeLayers(layers)
+	if err != nil {
+		t.Fatalf("mergeLayers: %v", err)
+	}
+
+	if got := files["/usr"]; got.entry.Mode != 0700 || got.layer != 1 {
+		t.Errorf("/usr = %+v (layer %d), want mode 0700 from layer 1", got.entry, got.layer)
+	}
+	if files["/usr/bin/tool"] == nil {
+		t.Error("re-declaring /usr must keep its contents")
+	}
+	if got := files["/usr/bin"]; got == nil || got.layer != -1 {
+		t.Error("/usr/bin should be an implicit directory")
+	}
+	if got := files["/usr/bin/tool-link"]; got == nil || got.entry.SHA256 != "aaa" || got.entry.Size != 3 {
+		t.Errorf("hard link should carry the contents of its source, got %+v", got)
+	}
+	if files["/opt/old/file"] != nil {
+		t.Error("opaque whiteout should remove directory contents")
+	}
+	if files["/opt/old"] == nil {
+		t.Error("opaque whiteout should keep the directory itself")
+	}
+	if files["/boot/efi/keep"] == nil {
+		t.Error("opaque whiteout of efi must be ignored like during extraction")
+	}
+	if files["/etc/gone"] != nil {
+		t.Error("whiteout should remove the file")
+	}
+	if files["/etc/missing"] != nil || files["/"] == nil {
+		t.Error("unexpected merged paths")
+	}
+
+	// Entries below a symlink are resolved on disk, which merging cannot model
+	layers = append(layers, layerFiles{Entries: []fileEntry{{Path: "/lib/libfoo.so", Type: tar.TypeReg}}})
+	if _, err := mergeLayers(layers); !errors.Is(err, errMergeUnsupported) {
+		t.Errorf("entry below symlink: err = %v, want errMergeUnsupported", err)
+	}
+}
+
+func TestMergeLayers_FileReplacesDirectory(t *testing.T) {
+	files, err := mergeLayers([]layerFiles{
+		{Entries: []fileEntry{{Path: "/srv/data/a", Type: tar.TypeReg}}},
+		{Entries: []fileEntry{{Path: "/srv/data", Type: tar.TypeReg}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["/srv/data/a"] != nil || files["/srv/data"].entry.Type != tar.TypeReg {
+		t.Error("a file replacing a directory should drop the directory's contents")
+	}
+}
+
+func TestExtractDelta_MatchesFullExtraction(t *testing.T) {
+	ctx := context.Background()
+
+	base := buildTar(t, []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "usr/bin/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "usr/bin/same", typeflag: tar.TypeReg, content: "unchanged", mode: 0755},
+		{name: "usr/bin/changed", typeflag: tar.TypeReg, content: "old", mode: 0755},
+		{name: "usr/bin/removed", typeflag: tar.TypeReg, content: "bye"},
+		{name: "usr/bin/alias", typeflag: tar.TypeLink, linkname: "usr/bin/changed"},
+		{name: "usr/bin/sym", typeflag: tar.TypeSymlink, linkname: "same"},
+		{name: "etc/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "etc/touched", typeflag: tar.TypeReg, content: "pristine"},
+	})
+	oldTop := buildTar(t, []tarEntry{
+		{name: "opt/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "opt/app", typeflag: tar.TypeReg, content: "v1"},
+	})
+	newTop := buildTar(t, []tarEntry{
+		{name: "usr/bin/changed", typeflag: tar.TypeReg, content: "new!", mode: 0755},
+		{name: "usr/bin/alias2", typeflag: tar.TypeLink, linkname: "usr/bin/changed"},
+		{name: "usr/bin/.wh.removed", typeflag: tar.TypeReg},
+		{name: "usr/bin/sym", typeflag: tar.TypeSymlink, linkname: "changed"},
+		{name: "opt/", typeflag: tar.TypeDir, mode: 0700},
+		{name: "opt/app", typeflag: tar.TypeReg, content: "v2"},
+		{name: "var/", typeflag: tar.TypeDir, mode: 0755},
+	})
+
+	slot := t.TempDir()
+	previous, err := testExtractor(writeTestLayout(t, base, oldTop), slot).extractRecorded(ctx)
+	if err != nil {
+		t.Fatalf("extractRecorded: %v", err)
+	}
+	if previous == nil || len(previous.Layers) != 2 {
+		t.Fatalf("expected a record of 2 layers, got %+v", previous)
+	}
+
+	// Changes made to the slot after extraction must be undone
+	if err := os.WriteFile(filepath.Join(slot, "etc/touched"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(slot, "stray"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sameInode := inode(t, filepath.Join(slot, "usr/bin/same"))
+	changedInode := inode(t, filepath.Join(slot, "usr/bin/changed"))
+
+	newLayout := writeTestLayout(t, base, newTop)
+	files, err := testExtractor(newLayout, slot).extractDelta(ctx, previous)
+	if err != nil {
+		t.Fatalf("extractDelta: %v", err)
+	}
+
+	want := t.TempDir()
+	if err := testExtractor(newLayout, want).Extract(ctx); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	got, expected := snapshotTree(t, slot), snapshotTree(t, want)
+	for path, desc := range expected {
+		if got[path] != desc {
+			t.Errorf("%s: got %q, want %q", path, got[path], desc)
+		}
+	}
+	for path := range got {
+		if _, ok := expected[path]; !ok {
+			t.Errorf("%s should have been removed", path)
+		}
+	}
+
+	if inode(t, filepath.Join(slot, "usr/bin/same")) != sameInode {
+		t.Error("unchanged file was rewritten")
+	}
+	if inode(t, filepath.Join(slot, "usr/bin/changed")) == changedInode {
+		t.Error("changed file was not rewritten")
+	}
+	if inode(t, filepath.Join(slot, "usr/bin/alias2")) != inode(t, filepath.Join(slot, "usr/bin/changed")) {
+		t.Error("new hard link should link to the rewritten file")
+	}
+
+	if files.Layers[0].Digest != previous.Layers[0].Digest {
+		t.Error("the unchanged base layer should keep its digest")
+	}
+	if _, ok := files.Disk["/opt/app"]; !ok {
+		t.Error("new record should stamp the written files")
+	}
+}
+
+func TestExtractDelta_RelinksHardLinks(t *testing.T) {
+	ctx := context.Background()
+	layer := func(mode int64) []byte {
+		return buildTar(t, []tarEntry{
+			{name: "usr/", typeflag: tar.TypeDir, mode: 0755},
+			{name: "usr/bin/", typeflag: tar.TypeDir, mode: 0755},
+			{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "tool", mode: mode},
+			{name: "usr/bin/tool-link", typeflag: tar.TypeLink, linkname: "usr/bin/tool"},
+		})
+	}
+	slot := t.TempDir()
+	previous, err := testExtractor(writeTestLayout(t, layer(0755)), slot).extractRecorded(ctx)
+	if err != nil || previous == nil {
+		t.Fatalf("extractRecorded: %v", err)
+	}
+
+	// Only the mode of the source changes, so the link entry is the same
+	if _, err := testExtractor(writeTestLayout(t, layer(0700)), slot).extractDelta(ctx, previous); err != nil {
+		t.Fatalf("extractDelta: %v", err)
+	}
+	if inode(t, filepath.Join(slot, "usr/bin/tool-link")) != inode(t, filepath.Join(slot, "usr/bin/tool")) {
+		t.Error("hard link should link to the rewritten source")
+	}
+	info, err := os.Lstat(filepath.Join(slot, "usr/bin/tool-link"))
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("hard link mode = %v, %v; want 0700", info.Mode().Perm(), err)
+	}
+}
+
+func TestExtractDelta_UnsupportedLeavesSlotUntouched(t *testing.T) {
+	ctx := context.Background()
+	base := buildTar(t, []tarEntry{
+		{name: "usr/lib/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		{name: "usr/lib/libc.so", typeflag: tar.TypeReg, content: "libc"},
+	})
+	slot := t.TempDir()
+	previous, err := testExtractor(writeTestLayout(t, base), slot).extractRecorded(ctx)
+	if err != nil || previous == nil {
+		t.Fatalf("extractRecorded: %v", err)
+	}
+	before := snapshotTree(t, slot)
+
+	top := buildTar(t, []tarEntry{{name: "lib/libfoo.so", typeflag: tar.TypeReg, content: "foo"}})
+	_, err = testExtractor(writeTestLayout(t, base, top), slot).extractDelta(ctx, previous)
+	if !errors.Is(err, errMergeUnsupported) {
+		t.Fatalf("err = %v, want errMergeUnsupported", err)
+	}
+	after := snapshotTree(t, slot)
+	if len(after) != len(before) {
+		t.Errorf("slot was modified: before %v, after %v", before, after)
+	}
+}
+
+func TestSlotFiles_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "root1", "files.json.gz")
+	files := &slotFiles{
+		Version:     slotFilesVersion,
+		ImageDigest: "sha256:abc",
+		Layers:      []layerFiles{{Digest: "sha256:def", Entries: []fileEntry{{Path: "/usr", Type: tar.TypeDir, Mode: 0755, Xattrs: map[string]string{"security.selinux": "system_u:object_r:usr_t:s0"}}}}},
+		Disk:        map[string]diskStamp{"/usr": {Mode: uint32(os.ModeDir | 0755)}},
+	}
+	if err := writeSlotFiles(path, files); err != nil {
+		t.Fatalf("writeSlotFiles: %v", err)
+	}
+	got, err := readSlotFiles(path)
+	if err != nil {
+		t.Fatalf("readSlotFiles: %v", err)
+	}
+	if got.ImageDigest != files.ImageDigest || !got.Layers[0].Entries[0].equal(files.Layers[0].Entries[0]) || got.Disk["/usr"] != files.Disk["/usr"] {
+		t.Errorf("round trip mismatch: %+v", got)
+	}
+
+	files.Version = slotFilesVersion + 1
+	if err := writeSlotFiles(path, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSlotFiles(path); err == nil {
+		t.Error("a record of another version should be rejected")
+	}
+}
@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/frostyard/std/reporter"
+)
+
+// Discoverable Partitions Specification (DPS) partition type GUIDs, see
+// https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+const (
+	dpsRootX86_64 = "4f68bce3-e8cd-4db1-96e7-fbcaf984b709"
+	dpsRootARM64  = "b921b045-1df0-41c3-af44-4c6f280d3fae"
+	dpsVar        = "4d21b016-b534-45c2-a9fb-5c16e091fd2d"
+
+	// gptAttrNoAuto is the GPT attribute bit that tells systemd-gpt-auto-generator
+	// (and other DPS tooling) to ignore a partition.
+	gptAttrNoAuto = 63
+)
+
+// dpsRootTypeGUID returns the DPS root partition type GUID for a Go
+// architecture name (runtime.GOARCH).
+func dpsRootTypeGUID(goarch string) (string, error) {
+	switch goarch {
+	case "amd64":
+		return dpsRootX86_64, nil
+	case "arm64":
+		return dpsRootARM64, nil
+	default:
+		return "", fmt.Errorf("no discoverable root partition type for architecture %s", goarch)
+	}
+}
+
+// parseID128 parses a UUID or a 32 character hex machine ID into its 16 bytes.
+func parseID128(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid 128-bit ID %q", s)
+	}
+	return b, nil
+}
+
+// formatUUID formats 16 bytes in the usual 8-4-4-4-12 UUID form.
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// makeV4UUID marks 16 bytes as a random (version 4, RFC 4122 variant) UUID.
+func makeV4UUID(b []byte) {
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+}
+
+// newMachineID generates a machine ID in the /etc/machine-id format.
+func newMachineID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate machine ID: %w", err)
+	}
+	makeV4UUID(b)
+	return hex.EncodeToString(b), nil
+}
+
+// dpsVarPartUUID returns the PARTUUID systemd-gpt-auto-generator expects for the
+// /var partition of machineID: the var type GUID hashed with HMAC-SHA256 keyed
+// by the machine ID, truncated to 128 bits and formatted as a v4 UUID (as
+// sd_id128_get_machine_app_specific does). Binding /var to the machine ID stops
+// a disk moved to another machine from having its /var mounted there.
+func dpsVarPartUUID(machineID string) (string, error) {
+	key, err := parseID128(machineID)
+	if err != nil {
+		return "", err
+	}
+	appID, _ := parseID128(dpsVar)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(appID)
+	sum := mac.Sum(nil)[:16]
+	makeV4UUID(sum)
+	return formatUUID(sum), nil
+}
+
+// partitionNumbers maps the partition devices of device to their GPT
+// partition numbers.
+func partitionNumbers(device string) (map[string]int, error) {
+	partitions, err := listDiskPartitions(device)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]int)
+	for _, part := range partitions {
+		numbers[part.Device] = part.Number
+	}
+	return numbers, nil
+}
+
+// discoverableTagArgs builds the sgdisk arguments that give the partitions in
+// scheme their DPS types: both root slots get the root type of goarch with
+// no-auto set on root2 (a fresh install boots root1), and var gets the var type
+// and the PARTUUID derived from machineID.
+func discoverableTagArgs(device string, scheme *PartitionScheme, goarch, machineID string) ([]string, error) {
+	rootType, err := dpsRootTypeGUID(goarch)
+	if err != nil {
+		return nil, err
+	}
+	varUUID, err := dpsVarPartUUID(machineID)
+	if err != nil {
+		return nil, err
+	}
+	numbers, err := partitionNumbers(device)
+	if err != nil {
+		return nil, err
+	}
+	root1, root2, varNum := numbers[scheme.Root1Partition], numbers[scheme.Root2Partition], numbers[scheme.VarPartition]
+	if root1 == 0 || root2 == 0 || varNum == 0 {
+		return nil, fmt.Errorf("could not determine partition numbers on %s", device)
+	}
+
+	return []string{
+		"--typecode=" + strconv.Itoa(root1) + ":" + rootType,
+		"--typecode=" + strconv.Itoa(root2) + ":" + rootType,
+		"--attributes=" + strconv.Itoa(root1) + ":clear:" + strconv.Itoa(gptAttrNoAuto),
+		"--attributes=" + strconv.Itoa(root2) + ":set:" + strconv.Itoa(gptAttrNoAuto),
+		"--typecode=" + strconv.Itoa(varNum) + ":" + dpsVar,
+		"--partition-guid=" + strconv.Itoa(varNum) + ":" + varUUID,
+		device,
+	}, nil
+}
+
+// rootSlotFlagArgs builds the sgdisk arguments that clear no-auto on the root
+// slot activeRoot and set it on the other slot.
+func rootSlotFlagArgs(device string, scheme *PartitionScheme, activeRoot string) ([]string, error) {
+	inactiveRoot := scheme.Root2Partition
+	switch activeRoot {
+	case scheme.Root1Partition:
+	case scheme.Root2Partition:
+		inactiveRoot = scheme.Root1Partition
+	default:
+		return nil, fmt.Errorf("%s is not a root slot of %s", activeRoot, device)
+	}
+
+	numbers, err := partitionNumbers(device)
+	if err != nil {
+		return nil, err
+	}
+	activeNum, inactiveNum := numbers[activeRoot], numbers[inactiveRoot]
+	if activeNum == 0 || inactiveNum == 0 {
+		return nil, fmt.Errorf("could not determine root partition numbers on %s", device)
+	}
+
+	return []string{
+		"--attributes=" + strconv.Itoa(activeNum) + ":clear:" + strconv.Itoa(gptAttrNoAuto),
+		"--attributes=" + strconv.Itoa(inactiveNum) + ":set:" + strconv.Itoa(gptAttrNoAuto),
+		device,
+	}, nil
+}
+
+// TagDiscoverablePartitions gives freshly created partitions their Discoverable
+// Partitions Specification types so systemd-gpt-auto-generator can find them.
+// The var PARTUUID is rewritten to the one derived from machineID, so this must
+// run before the partitions are formatted and their PARTUUIDs recorded.
+func TagDiscoverablePartitions(ctx context.Context, device string, scheme *PartitionScheme, goarch, machineID string, dryRun bool, progress reporter.Reporter) error {
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would tag partitions on %s with discoverable partition types", device)
+		return nil
+	}
+
+	args, err := discoverableTagArgs(device, scheme, goarch, machineID)
+	if err != nil {
+		return err
+	}
+
+	progress.Message("Tagging partitions with discoverable partition types...")
+	if output, err := exec.CommandContext(ctx, "sgdisk", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run sgdisk: %w\nOutput: %s", err, string(output))
+	}
+
+	rereadPartitionTable(ctx, device, progress)
+	return nil
+}
+
+// SetDiscoverableRootSlot points systemd-gpt-auto-generator and other DPS
+// tooling at the root slot activeRoot by clearing its no-auto flag and setting
+// the flag on the other slot. Update and rollback call it whenever the default
+// slot changes.
+func SetDiscoverableRootSlot(ctx context.Context, device string, scheme *PartitionScheme, activeRoot string, dryRun bool, progress reporter.Reporter) error {
+	args, err := rootSlotFlagArgs(device, scheme, activeRoot)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would mark %s as the auto-discoverable root slot", activeRoot)
+		return nil
+	}
+
+	// Only the partition entries change, so the kernel's view of the
+	// (mounted) partitions does not need to be re-read.
+	if output, err := exec.CommandContext(ctx, "sgdisk", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to update GPT attributes: %w\nOutput: %s", err, string(output))
+	}
+	progress.Message("Marked %s as the auto-discoverable root slot", activeRoot)
+	return nil
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDPSVarPartUUID(t *testing.T) {
+	// Matches systemd-id128 machine-id --app-specific=4d21b016b53445c2a9fb5c16e091fd2d -u
+	got, err := dpsVarPartUUID("fed6b2924c424cf1b9a322f606b4de6d")
+	if err != nil {
+		t.Fatalf("dpsVarPartUUID() error = %v", err)
+	}
+	if want := "a43e69e6-e645-433a-adc1-ccf77beb9074"; got != want {
+		t.Errorf("dpsVarPartUUID() = %s, want %s", got, want)
+	}
+
+	if _, err := dpsVarPartUUID("not-a-machine-id"); err == nil {
+		t.Error("dpsVarPartUUID() should reject an invalid machine ID")
+	}
+}
+
+func TestNewMachineID(t *testing.T) {
+	id, err := newMachineID()
+	if err != nil {
+		t.Fatalf("newMachineID() error = %v", err)
+	}
+	if len(id) != 32 || id[12] != '4' {
+		t.Errorf("newMachineID() = %q, want 32 hex characters of a v4 UUID", id)
+	}
+	if _, err := dpsVarPartUUID(id); err != nil {
+		t.Errorf("dpsVarPartUUID(newMachineID()) error = %v", err)
+	}
+}
+
+func TestDiscoverablePartitionArgs(t *testing.T) {
+	setupFakeBlockDevices(t, nil)
+	addFakeDisk(t, "nvme0n1", []fakePartition{
+		{"nvme0n1p1", 1, "boot", ""},
+		{"nvme0n1p2", 2, "root1", ""},
+		{"nvme0n1p3", 3, "root2", ""},
+		{"nvme0n1p4", 4, "var", ""},
+	})
+	scheme, err := DetectExistingPartitionScheme("/dev/nvme0n1")
+	if err != nil {
+		t.Fatalf("DetectExistingPartitionScheme() error = %v", err)
+	}
+
+	args, err := discoverableTagArgs("/dev/nvme0n1", scheme, "arm64", "fed6b2924c424cf1b9a322f606b4de6d")
+	if err != nil {
+		t.Fatalf("discoverableTagArgs() error = %v", err)
+	}
+	want := []string{
+		"--typecode=2:" + dpsRootARM64,
+		"--typecode=3:" + dpsRootARM64,
+		"--attributes=2:clear:63",
+		"--attributes=3:set:63",
+		"--typecode=4:" + dpsVar,
+		"--partition-guid=4:a43e69e6-e645-433a-adc1-ccf77beb9074",
+		"/dev/nvme0n1",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("discoverableTagArgs() =\n%v\nwant\n%v", args, want)
+	}
+
+	if _, err := discoverableTagArgs("/dev/nvme0n1", scheme, "riscv64", "fed6b2924c424cf1b9a322f606b4de6d"); err == nil {
+		t.Error("discoverableTagArgs() should fail for an architecture without a root type")
+	}
+
+	// Switching to root2 moves no-auto to root1
+	args, err = rootSlotFlagArgs("/dev/nvme0n1", scheme, scheme.Root2Partition)
+	if err != nil {
+		t.Fatalf("rootSlotFlagArgs() error = %v", err)
+	}
+	want = []string{"--attributes=3:clear:63", "--attributes=2:set:63", "/dev/nvme0n1"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("rootSlotFlagArgs() = %v, want %v", args, want)
+	}
+
+	if _, err := rootSlotFlagArgs("/dev/nvme0n1", scheme, scheme.VarPartition); err == nil {
+		t.Error("rootSlotFlagArgs() should reject a partition that is not a root slot")
+	}
+}
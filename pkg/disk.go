@@ -19,10 +19,31 @@ type DiskInfo struct {
 	Device      string
 	Size        uint64
 	Model       string
+	Serial      string
+	Transport   string   // nvme, sata, usb, virtio, scsi or mmc
+	IDs         []string // names in /dev/disk/by-id
 	IsRemovable bool
 	Partitions  []PartitionInfo
 }
 
+// Describe returns a one line description of the disk
+func (d DiskInfo) Describe() string {
+	details := []string{FormatSize(d.Size)}
+	if d.Model != "" {
+		details = append([]string{d.Model}, details...)
+	}
+	if d.Transport != "" {
+		details = append(details, d.Transport)
+	}
+	if d.Serial != "" {
+		details = append(details, "serial "+d.Serial)
+	}
+	if d.IsRemovable {
+		details = append(details, "removable")
+	}
+	return fmt.Sprintf("%s (%s)", d.Device, strings.Join(details, ", "))
+}
+
 // PartitionInfo represents information about a disk partition
 type PartitionInfo struct {
 	Device     string
@@ -53,12 +74,16 @@ func ListDisks() ([]DiskInfo, error) {
 		devices = append(devices, vdDevices...)
 	}
 
+	// Map devices to their stable names, if udev made any
+	ids := diskIDs("/dev/disk/by-id")
+
 	for _, device := range devices {
 		deviceName := filepath.Base(device)
 		diskInfo, err := getDiskInfo(deviceName)
 		if err != nil {
 			continue // Skip devices we can't read
 		}
+		diskInfo.IDs = ids[deviceName]
 		disks = append(disks, diskInfo)
 	}
 
@@ -95,6 +120,11 @@ func getDiskInfo(device string) (DiskInfo, error) {
 		info.Model = strings.TrimSpace(string(modelData))
 	}
 
+	info.Serial = diskSerial(filepath.Join("/sys/block", device))
+	if sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/block", device)); err == nil {
+		info.Transport = diskTransport(device, sysPath)
+	}
+
 	// Get partitions
 	partitions, err := getPartitions(device)
 	if err == nil {
@@ -104,6 +134,71 @@ func getDiskInfo(device string) (DiskInfo, error) {
 	return info, nil
 }
 
+// diskSerial reads the serial number of the disk at sysfs path sysDir
+func diskSerial(sysDir string) string {
+	// NVMe and virtio disks have a serial attribute
+	for _, name := range []string{"device/serial", "serial"} {
+		if data, err := os.ReadFile(filepath.Join(sysDir, name)); err == nil {
+			if serial := strings.TrimSpace(string(data)); serial != "" {
+				return serial
+			}
+		}
+	}
+
+	// SCSI disks (including SATA and USB) have the unit serial number VPD page:
+	// a 4 byte header with the page length, then the serial
+	data, err := os.ReadFile(filepath.Join(sysDir, "device/vpd_pg80"))
+	if err != nil || len(data) < 4 || data[1] != 0x80 {
+		return ""
+	}
+	length := int(data[2])<<8 | int(data[3])
+	data = data[4:]
+	if length < len(data) {
+		data = data[:length]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+}
+
+// diskTransport returns how a disk is attached from its name and resolved
+// sysfs path, such as /sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/.../block/sdb
+func diskTransport(device, sysPath string) string {
+	switch {
+	case strings.HasPrefix(device, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(device, "vd"):
+		return "virtio"
+	case strings.HasPrefix(device, "mmcblk"):
+		return "mmc"
+	case strings.Contains(sysPath, "/usb"):
+		return "usb"
+	case strings.Contains(sysPath, "/ata"):
+		return "sata"
+	}
+	return "scsi"
+}
+
+// diskIDs maps device names to the names of their whole-disk links in the
+// by-id directory dir
+func diskIDs(dir string) map[string][]string {
+	ids := make(map[string][]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ids
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "-part") {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		device := filepath.Base(target)
+		ids[device] = append(ids[device], entry.Name())
+	}
+	return ids
+}
+
 // getPartitions returns partition information for a disk
 func getPartitions(device string) ([]PartitionInfo, error) {
 	partitions := []PartitionInfo{}
@@ -0,0 +1,215 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// diskSelectorKeys are the disk properties a DiskSelector can match, and
+// whether they take a value
+var diskSelectorKeys = map[string]bool{
+	"model":     true,
+	"serial":    true,
+	"transport": true,
+	"id":        true,
+	"minsize":   true,
+	"maxsize":   true,
+	"removable": true,
+	"largest":   false,
+	"smallest":  false,
+}
+
+// DiskSelector picks the disk to install to by its properties, as device
+// names such as /dev/sda can change between boots. A selector is a comma
+// separated list of terms that must all match:
+//
+//	model=X, serial=X, id=X        exact match (id is a /dev/disk/by-id name)
+//	model~=X, serial~=X, id~=X     case-insensitive substring match
+//	transport=X                    nvme, sata, usb, virtio, scsi or mmc
+//	minsize=64G, maxsize=2T        disk size bounds
+//	removable=true|false           removable media
+//	largest, smallest              pick the largest or smallest match
+//
+// For example "transport=nvme,removable=false,largest" is the largest
+// non-removable NVMe disk. Selecting fails unless exactly one disk is
+// picked.
+type DiskSelector struct {
+	spec  string
+	terms []selectorTerm
+	pick  string // "largest", "smallest" or ""
+}
+
+// selectorTerm is a key=value or key~=value term of a DiskSelector
+type selectorTerm struct {
+	key, value string
+	substring  bool
+	size       uint64 // minsize and maxsize in bytes
+}
+
+// ParseDiskSelector parses a disk selector such as
+// "model~=Samsung,minsize=64G"
+func ParseDiskSelector(spec string) (*DiskSelector, error) {
+	s := &DiskSelector{spec: spec}
+	for field := range strings.SplitSeq(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		key, value, hasValue := strings.Cut(field, "=")
+		term := selectorTerm{key: strings.ToLower(strings.TrimSpace(key)), value: strings.TrimSpace(value)}
+		if k, ok := strings.CutSuffix(term.key, "~"); ok && hasValue {
+			term.key, term.substring = k, true
+		}
+		takesValue, known := diskSelectorKeys[term.key]
+		if !known {
+			return nil, fmt.Errorf("unknown disk selector term %q", field)
+		}
+		if takesValue != hasValue {
+			if takesValue {
+				return nil, fmt.Errorf("disk selector term %q needs a value", field)
+			}
+			return nil, fmt.Errorf("disk selector term %q takes no value", field)
+		}
+
+		switch term.key {
+		case "largest", "smallest":
+			if s.pick != "" {
+				return nil, errors.New("disk selector can only have one of largest and smallest")
+			}
+			s.pick = term.key
+			continue
+		case "minsize", "maxsize":
+			mib, err := parseSizeMiB(term.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", term.key, err)
+			}
+			term.size = mib * 1024 * 1024
+		case "removable":
+			if _, err := strconv.ParseBool(term.value); err != nil {
+				return nil, fmt.Errorf("invalid removable %q (use true or false)", term.value)
+			}
+		case "transport":
+			if !slices.Contains([]string{"nvme", "sata", "usb", "virtio", "scsi", "mmc"}, term.value) {
+				return nil, fmt.Errorf("invalid transport %q (supported: nvme, sata, usb, virtio, scsi, mmc)", term.value)
+			}
+		}
+		if term.substring && term.key != "model" && term.key != "serial" && term.key != "id" {
+			return nil, fmt.Errorf("disk selector term %q cannot use ~=", field)
+		}
+		if term.value == "" {
+			return nil, fmt.Errorf("disk selector term %q needs a value", field)
+		}
+		s.terms = append(s.terms, term)
+	}
+	if len(s.terms) == 0 && s.pick == "" {
+		return nil, errors.New("empty disk selector")
+	}
+	return s, nil
+}
+
+// String returns the selector as it was given
+func (s *DiskSelector) String() string {
+	return s.spec
+}
+
+// matchString matches a string property of a disk against the term
+func (t selectorTerm) matchString(value string) bool {
+	if t.substring {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(t.value))
+	}
+	return value == t.value
+}
+
+// matches reports whether disk matches every term of the selector
+func (s *DiskSelector) matches(disk DiskInfo) bool {
+	for _, t := range s.terms {
+		var ok bool
+		switch t.key {
+		case "model":
+			ok = t.matchString(disk.Model)
+		case "serial":
+			ok = disk.Serial != "" && t.matchString(disk.Serial)
+		case "id":
+			ok = slices.ContainsFunc(disk.IDs, t.matchString)
+		case "transport":
+			ok = disk.Transport == t.value
+		case "minsize":
+			ok = disk.Size >= t.size
+		case "maxsize":
+			ok = disk.Size <= t.size
+		case "removable":
+			removable, _ := strconv.ParseBool(t.value)
+			ok = disk.IsRemovable == removable
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// describeDisks lists disks for error messages
+func describeDisks(disks []DiskInfo) string {
+	var b strings.Builder
+	for _, disk := range disks {
+		fmt.Fprintf(&b, "\n  %s", disk.Describe())
+	}
+	return b.String()
+}
+
+// Select returns the one disk of disks the selector picks. It fails when no
+// disk matches, or when several do and largest or smallest does not single
+// one out.
+func (s *DiskSelector) Select(disks []DiskInfo) (*DiskInfo, error) {
+	var matched []DiskInfo
+	for _, disk := range disks {
+		if s.matches(disk) {
+			matched = append(matched, disk)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no disk matches selector %q, found:%s", s.spec, describeDisks(disks))
+	}
+
+	if s.pick != "" && len(matched) > 1 {
+		slices.SortStableFunc(matched, func(a, b DiskInfo) int {
+			if s.pick == "largest" {
+				a, b = b, a
+			}
+			switch {
+			case a.Size < b.Size:
+				return -1
+			case a.Size > b.Size:
+				return 1
+			}
+			return 0
+		})
+		// Disks of the same size leave the pick to chance
+		if matched[0].Size == matched[1].Size {
+			matched = slices.DeleteFunc(matched, func(d DiskInfo) bool { return d.Size != matched[0].Size })
+		} else {
+			matched = matched[:1]
+		}
+	}
+	if len(matched) > 1 {
+		return nil, fmt.Errorf("%d disks match selector %q, narrow it down:%s", len(matched), s.spec, describeDisks(matched))
+	}
+	return &matched[0], nil
+}
+
+// ResolveDiskSelector returns the disk of this machine that selector picks
+func ResolveDiskSelector(selector string) (*DiskInfo, error) {
+	s, err := ParseDiskSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	disks, err := ListDisks()
+	if err != nil {
+		return nil, err
+	}
+	return s.Select(disks)
+}
@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const gib = 1024 * 1024 * 1024
+
+var testDisks = []DiskInfo{
+	{Device: "/dev/sda", Size: 500 * gib, Model: "Samsung SSD 860", Serial: "S3Z9NB0K123456A", Transport: "sata", IDs: []string{"ata-Samsung_SSD_860_EVO_500GB_S3Z9NB0K123456A"}},
+	{Device: "/dev/sdb", Size: 32 * gib, Model: "Flash Drive", Serial: "0401abcd", Transport: "usb", IsRemovable: true},
+	{Device: "/dev/nvme0n1", Size: 1000 * gib, Model: "Samsung SSD 970 EVO", Serial: "S467NX0M987654C", Transport: "nvme", IDs: []string{"nvme-Samsung_SSD_970_EVO_1TB_S467NX0M987654C", "nvme-eui.0025385b71b0a1b2"}},
+	{Device: "/dev/nvme1n1", Size: 1000 * gib, Model: "WD Blue SN570", Serial: "22123A456789", Transport: "nvme"},
+}
+
+func TestDiskSelector_Select(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+		wantErr  string
+	}{
+		{selector: "serial=S3Z9NB0K123456A", want: "/dev/sda"},
+		{selector: "model~=samsung,transport=nvme", want: "/dev/nvme0n1"},
+		{selector: "model=Samsung SSD 970 EVO", want: "/dev/nvme0n1"},
+		{selector: "id=nvme-eui.0025385b71b0a1b2", want: "/dev/nvme0n1"},
+		{selector: "id~=SSD_860", want: "/dev/sda"},
+		{selector: "removable=true", want: "/dev/sdb"},
+		{selector: "maxsize=64G", want: "/dev/sdb"},
+		{selector: "removable=false,smallest", want: "/dev/sda"},
+		{selector: "minsize=600G,model~=wd", want: "/dev/nvme1n1"},
+		{selector: "model~=samsung,largest", want: "/dev/nvme0n1"},
+		{selector: "model=Samsung", wantErr: "no disk matches selector"},
+		{selector: "model~=samsung", wantErr: "2 disks match selector"},
+		{selector: "transport=nvme,largest", wantErr: "2 disks match selector"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			s, err := ParseDiskSelector(tt.selector)
+			if err != nil {
+				t.Fatalf("ParseDiskSelector() error = %v", err)
+			}
+			disk, err := s.Select(testDisks)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Select() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Select() error = %v", err)
+			}
+			if disk.Device != tt.want {
+				t.Errorf("Select() = %s, want %s", disk.Device, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskSelector_SelectListsCandidates(t *testing.T) {
+	s, err := ParseDiskSelector("transport=nvme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Select(testDisks)
+	if err == nil {
+		t.Fatal("Select() should fail on several matches")
+	}
+	for _, want := range []string{"/dev/nvme0n1 (Samsung SSD 970 EVO, 1000.0 GB, nvme, serial S467NX0M987654C)", "/dev/nvme1n1"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should list %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "/dev/sda") {
+		t.Errorf("error should only list the matches:\n%v", err)
+	}
+}
+
+func TestParseDiskSelector_Errors(t *testing.T) {
+	tests := []struct {
+		selector string
+		wantErr  string
+	}{
+		{"", "empty disk selector"},
+		{" , ", "empty disk selector"},
+		{"vendor=Samsung", "unknown disk selector term"},
+		{"model", "needs a value"},
+		{"model=", "needs a value"},
+		{"largest=true", "takes no value"},
+		{"largest,smallest", "only have one of largest and smallest"},
+		{"minsize=64", "needs a unit"},
+		{"removable=maybe", "invalid removable"},
+		{"transport=ide", "invalid transport"},
+		{"minsize~=64G", "cannot use ~="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			_, err := ParseDiskSelector(tt.selector)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseDiskSelector(%q) error = %v, want error containing %q", tt.selector, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDiskTransport(t *testing.T) {
+	tests := []struct {
+		device, sysPath, want string
+	}{
+		{"nvme0n1", "/sys/devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0/nvme0n1", "nvme"},
+		{"vda", "/sys/devices/pci0000:00/0000:00:04.0/virtio1/block/vda", "virtio"},
+		{"mmcblk0", "/sys/devices/platform/soc/fe340000.mmc/mmc_host/mmc0/mmc0:0001/block/mmcblk0", "mmc"},
+		{"sdb", "/sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdb", "usb"},
+		{"sda", "/sys/devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block/sda", "sata"},
+		{"sdc", "/sys/devices/pci0000:00/0000:00:03.0/virtio0/host2/target2:0:0/2:0:0:0/block/sdc", "scsi"},
+	}
+	for _, tt := range tests {
+		if got := diskTransport(tt.device, tt.sysPath); got != tt.want {
+			t.Errorf("diskTransport(%q) = %q, want %q", tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestDiskSerial(t *testing.T) {
+	nvme := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(nvme, "device"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(nvme, "device", "serial"), []byte("S467NX0M987654C     \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := diskSerial(nvme); got != "S467NX0M987654C" {
+		t.Errorf("diskSerial(nvme) = %q", got)
+	}
+
+	// Unit serial number VPD page of a SATA disk behind the SCSI layer
+	sata := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sata, "device"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	page := append([]byte{0x00, 0x80, 0x00, 0x14}, []byte("     S3Z9NB0K123456A\x00\x00")...)
+	if err := os.WriteFile(filepath.Join(sata, "device", "vpd_pg80"), page, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := diskSerial(sata); got != "S3Z9NB0K123456A" {
+		t.Errorf("diskSerial(sata) = %q", got)
+	}
+
+	if got := diskSerial(t.TempDir()); got != "" {
+		t.Errorf("diskSerial() without a serial = %q, want empty", got)
+	}
+}
+
+func TestDiskIDs(t *testing.T) {
+	root := t.TempDir()
+	byID := filepath.Join(root, "by-id")
+	if err := os.MkdirAll(byID, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dev := range []string{"sda", "sda1", "nvme0n1"} {
+		if err := os.WriteFile(filepath.Join(root, dev), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"ata-Samsung_SSD_860_S3Z9":       "../sda",
+		"ata-Samsung_SSD_860_S3Z9-part1": "../sda1",
+		"wwn-0x5002538e40a1b2c3":         "../sda",
+		"nvme-WD_Blue_SN570_22123A":      "../nvme0n1",
+		"dangling":                       "../sdz",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(byID, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]string{
+		"sda":     {"ata-Samsung_SSD_860_S3Z9", "wwn-0x5002538e40a1b2c3"},
+		"nvme0n1": {"nvme-WD_Blue_SN570_22123A"},
+	}
+	if got := diskIDs(byID); !reflect.DeepEqual(got, want) {
+		t.Errorf("diskIDs() = %v, want %v", got, want)
+	}
+	if got := diskIDs(filepath.Join(root, "missing")); len(got) != 0 {
+		t.Errorf("diskIDs() of a missing directory = %v, want none", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/frostyard/std/reporter"
@@ -18,9 +19,13 @@ import (
 // This ensures nbc always installs its own version of the dracut module,
 // regardless of what's in the container image.
 //
-//go:embed dracut/95etc-overlay/module-setup.sh dracut/95etc-overlay/etc-overlay-mount.sh
+//go:embed dracut/95etc-overlay/module-setup.sh dracut/95etc-overlay/etc-overlay-mount.sh dracut/95etc-overlay/composefs-mount.sh
 var dracutModuleFS embed.FS
 
+// dracutModuleHooks are the hook scripts the etc-overlay dracut module
+// installs into the initramfs
+var dracutModuleHooks = []string{"etc-overlay-mount.sh", "composefs-mount.sh"}
+
 // InstallDracutEtcOverlay installs the embedded etc-overlay dracut module to the target filesystem.
 // This overwrites any existing module from the container image to ensure the nbc binary's
 // version is used (which may have fixes not yet in the published container image).
@@ -43,6 +48,7 @@ func InstallDracutEtcOverlay(ctx context.Context, targetDir string, dryRun bool,
 	files := []string{
 		"dracut/95etc-overlay/module-setup.sh",
 		"dracut/95etc-overlay/etc-overlay-mount.sh",
+		"dracut/95etc-overlay/composefs-mount.sh",
 	}
 
 	for _, srcPath := range files {
@@ -70,7 +76,8 @@ func InstallDracutEtcOverlay(ctx context.Context, targetDir string, dryRun bool,
 // initramfs if it already has the module.
 //
 // The function uses lsinitrd (Fedora/RHEL) or lsinitramfs (Debian/Ubuntu) to
-// list the initramfs contents and searches for the etc-overlay hook script.
+// list the initramfs contents and searches for the module's hook scripts. An
+// initramfs built with an older module lacking one of them needs regenerating.
 func InitramfsHasEtcOverlay(initramfsPath string) (bool, error) {
 	// Determine which tool to use
 	var listCmd *exec.Cmd
@@ -94,26 +101,27 @@ func InitramfsHasEtcOverlay(initramfsPath string) (bool, error) {
 		return false, fmt.Errorf("failed to list initramfs contents: %w", err)
 	}
 
-	// Search for the etc-overlay hook script
+	// Search for the module's hook scripts
 	// Dracut installs hooks as: usr/lib/dracut/hooks/<hook-type>/<priority><script-name>.sh
 	// Our module installs: inst_hook pre-pivot 50 "$moddir/etc-overlay-mount.sh"
 	// This becomes something like: usr/lib/dracut/hooks/pre-pivot/50etc-overlay-mount.sh
 	scanner := bufio.NewScanner(stdout)
-	found := false
+	missing := slices.Clone(dracutModuleHooks)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if strings.Contains(line, "etc-overlay-mount.sh") {
-			found = true
-		}
+		missing = slices.DeleteFunc(missing, func(hook string) bool {
+			return strings.Contains(line, hook)
+		})
 	}
+	found := len(missing) == 0
 
 	// Wait for the command to finish after fully reading its output
 	if err := listCmd.Wait(); err != nil {
 		if found {
-			// We already found the hook; ignore the list error since we have our answer.
+			// We already found the hooks; ignore the list error since we have our answer.
 			_ = err
 		} else {
-			// Listing failed before we found the hook; propagate error so callers can regenerate.
+			// Listing failed before we found the hooks; propagate error so callers can regenerate.
 			return false, fmt.Errorf("failed to list initramfs contents: %w", err)
 		}
 	}
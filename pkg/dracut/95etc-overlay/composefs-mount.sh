@@ -0,0 +1,56 @@
+#!/bin/sh
+# SPDX-License-Identifier: GPL-2.0-or-later
+#
+# Dracut hook to mount the composefs image of the root slot
+# Runs in pre-pivot phase, after root is mounted and before the /etc overlay
+# (etc-overlay-mount.sh) is set up on top of it
+#
+# Kernel parameters:
+#   nbc.composefs=DIGEST  - fs-verity digest of the composefs image to mount
+#
+# nbc stores the files of a composefs root slot in a fs-verity protected object
+# store on the slot, next to the composefs images describing the tree:
+#   /.nbc-composefs/objects/ab/cdef...  - file contents, by fs-verity digest
+#   /.nbc-composefs/images/DIGEST       - composefs image, by fs-verity digest
+#
+# The slot stays reachable at /run/nbc/composefs/slot; the image is mounted
+# over the root. mount.composefs refuses an image whose digest differs from
+# the one on the command line, and with "verity" every object must have the
+# fs-verity digest the image records, so tampering with the slot fails the
+# boot instead of going unnoticed.
+
+type getarg >/dev/null 2>&1 || . /lib/dracut-lib.sh
+
+SYSROOT="${NEWROOT:-/sysroot}"
+
+CFS_DIGEST=$(getarg nbc.composefs=)
+if [ -z "$CFS_DIGEST" ]; then
+    info "composefs: nbc.composefs not set, using the root filesystem as is"
+    return 0
+fi
+
+CFS_SLOT="/run/nbc/composefs/slot"
+CFS_STORE="$CFS_SLOT/.nbc-composefs"
+CFS_IMAGE="$CFS_STORE/images/$CFS_DIGEST"
+
+info "composefs: Mounting root image $CFS_DIGEST"
+
+mkdir -p "$CFS_SLOT"
+if ! mount --bind "$SYSROOT" "$CFS_SLOT"; then
+    die "composefs: Failed to bind mount the root slot"
+fi
+
+if [ ! -f "$CFS_IMAGE" ]; then
+    die "composefs: Root image $CFS_DIGEST not found on the root slot"
+fi
+
+modprobe erofs 2>/dev/null || true
+modprobe overlay 2>/dev/null || true
+
+if ! mount -t composefs \
+    -o "basedir=$CFS_STORE/objects,digest=$CFS_DIGEST,verity" \
+    "$CFS_IMAGE" "$SYSROOT"; then
+    die "composefs: Failed to mount root image $CFS_DIGEST, the root slot may have been tampered with"
+fi
+
+info "composefs: Root image mounted"
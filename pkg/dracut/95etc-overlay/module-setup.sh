@@ -25,15 +25,20 @@ depends() {
 }
 
 install() {
-    # Install the hook script
+    # Install the hook scripts. The composefs root image is mounted over the
+    # root before the /etc overlay is set up on top of it.
+    inst_hook pre-pivot 40 "$moddir/composefs-mount.sh"
     inst_hook pre-pivot 50 "$moddir/etc-overlay-mount.sh"
 
     # Install required binaries
     # grep is needed to detect read-only root mount in /proc/mounts
     inst_multiple mount umount mkdir grep
+    # mount.composefs is only needed for composefs roots (nbc.composefs=)
+    inst_multiple -o mount.composefs
 }
 
 installkernel() {
-    # Ensure overlay filesystem module is available
-    instmods overlay
+    # Ensure overlay filesystem module is available, and the EROFS and loop
+    # modules composefs images are mounted with
+    instmods overlay erofs loop
 }
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"regexp"
+	"strconv"
 	"testing"
 )
 
@@ -23,3 +24,33 @@ func TestDracutModuleDeclaresCryptDependency(t *testing.T) {
 		t.Errorf("module-setup.sh depends() must echo the 'crypt' dependency (#98)")
 	}
 }
+
+// TestDracutModuleInstallsHooks checks that the embedded module installs every
+// hook InitramfsHasEtcOverlay looks for, with the composefs root mounted
+// before the /etc overlay is set up on top of it.
+func TestDracutModuleInstallsHooks(t *testing.T) {
+	content, err := dracutModuleFS.ReadFile("dracut/95etc-overlay/module-setup.sh")
+	if err != nil {
+		t.Fatalf("read embedded module-setup.sh: %v", err)
+	}
+
+	priorities := make(map[string]int)
+	instHook := regexp.MustCompile(`(?m)^\s*inst_hook\s+pre-pivot\s+(\d+)\s+"\$moddir/([^"]+)"`)
+	for _, m := range instHook.FindAllSubmatch(content, -1) {
+		priority, _ := strconv.Atoi(string(m[1]))
+		priorities[string(m[2])] = priority
+	}
+
+	for _, hook := range dracutModuleHooks {
+		if _, ok := priorities[hook]; !ok {
+			t.Errorf("module-setup.sh does not install the %s hook", hook)
+		}
+		if _, err := dracutModuleFS.ReadFile("dracut/95etc-overlay/" + hook); err != nil {
+			t.Errorf("hook %s is not embedded: %v", hook, err)
+		}
+	}
+	if priorities["composefs-mount.sh"] >= priorities["etc-overlay-mount.sh"] {
+		t.Errorf("composefs-mount.sh (priority %d) must run before etc-overlay-mount.sh (priority %d)",
+			priorities["composefs-mount.sh"], priorities["etc-overlay-mount.sh"])
+	}
+}
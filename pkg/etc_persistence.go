@@ -144,8 +144,9 @@ func PopulateEtcLower(ctx context.Context, targetDir string, dryRun bool, progre
 		return fmt.Errorf("failed to create .etc.lower directory: %w", err)
 	}
 
-	// Use rsync to copy /etc to /.etc.lower
-	cmd := exec.CommandContext(ctx, "rsync", "-a", "--delete", etcSource+"/", etcLowerDest+"/")
+	// Use rsync to copy /etc to /.etc.lower, keeping extended attributes such
+	// as SELinux labels and file capabilities
+	cmd := exec.CommandContext(ctx, "rsync", "-aX", "--delete", etcSource+"/", etcLowerDest+"/")
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to populate .etc.lower: %w\nOutput: %s", err, string(output))
 	}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+)
+
+// BootMode is the firmware interface an installation boots with
+type BootMode string
+
+const (
+	// BootModeUEFI boots from the EFI System Partition
+	BootModeUEFI BootMode = "uefi"
+	// BootModeBIOS boots GRUB from the disk's MBR and a BIOS boot partition
+	BootModeBIOS BootMode = "bios"
+)
+
+// efiFirmwareDir exists when the running system was booted by UEFI firmware
+var efiFirmwareDir = "/sys/firmware/efi"
+
+// biosBootSizeMiB is the size of the BIOS boot partition holding GRUB's core
+// image
+const biosBootSizeMiB = 1
+
+// grubBIOSTarget is the grub-install target platform of legacy BIOS boot
+const grubBIOSTarget = "i386-pc"
+
+// grubBIOSModuleDirs are where distributions install GRUB's i386-pc modules
+// (grub-pc-bin on Debian and Ubuntu, grub2-pc-modules on Fedora)
+var grubBIOSModuleDirs = []string{"/usr/lib/grub/i386-pc", "/usr/lib/grub2/i386-pc"}
+
+// DetectBootMode returns the boot mode of the running system: UEFI when the
+// firmware exposes /sys/firmware/efi, legacy BIOS otherwise
+func DetectBootMode() BootMode {
+	if _, err := os.Stat(efiFirmwareDir); err == nil {
+		return BootModeUEFI
+	}
+	return BootModeBIOS
+}
+
+// defaultBootMode returns the boot mode to install for goarch when none is
+// given: the running system's, except that only amd64 boots from BIOS
+func defaultBootMode(goarch string) BootMode {
+	if goarch != "amd64" {
+		return BootModeUEFI
+	}
+	return DetectBootMode()
+}
+
+// ParseBootMode parses a boot mode given on the command line. An empty string
+// or "auto" returns "", which is detected at install time.
+func ParseBootMode(s string) (BootMode, error) {
+	switch s {
+	case "", "auto":
+		return "", nil
+	case string(BootModeUEFI), string(BootModeBIOS):
+		return BootMode(s), nil
+	}
+	return "", fmt.Errorf("invalid boot mode %q (supported: auto, uefi, bios)", s)
+}
+
+// checkBIOSBoot returns an error unless GRUB can be installed for legacy BIOS
+// boot of goarch from this machine
+func checkBIOSBoot(goarch string) error {
+	if goarch != "amd64" {
+		return fmt.Errorf("BIOS boot is not supported on architecture %s", goarch)
+	}
+	for _, dir := range grubBIOSModuleDirs {
+		if _, err := os.Stat(dir); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("BIOS boot requires GRUB's %s modules - install grub-pc-bin or grub2-pc-modules", grubBIOSTarget)
+}
+
+// checkBootSupport returns an error unless the bootloader of goarch can be
+// installed for mode from this machine
+func checkBootSupport(goarch string, mode BootMode) error {
+	if mode == BootModeBIOS {
+		return checkBIOSBoot(goarch)
+	}
+	_, err := efiArchFor(goarch)
+	return err
+}
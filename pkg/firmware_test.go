@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectBootMode(t *testing.T) {
+	dir := t.TempDir()
+	orig := efiFirmwareDir
+	t.Cleanup(func() { efiFirmwareDir = orig })
+
+	efiFirmwareDir = filepath.Join(dir, "efi")
+	if got := DetectBootMode(); got != BootModeBIOS {
+		t.Errorf("DetectBootMode() without %s = %s, want bios", efiFirmwareDir, got)
+	}
+	if got := defaultBootMode("arm64"); got != BootModeUEFI {
+		t.Errorf("defaultBootMode(arm64) = %s, want uefi", got)
+	}
+
+	if err := os.Mkdir(efiFirmwareDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := DetectBootMode(); got != BootModeUEFI {
+		t.Errorf("DetectBootMode() with %s = %s, want uefi", efiFirmwareDir, got)
+	}
+}
+
+func TestParseBootMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    BootMode
+		wantErr bool
+	}{
+		{"", "", false},
+		{"auto", "", false},
+		{"uefi", BootModeUEFI, false},
+		{"bios", BootModeBIOS, false},
+		{"legacy", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBootMode(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBootMode(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseBootMode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package pkg
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/frostyard/std/reporter"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// layerWorkers is how many layers are downloaded, decompressed or written at
+// the same time during a flattened extraction
+const layerWorkers = 4
+
+// forEachLayer calls fn for every layer index in indexes, running up to
+// layerWorkers calls at a time. The first error cancels the context of the
+// other calls and is returned.
+func forEachLayer(ctx context.Context, indexes []int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	slots := make(chan struct{}, layerWorkers)
+	for _, i := range indexes {
+		wg.Go(func() {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		})
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// checkFlattenedLinks returns errMergeUnsupported when a hard link would not
+// get the contents it gets from layered extraction. A link made before its
+// source was replaced by a later layer keeps the old contents, which the
+// flattened view no longer has.
+func checkFlattenedLinks(merged map[string]*fileNode) error {
+	for _, node := range merged {
+		if node.entry.Type != tar.TypeLink {
+			continue
+		}
+		source := merged[node.entry.Linkname]
+		if source == nil || source.entry.Type != tar.TypeReg || source.layer > node.layer || source.entry.SHA256 != node.entry.SHA256 {
+			return fmt.Errorf("%w: source %s of hard link %s is replaced by a later layer", errMergeUnsupported, node.entry.Linkname, node.entry.Path)
+		}
+	}
+	return nil
+}
+
+// extractImageFlattened extracts img to root writing every path of the final,
+// flattened filesystem once, instead of every version of it from each layer.
+// Layers are downloaded (to spoolDir, unless it is empty) and scanned
+// concurrently, and the regular files of different layers are written
+// concurrently once the directories exist. Links follow last. It returns the
+// record of the layers, or errMergeUnsupported before touching root when the
+// layers cannot be flattened.
+//
+// Whiteouts only apply between the layers, so root is expected to be empty,
+// as it is on install and on full updates.
+func extractImageFlattened(ctx context.Context, img v1.Image, root, spoolDir string, verbose bool, progress reporter.Reporter) (*slotFiles, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image digest: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image layers: %w", err)
+	}
+
+	files := &slotFiles{Version: slotFilesVersion, ImageDigest: digest.String()}
+	files.Layers = make([]layerFiles, len(layers))
+	indexes := make([]int, len(layers))
+	for i, layer := range layers {
+		layerDigest, err := layer.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get digest of layer %d: %w", i, err)
+		}
+		files.Layers[i].Digest = layerDigest.String()
+		indexes[i] = i
+	}
+
+	progress.Message("Scanning %d layers...", len(layers))
+	err = forEachLayer(ctx, indexes, func(ctx context.Context, i int) error {
+		if spoolDir != "" {
+			layer, err := spoolLayer(layers[i], spoolDir)
+			if err != nil {
+				return fmt.Errorf("failed to download layer %d: %w", i, err)
+			}
+			layers[i] = layer
+		}
+		entries, err := scanLayer(ctx, layers[i])
+		if err != nil {
+			return fmt.Errorf("failed to scan layer %d: %w", i, err)
+		}
+		files.Layers[i].Entries = entries
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := mergeLayers(files.Layers)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFlattenedLinks(merged); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*fileNode, 0, len(merged))
+	for _, node := range merged {
+		nodes = append(nodes, node)
+	}
+	slices.SortFunc(nodes, func(a, b *fileNode) int { return strings.Compare(a.entry.Path, b.entry.Path) })
+
+	// Directories first, parents before their contents. Directories no layer
+	// has an entry for are created the way MkdirAll creates them.
+	for _, node := range nodes {
+		if node.entry.Type != tar.TypeDir {
+			continue
+		}
+		if node.layer >= 0 {
+			if err := extractDeltaEntry(root, node.entry); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if node.entry.Path == "/" {
+			continue
+		}
+		target, err := secureLeafPath(root, node.entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve safe extraction path for %q: %w", node.entry.Path, err)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", target, err)
+		}
+	}
+
+	// Regular files, each from the last layer providing it. The layers
+	// write disjoint paths into existing directories, so they run at once.
+	wanted := make(map[string]int)
+	var needed []int
+	for _, node := range nodes {
+		if node.entry.Type == tar.TypeReg {
+			wanted[node.entry.Path] = node.layer
+			if !slices.Contains(needed, node.layer) {
+				needed = append(needed, node.layer)
+			}
+		}
+	}
+	if verbose {
+		progress.Message("Writing %d files from %d of %d layers...", len(wanted), len(needed), len(layers))
+	}
+	err = forEachLayer(ctx, needed, func(ctx context.Context, i int) error {
+		rc, err := layers[i].Uncompressed()
+		if err != nil {
+			return fmt.Errorf("failed to decompress layer %d: %w", i, err)
+		}
+		defer func() { _ = rc.Close() }()
+		if err := writeLayerFiles(ctx, tar.NewReader(rc), root, i, wanted); err != nil {
+			return fmt.Errorf("failed to extract layer %d: %w", i, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		if node.entry.Type != tar.TypeSymlink && node.entry.Type != tar.TypeLink {
+			continue
+		}
+		if err := extractDeltaEntry(root, node.entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := restoreDirTimes(root, merged); err != nil {
+		return nil, err
+	}
+
+	progress.Message("Flattened %d layers into %d paths", len(layers), len(merged))
+	return files, nil
+}
+
+// extractImage extracts the layers of img to the target directory, flattened
+// when enabled. Images that cannot be flattened are extracted layer by layer.
+// When files is not nil, the layers are recorded in it for delta updates.
+func (c *ContainerExtractor) extractImage(ctx context.Context, img v1.Image, files *slotFiles) error {
+	if !c.Flatten {
+		return c.extractLayers(ctx, img, files)
+	}
+
+	spoolDir, err := c.layerSpoolDir("flatten-layers-")
+	if err != nil {
+		return err
+	}
+	if spoolDir != "" {
+		defer func() { _ = os.RemoveAll(spoolDir) }()
+	}
+
+	c.Progress.Message("Extracting flattened layers...")
+	flattened, err := extractImageFlattened(ctx, img, c.TargetDir, spoolDir, c.Verbose, c.Progress)
+	if errors.Is(err, errMergeUnsupported) {
+		c.Progress.Warning("Flattened extraction not possible, extracting layer by layer: %v", err)
+		return c.extractLayers(ctx, img, files)
+	}
+	if err != nil {
+		return err
+	}
+	if files != nil {
+		files.Layers = flattened.Layers
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package pkg
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/frostyard/std/reporter"
+)
+
+// extractBothWays extracts the image in layout layer by layer and flattened,
+// and fails the test unless both produce the same tree. It returns the root of
+// the flattened extraction.
+func extractBothWays(t *testing.T, layout string) string {
+	t.Helper()
+	ctx := context.Background()
+
+	layered := t.TempDir()
+	if err := testExtractor(layout, layered).Extract(ctx); err != nil {
+		t.Fatalf("layered Extract: %v", err)
+	}
+	flattened := t.TempDir()
+	c := testExtractor(layout, flattened)
+	c.Flatten = true
+	if err := c.Extract(ctx); err != nil {
+		t.Fatalf("flattened Extract: %v", err)
+	}
+
+	got, want := snapshotTree(t, flattened), snapshotTree(t, layered)
+	for path, desc := range want {
+		if got[path] != desc {
+			t.Errorf("%s: got %q, want %q", path, got[path], desc)
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("%s should not exist", path)
+		}
+	}
+	return flattened
+}
+
+func TestExtractFlattened_MatchesLayered(t *testing.T) {
+	base := buildTar(t, []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "usr/bin/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "v1", mode: 0755},
+		{name: "usr/bin/suid", typeflag: tar.TypeReg, content: "s", mode: 04755},
+		{name: "usr/bin/tool-alias", typeflag: tar.TypeLink, linkname: "usr/bin/suid"},
+		{name: "usr/share/doc/old", typeflag: tar.TypeReg, content: "doc"},
+		{name: "etc/gone", typeflag: tar.TypeReg, content: "bye"},
+		{name: "etc/localtime", typeflag: tar.TypeSymlink, linkname: "/usr/share/zoneinfo/UTC"},
+		{name: "boot/efi/EFI/keep", typeflag: tar.TypeReg, content: "efi"},
+		{name: "srv/data/a", typeflag: tar.TypeReg, content: "a"},
+		{name: "opt/app", typeflag: tar.TypeReg, content: "file"},
+	})
+	middle := buildTar(t, []tarEntry{
+		{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "v2", mode: 0755},
+		{name: "usr/share/doc/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "usr/share/doc/new", typeflag: tar.TypeReg, content: "new doc"},
+		{name: "boot/efi/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "srv/data", typeflag: tar.TypeReg, content: "now a file"},
+	})
+	top := buildTar(t, []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir, mode: 0700},
+		{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "v3!", mode: 0750},
+		{name: "etc/.wh.gone", typeflag: tar.TypeReg},
+		{name: "etc/localtime", typeflag: tar.TypeSymlink, linkname: "/usr/share/zoneinfo/Europe/Berlin"},
+		{name: "opt/app/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "opt/app/bin", typeflag: tar.TypeReg, content: "now a dir"},
+	})
+
+	layout := writeTestLayout(t, base, middle, top)
+	root := extractBothWays(t, layout)
+
+	// The image must not have needed the layered fallback
+	img, err := LoadImageFromOCILayout(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractImageFlattened(t.Context(), img, t.TempDir(), "", false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("extractImageFlattened: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "usr/bin/tool")); err != nil || string(data) != "v3!" {
+		t.Errorf("usr/bin/tool = %q, %v; want the top layer's contents", data, err)
+	}
+	if inode(t, filepath.Join(root, "usr/bin/tool-alias")) != inode(t, filepath.Join(root, "usr/bin/suid")) {
+		t.Error("hard link should share the inode of its source")
+	}
+}
+
+func TestExtractFlattened_RecordMatchesLayered(t *testing.T) {
+	ctx := context.Background()
+	layout := writeTestLayout(t,
+		buildTar(t, []tarEntry{
+			{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "v1"},
+			{name: "usr/bin/alias", typeflag: tar.TypeLink, linkname: "usr/bin/tool"},
+		}),
+		buildTar(t, []tarEntry{
+			{name: "usr/bin/.wh.alias", typeflag: tar.TypeReg},
+			{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "v2"},
+		}),
+	)
+
+	layered, err := testExtractor(layout, t.TempDir()).extractRecorded(ctx)
+	if err != nil {
+		t.Fatalf("layered extractRecorded: %v", err)
+	}
+	c := testExtractor(layout, t.TempDir())
+	c.Flatten = true
+	flattened, err := c.extractRecorded(ctx)
+	if err != nil {
+		t.Fatalf("flattened extractRecorded: %v", err)
+	}
+	if !reflect.DeepEqual(flattened.Layers, layered.Layers) {
+		t.Errorf("flattened record = %+v, want %+v", flattened.Layers, layered.Layers)
+	}
+	if _, ok := flattened.Disk["/usr/bin/tool"]; !ok {
+		t.Error("flattened record should stamp the written files")
+	}
+}
+
+func TestExtractFlattened_FallsBackToLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]tarEntry
+	}{
+		{
+			// Written through the symlink on disk, which merging cannot model
+			name: "entry below symlink",
+			layers: [][]tarEntry{
+				{
+					{name: "usr/lib/", typeflag: tar.TypeDir, mode: 0755},
+					{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+				},
+				{{name: "lib/libfoo.so", typeflag: tar.TypeReg, content: "foo"}},
+			},
+		},
+		{
+			// The link keeps the contents its source had in the first layer
+			name: "hard link source replaced",
+			layers: [][]tarEntry{
+				{
+					{name: "bin/tool", typeflag: tar.TypeReg, content: "old"},
+					{name: "bin/alias", typeflag: tar.TypeLink, linkname: "bin/tool"},
+				},
+				{{name: "bin/tool", typeflag: tar.TypeReg, content: "new"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tars [][]byte
+			for _, entries := range tt.layers {
+				tars = append(tars, buildTar(t, entries))
+			}
+			extractBothWays(t, writeTestLayout(t, tars...))
+		})
+	}
+}
+
+func TestCheckFlattenedLinks(t *testing.T) {
+	merged, err := mergeLayers([]layerFiles{
+		{Entries: []fileEntry{
+			{Path: "/bin/tool", Type: tar.TypeReg, Size: 3, SHA256: "aaa"},
+			{Path: "/bin/alias", Type: tar.TypeLink, Linkname: "/bin/tool"},
+		}},
+		{Entries: []fileEntry{
+			{Path: "/bin/other", Type: tar.TypeReg, Size: 3, SHA256: "bbb"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFlattenedLinks(merged); err != nil {
+		t.Errorf("checkFlattenedLinks() = %v, want nil", err)
+	}
+
+	merged["/bin/tool"].layer = 1
+	if err := checkFlattenedLinks(merged); !errors.Is(err, errMergeUnsupported) {
+		t.Errorf("source from a later layer: err = %v, want errMergeUnsupported", err)
+	}
+}
+
+func TestExtractFlattened_SymlinkEscapeDoesNotWriteOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	hostDir := filepath.Join(dir, "host")
+	if err := os.MkdirAll(hostDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	layout := writeTestLayout(t,
+		buildTar(t, []tarEntry{{name: "escape", typeflag: tar.TypeSymlink, linkname: hostDir}}),
+		buildTar(t, []tarEntry{
+			{name: "escape/pwned", typeflag: tar.TypeReg, content: "owned"},
+			{name: "../../outside", typeflag: tar.TypeReg, content: "owned"},
+		}),
+	)
+
+	c := testExtractor(layout, filepath.Join(dir, "rootfs"))
+	c.Flatten = true
+	if err := os.MkdirAll(c.TargetDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Extract(t.Context())
+
+	if _, err := os.Lstat(filepath.Join(hostDir, "pwned")); !os.IsNotExist(err) {
+		t.Error("a file was written outside the extraction root through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "outside")); !os.IsNotExist(err) {
+		t.Error("a file was written outside the extraction root through ..")
+	}
+}
+
+func TestExtractFlattened_HardlinkEscapeDoesNotDiscloseHostFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("TOP-SECRET-HOST-DATA"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	layout := writeTestLayout(t, buildTar(t, []tarEntry{
+		{name: "loot", typeflag: tar.TypeLink, linkname: "../secret.txt"},
+	}))
+
+	c := testExtractor(layout, filepath.Join(dir, "rootfs"))
+	c.Flatten = true
+	if err := os.MkdirAll(c.TargetDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Extract(t.Context())
+
+	if data, err := os.ReadFile(filepath.Join(c.TargetDir, "loot")); err == nil && strings.Contains(string(data), "TOP-SECRET") {
+		t.Fatal("host secret was disclosed into the image through a hard link")
+	}
+}
+
+func TestForEachLayer(t *testing.T) {
+	var running, most atomic.Int32
+	err := forEachLayer(context.Background(), []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, func(ctx context.Context, i int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEachLayer() = %v", err)
+	}
+	if most.Load() > layerWorkers {
+		t.Errorf("%d layers ran at once, want at most %d", most.Load(), layerWorkers)
+	}
+
+	errBroken := errors.New("broken layer")
+	err = forEachLayer(context.Background(), []int{0, 1, 2}, func(ctx context.Context, i int) error {
+		if i == 1 {
+			return errBroken
+		}
+		return nil
+	})
+	if !errors.Is(err, errBroken) {
+		t.Errorf("forEachLayer() = %v, want the layer's error", err)
+	}
+}
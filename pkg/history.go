@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/frostyard/nbc/pkg/types"
+)
+
+// HistoryFile is the append-only deployment journal. Each line is one JSON
+// encoded types.DeploymentRecord, oldest first. It lives on the shared /var
+// partition so both A/B slots see the same history.
+const HistoryFile = "/var/lib/nbc/state/history.jsonl"
+
+// Version is the nbc version recorded in deployment history entries.
+// It is set by main from the build-time version.
+var Version = "dev"
+
+// Deployment operations recorded in the history
+const (
+	DeploymentInstall = "install"
+	DeploymentUpdate  = "update"
+)
+
+// Deployment outcomes recorded in the history
+const (
+	DeploymentSuccess   = "success"
+	DeploymentFailed    = "failed"
+	DeploymentCancelled = "cancelled"
+)
+
+// historyFileInVar returns the path of the deployment journal on a /var
+// partition mounted at varMountPoint.
+func historyFileInVar(varMountPoint string) string {
+	return filepath.Join(varMountPoint, "lib", "nbc", "state", filepath.Base(HistoryFile))
+}
+
+// newDeploymentRecord builds a journal entry for a deployment that started at
+// start and finished with err (nil on success).
+func newDeploymentRecord(operation string, start time.Time, err error) types.DeploymentRecord {
+	record := types.DeploymentRecord{
+		Timestamp:       time.Now().UTC().Format(time.RFC3339),
+		Operation:       operation,
+		Outcome:         DeploymentSuccess,
+		DurationSeconds: time.Since(start).Round(time.Millisecond).Seconds(),
+		NBCVersion:      Version,
+	}
+	if err != nil {
+		record.Outcome = DeploymentFailed
+		if errors.Is(err, context.Canceled) {
+			record.Outcome = DeploymentCancelled
+		}
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// appendDeploymentRecord appends a record to the journal at path, creating the
+// file and its directory if needed. Existing entries are never rewritten.
+func appendDeploymentRecord(path string, record types.DeploymentRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal deployment record: %w", err)
+	}
+	data = append(data, '\n')
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync history file: %w", err)
+	}
+	return f.Close()
+}
+
+// ReadDeploymentHistory reads the deployment journal from
+// /var/lib/nbc/state/history.jsonl, oldest entry first. A missing journal
+// yields an empty history.
+func ReadDeploymentHistory() ([]types.DeploymentRecord, error) {
+	return readDeploymentHistory(HistoryFile)
+}
+
+func readDeploymentHistory(path string) ([]types.DeploymentRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []types.DeploymentRecord{}, nil
+		}
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	records := []types.DeploymentRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record types.DeploymentRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// A crash mid-append can leave a truncated final line; skip it
+			// rather than hiding the rest of the history.
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file line %d: %w", lineNum, err)
+	}
+	return records, nil
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeploymentHistoryAppendAndRead(t *testing.T) {
+	historyPath := historyFileInVar(t.TempDir())
+
+	// A missing journal is an empty history
+	records, err := readDeploymentHistory(historyPath)
+	if err != nil {
+		t.Fatalf("readDeploymentHistory() error = %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("got %d records from missing journal, want 0", len(records))
+	}
+
+	first := newDeploymentRecord(DeploymentInstall, time.Now(), nil)
+	first.ImageRef = "example.com/os:1"
+	first.TargetSlot = "root1"
+	second := newDeploymentRecord(DeploymentUpdate, time.Now(), errors.New("extraction failed"))
+	second.ImageRef = "example.com/os:2"
+	second.TargetSlot = "root2"
+
+	if err := appendDeploymentRecord(historyPath, first); err != nil {
+		t.Fatalf("appendDeploymentRecord() error = %v", err)
+	}
+	if err := appendDeploymentRecord(historyPath, second); err != nil {
+		t.Fatalf("appendDeploymentRecord() error = %v", err)
+	}
+
+	records, err = readDeploymentHistory(historyPath)
+	if err != nil {
+		t.Fatalf("readDeploymentHistory() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0].ImageRef != "example.com/os:1" || records[0].Outcome != DeploymentSuccess {
+		t.Errorf("records[0] = %+v, want successful install of example.com/os:1", records[0])
+	}
+	if records[1].ImageRef != "example.com/os:2" || records[1].Outcome != DeploymentFailed || records[1].Error != "extraction failed" {
+		t.Errorf("records[1] = %+v, want failed update of example.com/os:2", records[1])
+	}
+	if records[1].NBCVersion != Version {
+		t.Errorf("NBCVersion = %q, want %q", records[1].NBCVersion, Version)
+	}
+}
+
+func TestReadDeploymentHistorySkipsTruncatedLine(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), "history.jsonl")
+	content := `{"timestamp":"2026-01-02T03:04:05Z","operation":"install","image_ref":"example.com/os:1","target_slot":"root1","outcome":"success","duration_seconds":12.5,"nbc_version":"1.0.0"}
+{"timestamp":"2026-01-03T03:04:05Z","operation":"upd`
+	if err := os.WriteFile(historyPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readDeploymentHistory(historyPath)
+	if err != nil {
+		t.Fatalf("readDeploymentHistory() error = %v", err)
+	}
+	if len(records) != 1 || records[0].DurationSeconds != 12.5 {
+		t.Errorf("records = %+v, want only the complete install entry", records)
+	}
+}
+
+func TestNewDeploymentRecordOutcome(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, DeploymentSuccess},
+		{errors.New("boom"), DeploymentFailed},
+		{fmt.Errorf("failed to extract: %w", context.Canceled), DeploymentCancelled},
+	}
+
+	for _, tt := range tests {
+		if got := newDeploymentRecord(DeploymentUpdate, time.Now(), tt.err).Outcome; got != tt.want {
+			t.Errorf("outcome for %v = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,690 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/frostyard/std/reporter"
+)
+
+// IgnitionConfig is the subset of an Ignition config (spec 3.x) that nbc
+// applies at install time, in place of Ignition on first boot: users and
+// groups, files, directories and links below /etc and /var, and systemd
+// units. Configs using anything else, such as storage.disks or remote file
+// sources, are refused rather than partly applied.
+type IgnitionConfig struct {
+	Ignition IgnitionMeta    `json:"ignition"`
+	Passwd   IgnitionPasswd  `json:"passwd,omitzero"`
+	Storage  IgnitionStorage `json:"storage,omitzero"`
+	Systemd  IgnitionSystemd `json:"systemd,omitzero"`
+}
+
+// IgnitionMeta is the ignition section of an IgnitionConfig
+type IgnitionMeta struct {
+	Version string `json:"version"`
+}
+
+// IgnitionPasswd is the passwd section of an IgnitionConfig
+type IgnitionPasswd struct {
+	Users  []IgnitionUser  `json:"users,omitempty"`
+	Groups []IgnitionGroup `json:"groups,omitempty"`
+}
+
+// IgnitionUser is a user of an IgnitionConfig. Root takes a password hash
+// and SSH keys only.
+type IgnitionUser struct {
+	Name              string   `json:"name"`
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// IgnitionGroup is a group of an IgnitionConfig
+type IgnitionGroup struct {
+	Name string `json:"name"`
+}
+
+// IgnitionStorage is the storage section of an IgnitionConfig
+type IgnitionStorage struct {
+	Directories []IgnitionDirectory `json:"directories,omitempty"`
+	Files       []IgnitionFile      `json:"files,omitempty"`
+	Links       []IgnitionLink      `json:"links,omitempty"`
+}
+
+// IgnitionNode holds the fields common to files, directories and links
+type IgnitionNode struct {
+	Path      string            `json:"path"`
+	Overwrite bool              `json:"overwrite,omitempty"`
+	User      *IgnitionNodeUser `json:"user,omitempty"`
+	Group     *IgnitionNodeUser `json:"group,omitempty"`
+}
+
+// IgnitionNodeUser is the owning user or group of a node, by ID or name
+type IgnitionNodeUser struct {
+	ID   *int   `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// IgnitionFile is a file of an IgnitionConfig
+type IgnitionFile struct {
+	IgnitionNode
+	Contents IgnitionResource `json:"contents,omitzero"`
+	Mode     *int             `json:"mode,omitempty"`
+}
+
+// IgnitionResource is the contents of a file: a data URL, optionally gzip
+// compressed
+type IgnitionResource struct {
+	Source      string `json:"source,omitempty"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// IgnitionDirectory is a directory of an IgnitionConfig
+type IgnitionDirectory struct {
+	IgnitionNode
+	Mode *int `json:"mode,omitempty"`
+}
+
+// IgnitionLink is a symbolic link of an IgnitionConfig
+type IgnitionLink struct {
+	IgnitionNode
+	Target string `json:"target"`
+	Hard   bool   `json:"hard,omitempty"`
+}
+
+// IgnitionSystemd is the systemd section of an IgnitionConfig
+type IgnitionSystemd struct {
+	Units []IgnitionUnit `json:"units,omitempty"`
+}
+
+// IgnitionUnit is a systemd unit of an IgnitionConfig, written to
+// /etc/systemd/system
+type IgnitionUnit struct {
+	Name     string           `json:"name"`
+	Enabled  *bool            `json:"enabled,omitempty"`
+	Mask     bool             `json:"mask,omitempty"`
+	Contents *string          `json:"contents,omitempty"`
+	Dropins  []IgnitionDropin `json:"dropins,omitempty"`
+}
+
+// IgnitionDropin is a drop-in of an IgnitionUnit
+type IgnitionDropin struct {
+	Name     string  `json:"name"`
+	Contents *string `json:"contents,omitempty"`
+}
+
+// unitSuffixes are the unit types an IgnitionUnit can have
+var unitSuffixes = []string{".service", ".socket", ".timer", ".target", ".path", ".mount", ".automount", ".swap", ".slice"}
+
+// ParseIgnitionConfig parses and validates an Ignition config
+func ParseIgnitionConfig(data []byte) (*IgnitionConfig, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var cfg IgnitionConfig
+	if err := decoder.Decode(&cfg); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return nil, fmt.Errorf("unsupported Ignition config field %s (supported: passwd users and groups, storage files, directories and links, systemd units)", field)
+		}
+		return nil, fmt.Errorf("failed to parse Ignition config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// validateIgnitionPath returns an error unless path is a clean absolute path
+// below /etc or /var, the writable parts of an installed system
+func validateIgnitionPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("%q is not a clean absolute path", path)
+	}
+	if !strings.HasPrefix(path, "/etc/") && !strings.HasPrefix(path, "/var/") {
+		return fmt.Errorf("%s is outside /etc and /var, the rest of the image is read-only", path)
+	}
+	return nil
+}
+
+// validateIgnitionMode returns an error unless mode is a file mode
+func validateIgnitionMode(path string, mode *int) error {
+	if mode != nil && (*mode < 0 || *mode > 07777) {
+		return fmt.Errorf("%s: invalid mode %o", path, *mode)
+	}
+	return nil
+}
+
+// Validate checks the config for errors and anything nbc does not support
+func (c *IgnitionConfig) Validate() error {
+	if !strings.HasPrefix(c.Ignition.Version, "3.") {
+		return fmt.Errorf("unsupported Ignition config version %q (supported: 3.x)", c.Ignition.Version)
+	}
+	if err := c.provisionOptions().Validate(); err != nil {
+		return fmt.Errorf("invalid passwd: %w", err)
+	}
+
+	for _, dir := range c.Storage.Directories {
+		if err := validateIgnitionPath(dir.Path); err != nil {
+			return err
+		}
+		if err := validateIgnitionMode(dir.Path, dir.Mode); err != nil {
+			return err
+		}
+	}
+	for _, file := range c.Storage.Files {
+		if err := validateIgnitionPath(file.Path); err != nil {
+			return err
+		}
+		if err := validateIgnitionMode(file.Path, file.Mode); err != nil {
+			return err
+		}
+		if _, err := file.Contents.data(); err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+	for _, link := range c.Storage.Links {
+		if err := validateIgnitionPath(link.Path); err != nil {
+			return err
+		}
+		if link.Hard {
+			return fmt.Errorf("%s: hard links are not supported", link.Path)
+		}
+		if link.Target == "" {
+			return fmt.Errorf("%s: link has no target", link.Path)
+		}
+	}
+
+	for _, unit := range c.Systemd.Units {
+		base, _, _ := strings.Cut(unit.Name, "@")
+		if strings.ContainsRune(unit.Name, '/') || base == "" ||
+			!slices.ContainsFunc(unitSuffixes, func(s string) bool { return strings.HasSuffix(unit.Name, s) }) {
+			return fmt.Errorf("invalid systemd unit name %q", unit.Name)
+		}
+		if unit.Enabled != nil && !*unit.Enabled {
+			return fmt.Errorf("unit %s: disabling units is not supported, mask it instead", unit.Name)
+		}
+		if unit.Enabled != nil && strings.Contains(unit.Name, "@.") {
+			return fmt.Errorf("unit %s: enabling template units is not supported", unit.Name)
+		}
+		if unit.Contents != nil {
+			if _, err := unitInstallDirs(*unit.Contents); err != nil {
+				return fmt.Errorf("unit %s: %w", unit.Name, err)
+			}
+		}
+		for _, dropin := range unit.Dropins {
+			if strings.ContainsRune(dropin.Name, '/') || !strings.HasSuffix(dropin.Name, ".conf") {
+				return fmt.Errorf("unit %s: invalid drop-in name %q", unit.Name, dropin.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// data returns the contents of the resource, decoded and decompressed
+func (r IgnitionResource) data() ([]byte, error) {
+	if r.Source == "" {
+		return nil, nil
+	}
+	rest, ok := strings.CutPrefix(r.Source, "data:")
+	if !ok {
+		return nil, fmt.Errorf("unsupported contents source %q, only data URLs are supported", r.Source)
+	}
+	mediaType, encoded, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, errors.New("invalid data URL")
+	}
+
+	var data []byte
+	if strings.HasSuffix(mediaType, ";base64") {
+		// base64 data may be percent-encoded as well
+		unescaped, err := url.PathUnescape(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data URL: %w", err)
+		}
+		if data, err = base64.StdEncoding.DecodeString(unescaped); err != nil {
+			return nil, fmt.Errorf("invalid base64 in data URL: %w", err)
+		}
+	} else {
+		unescaped, err := url.PathUnescape(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data URL: %w", err)
+		}
+		data = []byte(unescaped)
+	}
+
+	switch r.Compression {
+	case "":
+		return data, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress contents: %w", err)
+		}
+		defer func() { _ = gz.Close() }()
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("failed to decompress contents: %w", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q (supported: gzip)", r.Compression)
+}
+
+// provisionOptions returns the users and groups of the config as
+// ProvisionOptions
+func (c *IgnitionConfig) provisionOptions() *ProvisionOptions {
+	opts := &ProvisionOptions{}
+	for _, group := range c.Passwd.Groups {
+		opts.Groups = append(opts.Groups, group.Name)
+	}
+	for _, user := range c.Passwd.Users {
+		if user.Name == "root" {
+			opts.RootPasswordHash = user.PasswordHash
+			opts.SSHAuthorizedKeys = append(opts.SSHAuthorizedKeys, user.SSHAuthorizedKeys...)
+			continue
+		}
+		opts.Users = append(opts.Users, UserOptions{
+			Name:              user.Name,
+			PasswordHash:      user.PasswordHash,
+			Groups:            user.Groups,
+			SSHAuthorizedKeys: user.SSHAuthorizedKeys,
+		})
+	}
+	return opts
+}
+
+// ignitionMode converts a Unix mode, as Ignition gives it, to an os.FileMode
+func ignitionMode(mode *int, fallback os.FileMode) os.FileMode {
+	if mode == nil {
+		return fallback
+	}
+	m := os.FileMode(*mode & 0777)
+	if *mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if *mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if *mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// ignitionApplier applies an IgnitionConfig to the system at targetDir
+type ignitionApplier struct {
+	targetDir string
+	dbs       *accountDBs // loaded on first use, after provisioning
+}
+
+// nodePath returns where path of the installed system is written: below
+// /etc to the overlay upper layer, below /var to the mounted /var
+func (a *ignitionApplier) nodePath(path string) (string, error) {
+	if rel, ok := strings.CutPrefix(path, "/etc/"); ok {
+		return securejoin.SecureJoin(etcUpperDir(a.targetDir), rel)
+	}
+	return securejoin.SecureJoin(a.targetDir, path)
+}
+
+// exists reports whether path exists on the installed system, in the
+// image's /etc or the overlay upper layer for paths below /etc
+func (a *ignitionApplier) exists(path, dst string) bool {
+	if _, err := os.Lstat(dst); err == nil {
+		return true
+	}
+	if strings.HasPrefix(path, "/etc/") {
+		if _, err := os.Lstat(filepath.Join(a.targetDir, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mkdirAll creates dir and its missing parents. In the overlay upper layer,
+// a directory hides the mode and owner of the image's, so missing ones take
+// those of the matching directory in the image's /etc, as on an overlayfs
+// copy-up. Other directories are created like MkdirAll creates them.
+func (a *ignitionApplier) mkdirAll(dir string) error {
+	upper := etcUpperDir(a.targetDir)
+	rel, err := filepath.Rel(upper, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		return err
+	}
+
+	path, lower := upper, filepath.Join(a.targetDir, "etc")
+	for name := range strings.SplitSeq(rel, "/") {
+		if name == "." {
+			continue
+		}
+		path, lower = filepath.Join(path, name), filepath.Join(lower, name)
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+
+		mode, uid, gid := os.FileMode(0755), 0, 0
+		if info, err := os.Lstat(lower); err == nil && info.IsDir() {
+			mode = info.Mode() & (os.ModePerm | os.ModeSetgid | os.ModeSticky)
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				uid, gid = int(st.Uid), int(st.Gid)
+			}
+		}
+		if err := os.Mkdir(path, 0700); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownerID resolves the owning user or group of a node to its ID; root
+// when not given
+func (a *ignitionApplier) ownerID(owner *IgnitionNodeUser, group bool) (int, error) {
+	if owner == nil {
+		return 0, nil
+	}
+	if owner.ID != nil {
+		return *owner.ID, nil
+	}
+	if owner.Name == "" {
+		return 0, nil
+	}
+	if a.dbs == nil {
+		dbs, err := loadAccountDBs(a.targetDir)
+		if err != nil {
+			return 0, err
+		}
+		a.dbs = dbs
+	}
+	db, kind := a.dbs.passwd, "user"
+	if group {
+		db, kind = a.dbs.group, "group"
+	}
+	record := db.find(owner.Name)
+	if record == nil || len(record) < 3 {
+		return 0, fmt.Errorf("%s %s does not exist", kind, owner.Name)
+	}
+	return strconv.Atoi(record[2])
+}
+
+// chown sets the owner of dst to the user and group of node
+func (a *ignitionApplier) chown(dst string, node IgnitionNode) error {
+	uid, err := a.ownerID(node.User, false)
+	if err != nil {
+		return err
+	}
+	gid, err := a.ownerID(node.Group, true)
+	if err != nil {
+		return err
+	}
+	if err := os.Lchown(dst, uid, gid); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %w", node.Path, err)
+	}
+	return nil
+}
+
+// writeDirectory creates the directory dir
+func (a *ignitionApplier) writeDirectory(dir IgnitionDirectory) error {
+	dst, err := a.nodePath(dir.Path)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dst); err == nil && !info.IsDir() {
+		if !dir.Overwrite {
+			return fmt.Errorf("%s exists and is not a directory", dir.Path)
+		}
+		if err := os.Remove(dst); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dir.Path, err)
+		}
+	}
+	mode := ignitionMode(dir.Mode, 0755)
+	if err := a.mkdirAll(dst); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir.Path, err)
+	}
+	if err := os.Chmod(dst, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", dir.Path, err)
+	}
+	return a.chown(dst, dir.IgnitionNode)
+}
+
+// writeFile writes the file
+func (a *ignitionApplier) writeFile(file IgnitionFile) error {
+	dst, err := a.nodePath(file.Path)
+	if err != nil {
+		return err
+	}
+	if !file.Overwrite && a.exists(file.Path, dst) {
+		return fmt.Errorf("%s already exists, set overwrite to replace it", file.Path)
+	}
+	data, err := file.Contents.data()
+	if err != nil {
+		return fmt.Errorf("%s: %w", file.Path, err)
+	}
+	if err := a.mkdirAll(filepath.Dir(dst)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(file.Path), err)
+	}
+	mode := ignitionMode(file.Mode, 0644)
+	if err := atomicWriteFile(dst, data, mode.Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", file.Path, err)
+	}
+	if err := os.Chmod(dst, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", file.Path, err)
+	}
+	return a.chown(dst, file.IgnitionNode)
+}
+
+// symlink replaces dst with a symbolic link to target, creating its missing
+// parents with mkdirAll
+func (a *ignitionApplier) symlink(target, dst string) error {
+	if err := a.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeLink creates the symbolic link
+func (a *ignitionApplier) writeLink(link IgnitionLink) error {
+	dst, err := a.nodePath(link.Path)
+	if err != nil {
+		return err
+	}
+	if !link.Overwrite && a.exists(link.Path, dst) {
+		if current, err := os.Readlink(dst); err != nil || current != link.Target {
+			return fmt.Errorf("%s already exists, set overwrite to replace it", link.Path)
+		}
+	}
+	if err := a.symlink(link.Target, dst); err != nil {
+		return fmt.Errorf("failed to link %s: %w", link.Path, err)
+	}
+	return a.chown(dst, link.IgnitionNode)
+}
+
+// unitInstallDirs returns the .wants and .requires directories that the
+// WantedBy= and RequiredBy= lines of the [Install] section of a unit file
+// enable it in. Unit names with a "/" are refused, as they would point
+// outside /etc/systemd/system.
+func unitInstallDirs(contents string) ([]string, error) {
+	var dirs []string
+	section := ""
+	for line := range strings.Lines(contents) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if section != "[Install]" || !ok {
+			continue
+		}
+		suffix := ""
+		switch strings.TrimSpace(key) {
+		case "WantedBy":
+			suffix = ".wants"
+		case "RequiredBy":
+			suffix = ".requires"
+		default:
+			continue
+		}
+		for _, unit := range strings.Fields(value) {
+			if strings.ContainsRune(unit, '/') {
+				return nil, fmt.Errorf("invalid unit name %q in %s=", unit, strings.TrimSpace(key))
+			}
+			dirs = append(dirs, unit+suffix)
+		}
+	}
+	return dirs, nil
+}
+
+// writeUnit writes, masks or enables the systemd unit in /etc/systemd/system
+func (a *ignitionApplier) writeUnit(unit IgnitionUnit) error {
+	unitDir := filepath.Join(etcUpperDir(a.targetDir), "systemd", "system")
+	if err := a.mkdirAll(unitDir); err != nil {
+		return fmt.Errorf("failed to create /etc/systemd/system: %w", err)
+	}
+
+	if unit.Mask {
+		if err := a.symlink("/dev/null", filepath.Join(unitDir, unit.Name)); err != nil {
+			return fmt.Errorf("failed to mask %s: %w", unit.Name, err)
+		}
+		return nil
+	}
+
+	if unit.Contents != nil {
+		if err := atomicWriteFile(filepath.Join(unitDir, unit.Name), []byte(*unit.Contents), 0644); err != nil {
+			return fmt.Errorf("failed to write unit %s: %w", unit.Name, err)
+		}
+	}
+	for _, dropin := range unit.Dropins {
+		if dropin.Contents == nil {
+			continue
+		}
+		dropinDir := filepath.Join(unitDir, unit.Name+".d")
+		if err := a.mkdirAll(dropinDir); err != nil {
+			return fmt.Errorf("failed to create %s.d: %w", unit.Name, err)
+		}
+		if err := atomicWriteFile(filepath.Join(dropinDir, dropin.Name), []byte(*dropin.Contents), 0644); err != nil {
+			return fmt.Errorf("failed to write drop-in %s of %s: %w", dropin.Name, unit.Name, err)
+		}
+	}
+
+	if unit.Enabled == nil {
+		return nil
+	}
+	// Enable the unit like systemctl enable, from the [Install] section of
+	// the unit given or the image's
+	unitPath := "/etc/systemd/system/" + unit.Name
+	contents := ""
+	if unit.Contents != nil {
+		contents = *unit.Contents
+	} else {
+		unitPath = "/usr/lib/systemd/system/" + unit.Name
+		data, err := os.ReadFile(filepath.Join(a.targetDir, unitPath))
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unit %s has no contents and is not in the image", unit.Name)
+		} else if err != nil {
+			return fmt.Errorf("failed to read unit %s: %w", unit.Name, err)
+		}
+		contents = string(data)
+	}
+	dirs, err := unitInstallDirs(contents)
+	if err != nil {
+		return fmt.Errorf("unit %s: %w", unit.Name, err)
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("unit %s has no WantedBy= or RequiredBy= in its [Install] section to enable it with", unit.Name)
+	}
+	for _, dir := range dirs {
+		if err := a.symlink(unitPath, filepath.Join(unitDir, dir, unit.Name)); err != nil {
+			return fmt.Errorf("failed to enable %s: %w", unit.Name, err)
+		}
+	}
+	return nil
+}
+
+// items returns the storage and systemd settings of the config in the
+// order Ignition applies them
+func (a *ignitionApplier) items(cfg *IgnitionConfig) []provisionItem {
+	var items []provisionItem
+	for _, dir := range cfg.Storage.Directories {
+		items = append(items, provisionItem{"directory " + dir.Path, func() error { return a.writeDirectory(dir) }})
+	}
+	for _, file := range cfg.Storage.Files {
+		items = append(items, provisionItem{"file " + file.Path, func() error { return a.writeFile(file) }})
+	}
+	for _, link := range cfg.Storage.Links {
+		items = append(items, provisionItem{"link " + link.Path, func() error { return a.writeLink(link) }})
+	}
+	for _, unit := range cfg.Systemd.Units {
+		desc := "unit " + unit.Name
+		switch {
+		case unit.Mask:
+			desc += " (masked)"
+		case unit.Enabled != nil:
+			desc += " (enabled)"
+		}
+		items = append(items, provisionItem{desc, func() error { return a.writeUnit(unit) }})
+	}
+	return items
+}
+
+// ApplyIgnitionConfig applies cfg to the system installed at targetDir:
+// users and groups as ProvisionTarget does, files, directories and links
+// below /etc to the overlay upper layer and below /var to the mounted /var,
+// and systemd units to /etc/systemd/system in the overlay upper layer.
+func ApplyIgnitionConfig(targetDir string, cfg *IgnitionConfig, dryRun bool, progress reporter.Reporter) error {
+	if cfg == nil {
+		return nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// Users and groups first, files may belong to them
+	if err := ProvisionTarget(targetDir, cfg.provisionOptions(), dryRun, progress); err != nil {
+		return err
+	}
+
+	a := &ignitionApplier{targetDir: targetDir}
+	items := a.items(cfg)
+	if len(items) == 0 {
+		return nil
+	}
+	if !dryRun {
+		progress.Message("Applying Ignition config...")
+	}
+	if err := applyProvisionItems(items, dryRun, progress); err != nil {
+		return err
+	}
+	if !dryRun {
+		progress.Message("✓ Applied %d Ignition settings", len(items))
+	}
+	return nil
+}
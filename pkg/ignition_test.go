@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/frostyard/nbc/pkg/testutil"
+	"github.com/frostyard/std/reporter"
+)
+
+// testIgnitionConfig is an Ignition config using each part nbc supports.
+// Modes are decimal, as in Ignition configs: 420 is 0644, 488 is 0750.
+const testIgnitionConfig = `{
+  "ignition": {"version": "3.4.0"},
+  "passwd": {
+    "groups": [{"name": "app"}],
+    "users": [
+      {"name": "root", "sshAuthorizedKeys": ["ssh-ed25519 AAAAroot root@example.com"]},
+      {"name": "admin", "groups": ["wheel", "app"], "sshAuthorizedKeys": ["ssh-ed25519 AAAAadmin admin@example.com"]}
+    ]
+  },
+  "storage": {
+    "directories": [{"path": "/var/lib/app", "mode": 488, "user": {"name": "admin"}, "group": {"name": "app"}}],
+    "files": [
+      {"path": "/etc/app/app.conf", "mode": 420, "contents": {"source": "data:,listen%20%3D%208080%0A"}},
+      {"path": "/etc/app/motd", "contents": {"source": "data:;base64,MOTD", "compression": "gzip"}},
+      {"path": "/var/lib/app/token", "mode": 384, "user": {"id": 1002}, "contents": {"source": "data:;base64,c2VjcmV0"}}
+    ],
+    "links": [{"path": "/etc/app/current", "target": "/var/lib/app"}]
+  },
+  "systemd": {
+    "units": [
+      {"name": "app.service", "enabled": true, "contents": "[Service]\nExecStart=/usr/bin/app\n\n[Install]\nWantedBy=multi-user.target\n"},
+      {"name": "sshd.service", "enabled": true, "dropins": [{"name": "10-port.conf", "contents": "[Service]\nEnvironment=PORT=2222\n"}]},
+      {"name": "cups.service", "mask": true}
+    ]
+  }
+}`
+
+func gzipBase64(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+func TestApplyIgnitionConfig(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+	unit := "[Service]\nExecStart=/usr/sbin/sshd -D\n\n[Install]\nWantedBy=multi-user.target\n"
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib/systemd/system"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "usr/lib/systemd/system/sshd.service"), []byte(unit), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseIgnitionConfig([]byte(strings.Replace(testIgnitionConfig, "MOTD", gzipBase64(t, "Welcome\n"), 1)))
+	if err != nil {
+		t.Fatalf("ParseIgnitionConfig() error = %v", err)
+	}
+	if err := ApplyIgnitionConfig(root, cfg, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("ApplyIgnitionConfig() error = %v", err)
+	}
+
+	// Users and groups are provisioned like ProvisionTarget does
+	if got := readUpper(t, root, "group"); !strings.Contains(got, "app:x:1001:admin\n") || !strings.Contains(got, "wheel:x:10:admin\n") {
+		t.Errorf("group should add app and admin's memberships:\n%s", got)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "var/roothome/.ssh/authorized_keys")); err != nil || !strings.Contains(string(data), "root@example.com") {
+		t.Errorf("root authorized_keys = %q, %v", data, err)
+	}
+
+	// Files below /etc go to the overlay upper layer
+	if got := readUpper(t, root, "app/app.conf"); got != "listen = 8080\n" {
+		t.Errorf("app.conf = %q", got)
+	}
+	if got := readUpper(t, root, "app/motd"); got != "Welcome\n" {
+		t.Errorf("motd = %q, want it decompressed", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/app")); err == nil {
+		t.Error("the image's /etc should not be changed")
+	}
+	if got, err := os.Readlink(filepath.Join(etcUpperDir(root), "app/current")); err != nil || got != "/var/lib/app" {
+		t.Errorf("app/current links to %q, %v", got, err)
+	}
+
+	// Files below /var go to /var, owned by name or ID
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(root, "var/lib/app"), &st); err != nil || st.Uid != 1002 || st.Gid != 1001 || st.Mode&0777 != 0750 {
+		t.Errorf("/var/lib/app owner %d:%d mode %o, want 1002:1001 and 0750", st.Uid, st.Gid, st.Mode&0777)
+	}
+	if err := syscall.Stat(filepath.Join(root, "var/lib/app/token"), &st); err != nil || st.Uid != 1002 || st.Mode&0777 != 0600 {
+		t.Errorf("token owner %d mode %o, want 1002 and 0600", st.Uid, st.Mode&0777)
+	}
+
+	// Units are written, enabled and masked in /etc/systemd/system
+	if got := readUpper(t, root, "systemd/system/app.service"); !strings.Contains(got, "ExecStart=/usr/bin/app") {
+		t.Errorf("app.service = %q", got)
+	}
+	links := map[string]string{
+		"systemd/system/multi-user.target.wants/app.service":  "/etc/systemd/system/app.service",
+		"systemd/system/multi-user.target.wants/sshd.service": "/usr/lib/systemd/system/sshd.service",
+		"systemd/system/cups.service":                         "/dev/null",
+	}
+	for link, want := range links {
+		if got, err := os.Readlink(filepath.Join(etcUpperDir(root), link)); err != nil || got != want {
+			t.Errorf("%s links to %q, %v; want %s", link, got, err, want)
+		}
+	}
+	if got := readUpper(t, root, "systemd/system/sshd.service.d/10-port.conf"); !strings.Contains(got, "PORT=2222") {
+		t.Errorf("sshd drop-in = %q", got)
+	}
+}
+
+func TestApplyIgnitionConfig_Overwrite(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+
+	// The image's /etc/passwd counts as existing, even with no copy in the
+	// overlay upper layer yet
+	cfg, err := ParseIgnitionConfig([]byte(`{"ignition": {"version": "3.0.0"}, "storage": {"files": [{"path": "/etc/passwd", "contents": {"source": "data:,"}}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ApplyIgnitionConfig(root, cfg, false, reporter.NoopReporter{})
+	if err == nil || !strings.Contains(err.Error(), "/etc/passwd already exists") {
+		t.Errorf("ApplyIgnitionConfig() error = %v, want an existing file error", err)
+	}
+
+	cfg.Storage.Files[0].Overwrite = true
+	if err := ApplyIgnitionConfig(root, cfg, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("ApplyIgnitionConfig() with overwrite error = %v", err)
+	}
+	if got := readUpper(t, root, "passwd"); got != "" {
+		t.Errorf("passwd = %q, want it overwritten", got)
+	}
+}
+
+func TestApplyIgnitionConfig_CopyUpParents(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+	rulesDir := filepath.Join(root, "etc/polkit-1/rules.d")
+	if err := os.MkdirAll(rulesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(rulesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(rulesDir, 27, 27); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseIgnitionConfig([]byte(`{"ignition": {"version": "3.4.0"}, "storage": {"files": [
+		{"path": "/etc/polkit-1/rules.d/50-admin.rules", "contents": {"source": "data:,"}},
+		{"path": "/etc/app/sub/app.conf", "contents": {"source": "data:,"}}
+	]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyIgnitionConfig(root, cfg, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("ApplyIgnitionConfig() error = %v", err)
+	}
+
+	// The upper layer's directories hide the image's, so they must keep
+	// the image's mode and owner; new ones are created like MkdirAll does
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(etcUpperDir(root), "polkit-1/rules.d"), &st); err != nil || st.Uid != 27 || st.Gid != 27 || st.Mode&07777 != 0700 {
+		t.Errorf("rules.d owner %d:%d mode %o, want 27:27 and 0700 as in the image", st.Uid, st.Gid, st.Mode&07777)
+	}
+	if err := syscall.Stat(filepath.Join(etcUpperDir(root), "app/sub"), &st); err != nil || st.Uid != 0 || st.Mode&07777 != 0755 {
+		t.Errorf("app/sub owner %d mode %o, want root and 0755", st.Uid, st.Mode&07777)
+	}
+}
+
+func TestApplyIgnitionConfig_DryRun(t *testing.T) {
+	root := t.TempDir()
+	cfg, err := ParseIgnitionConfig([]byte(strings.Replace(testIgnitionConfig, "MOTD", gzipBase64(t, "Welcome\n"), 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ApplyIgnitionConfig(root, cfg, true, reporter.NewTextReporter(&out)); err != nil {
+		t.Fatalf("ApplyIgnitionConfig() dry run error = %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Error("dry run should not write anything")
+	}
+	for _, want := range []string{
+		"[DRY RUN] Would provision user admin (wheel, app)",
+		"[DRY RUN] Would provision file /etc/app/app.conf",
+		"[DRY RUN] Would provision link /etc/app/current",
+		"[DRY RUN] Would provision unit app.service (enabled)",
+		"[DRY RUN] Would provision unit cups.service (masked)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dry run output should contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestParseIgnitionConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"version 2", `{"ignition": {"version": "2.3.0"}}`, "unsupported Ignition config version"},
+		{"disks", `{"ignition": {"version": "3.4.0"}, "storage": {"disks": []}}`, "unsupported Ignition config field \"disks\""},
+		{"kernel arguments", `{"ignition": {"version": "3.4.0"}, "kernelArguments": {}}`, "unsupported Ignition config field \"kernelArguments\""},
+		{"remote source", `{"ignition": {"version": "3.4.0"}, "storage": {"files": [{"path": "/etc/app.conf", "contents": {"source": "https://example.com/app.conf"}}]}}`, "only data URLs are supported"},
+		{"read-only path", `{"ignition": {"version": "3.4.0"}, "storage": {"files": [{"path": "/usr/bin/app"}]}}`, "outside /etc and /var"},
+		{"unclean path", `{"ignition": {"version": "3.4.0"}, "storage": {"directories": [{"path": "/etc/../usr/lib"}]}}`, "not a clean absolute path"},
+		{"hard link", `{"ignition": {"version": "3.4.0"}, "storage": {"links": [{"path": "/etc/app", "target": "/etc/hosts", "hard": true}]}}`, "hard links are not supported"},
+		{"bad compression", `{"ignition": {"version": "3.4.0"}, "storage": {"files": [{"path": "/etc/app", "contents": {"source": "data:,x", "compression": "xz"}}]}}`, "unsupported compression"},
+		{"disabled unit", `{"ignition": {"version": "3.4.0"}, "systemd": {"units": [{"name": "cups.service", "enabled": false}]}}`, "disabling units is not supported"},
+		{"bad unit name", `{"ignition": {"version": "3.4.0"}, "systemd": {"units": [{"name": "app"}]}}`, "invalid systemd unit name"},
+		{"WantedBy outside /etc", `{"ignition": {"version": "3.4.0"}, "systemd": {"units": [{"name": "app.service", "enabled": true, "contents": "[Install]\nWantedBy=../../x\n"}]}}`, "invalid unit name \"../../x\" in WantedBy="},
+		{"bad drop-in name", `{"ignition": {"version": "3.4.0"}, "systemd": {"units": [{"name": "app.service", "dropins": [{"name": "override"}]}]}}`, "invalid drop-in name"},
+		{"bad user", `{"ignition": {"version": "3.4.0"}, "passwd": {"users": [{"name": "Bad User"}]}}`, "invalid passwd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseIgnitionConfig([]byte(tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseIgnitionConfig() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/frostyard/nbc/pkg/types"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Image records
+//
+// Each root slot (or subvolume deployment) keeps the OCI manifest and config
+// blob of the image extracted to it, next to its file record:
+//
+//	/var/lib/nbc/state/deployments/<slot>/manifest.json - Manifest, with the layer digests
+//	/var/lib/nbc/state/deployments/<slot>/config.json   - Config blob: labels, history, created date, architecture
+//
+// nbc status reads them to describe the booted and the rollback slot without
+// network access.
+
+const (
+	imageManifestFile = "manifest.json"
+	imageConfigFile   = "config.json"
+)
+
+// imageVersionLabel is the image label holding the OS version
+const imageVersionLabel = "org.opencontainers.image.version"
+
+// imageRecordDir returns the directory holding the image record of a slot
+func imageRecordDir(slot string) string {
+	return filepath.Join(DeploymentsDir, slot)
+}
+
+// writeImageRecord saves the manifest and config blob of img to dir
+func writeImageRecord(dir string, img v1.Image) error {
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("failed to get image manifest: %w", err)
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to get image config: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create deployment state directory: %w", err)
+	}
+	if err := atomicWriteFile(filepath.Join(dir, imageManifestFile), manifest, 0644); err != nil {
+		return err
+	}
+	return atomicWriteFile(filepath.Join(dir, imageConfigFile), config, 0644)
+}
+
+// removeImageRecord removes the image record in dir, if any
+func removeImageRecord(dir string) error {
+	for _, name := range []string{imageManifestFile, imageConfigFile} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove image record: %w", err)
+		}
+	}
+	return nil
+}
+
+// readImageRecord reads the image record in dir written by writeImageRecord.
+// It returns an error matching fs.ErrNotExist when dir has no record.
+func readImageRecord(dir string) (*types.SlotImage, error) {
+	rawManifest, err := os.ReadFile(filepath.Join(dir, imageManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	rawConfig, err := os.ReadFile(filepath.Join(dir, imageConfigFile))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image manifest: %w", err)
+	}
+	config, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute manifest digest: %w", err)
+	}
+
+	image := &types.SlotImage{
+		Digest:       digest.String(),
+		Architecture: config.Architecture,
+		OS:           config.OS,
+		Version:      config.Config.Labels[imageVersionLabel],
+		Labels:       config.Config.Labels,
+	}
+	if image.Version == "" {
+		image.Version = config.OSVersion
+	}
+	if !config.Created.IsZero() {
+		image.Created = config.Created.UTC().Format(time.RFC3339)
+	}
+	for _, layer := range manifest.Layers {
+		image.Layers = append(image.Layers, layer.Digest.String())
+	}
+	return image, nil
+}
+
+// GetSlotImages describes the images recorded for the root slots, or for the
+// deployments of a subvolume installation (newest first). bootedSlot ("root1"
+// or "root2") is the root slot the running system was booted from; subvolume
+// deployments are matched against the kernel command line instead.
+func GetSlotImages(config *SystemConfig, bootedSlot string) []types.SlotImage {
+	var slots []string
+	if config.Subvolumes != nil {
+		for _, d := range config.Subvolumes.Deployments {
+			slots = append(slots, deploymentSlot(d.ID))
+		}
+		if booted, err := GetActiveDeployment(); err == nil {
+			bootedSlot = deploymentSlot(booted)
+		}
+	} else {
+		slots = []string{"root1", "root2"}
+	}
+
+	images := make([]types.SlotImage, 0, len(slots))
+	for _, slot := range slots {
+		image, err := readImageRecord(imageRecordDir(slot))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			image = &types.SlotImage{}
+		case err != nil:
+			image = &types.SlotImage{Error: err.Error()}
+		}
+		image.Slot = slot
+		image.Booted = slot == bootedSlot
+		images = append(images, *image)
+	}
+	return images
+}
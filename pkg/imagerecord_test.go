@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestImageRecord(t *testing.T) {
+	layer, err := random.Layer(64, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{imageVersionLabel: "42.20260301", "org.opencontainers.image.title": "Example OS"}
+	img, err = mutate.ConfigFile(img, &v1.ConfigFile{
+		Architecture: "arm64",
+		OS:           "linux",
+		Created:      v1.Time{Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)},
+		Config:       v1.Config{Labels: labels},
+		RootFS:       v1.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "root2")
+	if err := writeImageRecord(dir, img); err != nil {
+		t.Fatalf("writeImageRecord() error = %v", err)
+	}
+	image, err := readImageRecord(dir)
+	if err != nil {
+		t.Fatalf("readImageRecord() error = %v", err)
+	}
+
+	digest, _ := img.Digest()
+	layerDigest, _ := layer.Digest()
+	if image.Digest != digest.String() {
+		t.Errorf("Digest = %s, want %s", image.Digest, digest)
+	}
+	if !reflect.DeepEqual(image.Layers, []string{layerDigest.String()}) {
+		t.Errorf("Layers = %v, want [%s]", image.Layers, layerDigest)
+	}
+	if image.Version != "42.20260301" || image.Created != "2026-03-01T12:00:00Z" || image.Architecture != "arm64" || image.OS != "linux" {
+		t.Errorf("record = %+v, want version, build date and platform of the image", image)
+	}
+	if !reflect.DeepEqual(image.Labels, labels) {
+		t.Errorf("Labels = %v, want %v", image.Labels, labels)
+	}
+
+	if err := removeImageRecord(dir); err != nil {
+		t.Fatalf("removeImageRecord() error = %v", err)
+	}
+	if _, err := readImageRecord(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readImageRecord() after removal error = %v, want fs.ErrNotExist", err)
+	}
+	if err := removeImageRecord(dir); err != nil {
+		t.Errorf("removeImageRecord() without a record error = %v", err)
+	}
+}
+
+func TestExtract_RecordsImage(t *testing.T) {
+	layout := writeTestLayout(t, buildTar(t, []tarEntry{
+		{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "v1"},
+	}))
+	img, err := LoadImageFromOCILayout(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testExtractor(layout, t.TempDir())
+	c.RecordDir = filepath.Join(t.TempDir(), "root1")
+	if err := c.Extract(t.Context()); err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	image, err := readImageRecord(c.RecordDir)
+	if err != nil {
+		t.Fatalf("image not recorded: %v", err)
+	}
+	digest, _ := img.Digest()
+	if image.Digest != digest.String() || len(image.Layers) != 1 {
+		t.Errorf("record = %+v, want digest %s with 1 layer", image, digest)
+	}
+}
@@ -30,25 +30,32 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/frostyard/std/reporter"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 // InstallConfig holds all configuration options for an installation.
 // Either ImageRef or LocalImage must be provided.
-// Either Device or Loopback must be provided, but not both.
+// Exactly one of Device, DeviceSelector or Loopback must be provided.
 type InstallConfig struct {
 	// ImageRef is the container image reference (e.g., "quay.io/example/myimage:latest").
 	// Required unless LocalImage is provided.
 	ImageRef string
 
 	// Device is the target disk device (e.g., "/dev/sda").
-	// Required unless Loopback is provided.
+	// Required unless DeviceSelector or Loopback is provided.
 	Device string
 
+	// DeviceSelector picks the target disk by its properties, such as
+	// "model~=Samsung,minsize=64G" (see DiskSelector).
+	// Optional; mutually exclusive with Device and Loopback.
+	DeviceSelector string
+
 	// FilesystemType is the filesystem for root and var partitions.
 	// Supported: "ext4", "btrfs". Default: "btrfs".
 	FilesystemType string
@@ -60,6 +67,31 @@ type InstallConfig struct {
 	// Default: "/tmp/nbc-install".
 	MountPoint string
 
+	// Layout sets the boot, root slot and var partition sizes.
+	// Default: DefaultPartitionLayout() (2GB boot, 12GB root slots, var takes the rest).
+	Layout *PartitionLayout
+
+	// Discoverable tags the root and var partitions with Discoverable
+	// Partitions Specification types so systemd-gpt-auto-generator can mount
+	// them, shortening the kernel command line. Not supported with Encryption.
+	Discoverable bool
+
+	// UKI boots systemd-boot from a unified kernel image built with ukify
+	// (from the image's prebuilt UKI when it ships one) with the A/B kernel
+	// command line embedded. Requires an image using systemd-boot.
+	UKI bool
+
+	// Subvolumes installs to a single btrfs root partition holding a
+	// subvolume per deployment instead of the root1 and root2 slots. Updates
+	// snapshot the running deployment and apply the new image to the
+	// snapshot. Requires btrfs; not supported with Encryption, Discoverable
+	// or UKI.
+	Subvolumes bool
+
+	// KeepDeployments is how many deployments updates keep with Subvolumes.
+	// Default: DefaultKeepDeployments. Minimum: MinKeepDeployments.
+	KeepDeployments int
+
 	// Encryption configures LUKS full disk encryption.
 	// Optional; if nil, no encryption is used.
 	Encryption *EncryptionOptions
@@ -69,13 +101,30 @@ type InstallConfig struct {
 	LocalImage *LocalImageSource
 
 	// Loopback configures installation to a loopback image file.
-	// Optional; mutually exclusive with Device.
+	// Optional; mutually exclusive with Device and DeviceSelector.
 	Loopback *LoopbackOptions
 
-	// RootPassword sets the root password during installation.
+	// RootPassword sets the root password during installation. It is
+	// hashed and written to the /etc overlay like Provision.
 	// Optional; if empty, no password is set.
 	RootPassword string
 
+	// Provision sets the hostname, locale, timezone, root's password hash
+	// and SSH keys, and creates groups and users, in the /etc overlay so
+	// they survive updates.
+	// Optional; if nil, the image's identity is kept.
+	Provision *ProvisionOptions
+
+	// CloudInit is a cloud-init NoCloud seed placed on /var, for cloud-init
+	// in the image to apply on first boot.
+	// Optional; mutually exclusive with Ignition.
+	CloudInit *CloudInitSeed
+
+	// Ignition is an Ignition config applied at install time: its users,
+	// groups and systemd units, and its files below /etc and /var.
+	// Optional; mutually exclusive with CloudInit.
+	Ignition *IgnitionConfig
+
 	// Verbose enables verbose output.
 	Verbose bool
 
@@ -94,6 +143,35 @@ type InstallConfig struct {
 	// CosignKeyPath overrides the trusted cosign public key used for
 	// verification. Empty means use the key embedded in the binary.
 	CosignKeyPath string
+
+	// Flatten writes every path of the image once, instead of once per layer
+	// providing it, reading the layers concurrently.
+	Flatten bool
+
+	// Platform selects the image platform pulled from multi-platform images
+	// and the architecture the bootloader is installed for, to install for
+	// another machine. It is recorded so updates pull the same platform.
+	// Default: the platform of this machine.
+	Platform *v1.Platform
+
+	// BootMode is the firmware interface the installation boots with. Legacy
+	// BIOS boot adds a BIOS boot partition and installs GRUB2 to the disk's
+	// MBR; it requires an amd64 image using GRUB2 and is not supported with
+	// UKI. Default: the running system's (BIOS when /sys/firmware/efi is
+	// missing), UEFI when installing for another architecture.
+	BootMode BootMode
+
+	// SELinuxRelabel labels the installed files with the file contexts of
+	// the image's SELinux policy, and is recorded so updates do the same.
+	// Requires setfiles on the host.
+	SELinuxRelabel bool
+
+	// Composefs stores the root slots as fs-verity protected object stores
+	// and boots a composefs image of each slot, mounted by the digest on the
+	// kernel command line, so tampering with a slot is detected. Requires
+	// mkcomposefs on the host and composefs in the image; not supported with
+	// Subvolumes.
+	Composefs bool
 }
 
 // EncryptionOptions configures LUKS encryption for the installation.
@@ -102,8 +180,20 @@ type EncryptionOptions struct {
 	// Required for encryption.
 	Passphrase string
 
-	// TPM2 enables automatic unlock via TPM2 (no PCR binding).
+	// TPM2 enables automatic unlock via TPM2 (no PCR binding unless
+	// TPM2PCRs or TPM2PCRSigningKey is set).
 	TPM2 bool
+
+	// TPM2PCRs seals the TPM2 key to the current values of these PCRs
+	// (e.g. 7 for the Secure Boot state). Only PCRs that updates don't
+	// change are accepted, see ParseTPM2PCRs. Requires TPM2.
+	TPM2PCRs []int
+
+	// TPM2PCRSigningKey is a PEM private key whose signed PCR 11 policy the
+	// TPM2 key is bound to. Every UKI nbc builds is signed with it, so
+	// updates keep unlocking; the key is copied to the installed system for
+	// them. Requires TPM2 and UKI.
+	TPM2PCRSigningKey string
 }
 
 // LocalImageSource specifies a pre-staged local image.
@@ -167,56 +257,181 @@ type Installer struct {
 	progress  reporter.Reporter
 }
 
-// Validate checks the InstallConfig for errors.
+// Validate checks the InstallConfig for errors. Errors are FieldErrors
+// naming the install spec field at fault.
 func (c *InstallConfig) Validate() error {
 	// Check required fields
 	if c.ImageRef == "" && c.LocalImage == nil {
-		return errors.New("either ImageRef or LocalImage is required")
+		return &FieldError{Field: "image", Err: errors.New("either ImageRef or LocalImage is required")}
 	}
-	if c.Device == "" && c.Loopback == nil {
-		return errors.New("either Device or Loopback is required")
+	if c.Device == "" && c.DeviceSelector == "" && c.Loopback == nil {
+		return &FieldError{Field: "device", Err: errors.New("either Device, DeviceSelector or Loopback is required")}
 	}
 
 	// Check mutual exclusivity
 	if c.ImageRef != "" && c.LocalImage != nil {
-		return errors.New("imageRef and localImage are mutually exclusive")
+		return &FieldError{Field: "local_image", Err: errors.New("imageRef and localImage are mutually exclusive")}
 	}
 	if c.Device != "" && c.Loopback != nil {
-		return errors.New("device and loopback are mutually exclusive")
+		return &FieldError{Field: "loopback", Err: errors.New("device and loopback are mutually exclusive")}
+	}
+	if c.DeviceSelector != "" {
+		if c.Device != "" || c.Loopback != nil {
+			return &FieldError{Field: "device_selector", Err: errors.New("device selector is mutually exclusive with device and loopback")}
+		}
+		if _, err := ParseDiskSelector(c.DeviceSelector); err != nil {
+			return &FieldError{Field: "device_selector", Err: err}
+		}
 	}
 
 	// Validate filesystem type
 	if c.FilesystemType != "" && c.FilesystemType != "ext4" && c.FilesystemType != "btrfs" {
-		return fmt.Errorf("unsupported filesystem type: %s (supported: ext4, btrfs)", c.FilesystemType)
+		return &FieldError{Field: "filesystem", Err: fmt.Errorf("unsupported filesystem type: %s (supported: ext4, btrfs)", c.FilesystemType)}
+	}
+
+	// Validate the platform of a staged image
+	if c.Platform != nil && c.LocalImage != nil && c.LocalImage.Metadata != nil && c.LocalImage.Metadata.Platform != "" {
+		staged, err := ParsePlatform(c.LocalImage.Metadata.Platform)
+		if err != nil {
+			return &FieldError{Field: "local_image", Err: fmt.Errorf("invalid platform of local image: %w", err)}
+		}
+		if !platformMatches(*c.Platform, *staged) {
+			return &FieldError{Field: "platform", Err: fmt.Errorf("local image was downloaded for %s, not %s", staged.String(), c.Platform.String())}
+		}
+	}
+
+	// Validate partition layout
+	if c.Layout != nil {
+		if err := c.Layout.Validate(); err != nil {
+			return &FieldError{Field: "layout", Err: fmt.Errorf("invalid partition layout: %w", err)}
+		}
+	}
+
+	// Validate boot mode
+	switch c.BootMode {
+	case "", BootModeUEFI:
+	case BootModeBIOS:
+		if arch := targetPlatform(c.Platform).Architecture; arch != "amd64" {
+			return &FieldError{Field: "boot_mode", Err: fmt.Errorf("BIOS boot is not supported on architecture %s", arch)}
+		}
+		if c.UKI {
+			return &FieldError{Field: "uki", Err: errors.New("unified kernel images are not supported with BIOS boot")}
+		}
+	default:
+		return &FieldError{Field: "boot_mode", Err: fmt.Errorf("unsupported boot mode: %s (supported: uefi, bios)", c.BootMode)}
+	}
+
+	// Validate discoverable partitions
+	if c.Discoverable {
+		if c.Encryption != nil {
+			return &FieldError{Field: "discoverable", Err: errors.New("discoverable partitions are not supported with encryption")}
+		}
+		if _, err := dpsRootTypeGUID(targetPlatform(c.Platform).Architecture); err != nil {
+			return &FieldError{Field: "discoverable", Err: err}
+		}
+	}
+
+	// Validate subvolume deployments
+	if c.Subvolumes {
+		if c.FilesystemType != "" && c.FilesystemType != "btrfs" {
+			return &FieldError{Field: "root_subvolumes", Err: errors.New("subvolume deployments require the btrfs filesystem")}
+		}
+		if c.Encryption != nil {
+			return &FieldError{Field: "root_subvolumes", Err: errors.New("subvolume deployments are not supported with encryption")}
+		}
+		if c.Discoverable {
+			return &FieldError{Field: "root_subvolumes", Err: errors.New("subvolume deployments are not supported with discoverable partitions")}
+		}
+		if c.UKI {
+			return &FieldError{Field: "root_subvolumes", Err: errors.New("subvolume deployments are not supported with unified kernel images")}
+		}
+		if c.Composefs {
+			return &FieldError{Field: "root_subvolumes", Err: errors.New("subvolume deployments are not supported with composefs")}
+		}
+	}
+	if c.KeepDeployments != 0 {
+		if !c.Subvolumes {
+			return &FieldError{Field: "keep_deployments", Err: errors.New("keeping deployments requires subvolume deployments")}
+		}
+		if c.KeepDeployments < MinKeepDeployments {
+			return &FieldError{Field: "keep_deployments", Err: fmt.Errorf("at least %d deployments must be kept", MinKeepDeployments)}
+		}
 	}
 
 	// Validate encryption options
 	if c.Encryption != nil {
 		if c.Encryption.Passphrase == "" {
-			return errors.New("encryption passphrase is required when encryption is enabled")
+			return &FieldError{Field: "encryption.passphrase", Err: errors.New("encryption passphrase is required when encryption is enabled")}
+		}
+		if (len(c.Encryption.TPM2PCRs) > 0 || c.Encryption.TPM2PCRSigningKey != "") && !c.Encryption.TPM2 {
+			return &FieldError{Field: "encryption.tpm2", Err: errors.New("TPM2 PCR policies require TPM2 enrollment")}
+		}
+		if _, err := ParseTPM2PCRs(formatPCRs(c.Encryption.TPM2PCRs)); err != nil {
+			return &FieldError{Field: "encryption.tpm2_pcrs", Err: fmt.Errorf("invalid TPM2 PCRs: %w", err)}
+		}
+		if c.Encryption.TPM2PCRSigningKey != "" {
+			if !c.UKI {
+				return &FieldError{Field: "encryption.tpm2_pcr_signing_key", Err: errors.New("signed PCR policies require unified kernel images")}
+			}
+			if _, err := pcrPublicKeyPEM(c.Encryption.TPM2PCRSigningKey); err != nil {
+				return &FieldError{Field: "encryption.tpm2_pcr_signing_key", Err: err}
+			}
 		}
 	}
 
 	// Validate loopback options
 	if c.Loopback != nil {
 		if c.Loopback.ImagePath == "" {
-			return errors.New("loopback ImagePath is required")
+			return &FieldError{Field: "loopback.path", Err: errors.New("loopback ImagePath is required")}
 		}
 		if c.Loopback.SizeGB != 0 && c.Loopback.SizeGB < MinLoopbackSizeGB {
-			return fmt.Errorf("loopback size must be at least %dGB", MinLoopbackSizeGB)
+			return &FieldError{Field: "loopback.size_gb", Err: fmt.Errorf("loopback size must be at least %dGB", MinLoopbackSizeGB)}
 		}
 	}
 
 	// Validate local image
 	if c.LocalImage != nil {
 		if c.LocalImage.LayoutPath == "" {
-			return errors.New("LocalImage.LayoutPath is required")
+			return &FieldError{Field: "local_image", Err: errors.New("LocalImage.LayoutPath is required")}
+		}
+	}
+
+	// Validate provisioning
+	if c.Provision != nil {
+		if c.Provision.RootPasswordHash != "" && c.RootPassword != "" {
+			return &FieldError{Field: "root_password_hash", Err: errors.New("a root password and a root password hash are mutually exclusive")}
+		}
+		if err := c.Provision.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate user-data
+	if c.CloudInit != nil {
+		if c.Ignition != nil {
+			return &FieldError{Field: "ignition", Err: errors.New("cloud-init user-data and an Ignition config are mutually exclusive")}
+		}
+		if err := c.CloudInit.Validate(); err != nil {
+			return &FieldError{Field: "cloud_init.user_data", Err: err}
+		}
+	}
+	if c.Ignition != nil {
+		if err := c.Ignition.Validate(); err != nil {
+			return &FieldError{Field: "ignition", Err: err}
 		}
 	}
 
 	return nil
 }
 
+// keepDeployments returns how many deployments updates keep with Subvolumes
+func (c *InstallConfig) keepDeployments() int {
+	if c.KeepDeployments == 0 {
+		return DefaultKeepDeployments
+	}
+	return c.KeepDeployments
+}
+
 // NewInstaller creates a new Installer with the given configuration.
 // Returns an error if the configuration is invalid.
 func NewInstaller(cfg *InstallConfig) (*Installer, error) {
@@ -231,6 +446,17 @@ func NewInstaller(cfg *InstallConfig) (*Installer, error) {
 	if cfg.MountPoint == "" {
 		cfg.MountPoint = "/tmp/nbc-install"
 	}
+	if cfg.Layout == nil {
+		cfg.Layout = DefaultPartitionLayout()
+		if cfg.Subvolumes {
+			cfg.Layout.RootSizeMiB = DefaultSubvolumeRootSizeMiB
+		}
+	}
+	if cfg.BootMode == "" {
+		cfg.BootMode = defaultBootMode(targetPlatform(cfg.Platform).Architecture)
+	}
+	cfg.Layout.Subvolumes = cfg.Subvolumes
+	cfg.Layout.BIOSBoot = cfg.BootMode == BootModeBIOS
 	if cfg.Loopback != nil && cfg.Loopback.SizeGB == 0 {
 		cfg.Loopback.SizeGB = DefaultLoopbackSizeGB
 	}
@@ -256,10 +482,10 @@ func NewInstaller(cfg *InstallConfig) (*Installer, error) {
 // Install performs the bootc installation.
 // The context can be used to cancel the operation.
 // Returns a result with cleanup function even on error/cancellation if resources were allocated.
-func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
+func (i *Installer) Install(ctx context.Context) (result *InstallResult, err error) {
 	i.startTime = time.Now()
 
-	result := &InstallResult{
+	result = &InstallResult{
 		ImageRef:       i.config.ImageRef,
 		FilesystemType: i.config.FilesystemType,
 	}
@@ -315,11 +541,22 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 			i.progress.Error(err, "Prerequisites check failed")
 			return result, err
 		}
+		if err := checkBootSupport(targetPlatform(i.config.Platform).Architecture, i.config.BootMode); err != nil {
+			i.progress.Error(err, "Prerequisites check failed")
+			return result, err
+		}
+		if i.config.Composefs {
+			if _, err := exec.LookPath("mkcomposefs"); err != nil {
+				err = fmt.Errorf("composefs requires mkcomposefs - install the composefs package")
+				i.progress.Error(err, "Prerequisites check failed")
+				return result, err
+			}
+		}
 	}
 
 	// Validate disk
 	i.progress.Message("Validating disk %s...", device)
-	minSize := uint64(10 * 1024 * 1024 * 1024) // 10 GB minimum
+	minSize := i.config.Layout.MinDiskSize()
 	if err := ValidateDisk(device, minSize); err != nil {
 		i.progress.Error(err, "Disk validation failed")
 		return result, err
@@ -364,6 +601,37 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 		if len(i.config.KernelArgs) > 0 {
 			i.progress.MessagePlain("[DRY RUN] With kernel arguments: %s", strings.Join(i.config.KernelArgs, " "))
 		}
+		if i.config.BootMode == BootModeBIOS {
+			i.progress.MessagePlain("[DRY RUN] With legacy BIOS boot (GRUB2 %s and a BIOS boot partition)", grubBIOSTarget)
+		}
+		if i.config.Discoverable {
+			i.progress.MessagePlain("[DRY RUN] With discoverable partition types")
+		}
+		if i.config.UKI {
+			i.progress.MessagePlain("[DRY RUN] With a unified kernel image")
+		}
+		if i.config.Composefs {
+			i.progress.MessagePlain("[DRY RUN] With a fs-verity protected composefs root image")
+		}
+		if i.config.Subvolumes {
+			i.progress.MessagePlain("[DRY RUN] With btrfs subvolume deployments (keeping %d)", i.config.keepDeployments())
+		}
+		if enc := i.config.Encryption; enc != nil && enc.TPM2 {
+			i.progress.MessagePlain("[DRY RUN] With a TPM2 key bound to %s", i.config.tpm2Policy())
+		}
+		provision, err := i.config.provisionOptions()
+		if err != nil {
+			return result, err
+		}
+		if err := ProvisionTarget(i.config.MountPoint, provision, true, i.progress); err != nil {
+			return result, err
+		}
+		if err := WriteCloudInitSeed(i.config.MountPoint, i.config.CloudInit, true, i.progress); err != nil {
+			return result, err
+		}
+		if err := ApplyIgnitionConfig(i.config.MountPoint, i.config.Ignition, true, i.progress); err != nil {
+			return result, err
+		}
 		i.progress.Message("Installation complete! You can now boot from this disk.")
 		return result, nil
 	}
@@ -372,10 +640,11 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 	i.progress.Message("Image: %s", result.ImageRef)
 	i.progress.Message("Device: %s", device)
 	i.progress.Message("Filesystem: %s", i.config.FilesystemType)
+	i.progress.Message("Boot mode: %s", i.config.BootMode)
 
 	// Step 1: Create partitions
 	i.progress.Step(1, 6, "Creating partitions")
-	scheme, err = CreatePartitions(ctx, device, i.config.DryRun, i.progress)
+	scheme, err = CreatePartitions(ctx, device, i.config.Layout, i.config.DryRun, i.progress)
 	if err != nil {
 		err = fmt.Errorf("failed to create partitions: %w", err)
 		i.progress.Error(err, "Partitioning failed")
@@ -385,6 +654,23 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 	// Set filesystem type on partition scheme
 	scheme.FilesystemType = i.config.FilesystemType
 
+	// Tag partitions for systemd-gpt-auto-generator before they are formatted,
+	// since this rewrites the var PARTUUID
+	var discoverable *DiscoverableConfig
+	if i.config.Discoverable {
+		machineID, err := newMachineID()
+		if err != nil {
+			i.progress.Error(err, "Partitioning failed")
+			return result, err
+		}
+		if err := TagDiscoverablePartitions(ctx, device, scheme, targetPlatform(i.config.Platform).Architecture, machineID, i.config.DryRun, i.progress); err != nil {
+			err = fmt.Errorf("failed to tag discoverable partitions: %w", err)
+			i.progress.Error(err, "Partitioning failed")
+			return result, err
+		}
+		discoverable = &DiscoverableConfig{MachineID: machineID}
+	}
+
 	// Setup LUKS encryption if enabled
 	if i.config.Encryption != nil {
 		i.progress.Message("Setting up LUKS encryption...")
@@ -406,11 +692,24 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 
 	// Step 2: Format partitions
 	i.progress.Step(2, 6, "Formatting partitions")
+	scheme.Verity = i.config.Composefs
 	if err := FormatPartitions(ctx, scheme, i.config.DryRun, i.progress); err != nil {
 		err = fmt.Errorf("failed to format partitions: %w", err)
 		i.progress.Error(err, "Formatting failed")
 		return result, err
 	}
+	if i.config.Subvolumes {
+		if err := CreateDeploymentSubvolume(ctx, scheme, i.config.DryRun, i.progress); err != nil {
+			i.progress.Error(err, "Formatting failed")
+			return result, err
+		}
+	}
+	if scheme.FilesystemType == "btrfs" {
+		if err := CreateVarSubvolume(ctx, scheme, i.config.DryRun, i.progress); err != nil {
+			i.progress.Error(err, "Formatting failed")
+			return result, err
+		}
+	}
 
 	// Step 3: Mount partitions
 	i.progress.Step(3, 6, "Mounting partitions")
@@ -433,13 +732,23 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 		_ = os.RemoveAll(i.config.MountPoint)
 	}()
 
+	// Record the outcome in the deployment history on the new /var. Defers run
+	// LIFO, so this runs before the partitions are unmounted above.
+	defer func() { i.recordDeployment(result, scheme, err) }()
+
 	// Step 4: Extract container filesystem
 	i.progress.Step(4, 6, "Extracting container filesystem")
 	localLayoutPath := ""
 	if i.config.LocalImage != nil {
 		localLayoutPath = i.config.LocalImage.LayoutPath
 	}
-	if err := ExtractAndVerifyContainer(ctx, i.config.ImageRef, localLayoutPath, i.config.MountPoint, i.config.Verbose, i.config.SkipVerify, i.config.CosignKeyPath, i.progress); err != nil {
+	if i.config.Subvolumes {
+		err = i.extractDeployment(ctx, localLayoutPath)
+	} else {
+		recordDir := filepath.Join(i.config.MountPoint, imageRecordDir("root1"))
+		err = ExtractAndVerifyContainer(ctx, i.config.ImageRef, localLayoutPath, i.config.MountPoint, i.config.Verbose, i.config.SkipVerify, i.config.CosignKeyPath, i.config.Flatten, i.config.Platform, recordDir, i.progress)
+	}
+	if err != nil {
 		i.progress.Error(err, "Container extraction failed")
 		return result, err
 	}
@@ -500,11 +809,48 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 		return result, err
 	}
 
-	// Set root password if provided
-	if i.config.RootPassword != "" {
-		if err := SetRootPasswordInTarget(ctx, i.config.MountPoint, i.config.RootPassword, i.config.DryRun, i.progress); err != nil {
-			err = fmt.Errorf("failed to set root password: %w", err)
-			i.progress.Error(err, "Root password setup failed")
+	// Provision the hostname, locale, timezone, root credentials and users
+	// into the /etc overlay
+	provision, err := i.config.provisionOptions()
+	if err != nil {
+		i.progress.Error(err, "Root password setup failed")
+		return result, err
+	}
+	if err := ProvisionTarget(i.config.MountPoint, provision, i.config.DryRun, i.progress); err != nil {
+		err = fmt.Errorf("failed to provision system: %w", err)
+		i.progress.Error(err, "Provisioning failed")
+		return result, err
+	}
+
+	// Apply user-data: a cloud-init seed for first boot, or an Ignition
+	// config right away
+	if err := WriteCloudInitSeed(i.config.MountPoint, i.config.CloudInit, i.config.DryRun, i.progress); err != nil {
+		err = fmt.Errorf("failed to write cloud-init seed: %w", err)
+		i.progress.Error(err, "cloud-init seed failed")
+		return result, err
+	}
+	if err := ApplyIgnitionConfig(i.config.MountPoint, i.config.Ignition, i.config.DryRun, i.progress); err != nil {
+		err = fmt.Errorf("failed to apply Ignition config: %w", err)
+		i.progress.Error(err, "Ignition config failed")
+		return result, err
+	}
+
+	// Label the files last, once nothing else writes to the root
+	if i.config.SELinuxRelabel {
+		if err := RelabelSELinux(ctx, i.config.MountPoint, i.config.DryRun, i.progress); err != nil {
+			err = fmt.Errorf("failed to relabel SELinux contexts: %w", err)
+			i.progress.Error(err, "SELinux relabel failed")
+			return result, err
+		}
+	}
+
+	// Build the composefs image once the root is complete
+	var composefsDigest string
+	if i.config.Composefs {
+		composefsDigest, err = SetupComposefs(ctx, i.config.MountPoint, i.config.DryRun, i.config.Verbose, i.progress)
+		if err != nil {
+			err = fmt.Errorf("failed to set up composefs: %w", err)
+			i.progress.Error(err, "Composefs setup failed")
 			return result, err
 		}
 	}
@@ -532,6 +878,39 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 		KernelArgs:     i.config.KernelArgs,
 		BootloaderType: string(DetectBootloader(i.config.MountPoint)),
 		FilesystemType: i.config.FilesystemType,
+		Layout:         i.config.Layout,
+		Discoverable:   discoverable,
+		UKI:            i.config.UKI,
+		SELinuxRelabel: i.config.SELinuxRelabel,
+		Platform:       targetPlatform(i.config.Platform).String(),
+		BootMode:       string(i.config.BootMode),
+	}
+	if i.config.Composefs {
+		sysConfig.Composefs = &ComposefsConfig{}
+		sysConfig.Composefs.setDigest("root1", composefsDigest)
+	}
+
+	if i.config.Subvolumes {
+		first := SubvolumeDeployment{
+			ID:          1,
+			ImageRef:    result.ImageRef,
+			ImageDigest: result.ImageDigest,
+			Created:     time.Now().UTC().Format(time.RFC3339),
+		}
+		if kernelVersion, err := getKernelVersionFromRoot(i.config.MountPoint); err == nil {
+			first.KernelVersion = kernelVersion
+		}
+		sysConfig.Subvolumes = &SubvolumeConfig{
+			Keep:        i.config.keepDeployments(),
+			Deployments: []SubvolumeDeployment{first},
+		}
+	}
+
+	// Record PARTUUIDs so updates find the partitions regardless of device naming
+	if uuids, err := GetPartitionUUIDs(device, scheme); err == nil {
+		sysConfig.PartitionUUIDs = uuids
+	} else {
+		i.progress.Warning("could not record partition UUIDs: %v", err)
 	}
 
 	// Get stable disk ID
@@ -545,10 +924,17 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 	}
 
 	// Store encryption config if enabled
+	var tpm2Policy *TPM2Policy
 	if i.config.Encryption != nil && len(scheme.LUKSDevices) > 0 {
+		tpm2Policy, err = i.setupTPM2Policy(filepath.Join(i.config.MountPoint, "var"))
+		if err != nil {
+			i.progress.Error(err, "TPM2 policy setup failed")
+			return result, err
+		}
 		sysConfig.Encryption = &EncryptionConfig{
-			Enabled: true,
-			TPM2:    i.config.Encryption.TPM2,
+			Enabled:    true,
+			TPM2:       i.config.Encryption.TPM2,
+			TPM2Policy: tpm2Policy,
 		}
 		for _, dev := range scheme.LUKSDevices {
 			switch dev.MapperName {
@@ -582,6 +968,8 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 	bootloader := NewBootloaderInstaller(i.config.MountPoint, device, scheme, osName)
 	bootloader.SetVerbose(i.config.Verbose)
 	bootloader.SetProgress(i.progress)
+	bootloader.Arch = targetPlatform(i.config.Platform).Architecture
+	bootloader.SetBootMode(i.config.BootMode)
 
 	// Set encryption config if enabled
 	if i.config.Encryption != nil {
@@ -589,10 +977,15 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 			Enabled:    true,
 			Passphrase: i.config.Encryption.Passphrase,
 			TPM2:       i.config.Encryption.TPM2,
+			TPM2Policy: tpm2Policy.withKeysUnder(i.config.MountPoint),
 		}
 		bootloader.SetEncryption(luksConfig)
 	}
 
+	bootloader.SetDiscoverable(discoverable)
+	bootloader.SetUKI(i.config.UKI)
+	bootloader.SetComposefsDigest(composefsDigest)
+
 	// Add kernel arguments
 	for _, arg := range i.config.KernelArgs {
 		bootloader.AddKernelArg(arg)
@@ -603,6 +996,12 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 	bootloader.SetType(bootloaderType)
 	result.BootloaderType = bootloaderType
 
+	if i.config.UKI && bootloaderType != BootloaderSystemdBoot {
+		err = fmt.Errorf("unified kernel images require systemd-boot, but the image uses %s", bootloaderType)
+		i.progress.Error(err, "Bootloader installation failed")
+		return result, err
+	}
+
 	if err := bootloader.Install(ctx); err != nil {
 		err = fmt.Errorf("failed to install bootloader: %w", err)
 		i.progress.Error(err, "Bootloader installation failed")
@@ -615,6 +1014,7 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 			Enabled:    true,
 			Passphrase: i.config.Encryption.Passphrase,
 			TPM2:       true,
+			TPM2Policy: tpm2Policy.withKeysUnder(i.config.MountPoint),
 		}
 		i.progress.Message("Enrolling TPM2 for automatic unlock (%d LUKS devices)...", len(scheme.LUKSDevices))
 		for idx, luksDevice := range scheme.LUKSDevices {
@@ -639,6 +1039,73 @@ func (i *Installer) Install(ctx context.Context) (*InstallResult, error) {
 	return result, nil
 }
 
+// recordDeployment appends the outcome of an installation to the deployment
+// history on the target's /var partition. A failure to record is reported but
+// never fails the installation itself.
+func (i *Installer) recordDeployment(result *InstallResult, scheme *PartitionScheme, err error) {
+	record := newDeploymentRecord(DeploymentInstall, i.startTime, err)
+	record.ImageRef = result.ImageRef
+	record.ImageDigest = result.ImageDigest
+	record.TargetSlot = "root1"
+	if i.config.Subvolumes {
+		record.TargetSlot = deploymentSlot(1)
+	}
+	record.TargetPartition = scheme.Root1Partition
+	if kernelVersion, kerr := getKernelVersionFromRoot(i.config.MountPoint); kerr == nil {
+		record.KernelVersion = kernelVersion
+	}
+
+	historyPath := historyFileInVar(filepath.Join(i.config.MountPoint, "var"))
+	if err := appendDeploymentRecord(historyPath, record); err != nil {
+		i.progress.Warning("failed to record deployment history: %v", err)
+	}
+}
+
+// tpm2Policy returns the TPM2 policy requested by the encryption options, with
+// the signing key at its user-supplied path, or nil without PCR binding. Its
+// public key is only known once the signing key is installed.
+func (c *InstallConfig) tpm2Policy() *TPM2Policy {
+	enc := c.Encryption
+	if enc == nil || !enc.TPM2 || (len(enc.TPM2PCRs) == 0 && enc.TPM2PCRSigningKey == "") {
+		return nil
+	}
+	return &TPM2Policy{PCRs: enc.TPM2PCRs, PrivateKey: enc.TPM2PCRSigningKey}
+}
+
+// setupTPM2Policy returns the TPM2 policy to record in the system config. A PCR
+// signing key is installed on the var partition mounted at varMountPoint first,
+// so updates can sign the UKIs they build.
+func (i *Installer) setupTPM2Policy(varMountPoint string) (*TPM2Policy, error) {
+	policy := i.config.tpm2Policy()
+	if policy == nil || policy.PrivateKey == "" {
+		return policy, nil
+	}
+	installed, err := installPCRSigningKey(varMountPoint, i.config.Encryption.TPM2PCRSigningKey, policy.PCRs)
+	if err != nil {
+		return nil, err
+	}
+	i.progress.Message("Installed PCR signing key to %s", installed.PrivateKey)
+	return installed, nil
+}
+
+// provisionOptions returns the ProvisionOptions of the installation, with
+// RootPassword hashed into it
+func (c *InstallConfig) provisionOptions() (*ProvisionOptions, error) {
+	if c.RootPassword == "" {
+		return c.Provision, nil
+	}
+	hash, err := HashPassword(c.RootPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash root password: %w", err)
+	}
+	var opts ProvisionOptions
+	if c.Provision != nil {
+		opts = *c.Provision
+	}
+	opts.RootPasswordHash = hash
+	return &opts, nil
+}
+
 // setupDevice handles loopback setup or device path resolution.
 func (i *Installer) setupDevice(ctx context.Context) (string, error) {
 	if i.config.Loopback != nil {
@@ -660,6 +1127,21 @@ func (i *Installer) setupDevice(ctx context.Context) (string, error) {
 		return loopback.Device, nil
 	}
 
+	if i.config.DeviceSelector != "" {
+		disk, err := ResolveDiskSelector(i.config.DeviceSelector)
+		if err != nil {
+			err = fmt.Errorf("failed to select device: %w", err)
+			i.progress.Error(err, "Device selection failed")
+			return "", err
+		}
+		if i.config.DryRun {
+			i.progress.MessagePlain("[DRY RUN] Device selector %q picked %s", i.config.DeviceSelector, disk.Describe())
+		} else {
+			i.progress.Message("Device selector %q picked %s", i.config.DeviceSelector, disk.Describe())
+		}
+		return disk.Device, nil
+	}
+
 	// Resolve device path
 	device, err := GetDiskByPath(i.config.Device)
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 
 	"github.com/frostyard/nbc/pkg/testutil"
 	"github.com/frostyard/std/reporter"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 func TestInstallConfig_Validate(t *testing.T) {
@@ -76,7 +77,7 @@ func TestInstallConfig_Validate(t *testing.T) {
 		{
 			name:    "missing device and loopback",
 			config:  InstallConfig{ImageRef: "quay.io/example/image:latest"},
-			wantErr: "either Device or Loopback is required",
+			wantErr: "either Device, DeviceSelector or Loopback is required",
 		},
 		{
 			name: "image and local image both set",
@@ -96,6 +97,23 @@ func TestInstallConfig_Validate(t *testing.T) {
 			},
 			wantErr: "device and loopback are mutually exclusive",
 		},
+		{
+			name: "device and device selector both set",
+			config: InstallConfig{
+				ImageRef:       "quay.io/example/image:latest",
+				Device:         "/dev/sda",
+				DeviceSelector: "transport=nvme",
+			},
+			wantErr: "device selector is mutually exclusive with device and loopback",
+		},
+		{
+			name: "invalid device selector",
+			config: InstallConfig{
+				ImageRef:       "quay.io/example/image:latest",
+				DeviceSelector: "vendor=Samsung",
+			},
+			wantErr: "unknown disk selector term",
+		},
 		{
 			name: "invalid filesystem type",
 			config: InstallConfig{
@@ -114,6 +132,85 @@ func TestInstallConfig_Validate(t *testing.T) {
 			},
 			wantErr: "encryption passphrase is required",
 		},
+		{
+			name: "TPM2 PCRs without TPM2",
+			config: InstallConfig{
+				ImageRef:   "quay.io/example/image:latest",
+				Device:     "/dev/sda",
+				Encryption: &EncryptionOptions{Passphrase: "secret", TPM2PCRs: []int{7}},
+			},
+			wantErr: "TPM2 PCR policies require TPM2 enrollment",
+		},
+		{
+			name: "TPM2 PCR that updates change",
+			config: InstallConfig{
+				ImageRef:   "quay.io/example/image:latest",
+				Device:     "/dev/sda",
+				Encryption: &EncryptionOptions{Passphrase: "secret", TPM2: true, TPM2PCRs: []int{4}},
+			},
+			wantErr: "PCR 4 changes with every update",
+		},
+		{
+			name: "TPM2 PCR signing key without UKI",
+			config: InstallConfig{
+				ImageRef:   "quay.io/example/image:latest",
+				Device:     "/dev/sda",
+				Encryption: &EncryptionOptions{Passphrase: "secret", TPM2: true, TPM2PCRSigningKey: "/tmp/pcr-key.pem"},
+			},
+			wantErr: "signed PCR policies require unified kernel images",
+		},
+		{
+			name: "subvolumes with composefs",
+			config: InstallConfig{
+				ImageRef:   "quay.io/example/image:latest",
+				Device:     "/dev/sda",
+				Subvolumes: true,
+				Composefs:  true,
+			},
+			wantErr: "subvolume deployments are not supported with composefs",
+		},
+		{
+			name: "local image for another platform",
+			config: InstallConfig{
+				LocalImage: &LocalImageSource{
+					LayoutPath: "/tmp/layout",
+					Metadata:   &CachedImageMetadata{Platform: "linux/amd64"},
+				},
+				Device:   "/dev/sda",
+				Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+			},
+			wantErr: "local image was downloaded for linux/amd64, not linux/arm64",
+		},
+		{
+			name: "BIOS boot on arm64",
+			config: InstallConfig{
+				ImageRef: "quay.io/example/image:latest",
+				Device:   "/dev/sda",
+				Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+				BootMode: BootModeBIOS,
+			},
+			wantErr: "BIOS boot is not supported on architecture arm64",
+		},
+		{
+			name: "BIOS boot with UKI",
+			config: InstallConfig{
+				ImageRef: "quay.io/example/image:latest",
+				Device:   "/dev/sda",
+				Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+				BootMode: BootModeBIOS,
+				UKI:      true,
+			},
+			wantErr: "unified kernel images are not supported with BIOS boot",
+		},
+		{
+			name: "unknown boot mode",
+			config: InstallConfig{
+				ImageRef: "quay.io/example/image:latest",
+				Device:   "/dev/sda",
+				BootMode: "coreboot",
+			},
+			wantErr: "unsupported boot mode: coreboot",
+		},
 		{
 			name: "loopback without image path",
 			config: InstallConfig{
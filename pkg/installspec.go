@@ -0,0 +1,453 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.yaml.in/yaml/v3"
+)
+
+// InstallSpecVersion is the version of the install spec format written by
+// this nbc. Specs of other versions are refused.
+const InstallSpecVersion = 1
+
+// InstallSpec is a declarative install configuration, read from a YAML, JSON
+// or TOML file for unattended installs:
+//
+//	version: 1
+//	image: quay.io/example/myimage:latest
+//	device: /dev/nvme0n1
+//	filesystem: btrfs
+//	layout:
+//	  root_size: 20G
+//	encryption:
+//	  passphrase_file: ./passphrase
+//	  tpm2: true
+//	kernel_args: [console=ttyS0]
+//	hostname: kiosk-01
+//	timezone: Europe/Berlin
+//	users:
+//	  - name: admin
+//	    password_hash: $6$...
+//	    groups: [wheel]
+//	    ssh_authorized_keys: [ssh-ed25519 AAAA... admin@example.com]
+//	cloud_init:
+//	  user_data: ./user-data.yaml
+//
+// Relative paths in the spec are relative to the directory of the spec file.
+// It maps onto InstallConfig with InstallConfig.
+type InstallSpec struct {
+	Version            int             `yaml:"version" toml:"version"`
+	Image              string          `yaml:"image,omitempty" toml:"image,omitempty"`
+	LocalImage         string          `yaml:"local_image,omitempty" toml:"local_image,omitempty"`
+	Device             string          `yaml:"device,omitempty" toml:"device,omitempty"`
+	DeviceSelector     string          `yaml:"device_selector,omitempty" toml:"device_selector,omitempty"`
+	Loopback           *LoopbackSpec   `yaml:"loopback,omitempty" toml:"loopback,omitempty"`
+	Filesystem         string          `yaml:"filesystem,omitempty" toml:"filesystem,omitempty"`
+	Layout             *LayoutSpec     `yaml:"layout,omitempty" toml:"layout,omitempty"`
+	RootSubvolumes     bool            `yaml:"root_subvolumes,omitempty" toml:"root_subvolumes,omitempty"`
+	KeepDeployments    int             `yaml:"keep_deployments,omitempty" toml:"keep_deployments,omitempty"`
+	Discoverable       bool            `yaml:"discoverable,omitempty" toml:"discoverable,omitempty"`
+	UKI                bool            `yaml:"uki,omitempty" toml:"uki,omitempty"`
+	Encryption         *EncryptionSpec `yaml:"encryption,omitempty" toml:"encryption,omitempty"`
+	KernelArgs         []string        `yaml:"kernel_args,omitempty" toml:"kernel_args,omitempty"`
+	Platform           string          `yaml:"platform,omitempty" toml:"platform,omitempty"`
+	BootMode           string          `yaml:"boot_mode,omitempty" toml:"boot_mode,omitempty"`
+	Flatten            bool            `yaml:"flatten,omitempty" toml:"flatten,omitempty"`
+	SELinuxRelabel     bool            `yaml:"selinux_relabel,omitempty" toml:"selinux_relabel,omitempty"`
+	Composefs          bool            `yaml:"composefs,omitempty" toml:"composefs,omitempty"`
+	InsecureSkipVerify bool            `yaml:"insecure_skip_verify,omitempty" toml:"insecure_skip_verify,omitempty"`
+	CosignKey          string          `yaml:"cosign_key,omitempty" toml:"cosign_key,omitempty"`
+	Hostname           string          `yaml:"hostname,omitempty" toml:"hostname,omitempty"`
+	Locale             string          `yaml:"locale,omitempty" toml:"locale,omitempty"`
+	Timezone           string          `yaml:"timezone,omitempty" toml:"timezone,omitempty"`
+	RootPasswordHash   string          `yaml:"root_password_hash,omitempty" toml:"root_password_hash,omitempty"`
+	SSHAuthorizedKeys  []string        `yaml:"ssh_authorized_keys,omitempty" toml:"ssh_authorized_keys,omitempty"`
+	Groups             []string        `yaml:"groups,omitempty" toml:"groups,omitempty"`
+	Users              []UserSpec      `yaml:"users,omitempty" toml:"users,omitempty"`
+	CloudInit          *CloudInitSpec  `yaml:"cloud_init,omitempty" toml:"cloud_init,omitempty"`
+	Ignition           string          `yaml:"ignition,omitempty" toml:"ignition,omitempty"`
+}
+
+// LoopbackSpec is the loopback image file of an InstallSpec
+type LoopbackSpec struct {
+	Path   string `yaml:"path" toml:"path"`
+	SizeGB int    `yaml:"size_gb,omitempty" toml:"size_gb,omitempty"`
+	Force  bool   `yaml:"force,omitempty" toml:"force,omitempty"`
+}
+
+// LayoutSpec is the partition layout of an InstallSpec, in the forms
+// --boot-size, --root-size and --var-size take
+type LayoutSpec struct {
+	BootSize string `yaml:"boot_size,omitempty" toml:"boot_size,omitempty"`
+	RootSize string `yaml:"root_size,omitempty" toml:"root_size,omitempty"`
+	VarSize  string `yaml:"var_size,omitempty" toml:"var_size,omitempty"`
+}
+
+// EncryptionSpec is the LUKS encryption of an InstallSpec. The passphrase
+// is given inline or, better, in a file.
+type EncryptionSpec struct {
+	Passphrase        string `yaml:"passphrase,omitempty" toml:"passphrase,omitempty"`
+	PassphraseFile    string `yaml:"passphrase_file,omitempty" toml:"passphrase_file,omitempty"`
+	TPM2              bool   `yaml:"tpm2,omitempty" toml:"tpm2,omitempty"`
+	TPM2PCRs          string `yaml:"tpm2_pcrs,omitempty" toml:"tpm2_pcrs,omitempty"`
+	TPM2PCRSigningKey string `yaml:"tpm2_pcr_signing_key,omitempty" toml:"tpm2_pcr_signing_key,omitempty"`
+}
+
+// UserSpec is a user account of an InstallSpec
+type UserSpec struct {
+	Name              string   `yaml:"name" toml:"name"`
+	PasswordHash      string   `yaml:"password_hash,omitempty" toml:"password_hash,omitempty"`
+	Groups            []string `yaml:"groups,omitempty" toml:"groups,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty" toml:"ssh_authorized_keys,omitempty"`
+}
+
+// CloudInitSpec is the cloud_init section of an InstallSpec: the files of
+// a cloud-init NoCloud seed
+type CloudInitSpec struct {
+	UserData      string `yaml:"user_data" toml:"user_data"`
+	MetaData      string `yaml:"meta_data,omitempty" toml:"meta_data,omitempty"`
+	NetworkConfig string `yaml:"network_config,omitempty" toml:"network_config,omitempty"`
+}
+
+// FieldError is an error in a field of an install configuration. Field is
+// the path of the field in an install spec, e.g. "encryption.tpm2_pcrs" or
+// "users[1].name".
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ParseInstallSpec parses an install spec in YAML or JSON. Unknown fields
+// and other versions than InstallSpecVersion are refused.
+func ParseInstallSpec(data []byte) (*InstallSpec, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var spec InstallSpec
+	if err := dec.Decode(&spec); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("install spec is empty")
+		}
+		return nil, fmt.Errorf("failed to parse install spec: %w", err)
+	}
+	return checkInstallSpecVersion(&spec)
+}
+
+// ParseInstallSpecTOML parses an install spec in TOML. Unknown fields and
+// other versions than InstallSpecVersion are refused.
+func ParseInstallSpecTOML(data []byte) (*InstallSpec, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("install spec is empty")
+	}
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var spec InstallSpec
+	if err := dec.Decode(&spec); err != nil {
+		var missingErr *toml.StrictMissingError
+		var decodeErr *toml.DecodeError
+		switch {
+		case errors.As(err, &missingErr):
+			row, _ := missingErr.Errors[0].Position()
+			return nil, fmt.Errorf("failed to parse install spec: line %d: field %s not found", row, strings.Join(missingErr.Errors[0].Key(), "."))
+		case errors.As(err, &decodeErr):
+			row, _ := decodeErr.Position()
+			return nil, fmt.Errorf("failed to parse install spec: line %d: %w", row, err)
+		}
+		return nil, fmt.Errorf("failed to parse install spec: %w", err)
+	}
+	return checkInstallSpecVersion(&spec)
+}
+
+// checkInstallSpecVersion refuses specs of other versions than
+// InstallSpecVersion
+func checkInstallSpecVersion(spec *InstallSpec) (*InstallSpec, error) {
+	if spec.Version != InstallSpecVersion {
+		return nil, &FieldError{Field: "version", Err: fmt.Errorf("unsupported install spec version %d (supported: %d)", spec.Version, InstallSpecVersion)}
+	}
+	return spec, nil
+}
+
+// isTOMLSpec reports whether the spec file at path is TOML, by its extension
+func isTOMLSpec(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".toml")
+}
+
+// LoadInstallSpec reads the install spec file at path: TOML for a ".toml"
+// file, and YAML or JSON otherwise
+func LoadInstallSpec(path string) (*InstallSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read install spec: %w", err)
+	}
+	parse := ParseInstallSpec
+	if isTOMLSpec(path) {
+		parse = ParseInstallSpecTOML
+	}
+	spec, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// WriteInstallSpec writes spec to the file at path, in TOML for a ".toml"
+// file and in YAML otherwise. The file is only readable by its owner, as it
+// may hold password hashes.
+func WriteInstallSpec(path string, spec *InstallSpec) error {
+	var b bytes.Buffer
+	b.WriteString("# nbc install spec, install with: nbc install --config " + filepath.Base(path) + "\n")
+	if isTOMLSpec(path) {
+		if err := toml.NewEncoder(&b).Encode(spec); err != nil {
+			return fmt.Errorf("failed to encode install spec: %w", err)
+		}
+	} else {
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(spec); err != nil {
+			return fmt.Errorf("failed to encode install spec: %w", err)
+		}
+		if err := enc.Close(); err != nil {
+			return fmt.Errorf("failed to encode install spec: %w", err)
+		}
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write install spec: %w", err)
+	}
+	return nil
+}
+
+// specPath resolves a path of a spec relative to the spec's directory
+func specPath(baseDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// InstallConfig maps the spec onto an InstallConfig, to be checked with
+// InstallConfig.Validate. Relative paths are resolved against baseDir, the
+// directory of the spec file. A local image is looked up in the
+// staged-install cache. Errors in the spec are FieldErrors.
+func (s *InstallSpec) InstallConfig(baseDir string) (*InstallConfig, error) {
+	cfg := &InstallConfig{
+		ImageRef:        s.Image,
+		Device:          s.Device,
+		DeviceSelector:  s.DeviceSelector,
+		FilesystemType:  s.Filesystem,
+		KernelArgs:      s.KernelArgs,
+		Subvolumes:      s.RootSubvolumes,
+		KeepDeployments: s.KeepDeployments,
+		Discoverable:    s.Discoverable,
+		UKI:             s.UKI,
+		Flatten:         s.Flatten,
+		SELinuxRelabel:  s.SELinuxRelabel,
+		Composefs:       s.Composefs,
+		SkipVerify:      s.InsecureSkipVerify,
+		CosignKeyPath:   specPath(baseDir, s.CosignKey),
+	}
+
+	if s.LocalImage != "" {
+		cache := NewStagedInstallCache()
+		_, metadata, err := cache.GetImage(s.LocalImage)
+		if err != nil {
+			return nil, &FieldError{Field: "local_image", Err: err}
+		}
+		cfg.LocalImage = &LocalImageSource{
+			LayoutPath: cache.GetLayoutPath(metadata.ImageDigest),
+			Metadata:   metadata,
+		}
+		cfg.SkipPull = true
+	}
+
+	if s.Loopback != nil {
+		cfg.Loopback = &LoopbackOptions{
+			ImagePath: specPath(baseDir, s.Loopback.Path),
+			SizeGB:    s.Loopback.SizeGB,
+			Force:     s.Loopback.Force,
+		}
+	}
+
+	if s.Layout != nil {
+		layout, err := ParsePartitionLayout(s.Layout.BootSize, s.Layout.RootSize, s.Layout.VarSize)
+		if err != nil {
+			return nil, &FieldError{Field: "layout", Err: err}
+		}
+		// root_size sizes the single root partition of a subvolume layout,
+		// which holds the space of both root slots by default
+		if s.RootSubvolumes && s.Layout.RootSize == "" {
+			layout.RootSizeMiB = DefaultSubvolumeRootSizeMiB
+		}
+		cfg.Layout = layout
+	}
+
+	if s.Encryption != nil {
+		passphrase := s.Encryption.Passphrase
+		if s.Encryption.PassphraseFile != "" {
+			if passphrase != "" {
+				return nil, &FieldError{Field: "encryption.passphrase_file", Err: errors.New("passphrase and passphrase_file are mutually exclusive")}
+			}
+			data, err := os.ReadFile(specPath(baseDir, s.Encryption.PassphraseFile))
+			if err != nil {
+				return nil, &FieldError{Field: "encryption.passphrase_file", Err: err}
+			}
+			passphrase = strings.TrimRight(string(data), "\n\r")
+		}
+		pcrs, err := ParseTPM2PCRs(s.Encryption.TPM2PCRs)
+		if err != nil {
+			return nil, &FieldError{Field: "encryption.tpm2_pcrs", Err: err}
+		}
+		cfg.Encryption = &EncryptionOptions{
+			Passphrase:        passphrase,
+			TPM2:              s.Encryption.TPM2,
+			TPM2PCRs:          pcrs,
+			TPM2PCRSigningKey: specPath(baseDir, s.Encryption.TPM2PCRSigningKey),
+		}
+	}
+
+	platform, err := ParsePlatform(s.Platform)
+	if err != nil {
+		return nil, &FieldError{Field: "platform", Err: err}
+	}
+	cfg.Platform = platform
+
+	bootMode, err := ParseBootMode(s.BootMode)
+	if err != nil {
+		return nil, &FieldError{Field: "boot_mode", Err: err}
+	}
+	cfg.BootMode = bootMode
+
+	provision := &ProvisionOptions{
+		Hostname:          s.Hostname,
+		Locale:            s.Locale,
+		Timezone:          s.Timezone,
+		RootPasswordHash:  s.RootPasswordHash,
+		SSHAuthorizedKeys: s.SSHAuthorizedKeys,
+		Groups:            s.Groups,
+	}
+	for _, user := range s.Users {
+		provision.Users = append(provision.Users, UserOptions(user))
+	}
+	if !provision.Empty() {
+		cfg.Provision = provision
+	}
+
+	if s.CloudInit != nil {
+		seed := &CloudInitSeed{}
+		files := []struct {
+			field, path string
+			data        *[]byte
+		}{
+			{"cloud_init.user_data", s.CloudInit.UserData, &seed.UserData},
+			{"cloud_init.meta_data", s.CloudInit.MetaData, &seed.MetaData},
+			{"cloud_init.network_config", s.CloudInit.NetworkConfig, &seed.NetworkConfig},
+		}
+		for _, f := range files {
+			if f.path == "" {
+				continue
+			}
+			data, err := os.ReadFile(specPath(baseDir, f.path))
+			if err != nil {
+				return nil, &FieldError{Field: f.field, Err: err}
+			}
+			*f.data = data
+		}
+		cfg.CloudInit = seed
+	}
+
+	if s.Ignition != "" {
+		data, err := os.ReadFile(specPath(baseDir, s.Ignition))
+		if err != nil {
+			return nil, &FieldError{Field: "ignition", Err: err}
+		}
+		ignition, err := ParseIgnitionConfig(data)
+		if err != nil {
+			return nil, &FieldError{Field: "ignition", Err: err}
+		}
+		cfg.Ignition = ignition
+	}
+
+	return cfg, nil
+}
+
+// NewInstallSpec returns the install spec of cfg, to install the same way
+// again. The encryption passphrase is left out, so the spec can be shared;
+// give it with passphrase_file. So are cloud-init user-data and Ignition
+// configs, which the spec only refers to by path.
+func NewInstallSpec(cfg *InstallConfig) *InstallSpec {
+	spec := &InstallSpec{
+		Version:            InstallSpecVersion,
+		Image:              cfg.ImageRef,
+		Device:             cfg.Device,
+		DeviceSelector:     cfg.DeviceSelector,
+		Filesystem:         cfg.FilesystemType,
+		RootSubvolumes:     cfg.Subvolumes,
+		KeepDeployments:    cfg.KeepDeployments,
+		Discoverable:       cfg.Discoverable,
+		UKI:                cfg.UKI,
+		KernelArgs:         cfg.KernelArgs,
+		BootMode:           string(cfg.BootMode),
+		Flatten:            cfg.Flatten,
+		SELinuxRelabel:     cfg.SELinuxRelabel,
+		Composefs:          cfg.Composefs,
+		InsecureSkipVerify: cfg.SkipVerify,
+		CosignKey:          cfg.CosignKeyPath,
+	}
+	if cfg.LocalImage != nil && cfg.LocalImage.Metadata != nil {
+		spec.LocalImage = cfg.LocalImage.Metadata.ImageDigest
+	}
+	if cfg.Loopback != nil {
+		spec.Loopback = &LoopbackSpec{
+			Path:   cfg.Loopback.ImagePath,
+			SizeGB: cfg.Loopback.SizeGB,
+			Force:  cfg.Loopback.Force,
+		}
+	}
+	if cfg.Layout != nil {
+		spec.Layout = &LayoutSpec{
+			BootSize: formatSizeMiB(cfg.Layout.BootSizeMiB),
+			RootSize: formatSizeMiB(cfg.Layout.RootSizeMiB),
+		}
+		switch {
+		case cfg.Layout.VarSizeMiB != 0:
+			spec.Layout.VarSize = formatSizeMiB(cfg.Layout.VarSizeMiB)
+		case cfg.Layout.VarPercent != 0:
+			spec.Layout.VarSize = fmt.Sprintf("%d%%", cfg.Layout.VarPercent)
+		}
+	}
+	if cfg.Encryption != nil {
+		spec.Encryption = &EncryptionSpec{
+			TPM2:              cfg.Encryption.TPM2,
+			TPM2PCRs:          formatPCRs(cfg.Encryption.TPM2PCRs),
+			TPM2PCRSigningKey: cfg.Encryption.TPM2PCRSigningKey,
+		}
+	}
+	if cfg.Platform != nil {
+		spec.Platform = cfg.Platform.String()
+	}
+	if p := cfg.Provision; p != nil {
+		spec.Hostname = p.Hostname
+		spec.Locale = p.Locale
+		spec.Timezone = p.Timezone
+		spec.RootPasswordHash = p.RootPasswordHash
+		spec.SSHAuthorizedKeys = p.SSHAuthorizedKeys
+		spec.Groups = p.Groups
+		for _, user := range p.Users {
+			spec.Users = append(spec.Users, UserSpec(user))
+		}
+	}
+	return spec
+}
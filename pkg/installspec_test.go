@@ -0,0 +1,253 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSpecYAML = `version: 1
+image: quay.io/example/myimage:latest
+device: /dev/nvme0n1
+filesystem: ext4
+layout:
+  root_size: 20G
+  var_size: 50%
+encryption:
+  passphrase_file: secrets/passphrase
+  tpm2: true
+  tpm2_pcrs: "7"
+kernel_args: [console=ttyS0]
+hostname: kiosk-01
+root_password_hash: $6$salt$hash
+users:
+  - name: admin
+    groups: [wheel]
+    ssh_authorized_keys:
+      - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 admin@example.com
+`
+
+func TestParseInstallSpec(t *testing.T) {
+	spec, err := ParseInstallSpec([]byte(testSpecYAML))
+	if err != nil {
+		t.Fatalf("ParseInstallSpec() error = %v", err)
+	}
+	if spec.Image != "quay.io/example/myimage:latest" || spec.Layout.RootSize != "20G" || spec.Users[0].Groups[0] != "wheel" {
+		t.Errorf("ParseInstallSpec() = %+v", spec)
+	}
+
+	json := `{"version": 1, "image": "localhost/myimage", "device": "/dev/sda", "users": [{"name": "admin"}]}`
+	spec, err = ParseInstallSpec([]byte(json))
+	if err != nil {
+		t.Fatalf("ParseInstallSpec(JSON) error = %v", err)
+	}
+	if spec.Device != "/dev/sda" || spec.Users[0].Name != "admin" {
+		t.Errorf("ParseInstallSpec(JSON) = %+v", spec)
+	}
+
+	errTests := []struct {
+		name    string
+		spec    string
+		wantErr string
+	}{
+		{"empty", "", "install spec is empty"},
+		{"unknown field", "version: 1\nimage: foo\ndevise: /dev/sda\n", "line 3: field devise not found"},
+		{"wrong type", "version: 1\nlayout:\n  boot_size: [1G]\n", "line 3"},
+		{"missing version", "image: foo\n", "version: unsupported install spec version 0"},
+		{"future version", "version: 2\n", "version: unsupported install spec version 2"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseInstallSpec([]byte(tt.spec))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseInstallSpec() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseInstallSpecTOML(t *testing.T) {
+	spec, err := ParseInstallSpecTOML([]byte(`version = 1
+image = "quay.io/example/myimage:latest"
+device = "/dev/nvme0n1"
+kernel_args = ["console=ttyS0"]
+
+[layout]
+root_size = "20G"
+
+[[users]]
+name = "admin"
+groups = ["wheel"]
+`))
+	if err != nil {
+		t.Fatalf("ParseInstallSpecTOML() error = %v", err)
+	}
+	if spec.Image != "quay.io/example/myimage:latest" || spec.Layout.RootSize != "20G" || spec.Users[0].Groups[0] != "wheel" {
+		t.Errorf("ParseInstallSpecTOML() = %+v", spec)
+	}
+
+	errTests := []struct {
+		name    string
+		spec    string
+		wantErr string
+	}{
+		{"empty", "\n", "install spec is empty"},
+		{"unknown field", "version = 1\nimage = \"foo\"\ndevise = \"/dev/sda\"\n", "line 3: field devise not found"},
+		{"unknown nested field", "version = 1\n[layout]\nboot = \"1G\"\n", "line 3: field layout.boot not found"},
+		{"wrong type", "version = 1\n[layout]\nboot_size = [\"1G\"]\n", "LayoutSpec.BootSize"},
+		{"missing version", "image = \"foo\"\n", "version: unsupported install spec version 0"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseInstallSpecTOML([]byte(tt.spec))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseInstallSpecTOML() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstallSpec_InstallConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "secrets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secrets", "passphrase"), []byte("hunter22\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := ParseInstallSpec([]byte(testSpecYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := spec.InstallConfig(dir)
+	if err != nil {
+		t.Fatalf("InstallConfig() error = %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	if cfg.Encryption.Passphrase != "hunter22" {
+		t.Errorf("passphrase = %q, want it read from the file relative to the spec", cfg.Encryption.Passphrase)
+	}
+	if !reflect.DeepEqual(cfg.Encryption.TPM2PCRs, []int{7}) {
+		t.Errorf("TPM2PCRs = %v, want [7]", cfg.Encryption.TPM2PCRs)
+	}
+	if cfg.Layout.RootSizeMiB != 20*1024 || cfg.Layout.VarPercent != 50 {
+		t.Errorf("Layout = %+v", cfg.Layout)
+	}
+	want := &ProvisionOptions{
+		Hostname:         "kiosk-01",
+		RootPasswordHash: "$6$salt$hash",
+		Users: []UserOptions{{
+			Name:              "admin",
+			Groups:            []string{"wheel"},
+			SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 admin@example.com"},
+		}},
+	}
+	if !reflect.DeepEqual(cfg.Provision, want) {
+		t.Errorf("Provision = %+v, want %+v", cfg.Provision, want)
+	}
+}
+
+func TestInstallSpec_FieldErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantField string
+	}{
+		{"bad layout", "layout:\n  boot_size: 2X\n", "layout"},
+		{"bad PCRs", "encryption:\n  passphrase: secret\n  tpm2: true\n  tpm2_pcrs: \"4\"\n", "encryption.tpm2_pcrs"},
+		{"both passphrases", "encryption:\n  passphrase: secret\n  passphrase_file: pass\n", "encryption.passphrase_file"},
+		{"missing passphrase file", "encryption:\n  passphrase_file: missing\n", "encryption.passphrase_file"},
+		{"bad platform", "platform: windows/amd64\n", "platform"},
+		{"bad boot mode", "boot_mode: coreboot\n", "boot_mode"},
+		{"missing passphrase", "encryption:\n  tpm2: true\n", "encryption.passphrase"},
+		{"bad filesystem", "filesystem: xfs\n", "filesystem"},
+		{"device and selector", "device_selector: transport=nvme\n", "device_selector"},
+		{"bad hostname", "hostname: -kiosk\n", "hostname"},
+		{"bad timezone", "timezone: Europe/../Berlin\n", "timezone"},
+		{"bad user name", "users:\n  - name: admin\n  - name: Bad User\n", "users[1].name"},
+		{"bad user key", "users:\n  - name: admin\n    ssh_authorized_keys: [nokey]\n", "users[0].ssh_authorized_keys[0]"},
+		{"bad root hash", "root_password_hash: plaintext\n", "root_password_hash"},
+		{"both root passwords", "root_password_hash: $6$salt$hash\n", "root_password_hash"},
+		{"missing user-data", "cloud_init:\n  user_data: user-data.yaml\n", "cloud_init.user_data"},
+		{"missing Ignition config", "ignition: config.ign\n", "ignition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := ParseInstallSpec([]byte("version: 1\nimage: localhost/myimage\ndevice: /dev/sda\n" + tt.spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := spec.InstallConfig(t.TempDir())
+			if err == nil {
+				if tt.name == "both root passwords" {
+					cfg.RootPassword = "secret"
+				}
+				err = cfg.Validate()
+			}
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("error = %v, want a FieldError", err)
+			}
+			if fieldErr.Field != tt.wantField {
+				t.Errorf("error = %v, want field %s", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestInstallSpec_RoundTrip(t *testing.T) {
+	cfg := &InstallConfig{
+		ImageRef:       "quay.io/example/myimage:latest",
+		FilesystemType: "btrfs",
+		KernelArgs:     []string{"console=ttyS0"},
+		Loopback:       &LoopbackOptions{ImagePath: "/var/tmp/disk.img", SizeGB: 40},
+		Layout:         &PartitionLayout{BootSizeMiB: 1024, RootSizeMiB: 16 * 1024, VarSizeMiB: 64 * 1024},
+		BootMode:       BootModeUEFI,
+		Encryption:     &EncryptionOptions{Passphrase: "secret", TPM2: true, TPM2PCRs: []int{7, 14}},
+		Provision: &ProvisionOptions{
+			Hostname: "kiosk-01",
+			Locale:   "en_US.UTF-8",
+			Timezone: "Europe/Berlin",
+			Groups:   []string{"docker"},
+			Users:    []UserOptions{{Name: "admin", PasswordHash: "$6$salt$hash", Groups: []string{"docker"}}},
+		},
+	}
+
+	spec := NewInstallSpec(cfg)
+	if spec.Encryption.Passphrase != "" {
+		t.Error("NewInstallSpec() should leave the passphrase out")
+	}
+	spec.Encryption.Passphrase = "secret"
+
+	// The format follows the extension of the spec file
+	for _, name := range []string{"install.yaml", "install.toml"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := WriteInstallSpec(path, spec); err != nil {
+				t.Fatalf("WriteInstallSpec() error = %v", err)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("spec file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+			}
+
+			loaded, err := LoadInstallSpec(path)
+			if err != nil {
+				t.Fatalf("LoadInstallSpec() error = %v", err)
+			}
+			got, err := loaded.InstallConfig(filepath.Dir(path))
+			if err != nil {
+				t.Fatalf("InstallConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, cfg) {
+				t.Errorf("round trip = %+v, want %+v", got, cfg)
+			}
+		})
+	}
+}
@@ -23,7 +23,7 @@ func TestIntegration_PartitionAndFormat(t *testing.T) {
 
 	// Create partitions
 	t.Log("Creating partitions...")
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -77,7 +77,7 @@ func TestIntegration_MountUnmount(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -137,7 +137,7 @@ func TestIntegration_DetectPartitionScheme(t *testing.T) {
 	}
 
 	// Create partitions
-	originalScheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	originalScheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -180,7 +180,7 @@ func TestIntegration_EtcOverlaySetup(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -244,7 +244,7 @@ func TestIntegration_TmpfilesConfig(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -296,7 +296,7 @@ func TestIntegration_SystemConfig(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -394,7 +394,7 @@ func TestIntegration_Crypttab(t *testing.T) {
 	}
 
 	progress := reporter.NoopReporter{}
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, progress)
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, progress)
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
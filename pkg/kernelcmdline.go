@@ -18,6 +18,21 @@ type kernelCmdlineParams struct {
 	RootUUID string
 	VarUUID  string
 
+	// Subvolume layout (non-encrypted only): the deployment subvolume on the
+	// root partition to boot, e.g. "deployments/3"
+	RootSubvolume string
+
+	// Discoverable partitions (non-encrypted only): the machine ID the var
+	// PARTUUID is derived from, and whether systemd-gpt-auto-generator can
+	// mount /boot and /var itself (it needs the boot loader to report the
+	// ESP, which systemd-boot does and GRUB does not).
+	MachineID    string
+	GPTAutoMount bool
+
+	// Composefs (optional): the fs-verity digest of the root slot's
+	// composefs image, mounted over the root by the dracut module
+	ComposefsDigest string
+
 	// Always required:
 	BootUUID  string
 	ExtraArgs []string // user-supplied kernel arguments, appended last
@@ -74,15 +89,33 @@ func assembleKernelCmdline(p kernelCmdlineParams) []string {
 			"rd.etc.overlay.var=/dev/mapper/var",
 		)
 	} else {
+		// root= stays explicit even for discoverable partitions: it is how the
+		// boot entries select an A/B slot.
+		cmdline = append(cmdline, "root=UUID="+p.RootUUID, "ro")
+		if p.RootSubvolume != "" {
+			// All deployments share root=; rootflags selects one
+			cmdline = append(cmdline, "rootflags=subvol="+p.RootSubvolume)
+		}
+		if p.MachineID != "" {
+			// The discoverable var PARTUUID is bound to this machine ID.
+			cmdline = append(cmdline, "systemd.machine_id="+p.MachineID)
+		}
+		if p.MachineID == "" || !p.GPTAutoMount {
+			cmdline = append(cmdline,
+				"systemd.mount-extra=UUID="+p.BootUUID+":/boot:vfat:defaults",
+				"systemd.mount-extra=UUID="+p.VarUUID+":/var:"+fsType+":defaults",
+			)
+		}
 		cmdline = append(cmdline,
-			"root=UUID="+p.RootUUID, "ro",
-			"systemd.mount-extra=UUID="+p.BootUUID+":/boot:vfat:defaults",
-			"systemd.mount-extra=UUID="+p.VarUUID+":/var:"+fsType+":defaults",
 			"rd.etc.overlay=1",
 			"rd.etc.overlay.var=UUID="+p.VarUUID,
 		)
 	}
 
+	if p.ComposefsDigest != "" {
+		cmdline = append(cmdline, ComposefsCmdlineArg+"="+p.ComposefsDigest)
+	}
+
 	// HACK: Disable NVMe multipath so nvme0/nvme1 device naming stays stable
 	// across reboots (CONFIG_NVME_MULTIPATH=y otherwise enumerates them
 	// non-deterministically).
@@ -27,6 +27,82 @@ func TestAssembleKernelCmdline_NonEncrypted(t *testing.T) {
 	}
 }
 
+func TestAssembleKernelCmdline_RootSubvolume(t *testing.T) {
+	got := assembleKernelCmdline(kernelCmdlineParams{
+		FilesystemType: "btrfs",
+		RootUUID:       "ROOT",
+		VarUUID:        "VAR",
+		BootUUID:       "BOOT",
+		RootSubvolume:  "deployments/3",
+	})
+	want := []string{
+		"root=UUID=ROOT", "ro", "rootflags=subvol=deployments/3",
+		"systemd.mount-extra=UUID=BOOT:/boot:vfat:defaults",
+		"systemd.mount-extra=UUID=VAR:/var:btrfs:defaults",
+		"rd.etc.overlay=1", "rd.etc.overlay.var=UUID=VAR",
+		"nvme_core.multipath=N",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+	if id := cmdlineDeployment(got); id != 3 {
+		t.Errorf("cmdlineDeployment() = %d, want 3", id)
+	}
+}
+
+func TestAssembleKernelCmdline_Composefs(t *testing.T) {
+	got := assembleKernelCmdline(kernelCmdlineParams{
+		FilesystemType:  "ext4",
+		RootUUID:        "ROOT",
+		VarUUID:         "VAR",
+		BootUUID:        "BOOT",
+		ComposefsDigest: "0123abcd",
+		ExtraArgs:       []string{"quiet"},
+	})
+	want := []string{
+		"root=UUID=ROOT", "ro",
+		"systemd.mount-extra=UUID=BOOT:/boot:vfat:defaults",
+		"systemd.mount-extra=UUID=VAR:/var:ext4:defaults",
+		"rd.etc.overlay=1", "rd.etc.overlay.var=UUID=VAR",
+		"nbc.composefs=0123abcd",
+		"nvme_core.multipath=N",
+		"quiet",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+	if digest := cmdlineComposefsDigest(got); digest != "0123abcd" {
+		t.Errorf("cmdlineComposefsDigest() = %q, want 0123abcd", digest)
+	}
+}
+
+func TestAssembleKernelCmdline_Discoverable(t *testing.T) {
+	params := kernelCmdlineParams{
+		FilesystemType: "ext4",
+		RootUUID:       "ROOT",
+		VarUUID:        "VAR",
+		BootUUID:       "BOOT",
+		MachineID:      "0123456789abcdef0123456789abcdef",
+		GPTAutoMount:   true,
+	}
+	got := assembleKernelCmdline(params)
+	want := []string{
+		"root=UUID=ROOT", "ro",
+		"systemd.machine_id=0123456789abcdef0123456789abcdef",
+		"rd.etc.overlay=1", "rd.etc.overlay.var=UUID=VAR",
+		"nvme_core.multipath=N",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+
+	// Without a boot loader that reports the ESP, the mounts stay explicit
+	params.GPTAutoMount = false
+	if got := strings.Join(assembleKernelCmdline(params), " "); !strings.Contains(got, "systemd.mount-extra=UUID=VAR:/var:ext4:defaults") {
+		t.Errorf("cmdline %q should keep the /var mount", got)
+	}
+}
+
 func TestAssembleKernelCmdline_EncryptedWithTPM2(t *testing.T) {
 	got := assembleKernelCmdline(kernelCmdlineParams{
 		Encrypted:      true,
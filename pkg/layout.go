@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultBootSizeMiB is the default boot/EFI partition size (2GB)
+	DefaultBootSizeMiB = 2 * 1024
+	// DefaultRootSizeMiB is the default size of each root slot (12GB)
+	DefaultRootSizeMiB = 12 * 1024
+	// DefaultSubvolumeRootSizeMiB is the default size of the single root
+	// partition of a subvolume layout, the space of both root slots (24GB)
+	DefaultSubvolumeRootSizeMiB = 2 * DefaultRootSizeMiB
+	// MinBootSizeMiB is the smallest boot partition that holds the EFI
+	// binaries plus the current and previous kernel/initramfs pairs
+	MinBootSizeMiB = 512
+	// MinRootSizeMiB is the smallest accepted root slot
+	MinRootSizeMiB = 2 * 1024
+	// MinVarSizeMiB is the smallest accepted /var partition
+	MinVarSizeMiB = 1024
+
+	// gptOverheadMiB covers the 1MiB alignment gap before the first partition
+	// and the backup GPT at the end of the disk
+	gptOverheadMiB = 2
+)
+
+// PartitionLayout describes the partition sizes used by CreatePartitions.
+// Sizes are in MiB. The var partition takes a fixed size (VarSizeMiB) or a
+// percentage of the space left after the boot and root partitions
+// (VarPercent); with neither set it takes all remaining space. A subvolume
+// layout has a single root partition instead of the root1 and root2 slots.
+// Layouts for legacy BIOS boot add a small BIOS boot partition.
+type PartitionLayout struct {
+	BootSizeMiB uint64 `json:"boot_size_mib"`          // Boot/EFI partition size
+	RootSizeMiB uint64 `json:"root_size_mib"`          // Size of each root slot (root1 and root2), or of the single root partition
+	VarSizeMiB  uint64 `json:"var_size_mib,omitempty"` // Fixed /var size (0 = use VarPercent)
+	VarPercent  int    `json:"var_percent,omitempty"`  // Percentage of remaining space for /var (0 = all)
+	Subvolumes  bool   `json:"subvolumes,omitempty"`   // One root partition holding a btrfs subvolume per deployment
+	BIOSBoot    bool   `json:"bios_boot,omitempty"`    // Add a BIOS boot partition for GRUB's core image (legacy BIOS boot)
+}
+
+// DefaultPartitionLayout returns the standard 2G boot, 12G root slots and
+// remaining-space /var layout.
+func DefaultPartitionLayout() *PartitionLayout {
+	return &PartitionLayout{
+		BootSizeMiB: DefaultBootSizeMiB,
+		RootSizeMiB: DefaultRootSizeMiB,
+	}
+}
+
+// ParsePartitionLayout builds a layout from size strings such as "512M",
+// "2G" or "1T". varSize may also be a percentage of the remaining space
+// ("50%"). Empty strings keep the default for that partition.
+func ParsePartitionLayout(bootSize, rootSize, varSize string) (*PartitionLayout, error) {
+	layout := DefaultPartitionLayout()
+
+	if bootSize != "" {
+		size, err := parseSizeMiB(bootSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boot size: %w", err)
+		}
+		layout.BootSizeMiB = size
+	}
+
+	if rootSize != "" {
+		size, err := parseSizeMiB(rootSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root size: %w", err)
+		}
+		layout.RootSizeMiB = size
+	}
+
+	if varSize != "" {
+		if pct, ok := strings.CutSuffix(strings.TrimSpace(varSize), "%"); ok {
+			percent, err := strconv.Atoi(strings.TrimSpace(pct))
+			if err != nil {
+				return nil, fmt.Errorf("invalid var size: %q is not a percentage", varSize)
+			}
+			if percent < 1 || percent > 100 {
+				return nil, fmt.Errorf("invalid var size: percentage must be between 1 and 100, got %d", percent)
+			}
+			layout.VarPercent = percent
+		} else {
+			size, err := parseSizeMiB(varSize)
+			if err != nil {
+				return nil, fmt.Errorf("invalid var size: %w", err)
+			}
+			layout.VarSizeMiB = size
+		}
+	}
+
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// parseSizeMiB parses a size with a binary unit suffix (M, G or T, optionally
+// followed by "iB" or "B") and returns it in MiB.
+func parseSizeMiB(s string) (uint64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "IB")
+	str = strings.TrimSuffix(str, "B")
+	if str == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	var multiplier uint64
+	switch str[len(str)-1] {
+	case 'M':
+		multiplier = 1
+	case 'G':
+		multiplier = 1024
+	case 'T':
+		multiplier = 1024 * 1024
+	default:
+		return 0, fmt.Errorf("size %q needs a unit (M, G or T)", s)
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(str[:len(str)-1]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size value: %q", s)
+	}
+	return value * multiplier, nil
+}
+
+// Validate checks the layout against the minimum partition sizes.
+func (l *PartitionLayout) Validate() error {
+	if l.BootSizeMiB < MinBootSizeMiB {
+		return fmt.Errorf("boot partition size %s is below minimum %s", formatSizeMiB(l.BootSizeMiB), formatSizeMiB(MinBootSizeMiB))
+	}
+	if l.RootSizeMiB < MinRootSizeMiB {
+		return fmt.Errorf("root partition size %s is below minimum %s", formatSizeMiB(l.RootSizeMiB), formatSizeMiB(MinRootSizeMiB))
+	}
+	if l.VarSizeMiB != 0 && l.VarPercent != 0 {
+		return fmt.Errorf("var partition cannot have both a fixed size and a percentage")
+	}
+	if l.VarSizeMiB != 0 && l.VarSizeMiB < MinVarSizeMiB {
+		return fmt.Errorf("var partition size %s is below minimum %s", formatSizeMiB(l.VarSizeMiB), formatSizeMiB(MinVarSizeMiB))
+	}
+	if l.VarPercent < 0 || l.VarPercent > 100 {
+		return fmt.Errorf("var partition percentage must be between 0 and 100, got %d", l.VarPercent)
+	}
+	return nil
+}
+
+// MinDiskSize returns the smallest disk, in bytes, that fits the layout.
+func (l *PartitionLayout) MinDiskSize() uint64 {
+	varMiB := uint64(MinVarSizeMiB)
+	if l.VarSizeMiB > varMiB {
+		varMiB = l.VarSizeMiB
+	}
+	return (l.BootSizeMiB + l.rootPartitions()*l.RootSizeMiB + varMiB + l.overheadMiB()) * 1024 * 1024
+}
+
+// overheadMiB returns the space the layout needs besides the boot, root and
+// var partitions
+func (l *PartitionLayout) overheadMiB() uint64 {
+	if l.BIOSBoot {
+		return gptOverheadMiB + biosBootSizeMiB
+	}
+	return gptOverheadMiB
+}
+
+// rootPartitions returns the number of root partitions of the layout
+func (l *PartitionLayout) rootPartitions() uint64 {
+	if l.Subvolumes {
+		return 1
+	}
+	return 2
+}
+
+// varSizeMiB returns the /var partition size for a disk of diskSize bytes,
+// or 0 if /var takes all remaining space.
+func (l *PartitionLayout) varSizeMiB(diskSize uint64) (uint64, error) {
+	if l.VarSizeMiB != 0 {
+		return l.VarSizeMiB, nil
+	}
+	if l.VarPercent == 0 || l.VarPercent == 100 {
+		return 0, nil
+	}
+
+	used := l.BootSizeMiB + l.rootPartitions()*l.RootSizeMiB + l.overheadMiB()
+	diskMiB := diskSize / (1024 * 1024)
+	if diskMiB <= used {
+		return 0, fmt.Errorf("disk is too small for the partition layout (%s)", l)
+	}
+	size := (diskMiB - used) * uint64(l.VarPercent) / 100
+	if size < MinVarSizeMiB {
+		return 0, fmt.Errorf("%d%% of the remaining space gives a var partition of %s, below minimum %s",
+			l.VarPercent, formatSizeMiB(size), formatSizeMiB(MinVarSizeMiB))
+	}
+	return size, nil
+}
+
+// String returns a short human-readable description of the layout.
+func (l *PartitionLayout) String() string {
+	varDesc := "remaining space"
+	switch {
+	case l.VarSizeMiB != 0:
+		varDesc = formatSizeMiB(l.VarSizeMiB)
+	case l.VarPercent != 0 && l.VarPercent != 100:
+		varDesc = fmt.Sprintf("%d%% of remaining space", l.VarPercent)
+	}
+	bios := ""
+	if l.BIOSBoot {
+		bios = fmt.Sprintf("bios boot: %s, ", formatSizeMiB(biosBootSizeMiB))
+	}
+	if l.Subvolumes {
+		return fmt.Sprintf("%sboot: %s, root: %s, var: %s",
+			bios, formatSizeMiB(l.BootSizeMiB), formatSizeMiB(l.RootSizeMiB), varDesc)
+	}
+	return fmt.Sprintf("%sboot: %s, root1/root2: %s each, var: %s",
+		bios, formatSizeMiB(l.BootSizeMiB), formatSizeMiB(l.RootSizeMiB), varDesc)
+}
+
+// formatSizeMiB formats a MiB count using the largest whole binary unit, in
+// the same form accepted by parseSizeMiB and sgdisk.
+func formatSizeMiB(mib uint64) string {
+	switch {
+	case mib != 0 && mib%(1024*1024) == 0:
+		return fmt.Sprintf("%dT", mib/(1024*1024))
+	case mib != 0 && mib%1024 == 0:
+		return fmt.Sprintf("%dG", mib/1024)
+	default:
+		return fmt.Sprintf("%dM", mib)
+	}
+}
@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestParsePartitionLayout(t *testing.T) {
+	tests := []struct {
+		name                string
+		boot, root, varSize string
+		wantBoot, wantRoot  uint64
+		wantVarSize         uint64
+		wantVarPercent      int
+		wantErr             bool
+	}{
+		{name: "defaults", wantBoot: DefaultBootSizeMiB, wantRoot: DefaultRootSizeMiB},
+		{name: "gigabytes", boot: "1G", root: "20G", varSize: "100G", wantBoot: 1024, wantRoot: 20 * 1024, wantVarSize: 100 * 1024},
+		{name: "binary suffixes", boot: "512MiB", root: "8GiB", wantBoot: 512, wantRoot: 8 * 1024},
+		{name: "var percentage", varSize: "50%", wantBoot: DefaultBootSizeMiB, wantRoot: DefaultRootSizeMiB, wantVarPercent: 50},
+		{name: "terabytes", varSize: "1T", wantBoot: DefaultBootSizeMiB, wantRoot: DefaultRootSizeMiB, wantVarSize: 1024 * 1024},
+		{name: "missing unit", root: "20", wantErr: true},
+		{name: "boot too small", boot: "100M", wantErr: true},
+		{name: "root too small", root: "1G", wantErr: true},
+		{name: "var too small", varSize: "512M", wantErr: true},
+		{name: "zero percent", varSize: "0%", wantErr: true},
+		{name: "over 100 percent", varSize: "150%", wantErr: true},
+		{name: "garbage", boot: "lots", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := ParsePartitionLayout(tt.boot, tt.root, tt.varSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParsePartitionLayout() = %+v, want error", layout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePartitionLayout() error = %v", err)
+			}
+			if layout.BootSizeMiB != tt.wantBoot || layout.RootSizeMiB != tt.wantRoot ||
+				layout.VarSizeMiB != tt.wantVarSize || layout.VarPercent != tt.wantVarPercent {
+				t.Errorf("ParsePartitionLayout() = %+v", layout)
+			}
+		})
+	}
+}
+
+func TestPartitionLayoutVarSize(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	layout := &PartitionLayout{BootSizeMiB: 1024, RootSizeMiB: 8 * 1024, VarPercent: 50}
+
+	// 64GB disk: 64G - 1G - 16G - 2M overhead leaves 47G - 2M, half for /var
+	size, err := layout.varSizeMiB(64 * gib)
+	if err != nil {
+		t.Fatalf("varSizeMiB() error = %v", err)
+	}
+	if want := uint64((47*1024 - gptOverheadMiB) / 2); size != want {
+		t.Errorf("varSizeMiB() = %d, want %d", size, want)
+	}
+
+	if _, err := layout.varSizeMiB(18 * gib); err == nil {
+		t.Error("varSizeMiB() should fail when the percentage leaves less than the minimum")
+	}
+
+	layout.VarPercent = 100
+	if size, err := layout.varSizeMiB(64 * gib); err != nil || size != 0 {
+		t.Errorf("varSizeMiB() at 100%% = %d, %v; want 0 (remaining space)", size, err)
+	}
+}
+
+func TestPartitionLayoutMinDiskSize(t *testing.T) {
+	const mib = 1024 * 1024
+	layout := DefaultPartitionLayout()
+	if want := uint64(2048+2*12288+MinVarSizeMiB+gptOverheadMiB) * mib; layout.MinDiskSize() != want {
+		t.Errorf("default MinDiskSize() = %d, want %d", layout.MinDiskSize(), want)
+	}
+
+	layout = &PartitionLayout{BootSizeMiB: 512, RootSizeMiB: 4096, VarSizeMiB: 8192}
+	if want := uint64(512+2*4096+8192+gptOverheadMiB) * mib; layout.MinDiskSize() != want {
+		t.Errorf("MinDiskSize() = %d, want %d", layout.MinDiskSize(), want)
+	}
+}
+
+func TestPartitionLayoutSubvolumes(t *testing.T) {
+	const mib = 1024 * 1024
+	layout := &PartitionLayout{BootSizeMiB: 2048, RootSizeMiB: DefaultSubvolumeRootSizeMiB, Subvolumes: true}
+	if want := uint64(2048+DefaultSubvolumeRootSizeMiB+MinVarSizeMiB+gptOverheadMiB) * mib; layout.MinDiskSize() != want {
+		t.Errorf("MinDiskSize() = %d, want %d", layout.MinDiskSize(), want)
+	}
+	if got, want := layout.String(), "boot: 2G, root: 24G, var: remaining space"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestPartitionLayoutBIOSBoot(t *testing.T) {
+	const mib = 1024 * 1024
+	layout := DefaultPartitionLayout()
+	layout.BIOSBoot = true
+	if want := uint64(2048+2*12288+MinVarSizeMiB+gptOverheadMiB+biosBootSizeMiB) * mib; layout.MinDiskSize() != want {
+		t.Errorf("MinDiskSize() = %d, want %d", layout.MinDiskSize(), want)
+	}
+	if got, want := layout.String(), "bios boot: 1M, boot: 2G, root1/root2: 12G each, var: remaining space"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatSizeMiB(t *testing.T) {
+	tests := map[uint64]string{
+		512:         "512M",
+		1024:        "1G",
+		1536:        "1536M",
+		12 * 1024:   "12G",
+		1024 * 1024: "1T",
+	}
+	for in, want := range tests {
+		if got := formatSizeMiB(in); got != want {
+			t.Errorf("formatSizeMiB(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -17,6 +17,7 @@ type LUKSConfig struct {
 	Passphrase string // Passphrase for LUKS (mutually exclusive with Keyfile)
 	Keyfile    string // Path to keyfile containing passphrase (mutually exclusive with Passphrase)
 	TPM2       bool
+	TPM2Policy *TPM2Policy // PCR policy of the TPM2 key (nil = no PCR binding)
 }
 
 // LUKSDevice represents an opened LUKS container
@@ -172,13 +173,14 @@ func GetLUKSUUID(ctx context.Context, partition string) (string, error) {
 	return uuid, nil
 }
 
-// EnrollTPM2 enrolls a TPM2 key for automatic unlock with no PCRs
+// EnrollTPM2 enrolls a TPM2 key for automatic unlock, bound to the PCR policy
+// in config (no PCRs when it has none)
 func EnrollTPM2(ctx context.Context, partition string, config *LUKSConfig, progress reporter.Reporter) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	progress.Message("Enrolling TPM2 key on %s (no PCRs)", partition)
+	progress.Message("Enrolling TPM2 key on %s (%s)", partition, config.TPM2Policy)
 
 	var keyFilePath string
 	var cleanup func()
@@ -200,13 +202,9 @@ func EnrollTPM2(ctx context.Context, partition string, config *LUKSConfig, progr
 	}
 	defer cleanup()
 
-	// Use systemd-cryptenroll to add TPM2 key with no PCR binding
-	cmd := exec.CommandContext(ctx, "systemd-cryptenroll",
-		"--unlock-key-file="+keyFilePath,
-		"--tpm2-device=auto",
-		"--tpm2-pcrs=", // Empty PCRs = no binding
-		partition,
-	)
+	// Use systemd-cryptenroll to add the TPM2 key with the configured policy
+	args := append([]string{"--unlock-key-file=" + keyFilePath, "--tpm2-device=auto"}, config.TPM2Policy.cryptenrollArgs()...)
+	cmd := exec.CommandContext(ctx, "systemd-cryptenroll", append(args, partition)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
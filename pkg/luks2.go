@@ -0,0 +1,398 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/frostyard/nbc/pkg/types"
+)
+
+// LUKS2 on-disk header layout, see
+// https://gitlab.com/cryptsetup/LUKS2-docs/blob/main/luks2_doc_wip.pdf
+const (
+	luks2BinaryHeaderSize = 4096
+	luks2MinHeaderSize    = 0x4000   // Smallest hdr_size (binary header + JSON area)
+	luks2MaxHeaderSize    = 0x400000 // Largest hdr_size
+	luks2ChecksumOffset   = 448
+	luks2ChecksumLength   = 64
+)
+
+var (
+	luks2PrimaryMagic   = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+	luks2SecondaryMagic = []byte{'S', 'K', 'U', 'L', 0xba, 0xbe}
+)
+
+// luks2BinaryHeader is the fixed-size binary header that precedes the JSON
+// metadata area of each of the two LUKS2 header copies
+type luks2BinaryHeader struct {
+	Magic     [6]byte
+	Version   uint16
+	HdrSize   uint64
+	SeqID     uint64
+	Label     [48]byte
+	CsumAlg   [32]byte
+	Salt      [64]byte
+	UUID      [40]byte
+	Subsystem [48]byte
+	HdrOffset uint64
+	_         [184]byte
+	Csum      [64]byte
+}
+
+// LUKS2Header is the read-only view of a LUKS2 header that nbc reports on
+type LUKS2Header struct {
+	UUID      string
+	Label     string
+	Subsystem string
+	SeqID     uint64
+	Keyslots  []LUKS2Keyslot
+	Tokens    []LUKS2Token
+	Segments  []LUKS2Segment
+}
+
+// LUKS2Keyslot is a keyslot of the JSON metadata
+type LUKS2Keyslot struct {
+	ID       int
+	Type     string // "luks2" for regular keyslots
+	KeySize  int    // Size of the stored volume key in bytes
+	Priority int    // 0 = ignore, 1 = normal, 2 = high
+	KDF      LUKS2KDF
+}
+
+// LUKS2KDF holds the PBKDF parameters of a keyslot
+type LUKS2KDF struct {
+	Type       string // pbkdf2, argon2i or argon2id
+	Hash       string // pbkdf2 only
+	Iterations int    // pbkdf2 only
+	Time       int    // argon2 only: iterations
+	Memory     int    // argon2 only: KiB
+	CPUs       int    // argon2 only: parallel threads
+}
+
+// LUKS2Token is a token of the JSON metadata, e.g. a systemd-tpm2 token
+type LUKS2Token struct {
+	ID       int
+	Type     string
+	Keyslots []int
+	TPM2PCRs []int // systemd-tpm2 tokens only
+}
+
+// LUKS2Segment is a data segment of the JSON metadata
+type LUKS2Segment struct {
+	ID         int
+	Type       string // "crypt" for encrypted data
+	Encryption string // e.g. aes-xts-plain64
+	SectorSize int
+	Offset     string // Bytes from the start of the device
+	Size       string // Bytes, or "dynamic" for the rest of the device
+}
+
+// luks2Metadata mirrors the parts of the JSON metadata area nbc reads
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Type     string `json:"type"`
+		KeySize  int    `json:"key_size"`
+		Priority *int   `json:"priority"`
+		KDF      struct {
+			Type       string `json:"type"`
+			Hash       string `json:"hash"`
+			Iterations int    `json:"iterations"`
+			Time       int    `json:"time"`
+			Memory     int    `json:"memory"`
+			CPUs       int    `json:"cpus"`
+		} `json:"kdf"`
+	} `json:"keyslots"`
+	Tokens map[string]struct {
+		Type     string   `json:"type"`
+		Keyslots []string `json:"keyslots"`
+		TPM2PCRs []int    `json:"tpm2-pcrs"`
+	} `json:"tokens"`
+	Segments map[string]struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		Encryption string `json:"encryption"`
+		SectorSize int    `json:"sector_size"`
+	} `json:"segments"`
+}
+
+// ReadLUKS2Header reads the LUKS2 header of a device or image file without
+// cryptsetup. Of the two header copies, the valid one with the highest
+// sequence ID wins, as in cryptsetup.
+func ReadLUKS2Header(path string) (*LUKS2Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	header, err := parseLUKS2Header(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LUKS2 header of %s: %w", path, err)
+	}
+	return header, nil
+}
+
+// parseLUKS2Header reads both header copies from r. The secondary copy is
+// found at the primary's hdr_size, or by probing every valid size when the
+// primary is damaged.
+func parseLUKS2Header(r io.ReaderAt) (*LUKS2Header, error) {
+	primary, primaryErr := readLUKS2HeaderAt(r, 0, luks2PrimaryMagic)
+
+	offsets := []int64{}
+	if primary != nil {
+		offsets = append(offsets, int64(primary.hdrSize))
+	} else {
+		for size := int64(luks2MinHeaderSize); size <= luks2MaxHeaderSize; size *= 2 {
+			offsets = append(offsets, size)
+		}
+	}
+	var secondary *luks2HeaderCopy
+	for _, offset := range offsets {
+		if h, err := readLUKS2HeaderAt(r, offset, luks2SecondaryMagic); err == nil {
+			secondary = h
+			break
+		}
+	}
+
+	switch {
+	case primary == nil && secondary == nil:
+		return nil, primaryErr
+	case primary == nil:
+		return secondary.header, nil
+	case secondary != nil && secondary.header.SeqID > primary.header.SeqID:
+		return secondary.header, nil
+	default:
+		return primary.header, nil
+	}
+}
+
+// luks2HeaderCopy is one parsed copy of the header
+type luks2HeaderCopy struct {
+	header  *LUKS2Header
+	hdrSize uint64
+}
+
+// readLUKS2HeaderAt parses and verifies the header copy at offset
+func readLUKS2HeaderAt(r io.ReaderAt, offset int64, magic []byte) (*luks2HeaderCopy, error) {
+	buf := make([]byte, luks2BinaryHeaderSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("failed to read binary header: %w", err)
+	}
+
+	var bin luks2BinaryHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &bin); err != nil {
+		return nil, fmt.Errorf("failed to decode binary header: %w", err)
+	}
+	if !bytes.Equal(bin.Magic[:], magic) {
+		return nil, errors.New("not a LUKS header")
+	}
+	if bin.Version != 2 {
+		return nil, fmt.Errorf("unsupported LUKS version %d", bin.Version)
+	}
+	if bin.HdrSize < luks2MinHeaderSize || bin.HdrSize > luks2MaxHeaderSize || bin.HdrSize&(bin.HdrSize-1) != 0 {
+		return nil, fmt.Errorf("invalid header size %d", bin.HdrSize)
+	}
+	if bin.HdrOffset != uint64(offset) {
+		return nil, fmt.Errorf("header offset %d does not match its location %d", bin.HdrOffset, offset)
+	}
+
+	area := make([]byte, bin.HdrSize)
+	if _, err := r.ReadAt(area, offset); err != nil {
+		return nil, fmt.Errorf("failed to read metadata area: %w", err)
+	}
+	if alg := cString(bin.CsumAlg[:]); alg != "sha256" {
+		return nil, fmt.Errorf("unsupported header checksum %q", alg)
+	}
+	if !bytes.Equal(luks2Checksum(area), bin.Csum[:sha256.Size]) {
+		return nil, errors.New("header checksum mismatch")
+	}
+
+	// The JSON metadata is NUL-padded to the end of the area
+	jsonArea := area[luks2BinaryHeaderSize:]
+	if end := bytes.IndexByte(jsonArea, 0); end >= 0 {
+		jsonArea = jsonArea[:end]
+	}
+	var meta luks2Metadata
+	if err := json.Unmarshal(jsonArea, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON metadata: %w", err)
+	}
+
+	header := &LUKS2Header{
+		UUID:      cString(bin.UUID[:]),
+		Label:     cString(bin.Label[:]),
+		Subsystem: cString(bin.Subsystem[:]),
+		SeqID:     bin.SeqID,
+	}
+	for id, ks := range meta.Keyslots {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot ID %q", id)
+		}
+		priority := 1
+		if ks.Priority != nil {
+			priority = *ks.Priority
+		}
+		header.Keyslots = append(header.Keyslots, LUKS2Keyslot{
+			ID:       n,
+			Type:     ks.Type,
+			KeySize:  ks.KeySize,
+			Priority: priority,
+			KDF:      LUKS2KDF(ks.KDF),
+		})
+	}
+	for id, tok := range meta.Tokens {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token ID %q", id)
+		}
+		token := LUKS2Token{ID: n, Type: tok.Type, TPM2PCRs: tok.TPM2PCRs}
+		for _, ks := range tok.Keyslots {
+			k, err := strconv.Atoi(ks)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keyslot %q in token %s", ks, id)
+			}
+			token.Keyslots = append(token.Keyslots, k)
+		}
+		header.Tokens = append(header.Tokens, token)
+	}
+	for id, seg := range meta.Segments {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment ID %q", id)
+		}
+		header.Segments = append(header.Segments, LUKS2Segment{
+			ID:         n,
+			Type:       seg.Type,
+			Encryption: seg.Encryption,
+			SectorSize: seg.SectorSize,
+			Offset:     seg.Offset,
+			Size:       seg.Size,
+		})
+	}
+
+	// JSON objects are unordered; report everything by ID
+	slices.SortFunc(header.Keyslots, func(a, b LUKS2Keyslot) int { return a.ID - b.ID })
+	slices.SortFunc(header.Tokens, func(a, b LUKS2Token) int { return a.ID - b.ID })
+	slices.SortFunc(header.Segments, func(a, b LUKS2Segment) int { return a.ID - b.ID })
+
+	return &luks2HeaderCopy{header: header, hdrSize: bin.HdrSize}, nil
+}
+
+// luks2Checksum computes the SHA-256 checksum of a header copy, taken over
+// the binary header and JSON area with the checksum field zeroed
+func luks2Checksum(area []byte) []byte {
+	h := sha256.New()
+	h.Write(area[:luks2ChecksumOffset])
+	h.Write(make([]byte, luks2ChecksumLength))
+	h.Write(area[luks2ChecksumOffset+luks2ChecksumLength:])
+	return h.Sum(nil)
+}
+
+// cString returns the NUL-terminated string at the start of b
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Cipher returns the encryption of the first crypt segment
+func (h *LUKS2Header) Cipher() string {
+	for _, seg := range h.Segments {
+		if seg.Type == "crypt" {
+			return seg.Encryption
+		}
+	}
+	return ""
+}
+
+// TPM2Token returns the first systemd-tpm2 token, or nil when none is enrolled
+func (h *LUKS2Header) TPM2Token() *LUKS2Token {
+	for i := range h.Tokens {
+		if h.Tokens[i].Type == "systemd-tpm2" {
+			return &h.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// luksVolumeStatus describes the LUKS2 header of partition for nbc status
+func luksVolumeStatus(name, partition string) types.LUKSVolumeStatus {
+	status := types.LUKSVolumeStatus{Name: name, Partition: partition}
+	header, err := ReadLUKS2Header(partition)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	status.UUID = header.UUID
+	status.Cipher = header.Cipher()
+	for _, seg := range header.Segments {
+		if seg.Type == "crypt" {
+			status.SectorSize = seg.SectorSize
+			break
+		}
+	}
+	for _, ks := range header.Keyslots {
+		kdf := types.LUKSKeyslotStatus{
+			ID:         ks.ID,
+			KDF:        ks.KDF.Type,
+			Hash:       ks.KDF.Hash,
+			Iterations: ks.KDF.Iterations,
+			Time:       ks.KDF.Time,
+			MemoryKiB:  ks.KDF.Memory,
+			CPUs:       ks.KDF.CPUs,
+		}
+		for _, tok := range header.Tokens {
+			if slices.Contains(tok.Keyslots, ks.ID) {
+				kdf.Token = tok.Type
+			}
+		}
+		status.Keyslots = append(status.Keyslots, kdf)
+	}
+	if tok := header.TPM2Token(); tok != nil {
+		status.TPM2 = true
+		status.TPM2PCRs = tok.TPM2PCRs
+	}
+	return status
+}
+
+// GetEncryptionStatus reads the LUKS2 headers of the encrypted partitions
+// recorded in config. A partition that cannot be found or read is reported
+// with an error.
+func GetEncryptionStatus(config *SystemConfig) []types.LUKSVolumeStatus {
+	if config.Encryption == nil || !config.Encryption.Enabled {
+		return nil
+	}
+
+	var volumes []types.LUKSVolumeStatus
+	for _, vol := range []struct{ name, uuid string }{
+		{"root1", config.Encryption.Root1LUKSUUID},
+		{"root2", config.Encryption.Root2LUKSUUID},
+		{"var", config.Encryption.VarLUKSUUID},
+	} {
+		if vol.uuid == "" {
+			continue
+		}
+		partition, err := resolveLUKSPartition(vol.uuid)
+		if err != nil {
+			volumes = append(volumes, types.LUKSVolumeStatus{
+				Name:  vol.name,
+				UUID:  vol.uuid,
+				Error: fmt.Sprintf("partition with LUKS UUID %s not found", vol.uuid),
+			})
+			continue
+		}
+		volumes = append(volumes, luksVolumeStatus(vol.name, partition))
+	}
+	return volumes
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The fixtures in testdata/luks2 are the 32 KiB header areas (both header
+// copies, no keyslot or data areas) of LUKS2 volumes: passphrase.img has one
+// argon2id keyslot, tpm2.img also has a pbkdf2 keyslot used by a systemd-tpm2
+// token bound to PCR 7.
+
+func TestReadLUKS2Header(t *testing.T) {
+	header, err := ReadLUKS2Header(filepath.Join("testdata", "luks2", "tpm2.img"))
+	if err != nil {
+		t.Fatalf("ReadLUKS2Header() error = %v", err)
+	}
+
+	if header.UUID != "5d3c9e2b-1f4a-4b6d-8e7c-2a9f0b1c3d4e" || header.Label != "root1" || header.SeqID != 5 {
+		t.Errorf("header = %q %q seqid %d", header.UUID, header.Label, header.SeqID)
+	}
+	if got := header.Cipher(); got != "aes-xts-plain64" {
+		t.Errorf("Cipher() = %q, want aes-xts-plain64", got)
+	}
+	wantKeyslots := []LUKS2Keyslot{
+		{ID: 0, Type: "luks2", KeySize: 64, Priority: 1, KDF: LUKS2KDF{Type: "argon2id", Time: 4, Memory: 1048576, CPUs: 4}},
+		{ID: 1, Type: "luks2", KeySize: 64, Priority: 1, KDF: LUKS2KDF{Type: "pbkdf2", Hash: "sha512", Iterations: 1000}},
+	}
+	if !reflect.DeepEqual(header.Keyslots, wantKeyslots) {
+		t.Errorf("Keyslots = %+v, want %+v", header.Keyslots, wantKeyslots)
+	}
+	wantSegments := []LUKS2Segment{{ID: 0, Type: "crypt", Encryption: "aes-xts-plain64", SectorSize: 4096, Offset: "16777216", Size: "dynamic"}}
+	if !reflect.DeepEqual(header.Segments, wantSegments) {
+		t.Errorf("Segments = %+v, want %+v", header.Segments, wantSegments)
+	}
+	tok := header.TPM2Token()
+	if tok == nil {
+		t.Fatal("TPM2Token() = nil, want the systemd-tpm2 token")
+	}
+	if want := (LUKS2Token{ID: 0, Type: "systemd-tpm2", Keyslots: []int{1}, TPM2PCRs: []int{7}}); !reflect.DeepEqual(*tok, want) {
+		t.Errorf("TPM2Token() = %+v, want %+v", *tok, want)
+	}
+
+	header, err = ReadLUKS2Header(filepath.Join("testdata", "luks2", "passphrase.img"))
+	if err != nil {
+		t.Fatalf("ReadLUKS2Header() error = %v", err)
+	}
+	if len(header.Keyslots) != 1 || header.TPM2Token() != nil {
+		t.Errorf("passphrase.img: %d keyslots, TPM2 token %v", len(header.Keyslots), header.TPM2Token())
+	}
+}
+
+func TestReadLUKS2Header_Damaged(t *testing.T) {
+	image, err := os.ReadFile(filepath.Join("testdata", "luks2", "tpm2.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted primary header falls back to the secondary copy
+	damaged := bytes.Clone(image)
+	damaged[luks2BinaryHeaderSize+10] ^= 0xff
+	if _, err := readLUKS2HeaderAt(bytes.NewReader(damaged), 0, luks2PrimaryMagic); err == nil {
+		t.Error("readLUKS2HeaderAt() should detect the checksum mismatch")
+	}
+	header, err := parseLUKS2Header(bytes.NewReader(damaged))
+	if err != nil {
+		t.Fatalf("parseLUKS2Header() with damaged primary error = %v", err)
+	}
+	if header.TPM2Token() == nil {
+		t.Error("secondary header should carry the TPM2 token")
+	}
+
+	// Both copies damaged
+	damaged[luks2MinHeaderSize+luks2BinaryHeaderSize+10] ^= 0xff
+	if _, err := parseLUKS2Header(bytes.NewReader(damaged)); err == nil {
+		t.Error("parseLUKS2Header() should fail when both copies are damaged")
+	}
+
+	// Not LUKS at all
+	if _, err := parseLUKS2Header(bytes.NewReader(make([]byte, 2*luks2MinHeaderSize))); err == nil {
+		t.Error("parseLUKS2Header() should reject a device without a LUKS header")
+	}
+}
+
+func TestLUKSVolumeStatus(t *testing.T) {
+	status := luksVolumeStatus("root1", filepath.Join("testdata", "luks2", "tpm2.img"))
+	if status.Error != "" {
+		t.Fatalf("luksVolumeStatus() error = %s", status.Error)
+	}
+	if !status.TPM2 || !reflect.DeepEqual(status.TPM2PCRs, []int{7}) || status.Cipher != "aes-xts-plain64" || status.SectorSize != 4096 {
+		t.Errorf("luksVolumeStatus() = %+v", status)
+	}
+	if len(status.Keyslots) != 2 || status.Keyslots[0].Token != "" || status.Keyslots[1].Token != "systemd-tpm2" {
+		t.Errorf("Keyslots = %+v, want keyslot 1 used by the systemd-tpm2 token", status.Keyslots)
+	}
+
+	if status := luksVolumeStatus("var", filepath.Join(t.TempDir(), "missing")); status.Error == "" {
+		t.Error("luksVolumeStatus() should report an unreadable partition")
+	}
+}
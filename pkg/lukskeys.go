@@ -0,0 +1,436 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+)
+
+// luks2MaxKeyslots is the number of keyslots a LUKS2 header can hold
+const luks2MaxKeyslots = 32
+
+// LUKSKeyOptions configures a LUKS key management operation. Every operation
+// acts on all encrypted partitions recorded in the system config, so root1,
+// root2 and var always share the same keys.
+type LUKSKeyOptions struct {
+	// Passphrase is an existing passphrase or recovery key that unlocks the
+	// partitions. Not needed to wipe TPM2 tokens.
+	Passphrase string
+
+	// DryRun reports what would change without changing it.
+	DryRun bool
+}
+
+// luksVolume is an encrypted partition recorded in the system config
+type luksVolume struct {
+	Name      string // root1, root2 or var
+	Partition string
+}
+
+// resolveLUKSPartition finds the partition holding the LUKS container with
+// luksUUID, through its /dev/disk/by-uuid link or blkid.
+func resolveLUKSPartition(luksUUID string) (string, error) {
+	if partition, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-uuid", luksUUID)); err == nil {
+		return partition, nil
+	}
+	partition, err := findPartitionByLUKSUUID(luksUUID)
+	if err != nil {
+		return "", err
+	}
+	if partition == "" {
+		return "", fmt.Errorf("partition with LUKS UUID %s not found", luksUUID)
+	}
+	return partition, nil
+}
+
+// luksVolumes resolves the encrypted partitions recorded in config
+func luksVolumes(config *SystemConfig) ([]luksVolume, error) {
+	if config.Encryption == nil || !config.Encryption.Enabled {
+		return nil, errors.New("this system is not encrypted")
+	}
+
+	var volumes []luksVolume
+	for _, vol := range []struct{ name, uuid string }{
+		{"root1", config.Encryption.Root1LUKSUUID},
+		{"root2", config.Encryption.Root2LUKSUUID},
+		{"var", config.Encryption.VarLUKSUUID},
+	} {
+		if vol.uuid == "" {
+			continue
+		}
+		partition, err := resolveLUKSPartition(vol.uuid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find %s partition: %w", vol.name, err)
+		}
+		volumes = append(volumes, luksVolume{Name: vol.name, Partition: partition})
+	}
+	if len(volumes) == 0 {
+		return nil, errors.New("no encrypted partitions recorded in the system config")
+	}
+	return volumes, nil
+}
+
+// luksKeyTargets takes the system lock and returns the system config and its
+// encrypted partitions. The caller must release the lock.
+func luksKeyTargets() (*FileLock, *SystemConfig, []luksVolume, error) {
+	lock, err := AcquireSystemLock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	config, err := ReadSystemConfig()
+	if err != nil {
+		_ = lock.Release()
+		return nil, nil, nil, fmt.Errorf("failed to read system config: %w", err)
+	}
+	volumes, err := luksVolumes(config)
+	if err != nil {
+		_ = lock.Release()
+		return nil, nil, nil, err
+	}
+	return lock, config, volumes, nil
+}
+
+// volumePartitions returns the partitions of volumes
+func volumePartitions(volumes []luksVolume) []string {
+	partitions := make([]string, len(volumes))
+	for i, vol := range volumes {
+		partitions[i] = vol.Partition
+	}
+	return partitions
+}
+
+// checkLUKSPassphrase verifies that the passphrase in keyFile unlocks every
+// volume, so a key operation never changes only some of the partitions.
+func checkLUKSPassphrase(ctx context.Context, volumes []luksVolume, keyFile string) error {
+	for _, vol := range volumes {
+		cmd := exec.CommandContext(ctx, "cryptsetup", "open", "--test-passphrase", "--key-file="+keyFile, vol.Partition)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("passphrase does not unlock %s (%s): %w\nOutput: %s", vol.Name, vol.Partition, err, string(output))
+		}
+	}
+	return nil
+}
+
+// passphraseKeyslots returns the keyslots that can be unlocked by typing a
+// key: every keyslot except those of TPM2, FIDO2 and PKCS#11 tokens.
+// Recovery keys count, since they can be typed at the passphrase prompt.
+func passphraseKeyslots(h *LUKS2Header) []int {
+	var slots []int
+	for _, ks := range h.Keyslots {
+		hardware := false
+		for _, tok := range h.Tokens {
+			if tok.Type != "systemd-recovery" && slices.Contains(tok.Keyslots, ks.ID) {
+				hardware = true
+			}
+		}
+		if !hardware {
+			slots = append(slots, ks.ID)
+		}
+	}
+	return slots
+}
+
+// freeLUKS2Keyslot returns the lowest keyslot ID not in use
+func freeLUKS2Keyslot(h *LUKS2Header) (int, error) {
+	for id := range luks2MaxKeyslots {
+		if !slices.ContainsFunc(h.Keyslots, func(ks LUKS2Keyslot) bool { return ks.ID == id }) {
+			return id, nil
+		}
+	}
+	return 0, errors.New("no free keyslot")
+}
+
+// recoveryKeyAlphabet is the "modhex" alphabet systemd uses for recovery keys;
+// its characters sit at the same place on most keyboard layouts
+const recoveryKeyAlphabet = "cbdefghijklnrtuv"
+
+// newRecoveryKey generates a 256-bit recovery key in the format of
+// systemd-cryptenroll --recovery-key: 64 modhex characters in groups of 8
+func newRecoveryKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate recovery key: %w", err)
+	}
+	var key strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			key.WriteByte('-')
+		}
+		key.WriteByte(recoveryKeyAlphabet[c>>4])
+		key.WriteByte(recoveryKeyAlphabet[c&0x0f])
+	}
+	return key.String(), nil
+}
+
+// addLUKSKey adds the key in newKeyFile to partition, unlocking with keyFile.
+// A keyslot of -1 lets cryptsetup pick one.
+func addLUKSKey(ctx context.Context, partition, keyFile, newKeyFile string, keyslot int) error {
+	args := []string{"luksAddKey", "--batch-mode", "--key-file=" + keyFile}
+	if keyslot >= 0 {
+		args = append(args, "--key-slot="+strconv.Itoa(keyslot))
+	}
+	args = append(args, partition, newKeyFile)
+	if output, err := exec.CommandContext(ctx, "cryptsetup", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add key to %s: %w\nOutput: %s", partition, err, string(output))
+	}
+	return nil
+}
+
+// AddLUKSPassphrase adds newPassphrase to every encrypted partition.
+func AddLUKSPassphrase(ctx context.Context, opts LUKSKeyOptions, newPassphrase string, progress reporter.Reporter) (*types.LUKSKeyOutput, error) {
+	if newPassphrase == "" && !opts.DryRun {
+		return nil, errors.New("new passphrase must not be empty")
+	}
+	lock, _, volumes, err := luksKeyTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	output := &types.LUKSKeyOutput{Action: "passphrase-add", Partitions: volumePartitions(volumes), DryRun: opts.DryRun}
+	if opts.DryRun {
+		output.Message = fmt.Sprintf("Would add a passphrase to %d encrypted partitions", len(volumes))
+		return output, nil
+	}
+
+	keyFile, cleanup, err := writeEphemeralKeyFile(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	newKeyFile, cleanupNew, err := writeEphemeralKeyFile(newPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupNew()
+
+	if err := checkLUKSPassphrase(ctx, volumes, keyFile); err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes {
+		progress.Message("Adding passphrase to %s (%s)...", vol.Name, vol.Partition)
+		if err := addLUKSKey(ctx, vol.Partition, keyFile, newKeyFile, -1); err != nil {
+			return nil, err
+		}
+	}
+
+	output.Message = fmt.Sprintf("Added a passphrase to %d encrypted partitions", len(volumes))
+	return output, nil
+}
+
+// RemoveLUKSPassphrase removes the keyslot opts.Passphrase unlocks from every
+// encrypted partition. It refuses to remove the last key that can be typed,
+// since the TPM2 token alone gives no way in when the TPM refuses to unseal.
+func RemoveLUKSPassphrase(ctx context.Context, opts LUKSKeyOptions, progress reporter.Reporter) (*types.LUKSKeyOutput, error) {
+	lock, _, volumes, err := luksKeyTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	for _, vol := range volumes {
+		header, err := ReadLUKS2Header(vol.Partition)
+		if err != nil {
+			return nil, err
+		}
+		if len(passphraseKeyslots(header)) < 2 {
+			return nil, fmt.Errorf("refusing to remove the last passphrase of %s; add another passphrase or a recovery key first", vol.Name)
+		}
+	}
+
+	output := &types.LUKSKeyOutput{Action: "passphrase-remove", Partitions: volumePartitions(volumes), DryRun: opts.DryRun}
+	if opts.DryRun {
+		output.Message = fmt.Sprintf("Would remove the passphrase from %d encrypted partitions", len(volumes))
+		return output, nil
+	}
+
+	keyFile, cleanup, err := writeEphemeralKeyFile(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := checkLUKSPassphrase(ctx, volumes, keyFile); err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes {
+		progress.Message("Removing passphrase from %s (%s)...", vol.Name, vol.Partition)
+		cmd := exec.CommandContext(ctx, "cryptsetup", "luksRemoveKey", "--batch-mode", vol.Partition, keyFile)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to remove passphrase from %s: %w\nOutput: %s", vol.Partition, err, string(out))
+		}
+	}
+
+	output.Message = fmt.Sprintf("Removed the passphrase from %d encrypted partitions", len(volumes))
+	return output, nil
+}
+
+// AddLUKSRecoveryKey generates a recovery key and adds it to every encrypted
+// partition, marked with a systemd-recovery token as systemd-cryptenroll
+// does. The same key unlocks all partitions; it is returned in the output and
+// not stored anywhere.
+func AddLUKSRecoveryKey(ctx context.Context, opts LUKSKeyOptions, progress reporter.Reporter) (*types.LUKSKeyOutput, error) {
+	lock, _, volumes, err := luksKeyTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	output := &types.LUKSKeyOutput{Action: "recovery-key", Partitions: volumePartitions(volumes), DryRun: opts.DryRun}
+	if opts.DryRun {
+		output.Message = fmt.Sprintf("Would add a recovery key to %d encrypted partitions", len(volumes))
+		return output, nil
+	}
+
+	recoveryKey, err := newRecoveryKey()
+	if err != nil {
+		return nil, err
+	}
+	keyFile, cleanup, err := writeEphemeralKeyFile(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	recoveryKeyFile, cleanupRecovery, err := writeEphemeralKeyFile(recoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupRecovery()
+
+	if err := checkLUKSPassphrase(ctx, volumes, keyFile); err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes {
+		header, err := ReadLUKS2Header(vol.Partition)
+		if err != nil {
+			return nil, err
+		}
+		keyslot, err := freeLUKS2Keyslot(header)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", vol.Partition, err)
+		}
+
+		progress.Message("Adding recovery key to %s (%s, keyslot %d)...", vol.Name, vol.Partition, keyslot)
+		if err := addLUKSKey(ctx, vol.Partition, keyFile, recoveryKeyFile, keyslot); err != nil {
+			return nil, err
+		}
+		token := fmt.Sprintf(`{"type":"systemd-recovery","keyslots":["%d"]}`, keyslot)
+		cmd := exec.CommandContext(ctx, "cryptsetup", "token", "import", "--json-file=-", vol.Partition)
+		cmd.Stdin = strings.NewReader(token)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			// The key works without its token; the token only labels it
+			progress.Warning("failed to add recovery token to %s: %v\nOutput: %s", vol.Partition, err, string(out))
+		}
+	}
+
+	output.RecoveryKey = recoveryKey
+	output.Message = fmt.Sprintf("Added a recovery key to %d encrypted partitions", len(volumes))
+	return output, nil
+}
+
+// WipeLUKSTPM2 removes the TPM2 tokens and keyslots from every encrypted
+// partition and records that TPM2 unlock is disabled, so updates stop trying
+// it. Partitions then unlock with a passphrase or recovery key only. The boot
+// entries and /etc/crypttab are left as they are: they keep asking for
+// tpm2-device=auto, which finds no token, until the next update rewrites them.
+func WipeLUKSTPM2(ctx context.Context, opts LUKSKeyOptions, progress reporter.Reporter) (*types.LUKSKeyOutput, error) {
+	lock, config, volumes, err := luksKeyTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	output := &types.LUKSKeyOutput{Action: "tpm2-wipe", Partitions: volumePartitions(volumes), DryRun: opts.DryRun}
+	if opts.DryRun {
+		output.Message = fmt.Sprintf("Would wipe TPM2 keys from %d encrypted partitions", len(volumes))
+		return output, nil
+	}
+
+	for _, vol := range volumes {
+		progress.Message("Wiping TPM2 key from %s (%s)...", vol.Name, vol.Partition)
+		cmd := exec.CommandContext(ctx, "systemd-cryptenroll", "--wipe-slot=tpm2", vol.Partition)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to wipe TPM2 key from %s: %w\nOutput: %s", vol.Partition, err, string(out))
+		}
+	}
+
+	config.Encryption.TPM2 = false
+	if err := WriteSystemConfig(ctx, config, false, progress); err != nil {
+		return nil, err
+	}
+
+	output.Message = fmt.Sprintf("Wiped TPM2 keys from %d encrypted partitions; the boot entries stop trying TPM2 unlock with the next update", len(volumes))
+	return output, nil
+}
+
+// EnrollLUKSTPM2 replaces the TPM2 keys of every encrypted partition with
+// fresh ones sealed to the current PCR values. pcrs overrides the PCRs of the
+// recorded policy (a signed PCR 11 policy is kept); nil keeps them. Like
+// WipeLUKSTPM2, it leaves the boot entries and /etc/crypttab alone: on an
+// installation without TPM2 unlock they only ask for tpm2-device=auto once
+// the next update rewrites them.
+func EnrollLUKSTPM2(ctx context.Context, opts LUKSKeyOptions, pcrs []int, progress reporter.Reporter) (*types.LUKSKeyOutput, error) {
+	lock, config, volumes, err := luksKeyTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	var policy *TPM2Policy
+	if recorded := config.Encryption.TPM2Policy; recorded != nil {
+		copied := *recorded
+		policy = &copied
+	}
+	if pcrs != nil {
+		if policy == nil {
+			policy = &TPM2Policy{}
+		}
+		policy.PCRs = pcrs
+	}
+	if policy != nil && len(policy.PCRs) == 0 && policy.PublicKey == "" {
+		policy = nil
+	}
+
+	output := &types.LUKSKeyOutput{Action: "tpm2-enroll", Partitions: volumePartitions(volumes), DryRun: opts.DryRun}
+	if opts.DryRun {
+		output.Message = fmt.Sprintf("Would enroll TPM2 keys (%s) on %d encrypted partitions", policy, len(volumes))
+		return output, nil
+	}
+
+	keyFile, cleanup, err := writeEphemeralKeyFile(opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := checkLUKSPassphrase(ctx, volumes, keyFile); err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes {
+		if err := ResealTPM2(ctx, vol.Partition, opts.Passphrase, policy, progress); err != nil {
+			return nil, err
+		}
+	}
+
+	enabled := config.Encryption.TPM2
+	config.Encryption.TPM2 = true
+	config.Encryption.TPM2Policy = policy
+	if err := WriteSystemConfig(ctx, config, false, progress); err != nil {
+		return nil, err
+	}
+
+	output.Message = fmt.Sprintf("Enrolled TPM2 keys (%s) on %d encrypted partitions", policy, len(volumes))
+	if !enabled {
+		output.Message += "; the boot entries use them from the next update on"
+	}
+	return output, nil
+}
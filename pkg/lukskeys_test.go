@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestPassphraseKeyslots(t *testing.T) {
+	header, err := ReadLUKS2Header(filepath.Join("testdata", "luks2", "tpm2.img"))
+	if err != nil {
+		t.Fatalf("ReadLUKS2Header() error = %v", err)
+	}
+	// Keyslot 1 belongs to the systemd-tpm2 token
+	if got := passphraseKeyslots(header); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("passphraseKeyslots() = %v, want [0]", got)
+	}
+	if got, err := freeLUKS2Keyslot(header); err != nil || got != 2 {
+		t.Errorf("freeLUKS2Keyslot() = %d, %v, want 2", got, err)
+	}
+
+	// A recovery key can be typed, so it counts
+	header.Keyslots = append(header.Keyslots, LUKS2Keyslot{ID: 2})
+	header.Tokens = append(header.Tokens, LUKS2Token{ID: 1, Type: "systemd-recovery", Keyslots: []int{2}})
+	if got := passphraseKeyslots(header); !reflect.DeepEqual(got, []int{0, 2}) {
+		t.Errorf("passphraseKeyslots() with recovery key = %v, want [0 2]", got)
+	}
+
+	full := &LUKS2Header{}
+	for id := range luks2MaxKeyslots {
+		full.Keyslots = append(full.Keyslots, LUKS2Keyslot{ID: id})
+	}
+	if _, err := freeLUKS2Keyslot(full); err == nil {
+		t.Error("freeLUKS2Keyslot() should fail when every keyslot is used")
+	}
+}
+
+func TestNewRecoveryKey(t *testing.T) {
+	format := regexp.MustCompile(`^[cbdefghijklnrtuv]{8}(-[cbdefghijklnrtuv]{8}){7}$`)
+	a, err := newRecoveryKey()
+	if err != nil {
+		t.Fatalf("newRecoveryKey() error = %v", err)
+	}
+	if !format.MatchString(a) {
+		t.Errorf("newRecoveryKey() = %q, want 8 groups of 8 modhex characters", a)
+	}
+	if b, _ := newRecoveryKey(); a == b {
+		t.Error("newRecoveryKey() returned the same key twice")
+	}
+}
+
+func TestLUKSVolumes_NotEncrypted(t *testing.T) {
+	if _, err := luksVolumes(&SystemConfig{}); err == nil {
+		t.Error("luksVolumes() should fail on an unencrypted system")
+	}
+	if _, err := luksVolumes(&SystemConfig{Encryption: &EncryptionConfig{Enabled: true}}); err == nil {
+		t.Error("luksVolumes() should fail without recorded LUKS UUIDs")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/frostyard/std/reporter"
@@ -13,26 +15,51 @@ import (
 
 // PartitionScheme defines the disk partitioning layout
 type PartitionScheme struct {
-	BootPartition  string // Boot partition (EFI System Partition, FAT32, 2GB) - holds EFI binaries + kernel/initramfs
-	Root1Partition string // First root filesystem partition (12GB)
-	Root2Partition string // Second root filesystem partition (12GB)
-	VarPartition   string // /var partition (remaining space)
+	BootPartition  string // Boot partition (EFI System Partition, FAT32, 2GB by default) - holds EFI binaries + kernel/initramfs
+	Root1Partition string // First root filesystem partition (12GB by default)
+	Root2Partition string // Second root filesystem partition (12GB by default)
+	VarPartition   string // /var partition (remaining space by default)
 	FilesystemType string // Filesystem type for root/var partitions (ext4, btrfs)
 
+	// Subvolume layout (optional): Root1Partition is the only root partition
+	// and holds one btrfs subvolume per deployment; Root2Partition is empty
+	Subvolumes    bool
+	RootSubvolume string // Subvolume mounted as the root filesystem during install (e.g. deployments/1)
+
+	// Verity creates the root filesystems with fs-verity support, which
+	// composefs root images need (ext4 only; btrfs always supports it)
+	Verity bool
+
 	// LUKS encryption (optional)
 	Encrypted   bool          // Whether partitions are LUKS encrypted
 	LUKSDevices []*LUKSDevice // Opened LUKS devices (for cleanup)
 }
 
-// CreatePartitions creates a GPT partition table with EFI, boot, and root partitions
-func CreatePartitions(ctx context.Context, device string, dryRun bool, progress reporter.Reporter) (*PartitionScheme, error) {
+// CreatePartitions creates a GPT partition table with EFI, boot, and root partitions.
+// The partition sizes come from layout; nil uses DefaultPartitionLayout.
+func CreatePartitions(ctx context.Context, device string, layout *PartitionLayout, dryRun bool, progress reporter.Reporter) (*PartitionScheme, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	if layout == nil {
+		layout = DefaultPartitionLayout()
+	}
+	if err := layout.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid partition layout: %w", err)
+	}
+
 	if dryRun {
-		progress.MessagePlain("[DRY RUN] Would create partitions on %s", device)
+		progress.MessagePlain("[DRY RUN] Would create partitions on %s (%s)", device, layout)
 		deviceBase := filepath.Base(device)
+		if layout.Subvolumes {
+			return &PartitionScheme{
+				BootPartition:  "/dev/" + deviceBase + "1",
+				Root1Partition: "/dev/" + deviceBase + "2",
+				VarPartition:   "/dev/" + deviceBase + "3",
+				Subvolumes:     true,
+			}, nil
+		}
 		return &PartitionScheme{
 			BootPartition:  "/dev/" + deviceBase + "1",
 			Root1Partition: "/dev/" + deviceBase + "2",
@@ -41,29 +68,71 @@ func CreatePartitions(ctx context.Context, device string, dryRun bool, progress
 		}, nil
 	}
 
-	progress.MessagePlain("Creating GPT partition table...")
+	// A percentage-sized /var depends on the disk size
+	varEnd := "0"
+	if layout.VarSizeMiB != 0 || layout.VarPercent != 0 {
+		diskInfo, err := getDiskInfo(filepath.Base(device))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get disk size: %w", err)
+		}
+		varMiB, err := layout.varSizeMiB(diskInfo.Size)
+		if err != nil {
+			return nil, err
+		}
+		if varMiB != 0 {
+			varEnd = "+" + formatSizeMiB(varMiB)
+		}
+	}
+
+	progress.MessagePlain("Creating GPT partition table (%s)...", layout)
 
 	// Use sgdisk to create partitions
-	// Partition 1: Boot/EFI System Partition (2GB, FAT32) - holds EFI binaries + kernel/initramfs
-	// Partition 2: First root filesystem (12GB)
-	// Partition 3: Second root filesystem (12GB)
-	// Partition 4: /var partition (remaining space)
+	// Partition 1: Boot/EFI System Partition (FAT32) - holds EFI binaries + kernel/initramfs
+	// Partition 2: First root filesystem
+	// Partition 3: Second root filesystem
+	// Partition 4: /var partition
+	//
+	// The GPT partition names (boot, root1, root2, var) are how
+	// DetectExistingPartitionScheme finds the partitions at update time.
+	//
+	// A subvolume layout has a single root partition (named root) as
+	// partition 2 and /var as partition 3.
+	//
+	// A layout for legacy BIOS boot adds a BIOS boot partition (type EF02,
+	// named bios) for GRUB's core image. It comes first on the disk but takes
+	// the next free partition number, so the others keep theirs.
 
 	commands := [][]string{
 		// Create GPT partition table
 		{"sgdisk", "--clear", device},
-		// Create boot/EFI partition (2GB, type EF00 = EFI System Partition)
+		// Create boot/EFI partition (type EF00 = EFI System Partition)
 		// This single partition serves as both ESP and boot - holds EFI binaries + kernel/initramfs
-		{"sgdisk", "--new=1:0:+2G", "--typecode=1:EF00", "--change-name=1:boot", device},
-		// Create first root partition (12GB, type 8300 = generic Linux data)
-		// NOT using discoverable root partition type - root specified via kernel cmdline
-		{"sgdisk", "--new=2:0:+12G", "--typecode=2:8300", "--change-name=2:root1", device},
-		// Create second root partition (12GB, type 8300 = generic Linux data)
-		// NOT using discoverable root partition type - allows A/B updates with explicit control
-		{"sgdisk", "--new=3:0:+12G", "--typecode=3:8300", "--change-name=3:root2", device},
-		// Create /var partition (remaining space, type 8300 = generic Linux data)
-		// NOT using auto-discoverable var type (4d21b016...) - would require machine-id binding
-		{"sgdisk", "--new=4:0:0", "--typecode=4:8300", "--change-name=4:var", device},
+		{"sgdisk", "--new=1:0:+" + formatSizeMiB(layout.BootSizeMiB), "--typecode=1:EF00", "--change-name=1:boot", device},
+		// Create first root partition (type 8300 = generic Linux data)
+		// Discoverable root types are opt-in, see TagDiscoverablePartitions -
+		// root is otherwise specified via kernel cmdline
+		{"sgdisk", "--new=2:0:+" + formatSizeMiB(layout.RootSizeMiB), "--typecode=2:8300", "--change-name=2:root1", device},
+		// Create second root partition (type 8300 = generic Linux data)
+		// Same as root1 - allows A/B updates with explicit control
+		{"sgdisk", "--new=3:0:+" + formatSizeMiB(layout.RootSizeMiB), "--typecode=3:8300", "--change-name=3:root2", device},
+		// Create /var partition (type 8300 = generic Linux data)
+		// The auto-discoverable var type (4d21b016...) requires machine-id
+		// binding, so it is only used by the opt-in discoverable mode
+		{"sgdisk", "--new=4:0:" + varEnd, "--typecode=4:8300", "--change-name=4:var", device},
+	}
+	if layout.Subvolumes {
+		commands = [][]string{
+			commands[0],
+			commands[1],
+			{"sgdisk", "--new=2:0:+" + formatSizeMiB(layout.RootSizeMiB), "--typecode=2:8300", "--change-name=2:root", device},
+			{"sgdisk", "--new=3:0:" + varEnd, "--typecode=3:8300", "--change-name=3:var", device},
+		}
+	}
+	if layout.BIOSBoot {
+		// Every command after --clear creates one partition
+		biosNum := strconv.Itoa(len(commands))
+		biosBoot := []string{"sgdisk", "--new=" + biosNum + ":0:+" + formatSizeMiB(biosBootSizeMiB), "--typecode=" + biosNum + ":EF02", "--change-name=" + biosNum + ":bios", device}
+		commands = slices.Insert(commands, 1, biosBoot)
 	}
 
 	for _, cmdArgs := range commands {
@@ -80,9 +149,32 @@ func CreatePartitions(ctx context.Context, device string, dryRun bool, progress
 		return nil, err
 	}
 
-	// Inform kernel of partition changes
-	deviceBase := filepath.Base(device)
-	if strings.HasPrefix(deviceBase, "loop") {
+	rereadPartitionTable(ctx, device, progress)
+
+	// Locate the new partitions by their GPT names rather than deriving device
+	// names, which differ between disk types (sda1, nvme0n1p1, dm-3, ...)
+	scheme, err := DetectExistingPartitionScheme(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate created partitions: %w", err)
+	}
+
+	progress.MessagePlain("Created partitions:")
+	progress.Message("Boot:  %s", scheme.BootPartition)
+	if scheme.Subvolumes {
+		progress.Message("Root:  %s", scheme.Root1Partition)
+	} else {
+		progress.Message("Root1: %s", scheme.Root1Partition)
+		progress.Message("Root2: %s", scheme.Root2Partition)
+	}
+	progress.Message("Var:   %s", scheme.VarPartition)
+
+	return scheme, nil
+}
+
+// rereadPartitionTable informs the kernel of partition table changes on device
+// and waits for udev to create (or rename) the partition device nodes.
+func rereadPartitionTable(ctx context.Context, device string, progress reporter.Reporter) {
+	if strings.HasPrefix(filepath.Base(device), "loop") {
 		// For loop devices, use partx -u to update partition table
 		// Note: losetup --partscan only works during initial setup, not on existing devices
 		if err := exec.CommandContext(ctx, "partx", "-u", device).Run(); err != nil {
@@ -97,37 +189,6 @@ func CreatePartitions(ctx context.Context, device string, dryRun bool, progress
 	if err := exec.CommandContext(ctx, "udevadm", "settle").Run(); err != nil {
 		progress.Warning("udevadm settle failed: %v", err)
 	}
-
-	// Determine partition device names
-	// Handle different device naming conventions
-	// nvme, mmcblk, and loop devices use "p" prefix for partitions
-	var part1, part2, part3, part4 string
-	if strings.HasPrefix(deviceBase, "nvme") || strings.HasPrefix(deviceBase, "mmcblk") || strings.HasPrefix(deviceBase, "loop") {
-		part1 = device + "p1"
-		part2 = device + "p2"
-		part3 = device + "p3"
-		part4 = device + "p4"
-	} else {
-		part1 = device + "1"
-		part2 = device + "2"
-		part3 = device + "3"
-		part4 = device + "4"
-	}
-
-	scheme := &PartitionScheme{
-		BootPartition:  part1,
-		Root1Partition: part2,
-		Root2Partition: part3,
-		VarPartition:   part4,
-	}
-
-	progress.MessagePlain("Created partitions:")
-	progress.Message("Boot:  %s", scheme.BootPartition)
-	progress.Message("Root1: %s", scheme.Root1Partition)
-	progress.Message("Root2: %s", scheme.Root2Partition)
-	progress.Message("Var:   %s", scheme.VarPartition)
-
-	return scheme, nil
 }
 
 // SetupLUKS creates LUKS containers on root and var partitions
@@ -288,21 +349,29 @@ func FormatPartitions(ctx context.Context, scheme *PartitionScheme, dryRun bool,
 	root2Dev := scheme.GetRoot2Device()
 	varDev := scheme.GetVarDevice()
 
-	// Format first root partition (or LUKS mapper device)
-	progress.Message("Formatting %s as %s...", root1Dev, fsType)
-	if err := formatPartition(ctx, root1Dev, fsType, "root1"); err != nil {
-		return fmt.Errorf("failed to format root1 partition: %w", err)
-	}
+	if scheme.Subvolumes {
+		// Format the single root partition holding the deployment subvolumes
+		progress.Message("Formatting %s as %s...", root1Dev, fsType)
+		if err := formatPartition(ctx, root1Dev, fsType, "root", scheme.Verity); err != nil {
+			return fmt.Errorf("failed to format root partition: %w", err)
+		}
+	} else {
+		// Format first root partition (or LUKS mapper device)
+		progress.Message("Formatting %s as %s...", root1Dev, fsType)
+		if err := formatPartition(ctx, root1Dev, fsType, "root1", scheme.Verity); err != nil {
+			return fmt.Errorf("failed to format root1 partition: %w", err)
+		}
 
-	// Format second root partition (or LUKS mapper device)
-	progress.Message("Formatting %s as %s...", root2Dev, fsType)
-	if err := formatPartition(ctx, root2Dev, fsType, "root2"); err != nil {
-		return fmt.Errorf("failed to format root2 partition: %w", err)
+		// Format second root partition (or LUKS mapper device)
+		progress.Message("Formatting %s as %s...", root2Dev, fsType)
+		if err := formatPartition(ctx, root2Dev, fsType, "root2", scheme.Verity); err != nil {
+			return fmt.Errorf("failed to format root2 partition: %w", err)
+		}
 	}
 
 	// Format /var partition (or LUKS mapper device)
 	progress.Message("Formatting %s as %s...", varDev, fsType)
-	if err := formatPartition(ctx, varDev, fsType, "var"); err != nil {
+	if err := formatPartition(ctx, varDev, fsType, "var", false); err != nil {
 		return fmt.Errorf("failed to format var partition: %w", err)
 	}
 
@@ -310,8 +379,9 @@ func FormatPartitions(ctx context.Context, scheme *PartitionScheme, dryRun bool,
 	return nil
 }
 
-// formatPartition formats a single partition with the specified filesystem type
-func formatPartition(ctx context.Context, partition, fsType, label string) error {
+// formatPartition formats a single partition with the specified filesystem
+// type, with fs-verity support when verity is set
+func formatPartition(ctx context.Context, partition, fsType, label string, verity bool) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
@@ -320,7 +390,11 @@ func formatPartition(ctx context.Context, partition, fsType, label string) error
 
 	switch fsType {
 	case "ext4":
-		cmd = exec.CommandContext(ctx, "mkfs.ext4", "-F", "-L", label, partition)
+		args := []string{"-F", "-L", label}
+		if verity {
+			args = append(args, "-O", "verity")
+		}
+		cmd = exec.CommandContext(ctx, "mkfs.ext4", append(args, partition)...)
 	case "btrfs":
 		// Check if mkfs.btrfs is available
 		if _, err := exec.LookPath("mkfs.btrfs"); err != nil {
@@ -342,8 +416,12 @@ func formatPartition(ctx context.Context, partition, fsType, label string) error
 // partition setup. They are variables so the rollback path can be exercised in
 // tests without root or real block devices.
 var (
-	mountCommand = func(ctx context.Context, device, target string) error {
-		cmd := exec.CommandContext(ctx, "mount", device, target)
+	mountCommand = func(ctx context.Context, device, target string, options ...string) error {
+		args := []string{device, target}
+		if len(options) > 0 {
+			args = append([]string{"-o", strings.Join(options, ",")}, args...)
+		}
+		cmd := exec.CommandContext(ctx, "mount", args...)
 		if output, err := cmd.CombinedOutput(); err != nil {
 			return fmt.Errorf("%w\nOutput: %s", err, string(output))
 		}
@@ -394,8 +472,13 @@ func MountPartitions(ctx context.Context, scheme *PartitionScheme, mountPoint st
 		}
 	}()
 
-	// Mount first root partition (or LUKS mapper device)
-	if err := mountCommand(ctx, root1Dev, mountPoint); err != nil {
+	// Mount first root partition (or LUKS mapper device), or the deployment
+	// subvolume of a subvolume layout
+	var rootOptions []string
+	if scheme.RootSubvolume != "" {
+		rootOptions = append(rootOptions, "subvol="+scheme.RootSubvolume)
+	}
+	if err := mountCommand(ctx, root1Dev, mountPoint, rootOptions...); err != nil {
 		return fmt.Errorf("failed to mount root1 partition: %w", err)
 	}
 	mounted = append(mounted, mountPoint)
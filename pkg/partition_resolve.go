@@ -0,0 +1,281 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PartitionUUIDs records the GPT partition UUIDs (PARTUUIDs) of an
+// installation. They identify the partitions regardless of how the disk is
+// named (sda, nvme0n1, a multipath dm device or a /dev/disk/by-id link).
+type PartitionUUIDs struct {
+	Boot  string `json:"boot"`
+	Root1 string `json:"root1"`
+	Root2 string `json:"root2"` // Empty for a subvolume layout
+	Var   string `json:"var"`
+}
+
+// diskPartition describes one partition of a disk
+type diskPartition struct {
+	Device   string // Partition device path (e.g. /dev/sda2, /dev/nvme0n1p2, /dev/dm-3)
+	Number   int    // GPT partition number
+	Name     string // GPT partition name
+	PartUUID string // GPT partition UUID
+}
+
+// The sysfs and udev locations read by the resolver, and the blkid probe used
+// when they lack a value. They are variables so resolution can be tested
+// against a fake tree.
+var (
+	sysClassBlock     = "/sys/class/block"
+	devDiskByPartUUID = "/dev/disk/by-partuuid"
+	probePartition    = blkidProbe
+)
+
+// blkidProbe reads the partition table entry of a partition with blkid.
+func blkidProbe(device string) (map[string]string, error) {
+	output, err := exec.CommandContext(context.Background(), "blkid", "-p", "-o", "export", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("blkid failed on %s: %w", device, err)
+	}
+	return parseKeyValueLines(string(output)), nil
+}
+
+// parseKeyValueLines parses KEY=value lines as found in sysfs uevent files
+// and blkid export output.
+func parseKeyValueLines(data string) map[string]string {
+	values := make(map[string]string)
+	for line := range strings.SplitSeq(data, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// listDiskPartitions returns the partitions of device ordered by partition
+// number. Partitions are found in sysfs, either as children of the disk
+// (sda1, nvme0n1p1, loop0p1) or as device-mapper holders created by kpartx
+// for multipath disks. Symlinks such as /dev/disk/by-id paths are resolved
+// first.
+func listDiskPartitions(device string) ([]diskPartition, error) {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	deviceBase := filepath.Base(device)
+	diskDir := filepath.Join(sysClassBlock, deviceBase)
+	if _, err := os.Stat(diskDir); err != nil {
+		return nil, fmt.Errorf("block device %s not found in sysfs: %w", device, err)
+	}
+
+	var sysDirs []string
+	if entries, err := os.ReadDir(diskDir); err == nil {
+		for _, entry := range entries {
+			dir := filepath.Join(diskDir, entry.Name())
+			if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+				sysDirs = append(sysDirs, dir)
+			}
+		}
+	}
+	if holders, err := os.ReadDir(filepath.Join(diskDir, "holders")); err == nil {
+		for _, holder := range holders {
+			dir := filepath.Join(sysClassBlock, holder.Name())
+			dmUUID, err := os.ReadFile(filepath.Join(dir, "dm", "uuid"))
+			if err == nil && strings.HasPrefix(string(dmUUID), "part") {
+				sysDirs = append(sysDirs, dir)
+			}
+		}
+	}
+
+	partUUIDs := readPartUUIDLinks()
+
+	var partitions []diskPartition
+	for _, dir := range sysDirs {
+		name := filepath.Base(dir)
+		part := diskPartition{Device: "/dev/" + name}
+
+		uevent, _ := os.ReadFile(filepath.Join(dir, "uevent"))
+		values := parseKeyValueLines(string(uevent))
+		if devName := values["DEVNAME"]; devName != "" {
+			part.Device = "/dev/" + devName
+		}
+		part.Number, _ = strconv.Atoi(values["PARTN"])
+		part.Name = values["PARTNAME"]
+		part.PartUUID = partUUIDs[filepath.Base(part.Device)]
+
+		// device-mapper partitions carry no partition entry in sysfs, and
+		// by-partuuid links may be missing before udev has settled
+		if part.Number == 0 || part.Name == "" || part.PartUUID == "" {
+			if probed, err := probePartition(part.Device); err == nil {
+				if part.Number == 0 {
+					part.Number, _ = strconv.Atoi(probed["PART_ENTRY_NUMBER"])
+				}
+				if part.Name == "" {
+					part.Name = probed["PART_ENTRY_NAME"]
+				}
+				if part.PartUUID == "" {
+					part.PartUUID = probed["PART_ENTRY_UUID"]
+				}
+			}
+		}
+		part.PartUUID = strings.ToLower(part.PartUUID)
+
+		partitions = append(partitions, part)
+	}
+
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Number < partitions[j].Number })
+	return partitions, nil
+}
+
+// readPartUUIDLinks maps partition device names (sda2, dm-3) to their
+// PARTUUIDs using the udev /dev/disk/by-partuuid links.
+func readPartUUIDLinks() map[string]string {
+	links := make(map[string]string)
+	entries, err := os.ReadDir(devDiskByPartUUID)
+	if err != nil {
+		return links
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(devDiskByPartUUID, entry.Name()))
+		if err != nil {
+			continue
+		}
+		links[filepath.Base(target)] = entry.Name()
+	}
+	return links
+}
+
+// resolvePartitionScheme locates the nbc partitions on device. The PARTUUIDs
+// recorded at install time take precedence when given; otherwise partitions
+// are matched by their GPT names (boot, root1, root2, var, or boot, root, var
+// for a subvolume layout). Disks whose partitions carry neither fall back to
+// partition numbers 1-4.
+func resolvePartitionScheme(device string, uuids *PartitionUUIDs) (*PartitionScheme, error) {
+	partitions, err := listDiskPartitions(device)
+	if err != nil {
+		return nil, err
+	}
+
+	if uuids != nil {
+		byUUID := make(map[string]string)
+		for _, part := range partitions {
+			if part.PartUUID != "" {
+				byUUID[part.PartUUID] = part.Device
+			}
+		}
+		// A subvolume layout records no second root partition
+		scheme := &PartitionScheme{Subvolumes: uuids.Root2 == ""}
+		for _, want := range []struct {
+			role     string
+			partUUID string
+			dest     *string
+		}{
+			{"boot", uuids.Boot, &scheme.BootPartition},
+			{"root1", uuids.Root1, &scheme.Root1Partition},
+			{"root2", uuids.Root2, &scheme.Root2Partition},
+			{"var", uuids.Var, &scheme.VarPartition},
+		} {
+			if want.partUUID == "" && want.role == "root2" {
+				continue
+			}
+			dev, ok := byUUID[strings.ToLower(want.partUUID)]
+			if !ok {
+				return nil, fmt.Errorf("%s partition (PARTUUID %s) not found on %s", want.role, want.partUUID, device)
+			}
+			*want.dest = dev
+		}
+		return scheme, nil
+	}
+
+	byName := make(map[string]string)
+	for _, part := range partitions {
+		if part.Name == "" {
+			continue
+		}
+		if existing, dup := byName[part.Name]; dup {
+			return nil, fmt.Errorf("partitions %s and %s on %s are both named %q", existing, part.Device, device, part.Name)
+		}
+		byName[part.Name] = part.Device
+	}
+	if byName["boot"] != "" && byName["root1"] != "" && byName["root2"] != "" && byName["var"] != "" {
+		return &PartitionScheme{
+			BootPartition:  byName["boot"],
+			Root1Partition: byName["root1"],
+			Root2Partition: byName["root2"],
+			VarPartition:   byName["var"],
+		}, nil
+	}
+	if byName["boot"] != "" && byName["root"] != "" && byName["var"] != "" {
+		return &PartitionScheme{
+			BootPartition:  byName["boot"],
+			Root1Partition: byName["root"],
+			VarPartition:   byName["var"],
+			Subvolumes:     true,
+		}, nil
+	}
+
+	byNumber := make(map[int]string)
+	for _, part := range partitions {
+		byNumber[part.Number] = part.Device
+	}
+	for n := 1; n <= 4; n++ {
+		if byNumber[n] == "" {
+			return nil, fmt.Errorf("partition %d does not exist on %s", n, device)
+		}
+	}
+	return &PartitionScheme{
+		BootPartition:  byNumber[1],
+		Root1Partition: byNumber[2],
+		Root2Partition: byNumber[3],
+		VarPartition:   byNumber[4],
+	}, nil
+}
+
+// DetectExistingPartitionScheme detects the partition scheme of an existing
+// installation by GPT partition name, falling back to partition numbers 1-4.
+func DetectExistingPartitionScheme(device string) (*PartitionScheme, error) {
+	return resolvePartitionScheme(device, nil)
+}
+
+// DetectInstalledPartitionScheme detects the partition scheme of the
+// installation described by config, using the PARTUUIDs it recorded at
+// install time when present. Installs that predate PARTUUID tracking are
+// detected as in DetectExistingPartitionScheme.
+func DetectInstalledPartitionScheme(device string, config *SystemConfig) (*PartitionScheme, error) {
+	if config != nil && config.PartitionUUIDs != nil {
+		return resolvePartitionScheme(device, config.PartitionUUIDs)
+	}
+	return resolvePartitionScheme(device, nil)
+}
+
+// GetPartitionUUIDs returns the PARTUUIDs of the partitions in scheme, read
+// from device's partition table.
+func GetPartitionUUIDs(device string, scheme *PartitionScheme) (*PartitionUUIDs, error) {
+	partitions, err := listDiskPartitions(device)
+	if err != nil {
+		return nil, err
+	}
+	byDevice := make(map[string]string)
+	for _, part := range partitions {
+		byDevice[part.Device] = part.PartUUID
+	}
+
+	uuids := &PartitionUUIDs{
+		Boot:  byDevice[scheme.BootPartition],
+		Root1: byDevice[scheme.Root1Partition],
+		Var:   byDevice[scheme.VarPartition],
+	}
+	if !scheme.Subvolumes {
+		uuids.Root2 = byDevice[scheme.Root2Partition]
+	}
+	if uuids.Boot == "" || uuids.Root1 == "" || (uuids.Root2 == "" && !scheme.Subvolumes) || uuids.Var == "" {
+		return nil, fmt.Errorf("could not read the PARTUUID of every partition on %s", device)
+	}
+	return uuids, nil
+}
@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+type fakePartition struct {
+	name     string // sysfs/dev name, e.g. vdb1 or dm-3
+	number   int
+	label    string
+	partUUID string
+}
+
+// setupFakeBlockDevices points the resolver at a temporary sysfs tree and
+// by-partuuid directory, and stubs out blkid with the given probe results.
+func setupFakeBlockDevices(t *testing.T, probe map[string]map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+
+	oldSys, oldByUUID, oldProbe := sysClassBlock, devDiskByPartUUID, probePartition
+	sysClassBlock = filepath.Join(root, "sys", "class", "block")
+	devDiskByPartUUID = filepath.Join(root, "dev", "disk", "by-partuuid")
+	probePartition = func(device string) (map[string]string, error) {
+		if values, ok := probe[device]; ok {
+			return values, nil
+		}
+		return nil, errors.New("not probed")
+	}
+	t.Cleanup(func() {
+		sysClassBlock, devDiskByPartUUID, probePartition = oldSys, oldByUUID, oldProbe
+	})
+
+	if err := os.MkdirAll(devDiskByPartUUID, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// addFakeDisk creates sysfs entries for a disk and its child partitions.
+func addFakeDisk(t *testing.T, disk string, parts []fakePartition) {
+	t.Helper()
+	writeTestFile(t, filepath.Join(sysClassBlock, disk, "uevent"), "DEVNAME="+disk+"\nDEVTYPE=disk\n")
+	for _, p := range parts {
+		dir := filepath.Join(sysClassBlock, disk, p.name)
+		uevent := "DEVNAME=" + p.name + "\nDEVTYPE=partition\nPARTN=" + strconv.Itoa(p.number) + "\n"
+		if p.label != "" {
+			uevent += "PARTNAME=" + p.label + "\n"
+		}
+		writeTestFile(t, filepath.Join(dir, "uevent"), uevent)
+		writeTestFile(t, filepath.Join(dir, "partition"), strconv.Itoa(p.number)+"\n")
+		if p.partUUID != "" {
+			if err := os.Symlink("../../"+p.name, filepath.Join(devDiskByPartUUID, p.partUUID)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestDetectExistingPartitionSchemeByLabel(t *testing.T) {
+	setupFakeBlockDevices(t, nil)
+
+	// Partitions numbered out of order, as after a manual repartition
+	addFakeDisk(t, "vdb", []fakePartition{
+		{"vdb1", 1, "boot", ""},
+		{"vdb2", 2, "var", ""},
+		{"vdb5", 5, "root1", ""},
+		{"vdb6", 6, "root2", ""},
+	})
+
+	scheme, err := DetectExistingPartitionScheme("/dev/vdb")
+	if err != nil {
+		t.Fatalf("DetectExistingPartitionScheme() error = %v", err)
+	}
+	if scheme.BootPartition != "/dev/vdb1" || scheme.Root1Partition != "/dev/vdb5" ||
+		scheme.Root2Partition != "/dev/vdb6" || scheme.VarPartition != "/dev/vdb2" {
+		t.Errorf("scheme = %+v, want partitions matched by GPT name", scheme)
+	}
+
+	// Two partitions with the same name cannot be told apart
+	addFakeDisk(t, "vdb", []fakePartition{{"vdb7", 7, "root2", ""}})
+	if _, err := DetectExistingPartitionScheme("/dev/vdb"); err == nil {
+		t.Error("DetectExistingPartitionScheme() should fail on duplicate partition names")
+	}
+}
+
+func TestDetectExistingPartitionSchemeSubvolumes(t *testing.T) {
+	setupFakeBlockDevices(t, nil)
+
+	addFakeDisk(t, "vdb", []fakePartition{
+		{"vdb1", 1, "boot", ""},
+		{"vdb2", 2, "root", ""},
+		{"vdb3", 3, "var", ""},
+	})
+
+	scheme, err := DetectExistingPartitionScheme("/dev/vdb")
+	if err != nil {
+		t.Fatalf("DetectExistingPartitionScheme() error = %v", err)
+	}
+	if !scheme.Subvolumes || scheme.Root1Partition != "/dev/vdb2" || scheme.Root2Partition != "" ||
+		scheme.VarPartition != "/dev/vdb3" {
+		t.Errorf("scheme = %+v, want a subvolume layout with root on vdb2", scheme)
+	}
+}
+
+func TestDetectExistingPartitionSchemeNVMeByNumber(t *testing.T) {
+	setupFakeBlockDevices(t, nil)
+
+	// Unnamed partitions fall back to partition numbers
+	addFakeDisk(t, "nvme0n1", []fakePartition{
+		{"nvme0n1p1", 1, "", ""},
+		{"nvme0n1p2", 2, "", ""},
+		{"nvme0n1p3", 3, "", ""},
+		{"nvme0n1p4", 4, "", ""},
+	})
+
+	scheme, err := DetectExistingPartitionScheme("/dev/nvme0n1")
+	if err != nil {
+		t.Fatalf("DetectExistingPartitionScheme() error = %v", err)
+	}
+	if scheme.BootPartition != "/dev/nvme0n1p1" || scheme.VarPartition != "/dev/nvme0n1p4" {
+		t.Errorf("scheme = %+v, want partitions 1-4", scheme)
+	}
+}
+
+func TestDetectExistingPartitionSchemeMultipath(t *testing.T) {
+	setupFakeBlockDevices(t, map[string]map[string]string{
+		"/dev/dm-1": {"PART_ENTRY_NUMBER": "1", "PART_ENTRY_NAME": "boot", "PART_ENTRY_UUID": "AAAA"},
+		"/dev/dm-2": {"PART_ENTRY_NUMBER": "2", "PART_ENTRY_NAME": "root1", "PART_ENTRY_UUID": "BBBB"},
+		"/dev/dm-3": {"PART_ENTRY_NUMBER": "3", "PART_ENTRY_NAME": "root2", "PART_ENTRY_UUID": "CCCC"},
+		"/dev/dm-4": {"PART_ENTRY_NUMBER": "4", "PART_ENTRY_NAME": "var", "PART_ENTRY_UUID": "DDDD"},
+	})
+
+	// A multipath disk (dm-0) whose partitions are kpartx device-mapper
+	// holders, plus a non-partition holder that must be ignored
+	addFakeDisk(t, "dm-0", nil)
+	for i := 1; i <= 5; i++ {
+		name := "dm-" + strconv.Itoa(i)
+		writeTestFile(t, filepath.Join(sysClassBlock, name, "uevent"), "DEVNAME="+name+"\nDEVTYPE=disk\n")
+		dmUUID := "part" + strconv.Itoa(i) + "-mpath-3600a0b80"
+		if i == 5 {
+			dmUUID = "CRYPT-LUKS2-0000"
+		}
+		writeTestFile(t, filepath.Join(sysClassBlock, name, "dm", "uuid"), dmUUID+"\n")
+		writeTestFile(t, filepath.Join(sysClassBlock, "dm-0", "holders", name, "uevent"), "")
+	}
+
+	scheme, err := DetectExistingPartitionScheme("/dev/dm-0")
+	if err != nil {
+		t.Fatalf("DetectExistingPartitionScheme() error = %v", err)
+	}
+	if scheme.BootPartition != "/dev/dm-1" || scheme.Root1Partition != "/dev/dm-2" ||
+		scheme.Root2Partition != "/dev/dm-3" || scheme.VarPartition != "/dev/dm-4" {
+		t.Errorf("scheme = %+v, want dm-1..dm-4", scheme)
+	}
+
+	uuids, err := GetPartitionUUIDs("/dev/dm-0", scheme)
+	if err != nil {
+		t.Fatalf("GetPartitionUUIDs() error = %v", err)
+	}
+	if uuids.Boot != "aaaa" || uuids.Var != "dddd" {
+		t.Errorf("uuids = %+v, want lower-cased PARTUUIDs from blkid", uuids)
+	}
+}
+
+func TestDetectInstalledPartitionSchemeByPartUUID(t *testing.T) {
+	root := setupFakeBlockDevices(t, nil)
+
+	addFakeDisk(t, "sda", []fakePartition{
+		{"sda1", 1, "boot", "11111111-0000-0000-0000-000000000001"},
+		{"sda2", 2, "root1", "11111111-0000-0000-0000-000000000002"},
+		{"sda3", 3, "root2", "11111111-0000-0000-0000-000000000003"},
+		{"sda4", 4, "var", "11111111-0000-0000-0000-000000000004"},
+	})
+
+	// Reached through a /dev/disk/by-id style symlink
+	byID := filepath.Join(root, "dev", "disk", "by-id", "ata-TEST_DISK")
+	if err := os.MkdirAll(filepath.Dir(byID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "dev", "sda"), byID); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "dev", "sda"), "")
+
+	config := &SystemConfig{PartitionUUIDs: &PartitionUUIDs{
+		Boot:  "11111111-0000-0000-0000-000000000001",
+		Root1: "11111111-0000-0000-0000-000000000002",
+		Root2: "11111111-0000-0000-0000-000000000003",
+		Var:   "11111111-0000-0000-0000-000000000004",
+	}}
+	scheme, err := DetectInstalledPartitionScheme(byID, config)
+	if err != nil {
+		t.Fatalf("DetectInstalledPartitionScheme() error = %v", err)
+	}
+	if scheme.Root1Partition != "/dev/sda2" || scheme.Root2Partition != "/dev/sda3" {
+		t.Errorf("scheme = %+v, want partitions matched by PARTUUID", scheme)
+	}
+
+	// A recorded PARTUUID missing from the disk means the wrong disk
+	config.PartitionUUIDs.Var = "22222222-0000-0000-0000-000000000004"
+	if _, err := DetectInstalledPartitionScheme(byID, config); err == nil {
+		t.Error("DetectInstalledPartitionScheme() should fail when a recorded PARTUUID is missing")
+	}
+}
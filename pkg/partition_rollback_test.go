@@ -19,7 +19,7 @@ func TestMountPartitions_RollsBackOnPartialFailure(t *testing.T) {
 	origMount, origUmount := mountCommand, umountCommand
 	t.Cleanup(func() { mountCommand, umountCommand = origMount, origUmount })
 
-	mountCommand = func(_ context.Context, _, target string) error {
+	mountCommand = func(_ context.Context, _, target string, _ ...string) error {
 		// Simulate the boot partition mount failing after root1 succeeds.
 		if strings.HasSuffix(target, "/boot") {
 			return &mountError{}
@@ -21,7 +21,7 @@ func TestCreatePartitions(t *testing.T) {
 
 	// Create partitions
 	t.Log("Creating partitions on test disk")
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -67,7 +67,7 @@ func TestFormatPartitions(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -108,7 +108,7 @@ func TestMountPartitions(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
@@ -170,7 +170,7 @@ func TestDetectExistingPartitionScheme(t *testing.T) {
 		t.Fatalf("Failed to create test disk: %v", err)
 	}
 
-	originalScheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	originalScheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("CreatePartitions failed: %v", err)
 	}
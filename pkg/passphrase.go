@@ -1,7 +1,6 @@
 package pkg
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
@@ -38,18 +37,37 @@ func readPassphrase(prompt string) (string, error) {
 	return readPassphraseLine(os.Stdin)
 }
 
+// ReadPassphrase is readPassphrase for commands that prompt for LUKS keys.
+func ReadPassphrase(prompt string) (string, error) {
+	return readPassphrase(prompt)
+}
+
 // readPassphraseLine reads one line from r and returns it with the trailing
 // line terminator (\n or \r\n) removed. Interior and leading/trailing spaces are
 // preserved. A final line with no newline (EOF) is returned as-is.
+//
+// r is read one byte at a time so nothing past the newline is consumed, and a
+// later prompt reading the same piped stdin gets the next line.
 func readPassphraseLine(r io.Reader) (string, error) {
-	line, err := bufio.NewReader(r).ReadString('\n')
-	if err != nil {
-		if err == io.EOF && line == "" {
-			return "", io.EOF
+	var line strings.Builder
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line.WriteByte(b[0])
 		}
-		if err != io.EOF {
+		if err == io.EOF {
+			if line.Len() == 0 {
+				return "", io.EOF
+			}
+			break
+		}
+		if err != nil {
 			return "", err
 		}
 	}
-	return strings.TrimRight(line, "\r\n"), nil
+	return strings.TrimRight(line.String(), "\r"), nil
 }
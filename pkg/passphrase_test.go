@@ -47,3 +47,18 @@ func TestReadPassphraseLine_DoesNotStripInteriorOrLeadingSpaces(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+// TestReadPassphraseLine_LeavesNextLine ensures consecutive prompts reading the
+// same piped stdin each get their own line.
+func TestReadPassphraseLine_LeavesNextLine(t *testing.T) {
+	r := strings.NewReader("current\nnew\n")
+	for _, want := range []string{"current", "new"} {
+		got, err := readPassphraseLine(r)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+// cryptAlphabet is the base64 alphabet of crypt(3) hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptRounds is the default number of rounds of SHA-512 crypt, which
+// leaves the rounds out of the hash
+const sha512CryptRounds = 5000
+
+// HashPassword returns the SHA-512 crypt(3) hash ("$6$...") of password with
+// a random salt, as "openssl passwd -6" does, for /etc/shadow
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	for i, b := range salt {
+		salt[i] = cryptAlphabet[b&0x3f]
+	}
+	return sha512Crypt(password, string(salt)), nil
+}
+
+// sha512Crypt computes the SHA-512 crypt hash of password with salt (at most
+// 16 characters are used) and the default rounds, following Ulrich Drepper's
+// specification of the glibc algorithm
+func sha512Crypt(password, salt string) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alt := sha512.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	b := alt.Sum(nil)
+
+	h := sha512.New()
+	h.Write(p)
+	h.Write(s)
+	for n := len(p); n > 0; n -= 64 {
+		h.Write(b[:min(n, 64)])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	dp := sha512.New()
+	for range len(p) {
+		dp.Write(p)
+	}
+	pSeq := repeatDigest(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for range 16 + int(a[0]) {
+		ds.Write(s)
+	}
+	sSeq := repeatDigest(ds.Sum(nil), len(s))
+
+	for r := range sha512CryptRounds {
+		c := sha512.New()
+		if r&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(a)
+		}
+		if r%3 != 0 {
+			c.Write(sSeq)
+		}
+		if r%7 != 0 {
+			c.Write(pSeq)
+		}
+		if r&1 != 0 {
+			c.Write(a)
+		} else {
+			c.Write(pSeq)
+		}
+		a = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$" + salt + "$")
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for range n {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	// Each group takes a byte from each third of the digest, rotating which
+	// third comes first
+	for i := range 21 {
+		x, y, z := i, i+21, i+42
+		switch i % 3 {
+		case 1:
+			x, y, z = i+21, i+42, i
+		case 2:
+			x, y, z = i+42, i, i+21
+		}
+		encode(a[x], a[y], a[z], 4)
+	}
+	encode(0, 0, a[63], 2)
+	return out.String()
+}
+
+// repeatDigest repeats digest to n bytes
+func repeatDigest(digest []byte, n int) []byte {
+	seq := make([]byte, 0, n)
+	for len(seq) < n {
+		seq = append(seq, digest[:min(n-len(seq), len(digest))]...)
+	}
+	return seq
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	// Hashes of "openssl passwd -6"
+	tests := []struct {
+		password, salt, want string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"a much longer passphrase that is well beyond sixty-four bytes in length!", "nbcSalt/0123456", "$6$nbcSalt/0123456$jNKrIlXzvJjeEan8uTHd8RTZZsiAoml5H6r3cMWXEGIrVh9LYNWrB8u.oT9gSIgjDtUXoH.sYJ.AjY3/hvyFE/"},
+	}
+	for _, tt := range tests {
+		if got := sha512Crypt(tt.password, tt.salt); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	salt, _, ok := strings.Cut(strings.TrimPrefix(hash, "$6$"), "$")
+	if !ok || len(salt) != 16 {
+		t.Fatalf("HashPassword() = %q, want a $6$ hash with a 16 character salt", hash)
+	}
+	if sha512Crypt("secret", salt) != hash {
+		t.Error("hash does not verify against its salt")
+	}
+	if err := validatePasswordHash(hash); err != nil {
+		t.Errorf("validatePasswordHash() = %v", err)
+	}
+}
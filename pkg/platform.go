@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"cmp"
+	"fmt"
+	"runtime"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// efiArch holds the names of the EFI boot files of a CPU architecture
+type efiArch struct {
+	suffix     string // Suffix of EFI binary names, as in shimx64.efi
+	grubTarget string // grub-install target platform
+}
+
+// efiArches maps the architectures nbc installs on, in the naming of Go and
+// OCI image platforms, to their EFI names
+var efiArches = map[string]efiArch{
+	"amd64": {suffix: "x64", grubTarget: "x86_64-efi"},
+	"arm64": {suffix: "aa64", grubTarget: "arm64-efi"},
+}
+
+// efiArchFor returns the EFI names of goarch, or of this machine when goarch
+// is empty
+func efiArchFor(goarch string) (efiArch, error) {
+	goarch = cmp.Or(goarch, runtime.GOARCH)
+	arch, ok := efiArches[goarch]
+	if !ok {
+		return efiArch{}, fmt.Errorf("EFI boot is not supported on architecture %s", goarch)
+	}
+	return arch, nil
+}
+
+// removableBootFile returns the name of the file firmware boots from
+// EFI/BOOT on removable media, e.g. BOOTX64.EFI
+func (a efiArch) removableBootFile() string {
+	return "BOOT" + strings.ToUpper(a.suffix) + ".EFI"
+}
+
+// binary returns the file name of the EFI binary name built for the
+// architecture, e.g. shimx64.efi for shim
+func (a efiArch) binary(name string) string {
+	return name + a.suffix + ".efi"
+}
+
+// grubSignedDir returns the directory below /usr/lib/grub holding the signed
+// GRUB EFI binary on Debian and Ubuntu
+func (a efiArch) grubSignedDir() string {
+	return a.grubTarget + "-signed"
+}
+
+// ParsePlatform parses an image platform given as os/arch[/variant], e.g.
+// linux/arm64 or linux/arm/v7. An empty string returns nil, meaning the
+// platform of this machine. nbc only installs Linux images.
+func ParsePlatform(s string) (*v1.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	platform, err := v1.ParsePlatform(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %q: %w", s, err)
+	}
+	if platform.OS != "linux" || platform.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform %q: expected linux/<arch>[/<variant>]", s)
+	}
+	return platform, nil
+}
+
+// targetPlatform returns platform, or the platform of this machine when it
+// is nil
+func targetPlatform(platform *v1.Platform) v1.Platform {
+	if platform == nil {
+		return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	}
+	return *platform
+}
+
+// platformMatches reports whether an image built for got runs on want. The
+// variants are only compared when both name one.
+func platformMatches(want, got v1.Platform) bool {
+	if got.OS != want.OS || got.Architecture != want.Architecture {
+		return false
+	}
+	return got.Variant == "" || want.Variant == "" || got.Variant == want.Variant
+}
+
+// checkImagePlatform returns an error unless img is built for want. Images
+// whose config does not name an architecture are accepted.
+func checkImagePlatform(img v1.Image, want v1.Platform) error {
+	config, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to get image config: %w", err)
+	}
+	if config.Architecture == "" {
+		return nil
+	}
+	got := v1.Platform{OS: cmp.Or(config.OS, want.OS), Architecture: config.Architecture, Variant: config.Variant}
+	if !platformMatches(want, got) {
+		return fmt.Errorf("image is built for %s, but the target platform is %s", got.String(), want.String())
+	}
+	return nil
+}
+
+// UpdatePlatform returns the platform to pull updates of a system installed
+// for installed (as recorded in its config, empty for systems installed
+// before the platform was recorded, which run this machine's). A requested
+// platform must match the installed one.
+func UpdatePlatform(installed string, requested *v1.Platform) (*v1.Platform, error) {
+	current, err := ParsePlatform(installed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse installed platform: %w", err)
+	}
+	want := targetPlatform(current)
+	if requested == nil {
+		return &want, nil
+	}
+	if !platformMatches(want, *requested) {
+		return nil, fmt.Errorf("refusing to update a %s installation to a %s image", want.String(), requested.String())
+	}
+	return requested, nil
+}
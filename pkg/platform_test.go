@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+func TestEFIArchFor(t *testing.T) {
+	tests := []struct {
+		goarch     string
+		bootFile   string
+		shim       string
+		mokManager string
+		grubTarget string
+		grubSigned string
+	}{
+		{"amd64", "BOOTX64.EFI", "shimx64.efi", "mmx64.efi", "x86_64-efi", "x86_64-efi-signed"},
+		{"arm64", "BOOTAA64.EFI", "shimaa64.efi", "mmaa64.efi", "arm64-efi", "arm64-efi-signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.goarch, func(t *testing.T) {
+			arch, err := efiArchFor(tt.goarch)
+			if err != nil {
+				t.Fatalf("efiArchFor(%s) error = %v", tt.goarch, err)
+			}
+			if got := arch.removableBootFile(); got != tt.bootFile {
+				t.Errorf("removableBootFile() = %s, want %s", got, tt.bootFile)
+			}
+			if got := arch.binary("shim"); got != tt.shim {
+				t.Errorf("binary(shim) = %s, want %s", got, tt.shim)
+			}
+			if got := arch.binary("mm"); got != tt.mokManager {
+				t.Errorf("binary(mm) = %s, want %s", got, tt.mokManager)
+			}
+			if arch.grubTarget != tt.grubTarget || arch.grubSignedDir() != tt.grubSigned {
+				t.Errorf("GRUB target = %s (%s), want %s (%s)", arch.grubTarget, arch.grubSignedDir(), tt.grubTarget, tt.grubSigned)
+			}
+		})
+	}
+
+	if _, err := efiArchFor("riscv64"); err == nil {
+		t.Error("efiArchFor(riscv64) should fail for an architecture without EFI names")
+	}
+}
+
+// imageFor returns an empty image whose config declares os, arch and variant
+func imageFor(t *testing.T, os, arch, variant string) v1.Image {
+	t.Helper()
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: os, Architecture: arch, Variant: variant})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestCheckImagePlatform(t *testing.T) {
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	armv7 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	tests := []struct {
+		name    string
+		img     v1.Image
+		want    v1.Platform
+		wantErr bool
+	}{
+		{"matching", imageFor(t, "linux", "arm64", ""), arm64, false},
+		{"other architecture", imageFor(t, "linux", "amd64", ""), arm64, true},
+		{"other OS", imageFor(t, "windows", "arm64", ""), arm64, true},
+		{"architecture not declared", imageFor(t, "", "", ""), arm64, false},
+		{"matching variant", imageFor(t, "linux", "arm", "v7"), armv7, false},
+		{"other variant", imageFor(t, "linux", "arm", "v6"), armv7, true},
+		{"variant not declared", imageFor(t, "linux", "arm", ""), armv7, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkImagePlatform(tt.img, tt.want)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkImagePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"linux/arm64", "linux/arm64", false},
+		{"linux/arm/v7", "linux/arm/v7", false},
+		{"windows/amd64", "", true},
+		{"linux", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePlatform(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatform(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (got == nil) != (tt.want == "") || (got != nil && got.String() != tt.want) {
+				t.Errorf("ParsePlatform(%q) = %v, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdatePlatform(t *testing.T) {
+	machine := targetPlatform(nil).String()
+	tests := []struct {
+		name      string
+		installed string
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		{"installed platform", "linux/arm64", "", "linux/arm64", false},
+		{"installed before platforms were recorded", "", "", machine, false},
+		{"requested matches", "linux/arm64", "linux/arm64", "linux/arm64", false},
+		{"requested adds a variant", "linux/arm64", "linux/arm64/v8", "linux/arm64/v8", false},
+		{"requested differs", "linux/arm64", "linux/amd64", "", true},
+		{"requested variant differs", "linux/arm/v7", "linux/arm/v6", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested, err := ParsePlatform(tt.requested)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := UpdatePlatform(tt.installed, requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UpdatePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("UpdatePlatform() = %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+}
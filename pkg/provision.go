@@ -0,0 +1,696 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/frostyard/std/reporter"
+)
+
+// ProvisionOptions configures the identity of the installed system. It is
+// written to the upper layer of the /etc overlay, so it survives A/B updates
+// like changes made on the running system.
+type ProvisionOptions struct {
+	// Hostname is written to /etc/hostname.
+	// Optional; if empty, the image's hostname is kept.
+	Hostname string
+
+	// Locale is written to /etc/locale.conf as LANG, e.g. "en_US.UTF-8".
+	// Optional; if empty, the image's locale is kept.
+	Locale string
+
+	// Timezone links /etc/localtime to the image's zoneinfo, e.g.
+	// "Europe/Berlin". Optional; if empty, the image's timezone is kept.
+	Timezone string
+
+	// RootPasswordHash sets root's password to a crypt(3) hash, e.g. from
+	// "openssl passwd -6". Mutually exclusive with InstallConfig.RootPassword.
+	RootPasswordHash string
+
+	// SSHAuthorizedKeys are installed to root's ~/.ssh/authorized_keys.
+	SSHAuthorizedKeys []string
+
+	// Groups are created unless the image already has them, e.g. for Users
+	// to be added to.
+	Groups []string
+
+	// Users are created, or updated when the image already has them.
+	Users []UserOptions
+}
+
+// UserOptions configures a user account of the installed system.
+type UserOptions struct {
+	// Name is the login name.
+	Name string
+
+	// PasswordHash is a crypt(3) hash of the password.
+	// Optional; if empty, password login is disabled for new users.
+	PasswordHash string
+
+	// Groups are supplementary groups, which must exist in the image or
+	// be listed in ProvisionOptions.Groups.
+	Groups []string
+
+	// SSHAuthorizedKeys are installed to the user's ~/.ssh/authorized_keys.
+	SSHAuthorizedKeys []string
+}
+
+// Empty reports whether p provisions nothing
+func (p *ProvisionOptions) Empty() bool {
+	return p.Hostname == "" && p.Locale == "" && p.Timezone == "" && p.RootPasswordHash == "" &&
+		len(p.SSHAuthorizedKeys) == 0 && len(p.Groups) == 0 && len(p.Users) == 0
+}
+
+// First and last UID and GID given to users created during installation
+const (
+	provisionIDMin = 1000
+	provisionIDMax = 60000
+)
+
+var (
+	// accountNamePattern matches the user and group names useradd accepts
+	// by default
+	accountNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	// hostnameLabelPattern matches a label of a hostname (RFC 1123)
+	hostnameLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	// localePattern matches locale names such as en_US.UTF-8 or de_DE@euro
+	localePattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$`)
+	// timezonePattern matches tz database names such as America/New_York
+	timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+)
+
+// validateHostname returns an error unless name is a valid hostname
+func validateHostname(name string) error {
+	if len(name) > 253 {
+		return errors.New("hostname is longer than 253 characters")
+	}
+	for label := range strings.SplitSeq(name, ".") {
+		if !hostnameLabelPattern.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q", name)
+		}
+	}
+	return nil
+}
+
+// validatePasswordHash returns an error unless hash can be stored in
+// /etc/shadow as a crypt(3) hash
+func validatePasswordHash(hash string) error {
+	if strings.ContainsAny(hash, ":\n") {
+		return errors.New("password hash must not contain ':' or newlines")
+	}
+	if !strings.HasPrefix(hash, "$") && !strings.HasPrefix(hash, "!") && hash != "*" {
+		return errors.New("password hash must be a crypt(3) hash such as the output of \"openssl passwd -6\"")
+	}
+	return nil
+}
+
+// validateSSHKey returns an error unless key is a single authorized_keys line
+func validateSSHKey(key string) error {
+	if strings.ContainsAny(key, "\r\n") {
+		return errors.New("SSH key must be a single line")
+	}
+	if len(strings.Fields(key)) < 2 {
+		return fmt.Errorf("invalid SSH key %q", key)
+	}
+	return nil
+}
+
+// Validate checks the ProvisionOptions for errors. Errors are FieldErrors
+// naming the install spec field.
+func (p *ProvisionOptions) Validate() error {
+	if p.Hostname != "" {
+		if err := validateHostname(p.Hostname); err != nil {
+			return &FieldError{Field: "hostname", Err: err}
+		}
+	}
+	if p.Locale != "" && !localePattern.MatchString(p.Locale) {
+		return &FieldError{Field: "locale", Err: fmt.Errorf("invalid locale %q", p.Locale)}
+	}
+	if p.Timezone != "" && !timezonePattern.MatchString(p.Timezone) {
+		return &FieldError{Field: "timezone", Err: fmt.Errorf("invalid timezone %q", p.Timezone)}
+	}
+	if p.RootPasswordHash != "" {
+		if err := validatePasswordHash(p.RootPasswordHash); err != nil {
+			return &FieldError{Field: "root_password_hash", Err: err}
+		}
+	}
+	for i, key := range p.SSHAuthorizedKeys {
+		if err := validateSSHKey(key); err != nil {
+			return &FieldError{Field: fmt.Sprintf("ssh_authorized_keys[%d]", i), Err: err}
+		}
+	}
+
+	for i, group := range p.Groups {
+		if !accountNamePattern.MatchString(group) {
+			return &FieldError{Field: fmt.Sprintf("groups[%d]", i), Err: fmt.Errorf("invalid group name %q", group)}
+		}
+		if slices.Contains(p.Groups[:i], group) {
+			return &FieldError{Field: fmt.Sprintf("groups[%d]", i), Err: fmt.Errorf("duplicate group %s", group)}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, user := range p.Users {
+		field := fmt.Sprintf("users[%d]", i)
+		if !accountNamePattern.MatchString(user.Name) {
+			return &FieldError{Field: field + ".name", Err: fmt.Errorf("invalid user name %q", user.Name)}
+		}
+		if user.Name == "root" {
+			return &FieldError{Field: field + ".name", Err: errors.New("root is configured with root_password_hash and ssh_authorized_keys")}
+		}
+		if seen[user.Name] {
+			return &FieldError{Field: field + ".name", Err: fmt.Errorf("duplicate user %s", user.Name)}
+		}
+		seen[user.Name] = true
+		if user.PasswordHash != "" {
+			if err := validatePasswordHash(user.PasswordHash); err != nil {
+				return &FieldError{Field: field + ".password_hash", Err: err}
+			}
+		}
+		for j, group := range user.Groups {
+			if !accountNamePattern.MatchString(group) {
+				return &FieldError{Field: fmt.Sprintf("%s.groups[%d]", field, j), Err: fmt.Errorf("invalid group name %q", group)}
+			}
+		}
+		for j, key := range user.SSHAuthorizedKeys {
+			if err := validateSSHKey(key); err != nil {
+				return &FieldError{Field: fmt.Sprintf("%s.ssh_authorized_keys[%d]", field, j), Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// etcDB is an account database of /etc, such as passwd, as records of colon
+// separated fields
+type etcDB struct {
+	name    string
+	records [][]string
+	info    fs.FileInfo
+}
+
+// etcUpperDir returns the upper layer of the /etc overlay of the system
+// installed at targetDir
+func etcUpperDir(targetDir string) string {
+	return filepath.Join(targetDir, EtcOverlayPath, "upper")
+}
+
+// loadEtcDB reads the account database name of the system at targetDir:
+// the overlay upper layer's copy when there is one, the image's otherwise
+func loadEtcDB(targetDir, name string) (*etcDB, error) {
+	path := filepath.Join(etcUpperDir(targetDir), name)
+	if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		path = filepath.Join(targetDir, "etc", name)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat /etc/%s: %w", name, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /etc/%s: %w", name, err)
+	}
+
+	db := &etcDB{name: name, info: info}
+	for line := range strings.SplitSeq(strings.TrimRight(string(data), "\n"), "\n") {
+		if line != "" {
+			db.records = append(db.records, strings.Split(line, ":"))
+		}
+	}
+	return db, nil
+}
+
+// find returns the record of name, or nil
+func (db *etcDB) find(name string) []string {
+	for _, record := range db.records {
+		if record[0] == name {
+			return record
+		}
+	}
+	return nil
+}
+
+// hasID reports whether a record has the numeric ID id in its third field
+func (db *etcDB) hasID(id int) bool {
+	s := strconv.Itoa(id)
+	return slices.ContainsFunc(db.records, func(record []string) bool {
+		return len(record) > 2 && record[2] == s
+	})
+}
+
+// addMember adds user to the member list in the fourth field of the record
+// of group, returning false when there is no such group
+func (db *etcDB) addMember(group, user string) bool {
+	record := db.find(group)
+	if record == nil || len(record) < 4 {
+		return false
+	}
+	var members []string
+	if record[3] != "" {
+		members = strings.Split(record[3], ",")
+	}
+	if !slices.Contains(members, user) {
+		record[3] = strings.Join(append(members, user), ",")
+	}
+	return true
+}
+
+// save writes the database to the overlay upper layer of the system at
+// targetDir, with the mode and ownership of the file it was read from
+func (db *etcDB) save(targetDir string) error {
+	var b strings.Builder
+	for _, record := range db.records {
+		b.WriteString(strings.Join(record, ":"))
+		b.WriteByte('\n')
+	}
+	path := filepath.Join(etcUpperDir(targetDir), db.name)
+	if err := atomicWriteFile(path, []byte(b.String()), db.info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write /etc/%s: %w", db.name, err)
+	}
+	if st, ok := db.info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Chown(path, int(st.Uid), int(st.Gid)); err != nil {
+			return fmt.Errorf("failed to set ownership of /etc/%s: %w", db.name, err)
+		}
+	}
+	return nil
+}
+
+// accountDBs are the account databases of the system being provisioned.
+// gshadow is nil when the image has none.
+type accountDBs struct {
+	passwd, shadow, group, gshadow *etcDB
+}
+
+// loadAccountDBs reads the account databases of the system at targetDir
+func loadAccountDBs(targetDir string) (*accountDBs, error) {
+	dbs := &accountDBs{}
+	for name, db := range map[string]**etcDB{"passwd": &dbs.passwd, "shadow": &dbs.shadow, "group": &dbs.group} {
+		var err error
+		if *db, err = loadEtcDB(targetDir, name); err != nil {
+			return nil, err
+		}
+	}
+	gshadow, err := loadEtcDB(targetDir, "gshadow")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	dbs.gshadow = gshadow
+	return dbs, nil
+}
+
+// save writes the account databases to the overlay upper layer
+func (dbs *accountDBs) save(targetDir string) error {
+	for _, db := range []*etcDB{dbs.passwd, dbs.shadow, dbs.group, dbs.gshadow} {
+		if db == nil {
+			continue
+		}
+		if err := db.save(targetDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPassword sets the password hash of user in shadow
+func (dbs *accountDBs) setPassword(user, hash string) error {
+	record := dbs.shadow.find(user)
+	if record == nil || len(record) < 2 {
+		return fmt.Errorf("user %s has no /etc/shadow entry", user)
+	}
+	record[1] = hash
+	return nil
+}
+
+// addUser adds a user with its own group, with the first UID and GID that
+// are both free, and returns its passwd record
+func (dbs *accountDBs) addUser(name, shell string) ([]string, error) {
+	if dbs.group.find(name) != nil {
+		return nil, fmt.Errorf("group %s already exists", name)
+	}
+	id := provisionIDMin
+	for dbs.passwd.hasID(id) || dbs.group.hasID(id) {
+		id++
+		if id > provisionIDMax {
+			return nil, errors.New("no free UID and GID left")
+		}
+	}
+
+	record := []string{name, "x", strconv.Itoa(id), strconv.Itoa(id), "", "/home/" + name, shell}
+	dbs.passwd.records = append(dbs.passwd.records, record)
+	days := strconv.FormatInt(time.Now().Unix()/86400, 10)
+	dbs.shadow.records = append(dbs.shadow.records, []string{name, "!", days, "0", "99999", "7", "", "", ""})
+	dbs.group.records = append(dbs.group.records, []string{name, "x", strconv.Itoa(id), ""})
+	if dbs.gshadow != nil {
+		dbs.gshadow.records = append(dbs.gshadow.records, []string{name, "!", "", ""})
+	}
+	return record, nil
+}
+
+// addGroup adds a group with the first free GID
+func (dbs *accountDBs) addGroup(name string) error {
+	id := provisionIDMin
+	for dbs.group.hasID(id) {
+		id++
+		if id > provisionIDMax {
+			return errors.New("no free GID left")
+		}
+	}
+	dbs.group.records = append(dbs.group.records, []string{name, "x", strconv.Itoa(id), ""})
+	if dbs.gshadow != nil {
+		dbs.gshadow.records = append(dbs.gshadow.records, []string{name, "!", "", ""})
+	}
+	return nil
+}
+
+// addToGroup adds user to the supplementary group
+func (dbs *accountDBs) addToGroup(user, group string) error {
+	if !dbs.group.addMember(group, user) {
+		return fmt.Errorf("group %s does not exist in the image", group)
+	}
+	if dbs.gshadow != nil {
+		dbs.gshadow.addMember(group, user)
+	}
+	return nil
+}
+
+// loginShell returns bash when the image at targetDir has it, sh otherwise
+func loginShell(targetDir string) string {
+	if _, err := os.Stat(filepath.Join(targetDir, "usr", "bin", "bash")); err == nil {
+		return "/bin/bash"
+	}
+	return "/bin/sh"
+}
+
+// homeDir returns the path below targetDir of the home directory of the
+// passwd record, resolving symlinks such as /home -> var/home within
+// targetDir. The home must resolve onto /var: anything written to the root
+// filesystem is lost with the next update, SSH keys included.
+func homeDir(targetDir string, record []string) (string, error) {
+	if len(record) < 6 || !filepath.IsAbs(record[5]) {
+		return "", fmt.Errorf("user %s has no home directory", record[0])
+	}
+	home, err := securejoin.SecureJoin(targetDir, record[5])
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve home of %s: %w", record[0], err)
+	}
+	rel, err := filepath.Rel(filepath.Join(targetDir, "var"), home)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("home %s of %s is not on /var and would be lost on the next update (link it there in the image, e.g. /root -> var/roothome)", record[5], record[0])
+	}
+	return home, nil
+}
+
+// ownedMkdir creates dir with mode owned by uid and gid. Missing parents
+// are created as MkdirAll creates them.
+func ownedMkdir(dir string, mode os.FileMode, uid, gid int) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dir), err)
+	}
+	if err := os.Mkdir(dir, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", dir, err)
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %w", dir, err)
+	}
+	return nil
+}
+
+// installSSHKeys adds keys to the ~/.ssh/authorized_keys of the user of the
+// passwd record, keeping the keys it already has
+func installSSHKeys(targetDir string, record []string, keys []string) error {
+	home, err := homeDir(targetDir, record)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(record[2])
+	gid, _ := strconv.Atoi(record[3])
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := ownedMkdir(sshDir, 0700, uid, gid); err != nil {
+		return err
+	}
+	path := filepath.Join(sshDir, "authorized_keys")
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	lines := strings.Split(strings.TrimRight(string(existing), "\n"), "\n")
+	for _, key := range keys {
+		if !slices.Contains(lines, key) {
+			lines = append(lines, key)
+		}
+	}
+	data := strings.TrimLeft(strings.Join(lines, "\n"), "\n") + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %w", path, err)
+	}
+	return nil
+}
+
+// provisioner applies ProvisionOptions to the system installed at targetDir
+type provisioner struct {
+	targetDir string
+	shell     string
+	dbs       *accountDBs // loaded on first use
+}
+
+// provisionItem is a setting of ProvisionOptions, applied and reported on
+// its own
+type provisionItem struct {
+	desc  string
+	apply func() error
+}
+
+// accounts returns the account databases, loading them on first use
+func (p *provisioner) accounts() (*accountDBs, error) {
+	if p.dbs == nil {
+		dbs, err := loadAccountDBs(p.targetDir)
+		if err != nil {
+			return nil, err
+		}
+		p.dbs = dbs
+	}
+	return p.dbs, nil
+}
+
+// writeEtc writes the file name of /etc to the overlay upper layer
+func (p *provisioner) writeEtc(name, content string) error {
+	if err := atomicWriteFile(filepath.Join(etcUpperDir(p.targetDir), name), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write /etc/%s: %w", name, err)
+	}
+	return nil
+}
+
+// setTimezone links /etc/localtime to the zoneinfo file of timezone, which
+// the image must have
+func (p *provisioner) setTimezone(timezone string) error {
+	zoneinfo := filepath.Join("usr", "share", "zoneinfo", timezone)
+	if info, err := os.Stat(filepath.Join(p.targetDir, zoneinfo)); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("timezone %s is not in the image's /usr/share/zoneinfo", timezone)
+	}
+
+	// Replace the link atomically, like atomicWriteFile replaces files
+	link := filepath.Join(etcUpperDir(p.targetDir), "localtime")
+	tmp := link + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("..", zoneinfo), tmp); err != nil {
+		return fmt.Errorf("failed to link /etc/localtime: %w", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to link /etc/localtime: %w", err)
+	}
+	return nil
+}
+
+// setRootPassword sets root's password hash
+func (p *provisioner) setRootPassword(hash string) error {
+	dbs, err := p.accounts()
+	if err != nil {
+		return err
+	}
+	return dbs.setPassword("root", hash)
+}
+
+// installRootSSHKeys adds keys to root's authorized_keys
+func (p *provisioner) installRootSSHKeys(keys []string) error {
+	dbs, err := p.accounts()
+	if err != nil {
+		return err
+	}
+	root := dbs.passwd.find("root")
+	if root == nil {
+		return errors.New("image has no root user")
+	}
+	if err := installSSHKeys(p.targetDir, root, keys); err != nil {
+		return fmt.Errorf("failed to install SSH keys for root: %w", err)
+	}
+	return nil
+}
+
+// createGroup adds group unless the image already has it
+func (p *provisioner) createGroup(group string) error {
+	dbs, err := p.accounts()
+	if err != nil {
+		return err
+	}
+	if dbs.group.find(group) != nil {
+		return nil
+	}
+	if err := dbs.addGroup(group); err != nil {
+		return fmt.Errorf("failed to create group %s: %w", group, err)
+	}
+	return nil
+}
+
+// provisionUser creates user, or updates it when the image already has it
+func (p *provisioner) provisionUser(user UserOptions) error {
+	dbs, err := p.accounts()
+	if err != nil {
+		return err
+	}
+	record := dbs.passwd.find(user.Name)
+	if record == nil {
+		if record, err = dbs.addUser(user.Name, p.shell); err != nil {
+			return fmt.Errorf("failed to create user %s: %w", user.Name, err)
+		}
+		home, err := homeDir(p.targetDir, record)
+		if err != nil {
+			return err
+		}
+		uid, _ := strconv.Atoi(record[2])
+		if err := ownedMkdir(home, 0700, uid, uid); err != nil {
+			return fmt.Errorf("failed to create home of %s: %w", user.Name, err)
+		}
+	}
+
+	if user.PasswordHash != "" {
+		if err := dbs.setPassword(user.Name, user.PasswordHash); err != nil {
+			return err
+		}
+	}
+	for _, group := range user.Groups {
+		if err := dbs.addToGroup(user.Name, group); err != nil {
+			return fmt.Errorf("failed to add %s to group %s: %w", user.Name, group, err)
+		}
+	}
+	if len(user.SSHAuthorizedKeys) > 0 {
+		if err := installSSHKeys(p.targetDir, record, user.SSHAuthorizedKeys); err != nil {
+			return fmt.Errorf("failed to install SSH keys for %s: %w", user.Name, err)
+		}
+	}
+	return nil
+}
+
+// items returns the settings of opts in the order they are applied: groups
+// before the users added to them
+func (p *provisioner) items(opts *ProvisionOptions) []provisionItem {
+	var items []provisionItem
+	if opts.Hostname != "" {
+		items = append(items, provisionItem{"hostname " + opts.Hostname, func() error {
+			return p.writeEtc("hostname", opts.Hostname+"\n")
+		}})
+	}
+	if opts.Locale != "" {
+		items = append(items, provisionItem{"locale " + opts.Locale, func() error {
+			return p.writeEtc("locale.conf", "LANG="+opts.Locale+"\n")
+		}})
+	}
+	if opts.Timezone != "" {
+		items = append(items, provisionItem{"timezone " + opts.Timezone, func() error {
+			return p.setTimezone(opts.Timezone)
+		}})
+	}
+	if opts.RootPasswordHash != "" {
+		items = append(items, provisionItem{"root password", func() error {
+			return p.setRootPassword(opts.RootPasswordHash)
+		}})
+	}
+	if len(opts.SSHAuthorizedKeys) > 0 {
+		items = append(items, provisionItem{fmt.Sprintf("%d SSH keys for root", len(opts.SSHAuthorizedKeys)), func() error {
+			return p.installRootSSHKeys(opts.SSHAuthorizedKeys)
+		}})
+	}
+	for _, group := range opts.Groups {
+		items = append(items, provisionItem{"group " + group, func() error {
+			return p.createGroup(group)
+		}})
+	}
+	for _, user := range opts.Users {
+		desc := "user " + user.Name
+		if len(user.Groups) > 0 {
+			desc += " (" + strings.Join(user.Groups, ", ") + ")"
+		}
+		items = append(items, provisionItem{desc, func() error {
+			return p.provisionUser(user)
+		}})
+	}
+	return items
+}
+
+// ProvisionTarget applies the hostname, locale, timezone, root credentials,
+// groups and users of opts to the system installed at targetDir, reporting
+// each as a step of its own. The files of /etc are written to the overlay
+// upper layer, which must exist. Home directories are created where the
+// image links them into /var, which must be mounted at targetDir/var.
+func ProvisionTarget(targetDir string, opts *ProvisionOptions, dryRun bool, progress reporter.Reporter) error {
+	if opts == nil {
+		return nil
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	p := &provisioner{targetDir: targetDir, shell: loginShell(targetDir)}
+	items := p.items(opts)
+	if len(items) == 0 {
+		return nil
+	}
+	if !dryRun {
+		progress.Message("Provisioning system...")
+	}
+	if err := applyProvisionItems(items, dryRun, progress); err != nil {
+		return err
+	}
+	if p.dbs != nil {
+		if err := p.dbs.save(targetDir); err != nil {
+			return err
+		}
+	}
+	if !dryRun {
+		progress.Message("✓ Provisioned %d settings", len(items))
+	}
+	return nil
+}
+
+// applyProvisionItems applies items in order, reporting each as a step of
+// its own. A dry run only reports them.
+func applyProvisionItems(items []provisionItem, dryRun bool, progress reporter.Reporter) error {
+	for idx, item := range items {
+		if dryRun {
+			progress.MessagePlain("[DRY RUN] Would provision %s", item.desc)
+			continue
+		}
+		progress.MessagePlain("  [%d/%d] Provisioning %s", idx+1, len(items), item.desc)
+		if err := item.apply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/frostyard/nbc/pkg/testutil"
+	"github.com/frostyard/std/reporter"
+)
+
+// writeProvisionTarget creates an installed system at a temporary directory
+// with the account databases of a small image and an empty /etc overlay
+func writeProvisionTarget(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"etc/passwd":                       "root:x:0:0:root:/root:/bin/bash\nbin:x:1:1:bin:/bin:/sbin/nologin\ndev:x:1000:1000::/home/dev:/bin/bash\n",
+		"etc/shadow":                       "root:*:19000:0:99999:7:::\nbin:*:19000:0:99999:7:::\ndev:!:19000:0:99999:7:::\n",
+		"etc/group":                        "root:x:0:\nwheel:x:10:\nusers:x:100:dev\ndev:x:1000:\n",
+		"etc/gshadow":                      "root:::\nwheel:::\nusers:::dev\ndev:!::\n",
+		"usr/bin/bash":                     "",
+		"usr/share/zoneinfo/Europe/Berlin": "TZif2",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "etc/shadow"), 0000); err != nil {
+		t.Fatal(err)
+	}
+	// bootc images keep homes on /var
+	for _, dir := range []string{"var/home", "var/roothome", etcUpperDir("")} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"home": "var/home", "root": "var/roothome"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func readUpper(t *testing.T, root, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(etcUpperDir(root), name))
+	if err != nil {
+		t.Fatalf("failed to read %s from the overlay upper layer: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestProvisionTarget(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+
+	opts := &ProvisionOptions{
+		Hostname:          "kiosk-01",
+		Locale:            "de_DE.UTF-8",
+		Timezone:          "Europe/Berlin",
+		RootPasswordHash:  "$6$salt$roothash",
+		SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAroot root@example.com"},
+		Groups:            []string{"docker", "wheel"},
+		Users: []UserOptions{
+			{Name: "admin", PasswordHash: "$6$salt$adminhash", Groups: []string{"wheel", "users", "docker"}, SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAadmin admin@example.com"}},
+			{Name: "dev", Groups: []string{"wheel"}},
+		},
+	}
+	if err := ProvisionTarget(root, opts, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("ProvisionTarget() error = %v", err)
+	}
+
+	if got := readUpper(t, root, "hostname"); got != "kiosk-01\n" {
+		t.Errorf("hostname = %q", got)
+	}
+	if got := readUpper(t, root, "locale.conf"); got != "LANG=de_DE.UTF-8\n" {
+		t.Errorf("locale.conf = %q", got)
+	}
+	if got, err := os.Readlink(filepath.Join(etcUpperDir(root), "localtime")); err != nil || got != "../usr/share/zoneinfo/Europe/Berlin" {
+		t.Errorf("localtime links to %q, %v", got, err)
+	}
+	if got := readUpper(t, root, "passwd"); !strings.Contains(got, "admin:x:1002:1002::/home/admin:/bin/bash\n") {
+		t.Errorf("passwd should add admin with the first free ID:\n%s", got)
+	}
+	shadow := readUpper(t, root, "shadow")
+	for _, want := range []string{"root:$6$salt$roothash:", "admin:$6$salt$adminhash:", "dev:!:19000:"} {
+		if !strings.Contains(shadow, want) {
+			t.Errorf("shadow should contain %q:\n%s", want, shadow)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(etcUpperDir(root), "shadow")); err != nil || info.Mode().Perm() != 0000 {
+		t.Errorf("shadow mode = %v, %v; want the image's", info.Mode().Perm(), err)
+	}
+	group := readUpper(t, root, "group")
+	for _, want := range []string{"wheel:x:10:admin,dev\n", "users:x:100:dev,admin\n", "docker:x:1001:admin\n", "admin:x:1002:\n"} {
+		if !strings.Contains(group, want) {
+			t.Errorf("group should contain %q:\n%s", want, group)
+		}
+	}
+	if got := readUpper(t, root, "gshadow"); !strings.Contains(got, "wheel:::admin,dev\n") {
+		t.Errorf("gshadow should list the new members:\n%s", got)
+	}
+
+	// The image's /etc is left alone
+	if data, _ := os.ReadFile(filepath.Join(root, "etc/passwd")); strings.Contains(string(data), "admin") {
+		t.Error("the image's /etc/passwd should not be changed")
+	}
+
+	keys := filepath.Join(root, "var/home/admin/.ssh/authorized_keys")
+	data, err := os.ReadFile(keys)
+	if err != nil || string(data) != "ssh-ed25519 AAAAadmin admin@example.com\n" {
+		t.Errorf("admin authorized_keys = %q, %v", data, err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(keys, &st); err != nil || st.Uid != 1002 || st.Mode&0777 != 0600 {
+		t.Errorf("admin authorized_keys owner %d mode %o, want 1002 and 0600", st.Uid, st.Mode&0777)
+	}
+	if err := syscall.Stat(filepath.Join(root, "var/home/admin"), &st); err != nil || st.Uid != 1002 || st.Mode&0777 != 0700 {
+		t.Errorf("admin home owner %d mode %o, want 1002 and 0700", st.Uid, st.Mode&0777)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "var/roothome/.ssh/authorized_keys")); err != nil || !strings.Contains(string(data), "root@example.com") {
+		t.Errorf("root authorized_keys = %q, %v", data, err)
+	}
+
+	// Provisioning again keeps the result
+	if err := ProvisionTarget(root, opts, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("second ProvisionTarget() error = %v", err)
+	}
+	if got := readUpper(t, root, "passwd"); strings.Count(got, "\nadmin:") != 1 {
+		t.Errorf("second run should not add admin again:\n%s", got)
+	}
+	if got := readUpper(t, root, "group"); strings.Count(got, "\ndocker:") != 1 {
+		t.Errorf("second run should not add docker again:\n%s", got)
+	}
+	if data, _ := os.ReadFile(keys); strings.Count(string(data), "admin@example.com") != 1 {
+		t.Errorf("second run should not add the key again:\n%s", data)
+	}
+}
+
+func TestProvisionTarget_MissingGroup(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+
+	opts := &ProvisionOptions{Users: []UserOptions{{Name: "admin", Groups: []string{"docker"}}}}
+	err := ProvisionTarget(root, opts, false, reporter.NoopReporter{})
+	if err == nil || !strings.Contains(err.Error(), "group docker does not exist") {
+		t.Errorf("ProvisionTarget() error = %v, want missing group error", err)
+	}
+}
+
+func TestProvisionTarget_MissingTimezone(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+
+	err := ProvisionTarget(root, &ProvisionOptions{Timezone: "Mars/Olympus_Mons"}, false, reporter.NoopReporter{})
+	if err == nil || !strings.Contains(err.Error(), "timezone Mars/Olympus_Mons is not in the image") {
+		t.Errorf("ProvisionTarget() error = %v, want missing timezone error", err)
+	}
+}
+
+func TestProvisionTarget_HomeNotOnVar(t *testing.T) {
+	testutil.RequireRoot(t)
+	root := writeProvisionTarget(t)
+	// The keys would be lost with the next update of the root filesystem
+	if err := os.Remove(filepath.Join(root, "root")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "root"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ProvisionOptions{SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAroot root@example.com"}}
+	err := ProvisionTarget(root, opts, false, reporter.NoopReporter{})
+	if err == nil || !strings.Contains(err.Error(), "home /root of root is not on /var") {
+		t.Errorf("ProvisionTarget() error = %v, want home not on /var error", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "root/.ssh")); err == nil {
+		t.Error("SSH keys should not be written to the root filesystem")
+	}
+}
+
+func TestProvisionTarget_DryRun(t *testing.T) {
+	root := t.TempDir()
+	opts := &ProvisionOptions{
+		Hostname: "kiosk-01",
+		Timezone: "Europe/Berlin",
+		Groups:   []string{"docker"},
+		Users:    []UserOptions{{Name: "admin", Groups: []string{"docker"}}},
+	}
+	var out bytes.Buffer
+	if err := ProvisionTarget(root, opts, true, reporter.NewTextReporter(&out)); err != nil {
+		t.Fatalf("ProvisionTarget() dry run error = %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Error("dry run should not write anything")
+	}
+	for _, want := range []string{
+		"[DRY RUN] Would provision hostname kiosk-01",
+		"[DRY RUN] Would provision timezone Europe/Berlin",
+		"[DRY RUN] Would provision group docker",
+		"[DRY RUN] Would provision user admin (docker)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dry run output should contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestProvisionOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      ProvisionOptions
+		wantField string
+	}{
+		{"valid", ProvisionOptions{Hostname: "kiosk-01.example.com", Locale: "en_US.UTF-8", Timezone: "America/Argentina/Buenos_Aires", Groups: []string{"docker"}}, ""},
+		{"valid locale with modifier", ProvisionOptions{Locale: "de_DE@euro"}, ""},
+		{"bad locale", ProvisionOptions{Locale: "en US"}, "locale"},
+		{"bad timezone", ProvisionOptions{Timezone: "../../etc/shadow"}, "timezone"},
+		{"absolute timezone", ProvisionOptions{Timezone: "/Europe/Berlin"}, "timezone"},
+		{"bad group", ProvisionOptions{Groups: []string{"docker", "Bad Group"}}, "groups[1]"},
+		{"duplicate group", ProvisionOptions{Groups: []string{"docker", "docker"}}, "groups[1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.wantField == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) || fieldErr.Field != tt.wantField {
+				t.Errorf("Validate() error = %v, want field %s", err, tt.wantField)
+			}
+		})
+	}
+}
@@ -0,0 +1,598 @@
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+)
+
+// RollbackOptions configures a rollback of the default boot entry
+type RollbackOptions struct {
+	Device string // Disk holding the A/B partitions (e.g. /dev/sda)
+	DryRun bool   // Report what would change without writing anything
+
+	RestoreVar  bool   // Also restore /var from the snapshot taken before the update
+	VarSnapshot string // Snapshot of /var to restore instead (implies RestoreVar)
+}
+
+// bootDefaultSwitch describes how a bootloader's default entry moves to the other slot
+type bootDefaultSwitch struct {
+	ConfigPath string // File that selects the default entry (grub.cfg or loader.conf)
+	Content    []byte // Rewritten content of ConfigPath
+	FromSlot   string // Slot ("root1"/"root2") booted by default before the switch
+	ToSlot     string // Slot booted by default after the switch
+	ToEntry    string // Menu entry title (GRUB) or entry ID (systemd-boot) that becomes the default
+}
+
+// Rollback makes the other A/B slot the default boot entry.
+//
+// The update flow always leaves two entries behind: the newly written slot and a
+// "(Previous)" entry for the slot that was running. Rollback rewrites grub.cfg or
+// loader.conf on the boot partition so the slot that is currently NOT the default
+// boots next, and swaps the current and previous image in the system config so
+// status and later updates describe the slot that will actually boot. Running it
+// twice restores the original default.
+func Rollback(ctx context.Context, opts RollbackOptions, progress reporter.Reporter) (*types.RollbackOutput, error) {
+	if progress == nil {
+		progress = reporter.NoopReporter{}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Acquire exclusive lock so a rollback cannot race an update
+	lock, err := AcquireSystemLock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	config, err := ReadSystemConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system config: %w", err)
+	}
+	if config.Subvolumes != nil {
+		return nil, fmt.Errorf("rollback switches between root slots, but this installation uses subvolume deployments; select an older deployment in the boot menu instead")
+	}
+
+	scheme, err := DetectInstalledPartitionScheme(opts.Device, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect partition scheme: %w", err)
+	}
+
+	rootArgs, err := slotRootArgs(ctx, scheme, config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick the snapshot of /var before changing anything, so a missing one
+	// fails the rollback as a whole
+	var varSnapshot *VarSnapshot
+	if opts.RestoreVar || opts.VarSnapshot != "" {
+		varSnapshot, err = selectVarSnapshot(varSnapshotConfig(config).Snapshots, opts.VarSnapshot, config.PreviousImageDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Mount the boot partition (read-only for a dry run)
+	bootMountPoint, err := os.MkdirTemp("", "nbc-rollback-boot-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create boot mount point: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(bootMountPoint) }()
+
+	mountArgs := []string{scheme.BootPartition, bootMountPoint}
+	if opts.DryRun {
+		mountArgs = append([]string{"-o", "ro"}, mountArgs...)
+	}
+	cmd := exec.CommandContext(ctx, "mount", mountArgs...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to mount boot partition: %w\nOutput: %s", err, string(output))
+	}
+	defer func() { _ = exec.Command("umount", bootMountPoint).Run() }()
+
+	bootloaderType := detectBootloaderTypeAt(bootMountPoint)
+	progress.Message("Detected bootloader: %s", bootloaderType)
+
+	var plan *bootDefaultSwitch
+	switch bootloaderType {
+	case BootloaderGRUB2:
+		plan, err = planGRUBRollback(bootMountPoint, rootArgs)
+	case BootloaderSystemdBoot:
+		plan, err = planSystemdBootRollback(bootMountPoint, rootArgs)
+	default:
+		err = fmt.Errorf("unsupported bootloader type: %s", bootloaderType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	targetPartition := scheme.Root1Partition
+	if plan.ToSlot == "root2" {
+		targetPartition = scheme.Root2Partition
+	}
+
+	if opts.DryRun {
+		progress.MessagePlain("[DRY RUN] Would set default boot entry to %s (%s, %s)", plan.ToEntry, plan.ToSlot, targetPartition)
+	} else {
+		if err := atomicWriteFile(plan.ConfigPath, plan.Content, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", filepath.Base(plan.ConfigPath), err)
+		}
+		// An armed boot counter would override the chosen default once it
+		// runs out, so a manual rollback disarms it.
+		if bootloaderType == BootloaderGRUB2 {
+			if err := setGRUBBootCounter(filepath.Dir(plan.ConfigPath), 0); err != nil {
+				return nil, err
+			}
+		}
+		progress.Message("Default boot entry is now %s (%s, %s)", plan.ToEntry, plan.ToSlot, targetPartition)
+	}
+
+	// Keep the discoverable no-auto flags in step with the default slot
+	if config.Discoverable != nil {
+		if err := SetDiscoverableRootSlot(ctx, opts.Device, scheme, targetPartition, opts.DryRun, progress); err != nil {
+			progress.Warning("failed to update discoverable partition flags: %v", err)
+		}
+	}
+
+	// Swap current and previous image so the config describes the default slot
+	if config.PreviousImageRef == "" && config.PreviousImageDigest == "" {
+		progress.Warning("previous image is not recorded in the system config; leaving image reference unchanged")
+	} else {
+		config.ImageRef, config.PreviousImageRef = config.PreviousImageRef, config.ImageRef
+		config.ImageDigest, config.PreviousImageDigest = config.PreviousImageDigest, config.ImageDigest
+		if err := WriteSystemConfig(ctx, config, opts.DryRun, progress); err != nil {
+			return nil, fmt.Errorf("failed to update system config: %w", err)
+		}
+	}
+
+	// The nbc state copied into the restored /var includes the swapped config
+	if varSnapshot != nil {
+		if opts.DryRun {
+			progress.MessagePlain("[DRY RUN] Would restore /var from snapshot %s", varSnapshot.Name)
+		} else if err := restoreVarSnapshot(ctx, config, varSnapshot, progress); err != nil {
+			return nil, fmt.Errorf("failed to restore /var: %w", err)
+		}
+	}
+
+	// A reboot is only needed when the new default differs from the running
+	// slot, or when /var was restored
+	runningSlot := ""
+	if active, err := GetActiveRootPartition(); err == nil {
+		runningSlot = activeRootSlot(active, scheme)
+	}
+	rebootRequired := plan.ToSlot != runningSlot || varSnapshot != nil
+
+	if !opts.DryRun {
+		if rebootRequired {
+			rebootInfo := &types.RebootPendingInfo{
+				PendingImageRef:    config.ImageRef,
+				PendingImageDigest: config.ImageDigest,
+				UpdateTime:         time.Now().UTC().Format(time.RFC3339),
+				TargetPartition:    targetPartition,
+			}
+			if err := WriteRebootRequiredMarker(rebootInfo); err != nil {
+				progress.Warning("failed to write reboot-required marker: %v", err)
+			}
+		} else if err := ClearRebootRequiredMarker(); err != nil {
+			progress.Warning("failed to clear reboot-required marker: %v", err)
+		}
+	}
+
+	output := &types.RollbackOutput{
+		Device:          opts.Device,
+		BootloaderType:  string(bootloaderType),
+		PreviousDefault: plan.FromSlot,
+		NewDefault:      plan.ToSlot,
+		DefaultEntry:    plan.ToEntry,
+		TargetPartition: targetPartition,
+		ImageRef:        config.ImageRef,
+		ImageDigest:     config.ImageDigest,
+		RebootRequired:  rebootRequired,
+		DryRun:          opts.DryRun,
+	}
+	if varSnapshot != nil {
+		output.RestoredVar = varSnapshot.Name
+	}
+	switch {
+	case opts.DryRun:
+		output.Message = fmt.Sprintf("Would roll back default boot entry from %s to %s", plan.FromSlot, plan.ToSlot)
+	case rebootRequired:
+		output.Message = fmt.Sprintf("Rolled back default boot entry to %s. Reboot to activate it.", plan.ToSlot)
+	default:
+		output.Message = fmt.Sprintf("Rolled back default boot entry to the running slot %s. No reboot required.", plan.ToSlot)
+	}
+
+	return output, nil
+}
+
+// slotRootArgs maps the root= kernel argument written for each A/B slot to the
+// slot name. Encrypted installs identify slots by their device-mapper name,
+// plain installs by the root partition's filesystem UUID.
+func slotRootArgs(ctx context.Context, scheme *PartitionScheme, encryption *EncryptionConfig) (map[string]string, error) {
+	if encryption != nil && encryption.Enabled {
+		return map[string]string{
+			"root=/dev/mapper/root1": "root1",
+			"root=/dev/mapper/root2": "root2",
+		}, nil
+	}
+
+	root1UUID, err := GetPartitionUUID(ctx, scheme.Root1Partition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get root1 UUID: %w", err)
+	}
+	root2UUID, err := GetPartitionUUID(ctx, scheme.Root2Partition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get root2 UUID: %w", err)
+	}
+
+	return map[string]string{
+		"root=UUID=" + root1UUID: "root1",
+		"root=UUID=" + root2UUID: "root2",
+	}, nil
+}
+
+// cmdlineSlot returns the slot a kernel command line boots, or "" if its root=
+// argument matches neither slot.
+func cmdlineSlot(cmdline []string, rootArgs map[string]string) string {
+	for _, arg := range cmdline {
+		if slot, ok := rootArgs[arg]; ok {
+			return slot
+		}
+	}
+	return ""
+}
+
+// activeRootSlot returns the slot of the running root device as reported by
+// GetActiveRootPartition, or "" if it is neither root partition.
+func activeRootSlot(active string, scheme *PartitionScheme) string {
+	switch {
+	case active == "/dev/mapper/root1" || filepath.Base(active) == filepath.Base(scheme.Root1Partition):
+		return "root1"
+	case active == "/dev/mapper/root2" || filepath.Base(active) == filepath.Base(scheme.Root2Partition):
+		return "root2"
+	}
+	return ""
+}
+
+// otherSlot returns the A/B slot that is not slot
+func otherSlot(slot string) string {
+	if slot == "root1" {
+		return "root2"
+	}
+	return "root1"
+}
+
+// grubMenuEntry is a top-level menuentry parsed from grub.cfg
+type grubMenuEntry struct {
+	Title   string
+	Cmdline []string
+}
+
+// parseGRUBConfig extracts the top-level menu entries and the numeric default
+// entry from a grub.cfg written by nbc. A missing "set default" means entry 0.
+// Indented "set default" lines (such as the boot-counting fallback) are
+// conditional and do not select the default.
+func parseGRUBConfig(cfg string) ([]grubMenuEntry, int, error) {
+	var entries []grubMenuEntry
+	defaultIndex := 0
+
+	for rawLine := range strings.SplitSeq(cfg, "\n") {
+		line := strings.TrimSpace(rawLine)
+		switch {
+		case strings.HasPrefix(rawLine, "set default="):
+			value := strings.Trim(strings.TrimPrefix(line, "set default="), `"'`)
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("unsupported GRUB default entry %q (expected an entry index)", value)
+			}
+			defaultIndex = n
+		case strings.HasPrefix(line, "menuentry "):
+			title := strings.TrimPrefix(line, "menuentry ")
+			if q := title[0]; q == '\'' || q == '"' {
+				if end := strings.IndexByte(title[1:], q); end >= 0 {
+					title = title[1 : end+1]
+				}
+			}
+			entries = append(entries, grubMenuEntry{Title: title})
+		case strings.HasPrefix(line, "linux ") && len(entries) > 0:
+			fields := strings.Fields(line)
+			// fields[0] is "linux", fields[1] is the kernel path
+			if len(fields) > 2 {
+				entries[len(entries)-1].Cmdline = fields[2:]
+			}
+		}
+	}
+
+	return entries, defaultIndex, nil
+}
+
+// setGRUBDefault rewrites (or adds) the top-level "set default=" line of a grub.cfg
+func setGRUBDefault(cfg string, index int) string {
+	defaultLine := "set default=" + strconv.Itoa(index)
+	lines := strings.Split(cfg, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "set default=") {
+			lines[i] = defaultLine
+			return strings.Join(lines, "\n")
+		}
+	}
+	return defaultLine + "\n" + cfg
+}
+
+// planGRUBRollback finds the grub.cfg entry for the slot that is not the
+// current default and prepares a grub.cfg selecting it.
+func planGRUBRollback(bootMount string, rootArgs map[string]string) (*bootDefaultSwitch, error) {
+	var cfgPath string
+	for _, dir := range []string{"grub", "grub2"} {
+		candidate := filepath.Join(bootMount, dir, "grub.cfg")
+		if _, err := os.Stat(candidate); err == nil {
+			cfgPath = candidate
+			break
+		}
+	}
+	if cfgPath == "" {
+		return nil, fmt.Errorf("could not find grub.cfg on boot partition")
+	}
+
+	data, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grub.cfg: %w", err)
+	}
+
+	entries, defaultIndex, err := parseGRUBConfig(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if defaultIndex < 0 || defaultIndex >= len(entries) {
+		return nil, fmt.Errorf("GRUB default entry %d does not exist (%d entries)", defaultIndex, len(entries))
+	}
+
+	fromSlot := cmdlineSlot(entries[defaultIndex].Cmdline, rootArgs)
+	if fromSlot == "" {
+		return nil, fmt.Errorf("GRUB default entry %q does not boot either root slot", entries[defaultIndex].Title)
+	}
+
+	toSlot := otherSlot(fromSlot)
+	for i, entry := range entries {
+		if cmdlineSlot(entry.Cmdline, rootArgs) == toSlot {
+			return &bootDefaultSwitch{
+				ConfigPath: cfgPath,
+				Content:    []byte(setGRUBDefault(string(data), i)),
+				FromSlot:   fromSlot,
+				ToSlot:     toSlot,
+				ToEntry:    entry.Title,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no GRUB entry boots %s; a rollback needs a previous update", toSlot)
+}
+
+// systemdBootEntryID returns the entry ID from an entry file name or a
+// loader.conf default value, which may be given with or without ".conf".
+// Boot counters ("bootc+2-1.conf", "bootc+2-1.efi") are not part of the ID.
+func systemdBootEntryID(name string) string {
+	if !strings.HasSuffix(name, ".conf") && !strings.HasSuffix(name, ".efi") {
+		name += ".conf"
+	}
+	id, _, _, _ := parseSystemdBootCounter(name)
+	return id
+}
+
+// loaderConfDefault returns the "default" value from loader.conf content
+func loaderConfDefault(content string) string {
+	for line := range strings.SplitSeq(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "default" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// setLoaderConfDefault rewrites (or adds) the "default" line of loader.conf content
+func setLoaderConfDefault(content, entryID string) string {
+	defaultLine := "default " + entryID
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "default" {
+			lines[i] = defaultLine
+			return strings.Join(lines, "\n")
+		}
+	}
+	return defaultLine + "\n" + content
+}
+
+// setSystemdBootDefault points loader.conf at entryID, leaving the file
+// untouched when it already does.
+func setSystemdBootDefault(loaderConfPath, entryID string) error {
+	data, err := os.ReadFile(loaderConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read loader.conf: %w", err)
+	}
+
+	content := string(data)
+	if loaderConfDefault(content) == entryID {
+		return nil
+	}
+
+	if err := atomicWriteFile(loaderConfPath, []byte(setLoaderConfDefault(content, entryID)), 0644); err != nil {
+		return fmt.Errorf("failed to write loader.conf: %w", err)
+	}
+	return nil
+}
+
+// planSystemdBootRollback finds the loader entry for the slot that is not the
+// current default and prepares a loader.conf selecting it.
+func planSystemdBootRollback(bootMount string, rootArgs map[string]string) (*bootDefaultSwitch, error) {
+	loaderDir := filepath.Join(bootMount, "loader")
+	loaderConfPath := filepath.Join(loaderDir, "loader.conf")
+
+	data, err := os.ReadFile(loaderConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read loader.conf: %w", err)
+	}
+	defaultPattern := loaderConfDefault(string(data))
+	if defaultPattern == "" {
+		defaultPattern = systemdBootDefaultPattern
+	} else {
+		defaultPattern = systemdBootEntryID(defaultPattern)
+	}
+
+	entries, err := listSystemdBootEntries(bootMount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Order entries the way systemd-boot does for entries without sort-key:
+	// entries with no tries left last, otherwise by version-compared file
+	// ID in descending order. systemd-boot compares IDs with their ".conf"
+	// or ".efi" suffix, which puts "bootc.conf" before "bootc-previous.conf".
+	bad := make(map[string]bool, len(entries))
+	fileIDs := make(map[string]string, len(entries))
+	slots := make(map[string]string, len(entries))
+	var ids []string
+	for _, entry := range entries {
+		bad[entry.ID] = entry.Counted && entry.TriesLeft == 0
+		fileIDs[entry.ID] = systemdBootEntryFileName(entry.ID, 0)
+		ids = append(ids, entry.ID)
+		slots[entry.ID] = cmdlineSlot(entry.Cmdline, rootArgs)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if bad[ids[i]] != bad[ids[j]] {
+			return !bad[ids[i]]
+		}
+		return strverscmp(fileIDs[ids[i]], fileIDs[ids[j]]) > 0
+	})
+
+	// loader.conf "default" is a glob matched against entry IDs
+	fromSlot, fromID := "", ""
+	for _, id := range ids {
+		if matched, _ := path.Match(defaultPattern, id); matched {
+			fromSlot, fromID = slots[id], id
+			break
+		}
+	}
+	if fromID == "" {
+		return nil, fmt.Errorf("no boot entry matches loader.conf default %q", defaultPattern)
+	}
+	if fromSlot == "" {
+		return nil, fmt.Errorf("default boot entry %s does not boot either root slot", fromID)
+	}
+
+	toSlot := otherSlot(fromSlot)
+	for _, id := range ids {
+		if slots[id] == toSlot {
+			return &bootDefaultSwitch{
+				ConfigPath: loaderConfPath,
+				Content:    []byte(setLoaderConfDefault(string(data), id)),
+				FromSlot:   fromSlot,
+				ToSlot:     toSlot,
+				ToEntry:    id,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no boot entry boots %s; a rollback needs a previous update", toSlot)
+}
+
+// strverscmp compares a and b like systemd's strverscmp_improved, which
+// systemd-boot uses to order boot entries. It returns -1, 0 or 1.
+func strverscmp(a, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isLetter := func(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+	isVersionChar := func(c byte) bool {
+		return isDigit(c) || isLetter(c) || strings.IndexByte("~-^.", c) >= 0
+	}
+	span := func(s string, f func(byte) bool) int {
+		n := 0
+		for n < len(s) && f(s[n]) {
+			n++
+		}
+		return n
+	}
+	first := func(s string) byte {
+		if s == "" {
+			return 0
+		}
+		return s[0]
+	}
+	// separator compares a leading separator: the string with it is older
+	separator := func(sep byte) int {
+		switch {
+		case first(a) == sep && first(b) == sep:
+			a, b = a[1:], b[1:]
+		case first(a) == sep:
+			return -1
+		case first(b) == sep:
+			return 1
+		}
+		return 0
+	}
+
+	for {
+		for a != "" && !isVersionChar(a[0]) {
+			a = a[1:]
+		}
+		for b != "" && !isVersionChar(b[0]) {
+			b = b[1:]
+		}
+
+		// "~" marks a pre-release, older than anything, even the end
+		if r := separator('~'); r != 0 {
+			return r
+		}
+		if a == "" || b == "" {
+			return cmp.Compare(first(a), first(b))
+		}
+		for _, sep := range []byte{'-', '^', '.'} {
+			if r := separator(sep); r != 0 {
+				return r
+			}
+		}
+
+		var p, q int
+		if isDigit(first(a)) || isDigit(first(b)) {
+			// A number is newer than anything else
+			if isDigit(first(a)) != isDigit(first(b)) {
+				if isDigit(first(a)) {
+					return 1
+				}
+				return -1
+			}
+			a = strings.TrimLeft(a, "0")
+			b = strings.TrimLeft(b, "0")
+			p, q = span(a, isDigit), span(b, isDigit)
+			if r := cmp.Compare(p, q); r != 0 {
+				return r
+			}
+			if r := strings.Compare(a[:p], b[:q]); r != 0 {
+				return r
+			}
+		} else {
+			p, q = span(a, isLetter), span(b, isLetter)
+			if r := strings.Compare(a[:min(p, q)], b[:min(p, q)]); r != 0 {
+				return r
+			}
+			if r := cmp.Compare(p, q); r != 0 {
+				return r
+			}
+		}
+		a, b = a[p:], b[q:]
+	}
+}
@@ -0,0 +1,244 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRootArgs = map[string]string{
+	"root=UUID=uuid-root1": "root1",
+	"root=UUID=uuid-root2": "root2",
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestParseGRUBConfig(t *testing.T) {
+	cfg := buildGRUBConfig(
+		"Test Linux",
+		"6.18.3-current",
+		"initramfs-6.18.3-current.img",
+		[]string{"root=UUID=uuid-root2", "ro"},
+		"6.18.2-previous",
+		"initramfs-6.18.2-previous.img",
+		[]string{"root=UUID=uuid-root1", "ro"},
+		0,
+	)
+
+	entries, defaultIndex, err := parseGRUBConfig(cfg)
+	if err != nil {
+		t.Fatalf("parseGRUBConfig() error = %v", err)
+	}
+	if defaultIndex != 0 {
+		t.Errorf("defaultIndex = %d, want 0", defaultIndex)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[1].Title != "Test Linux (Previous)" {
+		t.Errorf("entries[1].Title = %q, want %q", entries[1].Title, "Test Linux (Previous)")
+	}
+	if got := cmdlineSlot(entries[0].Cmdline, testRootArgs); got != "root2" {
+		t.Errorf("entry 0 slot = %q, want root2", got)
+	}
+	if got := cmdlineSlot(entries[1].Cmdline, testRootArgs); got != "root1" {
+		t.Errorf("entry 1 slot = %q, want root1", got)
+	}
+}
+
+func TestParseGRUBConfigRejectsNonNumericDefault(t *testing.T) {
+	if _, _, err := parseGRUBConfig("set default=saved\n"); err == nil {
+		t.Error("parseGRUBConfig() should reject a non-numeric default")
+	}
+}
+
+func TestPlanGRUBRollback(t *testing.T) {
+	bootDir := t.TempDir()
+	cfgPath := filepath.Join(bootDir, "grub2", "grub.cfg")
+	writeTestFile(t, cfgPath, buildGRUBConfig(
+		"Test Linux",
+		"6.18.3-current",
+		"initramfs-6.18.3-current.img",
+		[]string{"root=UUID=uuid-root2", "ro"},
+		"6.18.2-previous",
+		"initramfs-6.18.2-previous.img",
+		[]string{"root=UUID=uuid-root1", "ro"},
+		DefaultBootTries,
+	))
+
+	plan, err := planGRUBRollback(bootDir, testRootArgs)
+	if err != nil {
+		t.Fatalf("planGRUBRollback() error = %v", err)
+	}
+	if plan.ConfigPath != cfgPath {
+		t.Errorf("ConfigPath = %q, want %q", plan.ConfigPath, cfgPath)
+	}
+	if plan.FromSlot != "root2" || plan.ToSlot != "root1" {
+		t.Errorf("switch = %s -> %s, want root2 -> root1", plan.FromSlot, plan.ToSlot)
+	}
+	if plan.ToEntry != "Test Linux (Previous)" {
+		t.Errorf("ToEntry = %q, want %q", plan.ToEntry, "Test Linux (Previous)")
+	}
+	if !strings.Contains(string(plan.Content), "set default=1\n") {
+		t.Errorf("rewritten config should default to entry 1, got:\n%s", plan.Content)
+	}
+	if strings.Contains(string(plan.Content), "\nset default=0") {
+		t.Errorf("rewritten config should not keep the old default, got:\n%s", plan.Content)
+	}
+	if !strings.Contains(string(plan.Content), "        set default=1\n") {
+		t.Errorf("rewritten config should keep the boot-counting fallback, got:\n%s", plan.Content)
+	}
+
+	// Applying the plan and planning again switches back
+	writeTestFile(t, cfgPath, string(plan.Content))
+	plan, err = planGRUBRollback(bootDir, testRootArgs)
+	if err != nil {
+		t.Fatalf("second planGRUBRollback() error = %v", err)
+	}
+	if plan.ToSlot != "root2" || !strings.Contains(string(plan.Content), "set default=0\n") {
+		t.Errorf("second rollback should switch back to entry 0 (root2), got %s:\n%s", plan.ToSlot, plan.Content)
+	}
+}
+
+func TestPlanGRUBRollbackEncrypted(t *testing.T) {
+	bootDir := t.TempDir()
+	writeTestFile(t, filepath.Join(bootDir, "grub", "grub.cfg"), buildGRUBConfig(
+		"Test Linux",
+		"6.18.3",
+		"initramfs-6.18.3.img",
+		[]string{"root=/dev/mapper/root1", "ro", "rd.luks.name=aaa=root1"},
+		"6.18.3",
+		"initramfs-6.18.3.img",
+		[]string{"root=/dev/mapper/root2", "ro", "rd.luks.name=bbb=root2"},
+		0,
+	))
+
+	rootArgs, err := slotRootArgs(t.Context(), &PartitionScheme{}, &EncryptionConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("slotRootArgs() error = %v", err)
+	}
+
+	plan, err := planGRUBRollback(bootDir, rootArgs)
+	if err != nil {
+		t.Fatalf("planGRUBRollback() error = %v", err)
+	}
+	if plan.FromSlot != "root1" || plan.ToSlot != "root2" {
+		t.Errorf("switch = %s -> %s, want root1 -> root2", plan.FromSlot, plan.ToSlot)
+	}
+}
+
+func TestPlanGRUBRollbackWithoutPreviousEntry(t *testing.T) {
+	bootDir := t.TempDir()
+	writeTestFile(t, filepath.Join(bootDir, "grub", "grub.cfg"), `set timeout=5
+set default=0
+
+menuentry 'Test Linux' {
+    linux /vmlinuz-6.18.3 root=UUID=uuid-root1 ro
+    initrd /initramfs-6.18.3.img
+}
+`)
+
+	if _, err := planGRUBRollback(bootDir, testRootArgs); err == nil {
+		t.Error("planGRUBRollback() should fail when no entry boots the other slot")
+	}
+}
+
+func TestPlanSystemdBootRollback(t *testing.T) {
+	bootDir := t.TempDir()
+	loaderConf := filepath.Join(bootDir, "loader", "loader.conf")
+	writeTestFile(t, loaderConf, "default bootc\ntimeout 5\nconsole-mode max\neditor yes\n")
+	writeTestFile(t, filepath.Join(bootDir, "loader", "entries", "bootc.conf"),
+		buildSystemdBootEntry("Test Linux", "6.18.3", "initramfs-6.18.3.img", []string{"root=UUID=uuid-root1", "ro"}))
+	writeTestFile(t, filepath.Join(bootDir, "loader", "entries", "bootc-previous.conf"),
+		buildSystemdBootEntry("Test Linux (Previous)", "6.18.2", "initramfs-6.18.2.img", []string{"root=UUID=uuid-root2", "ro"}))
+
+	plan, err := planSystemdBootRollback(bootDir, testRootArgs)
+	if err != nil {
+		t.Fatalf("planSystemdBootRollback() error = %v", err)
+	}
+	if plan.FromSlot != "root1" || plan.ToSlot != "root2" {
+		t.Errorf("switch = %s -> %s, want root1 -> root2", plan.FromSlot, plan.ToSlot)
+	}
+	if plan.ToEntry != "bootc-previous" {
+		t.Errorf("ToEntry = %q, want bootc-previous", plan.ToEntry)
+	}
+	want := "default bootc-previous\ntimeout 5\nconsole-mode max\neditor yes\n"
+	if string(plan.Content) != want {
+		t.Errorf("loader.conf = %q, want %q", plan.Content, want)
+	}
+}
+
+func TestStrverscmp(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"bootc.conf", "bootc-previous.conf", 1},
+		{"bootc.efi", "bootc-previous.efi", 1},
+		{"bootc", "bootc-previous", -1},
+		{"arch-6.10.conf", "arch-6.9.conf", 1},
+		{"1.0", "1.00", 0},
+		{"1~rc1", "1", -1},
+		{"1.0", "1.a", 1},
+		{"1^p", "1", 1},
+		{"a_b", "ab", -1},
+	}
+	for _, tt := range tests {
+		if got := strverscmp(tt.a, tt.b); got != tt.want {
+			t.Errorf("strverscmp(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := strverscmp(tt.b, tt.a); got != -tt.want {
+			t.Errorf("strverscmp(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestSetSystemdBootDefault(t *testing.T) {
+	loaderConf := filepath.Join(t.TempDir(), "loader.conf")
+	writeTestFile(t, loaderConf, "default bootc-previous.conf\ntimeout 5\n")
+
+	if err := setSystemdBootDefault(loaderConf, "bootc"); err != nil {
+		t.Fatalf("setSystemdBootDefault() error = %v", err)
+	}
+
+	data, err := os.ReadFile(loaderConf)
+	if err != nil {
+		t.Fatalf("failed to read loader.conf: %v", err)
+	}
+	if string(data) != "default bootc\ntimeout 5\n" {
+		t.Errorf("loader.conf = %q, want default reset to bootc", data)
+	}
+}
+
+func TestActiveRootSlot(t *testing.T) {
+	scheme := &PartitionScheme{
+		Root1Partition: "/dev/nvme0n1p2",
+		Root2Partition: "/dev/nvme0n1p3",
+	}
+
+	tests := []struct {
+		active string
+		want   string
+	}{
+		{"/dev/nvme0n1p2", "root1"},
+		{"/dev/nvme0n1p3", "root2"},
+		{"/dev/mapper/root1", "root1"},
+		{"/dev/mapper/root2", "root2"},
+		{"/dev/sda2", ""},
+	}
+
+	for _, tt := range tests {
+		if got := activeRootSlot(tt.active, scheme); got != tt.want {
+			t.Errorf("activeRootSlot(%q) = %q, want %q", tt.active, got, tt.want)
+		}
+	}
+}
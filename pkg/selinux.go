@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/frostyard/std/reporter"
+	"golang.org/x/sys/unix"
+)
+
+// selinuxXattr is the extended attribute holding a file's SELinux label
+const selinuxXattr = "security.selinux"
+
+// selinuxPolicyType returns the SELINUXTYPE of the image at root, or "" when
+// the image has no SELinux config or disables SELinux
+func selinuxPolicyType(root string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(root, "etc", "selinux", "config"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read SELinux config: %w", err)
+	}
+
+	policy := "targeted"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "SELINUX":
+			if value == "disabled" {
+				return "", nil
+			}
+		case "SELINUXTYPE":
+			policy = value
+		}
+	}
+	return policy, nil
+}
+
+// RelabelSELinux labels every file below root with the file contexts of the
+// image's SELinux policy, as a relabel of the booted system would. The
+// /.etc.lower copy of /etc is the lower layer of the /etc overlay, so it gets
+// the labels of /etc rather than those of its own path. Images without an
+// SELinux policy are left alone.
+func RelabelSELinux(ctx context.Context, root string, dryRun bool, progress reporter.Reporter) error {
+	policy, err := selinuxPolicyType(root)
+	if err != nil {
+		return err
+	}
+	if policy == "" {
+		progress.Message("Image has no SELinux policy, skipping relabel")
+		return nil
+	}
+	fileContexts := filepath.Join(root, "etc", "selinux", policy, "contexts", "files", "file_contexts")
+	if _, err := os.Stat(fileContexts); err != nil {
+		return fmt.Errorf("image has no file contexts for SELinux policy %s: %w", policy, err)
+	}
+
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would relabel the root filesystem with the %s SELinux policy", policy)
+		return nil
+	}
+
+	if _, err := exec.LookPath("setfiles"); err != nil {
+		return fmt.Errorf("setfiles not found, install policycoreutils: %w", err)
+	}
+
+	progress.Message("Relabeling the root filesystem with the %s SELinux policy...", policy)
+	etcLower := filepath.Join(root, ".etc.lower")
+	cmd := exec.CommandContext(ctx, "setfiles", "-F", "-r", root, "-e", etcLower, fileContexts, root)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("setfiles failed: %w\nOutput: %s", err, string(output))
+	}
+
+	if _, err := os.Lstat(etcLower); err == nil {
+		if err := copyXattrTree(filepath.Join(root, "etc"), etcLower, selinuxXattr); err != nil {
+			return fmt.Errorf("failed to label /.etc.lower: %w", err)
+		}
+	}
+	return nil
+}
+
+// copyXattrTree sets the extended attribute name of every path below dst to
+// its value on the same path below src. Paths missing in src, or without the
+// attribute there, are left alone.
+func copyXattrTree(src, dst, name string) error {
+	return filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+
+		value, err := lgetxattr(filepath.Join(src, rel), name)
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s of %s: %w", name, filepath.Join(src, rel), err)
+		}
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("failed to set %s on %s: %w", name, path, err)
+		}
+		return nil
+	})
+}
+
+// lgetxattr returns the value of the extended attribute name of path, without
+// following a symlink at path
+func lgetxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			// The value grew since its size was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
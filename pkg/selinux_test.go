@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/frostyard/std/reporter"
+	"golang.org/x/sys/unix"
+)
+
+func TestSELinuxPolicyType(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string // "" for no config file
+		want   string
+	}{
+		{"no config", "", ""},
+		{"enforcing", "SELINUX=enforcing\nSELINUXTYPE=targeted\n", "targeted"},
+		{"comments and quotes", "# SELINUXTYPE=mls\nSELINUX=permissive\nSELINUXTYPE=\"mls\"\n", "mls"},
+		{"type defaults to targeted", "SELINUX=enforcing\n", "targeted"},
+		{"disabled", "SELINUX=disabled\nSELINUXTYPE=targeted\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.config != "" {
+				dir := filepath.Join(root, "etc", "selinux")
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "config"), []byte(tt.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := selinuxPolicyType(root)
+			if err != nil {
+				t.Fatalf("selinuxPolicyType() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("selinuxPolicyType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelabelSELinux_NoPolicy(t *testing.T) {
+	// Images without SELinux are left alone, even without setfiles on the host
+	if err := RelabelSELinux(t.Context(), t.TempDir(), false, reporter.NoopReporter{}); err != nil {
+		t.Errorf("RelabelSELinux() error = %v, want nil", err)
+	}
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "etc", "selinux")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config"), []byte("SELINUX=enforcing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RelabelSELinux(t.Context(), root, true, reporter.NoopReporter{}); err == nil {
+		t.Error("RelabelSELinux() without file contexts should fail")
+	}
+}
+
+func TestCopyXattrTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	requireUserXattrs(t, src)
+
+	for _, root := range []string{src, dst} {
+		if err := os.MkdirAll(filepath.Join(root, "ssh"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "ssh", "sshd_config"), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dst, "only-in-dst"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(src, "ssh"), "user.label", []byte("ssh_dir"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(src, "ssh", "sshd_config"), "user.label", []byte("sshd_conf"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyXattrTree(src, dst, "user.label"); err != nil {
+		t.Fatalf("copyXattrTree() error = %v", err)
+	}
+
+	for path, want := range map[string]string{"ssh": "ssh_dir", "ssh/sshd_config": "sshd_conf"} {
+		got, err := lgetxattr(filepath.Join(dst, path), "user.label")
+		if err != nil || string(got) != want {
+			t.Errorf("%s user.label = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if _, err := lgetxattr(filepath.Join(dst, "only-in-dst"), "user.label"); err == nil {
+		t.Error("only-in-dst should not get a label")
+	}
+}
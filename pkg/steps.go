@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"github.com/frostyard/std/reporter"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 // SetupTargetSystem performs the common post-extraction system setup sequence
@@ -16,6 +17,7 @@ import (
 // - Preparing machine-id for first boot
 // - Populating /.etc.lower for overlay
 // - Installing tmpfiles.d config for /run/nbc-booted marker
+// - Installing the boot-complete unit that marks a boot good
 //
 // Operations specific to install (InstallEtcMountUnit, SavePristineEtc)
 // or update (MergeEtcFromActive) must be called separately.
@@ -57,23 +59,26 @@ func SetupTargetSystem(ctx context.Context, mountPoint string, dryRun, verbose b
 		return fmt.Errorf("failed to install tmpfiles config: %w", err)
 	}
 
+	// Install the unit that marks a boot good for boot counting
+	if err := InstallBootCompleteUnit(ctx, mountPoint, dryRun, progress); err != nil {
+		return fmt.Errorf("failed to install boot-complete unit: %w", err)
+	}
+
+	// Install the timer taking scheduled snapshots of /var
+	if err := InstallVarSnapshotTimer(ctx, mountPoint, dryRun, progress); err != nil {
+		return fmt.Errorf("failed to install var snapshot timer: %w", err)
+	}
+
 	return nil
 }
 
 // ExtractAndVerifyContainer creates and runs a container extractor, then verifies
-// the extraction succeeded. Used by both install and update flows.
-func ExtractAndVerifyContainer(ctx context.Context, imageRef, localLayoutPath, mountPoint string, verbose, skipVerify bool, cosignKeyPath string, progress reporter.Reporter) error {
-	var extractor *ContainerExtractor
-	if localLayoutPath != "" {
-		extractor = NewContainerExtractorFromLocal(localLayoutPath, mountPoint)
-	} else {
-		extractor = NewContainerExtractor(imageRef, mountPoint)
-	}
-	extractor.SetVerbose(verbose)
-	extractor.SetProgress(progress)
-	extractor.SkipVerify = skipVerify
-	extractor.CosignKeyPath = cosignKeyPath
-
+// the extraction succeeded. Used by both install and update flows. When
+// recordDir is not empty, the image's manifest and config are saved there.
+// Images not built for platform (nil = this machine's) are refused.
+func ExtractAndVerifyContainer(ctx context.Context, imageRef, localLayoutPath, mountPoint string, verbose, skipVerify bool, cosignKeyPath string, flatten bool, platform *v1.Platform, recordDir string, progress reporter.Reporter) error {
+	extractor := newContainerExtractor(imageRef, localLayoutPath, mountPoint, verbose, skipVerify, cosignKeyPath, flatten, platform, progress)
+	extractor.RecordDir = recordDir
 	if err := extractor.Extract(ctx); err != nil {
 		return fmt.Errorf("failed to extract container: %w", err)
 	}
@@ -86,3 +91,21 @@ func ExtractAndVerifyContainer(ctx context.Context, imageRef, localLayoutPath, m
 
 	return nil
 }
+
+// newContainerExtractor returns an extractor for the image in the local OCI
+// layout, or for imageRef when localLayoutPath is empty
+func newContainerExtractor(imageRef, localLayoutPath, mountPoint string, verbose, skipVerify bool, cosignKeyPath string, flatten bool, platform *v1.Platform, progress reporter.Reporter) *ContainerExtractor {
+	var extractor *ContainerExtractor
+	if localLayoutPath != "" {
+		extractor = NewContainerExtractorFromLocal(localLayoutPath, mountPoint)
+	} else {
+		extractor = NewContainerExtractor(imageRef, mountPoint)
+	}
+	extractor.SetVerbose(verbose)
+	extractor.SetProgress(progress)
+	extractor.SkipVerify = skipVerify
+	extractor.CosignKeyPath = cosignKeyPath
+	extractor.Flatten = flatten
+	extractor.Platform = platform
+	return extractor
+}
@@ -0,0 +1,526 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+)
+
+// A subvolume layout has a single btrfs root partition instead of the root1
+// and root2 slots. Every deployment lives in its own subvolume,
+// deployments/<ID>, and boot entries select one with rootflags=subvol=. An
+// update snapshots the running deployment into a new subvolume and applies
+// the new image to it as a delta, so any number of deployments can be kept.
+
+const (
+	// DefaultKeepDeployments is how many deployments updates keep by default
+	DefaultKeepDeployments = 3
+	// MinKeepDeployments keeps at least the new and the running deployment
+	MinKeepDeployments = 2
+
+	// deploymentsSubvolumeDir is the directory on the root filesystem that
+	// holds the deployment subvolumes
+	deploymentsSubvolumeDir = "deployments"
+	// deploymentEntryPrefix starts the systemd-boot entry IDs of deployments
+	// older than the previous one. They do not match the "bootc*" default.
+	deploymentEntryPrefix = "nbc-deployment-"
+	// btrfsTopLevelSubvolID is the ID of the top-level subvolume of a btrfs
+	// filesystem
+	btrfsTopLevelSubvolID = 5
+)
+
+// deploymentSubvolume returns the path of deployment id's subvolume on the
+// root filesystem
+func deploymentSubvolume(id int) string {
+	return deploymentsSubvolumeDir + "/" + strconv.Itoa(id)
+}
+
+// deploymentSlot returns the slot name of deployment id, used for its file
+// record and in the deployment history
+func deploymentSlot(id int) string {
+	return "deployment-" + strconv.Itoa(id)
+}
+
+// cmdlineDeployment returns the deployment a kernel command line boots, or 0
+// if its rootflags select no deployment subvolume
+func cmdlineDeployment(cmdline []string) int {
+	for _, arg := range cmdline {
+		flags, ok := strings.CutPrefix(arg, "rootflags=")
+		if !ok {
+			continue
+		}
+		for flag := range strings.SplitSeq(flags, ",") {
+			subvol, ok := strings.CutPrefix(flag, "subvol=")
+			if !ok {
+				continue
+			}
+			name, ok := strings.CutPrefix(strings.TrimPrefix(subvol, "/"), deploymentsSubvolumeDir+"/")
+			if !ok {
+				return 0
+			}
+			id, err := strconv.Atoi(name)
+			if err != nil || id < 1 {
+				return 0
+			}
+			return id
+		}
+	}
+	return 0
+}
+
+// GetActiveDeployment returns the ID of the deployment the running system was
+// booted from
+func GetActiveDeployment() (int, error) {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read /proc/cmdline: %w", err)
+	}
+	id := cmdlineDeployment(strings.Fields(string(cmdline)))
+	if id == 0 {
+		return 0, fmt.Errorf("kernel command line does not boot a deployment subvolume")
+	}
+	return id, nil
+}
+
+// KeepCount returns how many deployments updates keep
+func (c *SubvolumeConfig) KeepCount() int {
+	if c.Keep == 0 {
+		return DefaultKeepDeployments
+	}
+	return max(c.Keep, MinKeepDeployments)
+}
+
+// deployment returns the deployment with id, or nil if there is none
+func (c *SubvolumeConfig) deployment(id int) *SubvolumeDeployment {
+	for i := range c.Deployments {
+		if c.Deployments[i].ID == id {
+			return &c.Deployments[i]
+		}
+	}
+	return nil
+}
+
+// nextID returns the ID of the next deployment. IDs are never reused.
+func (c *SubvolumeConfig) nextID() int {
+	next := 1
+	for _, d := range c.Deployments {
+		next = max(next, d.ID+1)
+	}
+	return next
+}
+
+// keepDeployments splits deployments (newest first) into those to keep and
+// those to remove. The newest deployment and the running one (activeID) are
+// always kept, then the newest others up to keep in total. Both lists keep
+// the order of deployments.
+func keepDeployments(deployments []SubvolumeDeployment, keep, activeID int) (kept, removed []SubvolumeDeployment) {
+	room := keep - 1
+	if activeID != 0 && len(deployments) > 0 && deployments[0].ID != activeID {
+		room--
+	}
+	for i, d := range deployments {
+		switch {
+		case i == 0 || d.ID == activeID:
+			kept = append(kept, d)
+		case room > 0:
+			kept = append(kept, d)
+			room--
+		default:
+			removed = append(removed, d)
+		}
+	}
+	return kept, removed
+}
+
+// bootOrder returns deployments (newest first) in boot menu order: the newest
+// one, then the running one the boot counter falls back to, then the others.
+func bootOrder(deployments []SubvolumeDeployment, activeID int) []SubvolumeDeployment {
+	ordered := slices.Clone(deployments)
+	if i := slices.IndexFunc(ordered, func(d SubvolumeDeployment) bool { return d.ID == activeID }); i > 1 {
+		active := ordered[i]
+		copy(ordered[2:i+1], ordered[1:i])
+		ordered[1] = active
+	}
+	return ordered
+}
+
+// GetDeploymentStatus lists the deployments of a subvolume layout, newest
+// first, or nil for other installations
+func GetDeploymentStatus(config *SystemConfig) []types.DeploymentStatus {
+	if config.Subvolumes == nil {
+		return nil
+	}
+	booted, _ := GetActiveDeployment()
+	status := make([]types.DeploymentStatus, 0, len(config.Subvolumes.Deployments))
+	for i, d := range config.Subvolumes.Deployments {
+		status = append(status, types.DeploymentStatus{
+			ID:            d.ID,
+			Subvolume:     deploymentSubvolume(d.ID),
+			ImageRef:      d.ImageRef,
+			ImageDigest:   d.ImageDigest,
+			KernelVersion: d.KernelVersion,
+			Created:       d.Created,
+			Booted:        d.ID == booted,
+			Default:       i == 0,
+		})
+	}
+	return status
+}
+
+// btrfsSubvolume runs "btrfs subvolume" with args
+func btrfsSubvolume(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "btrfs", append([]string{"subvolume"}, args...)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("btrfs subvolume %s failed: %w\nOutput: %s", args[0], err, string(output))
+	}
+	return nil
+}
+
+// withTopLevel mounts the top-level subvolume of the btrfs filesystem on
+// device at a temporary directory and calls fn with it
+func withTopLevel(ctx context.Context, device string, fn func(top string) error) error {
+	top, err := os.MkdirTemp("", "nbc-btrfs-top-*")
+	if err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	// Remove, not RemoveAll: should the unmount fail, the filesystem must
+	// not be emptied
+	defer func() { _ = os.Remove(top) }()
+
+	if err := mountCommand(ctx, device, top, "subvolid="+strconv.Itoa(btrfsTopLevelSubvolID)); err != nil {
+		return fmt.Errorf("failed to mount top-level subvolume of %s: %w", device, err)
+	}
+	defer func() { _ = umountCommand(context.WithoutCancel(ctx), top) }()
+
+	return fn(top)
+}
+
+// CreateDeploymentSubvolume creates the subvolume of the first deployment on
+// the freshly formatted root partition of a subvolume layout, and makes it the
+// root filesystem MountPartitions mounts
+func CreateDeploymentSubvolume(ctx context.Context, scheme *PartitionScheme, dryRun bool, progress reporter.Reporter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	subvolume := deploymentSubvolume(1)
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would create subvolume %s on %s", subvolume, scheme.Root1Partition)
+		scheme.RootSubvolume = subvolume
+		return nil
+	}
+
+	progress.Message("Creating subvolume %s...", subvolume)
+	err := withTopLevel(ctx, scheme.GetRoot1Device(), func(top string) error {
+		if err := os.MkdirAll(filepath.Join(top, deploymentsSubvolumeDir), 0755); err != nil {
+			return fmt.Errorf("failed to create deployments directory: %w", err)
+		}
+		return btrfsSubvolume(ctx, "create", filepath.Join(top, subvolume))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create deployment subvolume: %w", err)
+	}
+	scheme.RootSubvolume = subvolume
+	return nil
+}
+
+// extractDeployment extracts the image to the first deployment and records
+// what was extracted, so the first update can snapshot it and apply only the
+// changes
+func (i *Installer) extractDeployment(ctx context.Context, localLayoutPath string) error {
+	extractor := newContainerExtractor(i.config.ImageRef, localLayoutPath, i.config.MountPoint, i.config.Verbose, i.config.SkipVerify, i.config.CosignKeyPath, i.config.Flatten, i.config.Platform, i.progress)
+	extractor.RecordDir = filepath.Join(i.config.MountPoint, imageRecordDir(deploymentSlot(1)))
+	files, err := extractor.extractRecorded(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to extract container: %w", err)
+	}
+
+	i.progress.Message("Verifying extraction...")
+	if err := VerifyExtraction(i.config.MountPoint); err != nil {
+		return fmt.Errorf("container extraction verification failed: %w", err)
+	}
+
+	if files != nil {
+		path := filepath.Join(i.config.MountPoint, slotFilesPath(deploymentSlot(1)))
+		if err := writeSlotFiles(path, files); err != nil {
+			i.progress.Warning("failed to record contents of %s, the first update will be a full update: %v", deploymentSlot(1), err)
+		}
+	}
+	return nil
+}
+
+// prepareDeployments picks the running deployment as the snapshot source and
+// a new deployment as the update target
+func (u *SystemUpdater) prepareDeployments() error {
+	p := u.Progress
+	if !u.Scheme.Subvolumes {
+		return fmt.Errorf("system config records subvolume deployments, but %s has no single root partition", u.Config.Device)
+	}
+	if len(u.Subvolumes.Deployments) == 0 {
+		return fmt.Errorf("no deployments recorded in the system config")
+	}
+
+	active, err := GetActiveDeployment()
+	if err == nil && u.Subvolumes.deployment(active) == nil {
+		err = fmt.Errorf("deployment %d is not recorded in the system config", active)
+	}
+	if err != nil {
+		active = u.Subvolumes.Deployments[0].ID
+		p.Warning("could not determine active deployment: %v", err)
+		p.Warning("Defaulting to deployment %d as active", active)
+	}
+
+	u.Target = u.Scheme.Root1Partition
+	u.Active = true
+	u.ActiveDeployment = active
+	u.TargetDeployment = u.Subvolumes.nextID()
+
+	p.Message("Currently booted from: deployment %d (%s on %s)", active, deploymentSubvolume(active), u.Target)
+	p.Message("Update target: deployment %d (%s on %s)", u.TargetDeployment, deploymentSubvolume(u.TargetDeployment), u.Target)
+	return nil
+}
+
+// createTargetDeployment creates the subvolume of the new deployment. With
+// snapshot it starts as a snapshot of the running deployment, otherwise empty.
+func (u *SystemUpdater) createTargetDeployment(ctx context.Context, snapshot bool) error {
+	target := deploymentSubvolume(u.TargetDeployment)
+	return withTopLevel(ctx, u.Scheme.Root1Partition, func(top string) error {
+		// A subvolume left behind by an interrupted update has no boot entry
+		if _, err := os.Lstat(filepath.Join(top, target)); err == nil {
+			u.Progress.Message("Removing %s left behind by an interrupted update...", target)
+			if err := btrfsSubvolume(ctx, "delete", filepath.Join(top, target)); err != nil {
+				return err
+			}
+		}
+
+		if snapshot {
+			source := deploymentSubvolume(u.ActiveDeployment)
+			u.Progress.Message("Snapshotting %s to %s...", source, target)
+			return btrfsSubvolume(ctx, "snapshot", filepath.Join(top, source), filepath.Join(top, target))
+		}
+		u.Progress.Message("Creating subvolume %s...", target)
+		return btrfsSubvolume(ctx, "create", filepath.Join(top, target))
+	})
+}
+
+// deleteDeployments deletes the subvolumes and file records of deployments.
+// It tries all of them and returns the first error.
+func (u *SystemUpdater) deleteDeployments(ctx context.Context, deployments []SubvolumeDeployment) error {
+	return withTopLevel(ctx, u.Scheme.Root1Partition, func(top string) error {
+		var firstErr error
+		for _, d := range deployments {
+			err := btrfsSubvolume(ctx, "delete", filepath.Join(top, deploymentSubvolume(d.ID)))
+			if err == nil {
+				err = os.RemoveAll(filepath.Dir(slotFilesPath(deploymentSlot(d.ID))))
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to remove deployment %d: %w", d.ID, err)
+				}
+				continue
+			}
+			u.Progress.Message("Removed deployment %d (%s)", d.ID, d.ImageRef)
+		}
+		return firstErr
+	})
+}
+
+// addTargetDeployment adds the new deployment to the deployment list and
+// drops the deployments beyond the retention count from it. The dropped ones
+// are deleted by removeOldDeployments once the boot entries no longer use them.
+func (u *SystemUpdater) addTargetDeployment(kernelVersion string) {
+	deployments := append([]SubvolumeDeployment{{
+		ID:            u.TargetDeployment,
+		ImageRef:      u.Config.ImageRef,
+		ImageDigest:   u.Config.ImageDigest,
+		KernelVersion: kernelVersion,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+	}}, u.Subvolumes.Deployments...)
+	u.Subvolumes.Deployments, u.removedDeployments = keepDeployments(deployments, u.Subvolumes.KeepCount(), u.ActiveDeployment)
+}
+
+// removeOldDeployments deletes the deployments dropped by addTargetDeployment
+// and records the kept ones in the system config
+func (u *SystemUpdater) removeOldDeployments(ctx context.Context) error {
+	var deleteErr error
+	if len(u.removedDeployments) > 0 {
+		deleteErr = u.deleteDeployments(ctx, u.removedDeployments)
+	}
+
+	config, err := ReadSystemConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read system config: %w", err)
+	}
+	config.Subvolumes = u.Subvolumes
+	if err := WriteSystemConfig(ctx, config, false, reporter.NoopReporter{}); err != nil {
+		return fmt.Errorf("failed to record deployments: %w", err)
+	}
+	return deleteErr
+}
+
+// deploymentBootEntry is a boot menu entry
+type deploymentBootEntry struct {
+	Title         string
+	KernelVersion string
+	Initrd        string
+	Cmdline       []string
+}
+
+// buildDeploymentCmdline builds the kernel command line booting deployment id
+func (u *SystemUpdater) buildDeploymentCmdline(ctx context.Context, rootUUID, varUUID, fsType string, id int) ([]string, error) {
+	params, err := u.kernelCmdlineParams(ctx, rootUUID, varUUID, fsType, true)
+	if err != nil {
+		return nil, err
+	}
+	params.RootSubvolume = deploymentSubvolume(id)
+	return assembleKernelCmdline(params), nil
+}
+
+// deploymentBootEntries returns the boot entries of the kept deployments in
+// boot menu order. The bootloader's boot partition is mounted at
+// BootMountPoint.
+func (u *SystemUpdater) deploymentBootEntries(ctx context.Context) ([]SubvolumeDeployment, []deploymentBootEntry, error) {
+	rootUUID, err := GetPartitionUUID(ctx, u.Scheme.Root1Partition)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get root UUID: %w", err)
+	}
+	varUUID, err := GetPartitionUUID(ctx, u.Scheme.VarPartition)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get var UUID: %w", err)
+	}
+	fsType := u.Config.FilesystemType
+	if fsType == "" {
+		fsType = "btrfs"
+	}
+
+	// Verify the kernel exists on the boot partition (it should have been copied by InstallKernelAndInitramfs)
+	kernelVersion, err := u.getUpdatedRootKernelVersion()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get kernel version from updated root: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(u.Config.BootMountPoint, "vmlinuz-"+kernelVersion)); err != nil {
+		return nil, nil, fmt.Errorf("kernel vmlinuz-%s not found on boot partition (should have been copied earlier): %w", kernelVersion, err)
+	}
+	initrd, err := getBootInitramfsName(u.Config.BootMountPoint, kernelVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	osName := ParseOSRelease(u.Config.MountPoint)
+	deployments := bootOrder(u.Subvolumes.Deployments, u.ActiveDeployment)
+	entries := make([]deploymentBootEntry, 0, len(deployments))
+	for i, d := range deployments {
+		cmdline, err := u.buildDeploymentCmdline(ctx, rootUUID, varUUID, fsType, d.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to build kernel cmdline of deployment %d: %w", d.ID, err)
+		}
+
+		entry := deploymentBootEntry{Title: osName, KernelVersion: kernelVersion, Initrd: initrd, Cmdline: cmdline}
+		switch i {
+		case 0:
+		case 1:
+			entry.Title = osName + " (Previous)"
+		default:
+			entry.Title = fmt.Sprintf("%s (Deployment %d)", osName, d.ID)
+		}
+		if d.ID != u.TargetDeployment {
+			if d.KernelVersion == "" {
+				u.Progress.Warning("kernel of deployment %d is not recorded, falling back to current kernel for its boot entry", d.ID)
+			} else if oldInitrd, err := getBootInitramfsName(u.Config.BootMountPoint, d.KernelVersion); err != nil {
+				u.Progress.Warning("failed to find initramfs for kernel %s of deployment %d, falling back to current initramfs: %v", d.KernelVersion, d.ID, err)
+			} else {
+				entry.KernelVersion, entry.Initrd = d.KernelVersion, oldInitrd
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return deployments, entries, nil
+}
+
+// updateDeploymentsBootloader writes a boot entry for every kept deployment,
+// the new one first and booted by default
+func (u *SystemUpdater) updateDeploymentsBootloader(ctx context.Context, bootloaderType BootloaderType) error {
+	deployments, entries, err := u.deploymentBootEntries(ctx)
+	if err != nil {
+		return err
+	}
+	bootTries := u.bootTries()
+
+	switch bootloaderType {
+	case BootloaderGRUB2:
+		grubDir := ""
+		for _, dir := range []string{"grub", "grub2"} {
+			if _, err := os.Stat(filepath.Join(u.Config.BootMountPoint, dir)); err == nil {
+				grubDir = filepath.Join(u.Config.BootMountPoint, dir)
+				break
+			}
+		}
+		if grubDir == "" {
+			return fmt.Errorf("could not find grub directory")
+		}
+		grubCfg := buildGRUBEntriesConfig(entries, bootTries)
+		if err := atomicWriteFile(filepath.Join(grubDir, "grub.cfg"), []byte(grubCfg), 0644); err != nil {
+			return fmt.Errorf("failed to write grub.cfg: %w", err)
+		}
+		if err := setGRUBBootCounter(grubDir, bootTries); err != nil {
+			return err
+		}
+
+	case BootloaderSystemdBoot:
+		loaderDir := filepath.Join(u.Config.BootMountPoint, "loader")
+		entriesDir := filepath.Join(loaderDir, "entries")
+		if err := os.MkdirAll(entriesDir, 0755); err != nil {
+			return fmt.Errorf("failed to create entries directory: %w", err)
+		}
+
+		keep := make(map[string]bool, len(entries))
+		for i, entry := range entries {
+			id, tries := "bootc", bootTries
+			switch i {
+			case 0:
+			case 1:
+				id, tries = "bootc-previous", 0
+			default:
+				id, tries = deploymentEntryPrefix+strconv.Itoa(deployments[i].ID), 0
+			}
+			keep[id] = true
+			content := buildSystemdBootEntry(entry.Title, entry.KernelVersion, entry.Initrd, entry.Cmdline)
+			if err := writeSystemdBootEntry(entriesDir, id, tries, content); err != nil {
+				return fmt.Errorf("failed to write boot entry of deployment %d: %w", deployments[i].ID, err)
+			}
+		}
+
+		// Remove the entries of deployments that are no longer kept
+		existing, err := os.ReadDir(entriesDir)
+		if err != nil {
+			return fmt.Errorf("failed to list boot entries: %w", err)
+		}
+		for _, file := range existing {
+			id, _, _, _ := parseSystemdBootCounter(file.Name())
+			if strings.HasPrefix(id, deploymentEntryPrefix) && !keep[id] {
+				if err := os.Remove(filepath.Join(entriesDir, file.Name())); err != nil {
+					return fmt.Errorf("failed to remove boot entry %s: %w", file.Name(), err)
+				}
+			}
+		}
+
+		if err := setSystemdBootDefault(filepath.Join(loaderDir, "loader.conf"), systemdBootDefaultPattern); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported bootloader type: %s", bootloaderType)
+	}
+
+	u.Progress.Message("Updated %s to boot deployment %d (%d deployments in the boot menu)", bootloaderType, u.TargetDeployment, len(entries))
+	return nil
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCmdlineDeployment(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    int
+	}{
+		{"root=UUID=R ro rootflags=subvol=deployments/7 quiet", 7},
+		{"root=UUID=R ro rootflags=compress=zstd,subvol=/deployments/12", 12},
+		{"root=UUID=R ro", 0},
+		{"root=UUID=R ro rootflags=subvol=@root", 0},
+		{"root=UUID=R ro rootflags=subvol=deployments/x", 0},
+		{"root=UUID=R ro rootflags=subvol=deployments/0", 0},
+	}
+	for _, tt := range tests {
+		if got := cmdlineDeployment(strings.Fields(tt.cmdline)); got != tt.want {
+			t.Errorf("cmdlineDeployment(%q) = %d, want %d", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func deploymentIDs(deployments []SubvolumeDeployment) []int {
+	ids := []int{}
+	for _, d := range deployments {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+func testDeployments(ids ...int) []SubvolumeDeployment {
+	deployments := make([]SubvolumeDeployment, len(ids))
+	for i, id := range ids {
+		deployments[i] = SubvolumeDeployment{ID: id}
+	}
+	return deployments
+}
+
+func TestKeepDeployments(t *testing.T) {
+	tests := []struct {
+		name        string
+		ids         []int
+		keep        int
+		active      int
+		wantKept    []int
+		wantRemoved []int
+	}{
+		{"under the limit", []int{2, 1}, 3, 1, []int{2, 1}, []int{}},
+		{"newest kept", []int{5, 4, 3, 2}, 3, 4, []int{5, 4, 3}, []int{2}},
+		// Booted from an old deployment picked in the boot menu
+		{"old active kept", []int{5, 4, 3, 2}, 3, 2, []int{5, 4, 2}, []int{3}},
+		{"minimum", []int{5, 4, 3}, 2, 3, []int{5, 3}, []int{4}},
+		{"active unknown", []int{5, 4, 3}, 2, 0, []int{5, 4}, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, removed := keepDeployments(testDeployments(tt.ids...), tt.keep, tt.active)
+			if got := deploymentIDs(kept); !reflect.DeepEqual(got, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", got, tt.wantKept)
+			}
+			if got := deploymentIDs(removed); !reflect.DeepEqual(got, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", got, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestBootOrder(t *testing.T) {
+	deployments := testDeployments(6, 5, 4, 3)
+
+	// The running deployment follows the new one, so the boot counter's
+	// fallback to entry 1 boots what ran before the update
+	if got := deploymentIDs(bootOrder(deployments, 3)); !reflect.DeepEqual(got, []int{6, 3, 5, 4}) {
+		t.Errorf("bootOrder(active 3) = %v, want [6 3 5 4]", got)
+	}
+	if got := deploymentIDs(bootOrder(deployments, 5)); !reflect.DeepEqual(got, []int{6, 5, 4, 3}) {
+		t.Errorf("bootOrder(active 5) = %v, want [6 5 4 3]", got)
+	}
+	if got := deploymentIDs(deployments); !reflect.DeepEqual(got, []int{6, 5, 4, 3}) {
+		t.Errorf("bootOrder modified its input: %v", got)
+	}
+}
+
+func TestSubvolumeConfigNextID(t *testing.T) {
+	config := &SubvolumeConfig{Deployments: testDeployments(4, 7, 2)}
+	if got := config.nextID(); got != 8 {
+		t.Errorf("nextID() = %d, want 8", got)
+	}
+	if got := (&SubvolumeConfig{}).nextID(); got != 1 {
+		t.Errorf("nextID() of no deployments = %d, want 1", got)
+	}
+	if got := (&SubvolumeConfig{}).KeepCount(); got != DefaultKeepDeployments {
+		t.Errorf("KeepCount() = %d, want %d", got, DefaultKeepDeployments)
+	}
+}
+
+func TestBuildGRUBEntriesConfig(t *testing.T) {
+	cfg := buildGRUBEntriesConfig([]deploymentBootEntry{
+		{Title: "Test OS", KernelVersion: "6.2", Initrd: "initramfs-6.2.img", Cmdline: []string{"root=UUID=R", "rootflags=subvol=deployments/3"}},
+		{Title: "Test OS (Previous)", KernelVersion: "6.1", Initrd: "initramfs-6.1.img", Cmdline: []string{"root=UUID=R", "rootflags=subvol=deployments/1"}},
+		{Title: "Test OS (Deployment 2)", KernelVersion: "6.1", Initrd: "initramfs-6.1.img", Cmdline: []string{"root=UUID=R", "rootflags=subvol=deployments/2"}},
+	}, 0)
+
+	entries, defaultIndex, err := parseGRUBConfig(cfg)
+	if err != nil {
+		t.Fatalf("parseGRUBConfig() error = %v", err)
+	}
+	if defaultIndex != 0 || len(entries) != 3 {
+		t.Fatalf("got %d entries with default %d, want 3 with default 0:\n%s", len(entries), defaultIndex, cfg)
+	}
+	for i, want := range []string{"deployments/3", "deployments/1", "deployments/2"} {
+		if got := cmdlineDeployment(entries[i].Cmdline); deploymentSubvolume(got) != want {
+			t.Errorf("entry %d boots deployment %d, want %s", i, got, want)
+		}
+	}
+	if !strings.Contains(cfg, "menuentry 'Test OS (Deployment 2)' {") {
+		t.Errorf("config lacks the entry of deployment 2:\n%s", cfg)
+	}
+}
+
+func TestCmdlineRootArgSubvolume(t *testing.T) {
+	if got := cmdlineRootArg("root=UUID=R ro rootflags=subvol=deployments/4 quiet"); got != "rootflags=subvol=deployments/4" {
+		t.Errorf("cmdlineRootArg() = %q, want the rootflags selecting the deployment", got)
+	}
+	if got := cmdlineRootArg("root=UUID=R ro rootflags=compress=zstd"); got != "root=UUID=R" {
+		t.Errorf("cmdlineRootArg() = %q, want root=UUID=R", got)
+	}
+}
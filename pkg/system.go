@@ -12,6 +12,11 @@ import (
 
 // SetRootPasswordInTarget sets the root password in the installed system using chpasswd
 // The password is passed via stdin for security (not visible in process list)
+//
+// Deprecated: chpasswd changes the image's /etc, which is not seen at boot
+// once it has been copied to .etc.lower, the lower layer of the /etc overlay.
+// Install hashes InstallConfig.RootPassword into the overlay upper layer with
+// ProvisionTarget instead.
 func SetRootPasswordInTarget(ctx context.Context, targetDir, password string, dryRun bool, progress reporter.Reporter) error {
 	if password == "" {
 		return nil // No password to set
@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/frostyard/std/reporter"
+	"golang.org/x/term"
+)
+
+const (
+	// signedPCR is the PCR systemd-stub measures the UKI into. Its values are
+	// predicted and signed when a UKI is built, so a key bound to a signed
+	// PCR 11 policy unseals for any UKI signed with the policy's key.
+	signedPCR = 11
+
+	// Names of the PCR signing key pair in SystemConfigDir
+	pcrPrivateKeyFile = "tpm2-pcr-private-key.pem"
+	pcrPublicKeyFile  = "tpm2-pcr-public-key.pem"
+)
+
+// stableTPM2PCRs are the PCRs a key may be sealed to by value. They measure
+// firmware, its configuration and the Secure Boot state, none of which an A/B
+// update changes. PCRs measuring the kernel, initramfs or command line (4, 8,
+// 9, 11 and 12) change with every update and would lock the user out.
+var stableTPM2PCRs = []int{0, 1, 2, 3, 5, 6, 7, 14}
+
+// ParseTPM2PCRs parses a PCR list such as "7" or "7+14" (commas are accepted
+// too) into sorted PCR indexes. It rejects PCRs that updates change.
+func ParseTPM2PCRs(s string) ([]int, error) {
+	var pcrs []int
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == '+' || r == ',' }) {
+		pcr, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || pcr < 0 || pcr > 23 {
+			return nil, fmt.Errorf("invalid PCR %q", field)
+		}
+		if !slices.Contains(stableTPM2PCRs, pcr) {
+			if pcr == signedPCR {
+				return nil, fmt.Errorf("PCR %d changes with every update; use a signed PCR %d policy instead", pcr, signedPCR)
+			}
+			return nil, fmt.Errorf("PCR %d changes with every update", pcr)
+		}
+		if !slices.Contains(pcrs, pcr) {
+			pcrs = append(pcrs, pcr)
+		}
+	}
+	slices.Sort(pcrs)
+	return pcrs, nil
+}
+
+// formatPCRs formats PCR indexes the way systemd-cryptenroll takes them ("7+14")
+func formatPCRs(pcrs []int) string {
+	parts := make([]string, len(pcrs))
+	for i, pcr := range pcrs {
+		parts[i] = strconv.Itoa(pcr)
+	}
+	return strings.Join(parts, "+")
+}
+
+// String describes the policy for progress messages
+func (p *TPM2Policy) String() string {
+	var parts []string
+	if p != nil && len(p.PCRs) > 0 {
+		parts = append(parts, "PCRs "+formatPCRs(p.PCRs))
+	}
+	if p != nil && (p.PublicKey != "" || p.PrivateKey != "") {
+		parts = append(parts, fmt.Sprintf("signed PCR %d policy", signedPCR))
+	}
+	if len(parts) == 0 {
+		return "no PCRs"
+	}
+	return strings.Join(parts, " + ")
+}
+
+// cryptenrollArgs returns the systemd-cryptenroll arguments that enroll a TPM2
+// key with the policy. A nil policy enrolls a key without PCR binding.
+func (p *TPM2Policy) cryptenrollArgs() []string {
+	if p == nil {
+		return []string{"--tpm2-pcrs="}
+	}
+	args := []string{"--tpm2-pcrs=" + formatPCRs(p.PCRs)}
+	if p.PublicKey != "" {
+		args = append(args,
+			"--tpm2-public-key="+p.PublicKey,
+			"--tpm2-public-key-pcrs="+strconv.Itoa(signedPCR),
+		)
+	}
+	return args
+}
+
+// ukifyArgs returns the ukify arguments that sign the PCR 11 values of a UKI
+// for the policy, or nothing when the policy has no signing key.
+func (p *TPM2Policy) ukifyArgs() []string {
+	if p == nil || p.PrivateKey == "" {
+		return nil
+	}
+	return []string{"--pcr-private-key=" + p.PrivateKey, "--pcr-public-key=" + p.PublicKey}
+}
+
+// pcrPublicKeyPEM reads the PEM private key used to sign PCR 11 policies and
+// returns its public key in PEM form.
+func pcrPublicKeyPEM(privateKeyPath string) ([]byte, error) {
+	data, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PCR signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", privateKeyPath)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PCR signing key %s: %w", privateKeyPath, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported PCR signing key type %T", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PCR public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// installPCRSigningKey copies the PCR signing key to the state directory of the
+// var partition mounted at varMountPoint, next to its public key, so updates
+// can sign the UKIs they build. It returns the policy with the paths of the
+// installed keys as seen from the running system.
+//
+// The copy is only readable by root, on the encrypted var partition, but any
+// root process of the running system can use it to sign a UKI that unseals
+// the disk. The policy keeps other kernels out, not a compromised system.
+func installPCRSigningKey(varMountPoint, privateKeyPath string, pcrs []int) (*TPM2Policy, error) {
+	publicKey, err := pcrPublicKeyPEM(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PCR signing key: %w", err)
+	}
+
+	// {varMountPoint}/lib/nbc/state is SystemConfigDir on the running system
+	stateDir := filepath.Join(varMountPoint, "lib", "nbc", "state")
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err := atomicWriteFile(filepath.Join(stateDir, pcrPrivateKeyFile), privateKey, 0600); err != nil {
+		return nil, fmt.Errorf("failed to install PCR signing key: %w", err)
+	}
+	if err := atomicWriteFile(filepath.Join(stateDir, pcrPublicKeyFile), publicKey, 0644); err != nil {
+		return nil, fmt.Errorf("failed to install PCR public key: %w", err)
+	}
+
+	return &TPM2Policy{
+		PCRs:       pcrs,
+		PublicKey:  filepath.Join(SystemConfigDir, pcrPublicKeyFile),
+		PrivateKey: filepath.Join(SystemConfigDir, pcrPrivateKeyFile),
+	}, nil
+}
+
+// withKeysUnder returns a copy of the policy with its key paths resolved under
+// root, for use before the installed system is booted.
+func (p *TPM2Policy) withKeysUnder(root string) *TPM2Policy {
+	if p == nil {
+		return nil
+	}
+	resolved := *p
+	if p.PublicKey != "" {
+		resolved.PublicKey = filepath.Join(root, p.PublicKey)
+	}
+	if p.PrivateKey != "" {
+		resolved.PrivateKey = filepath.Join(root, p.PrivateKey)
+	}
+	return &resolved
+}
+
+// tpm2Policy returns the TPM2 policy of the system being installed, if any
+func (b *BootloaderInstaller) tpm2Policy() *TPM2Policy {
+	if b.Encryption == nil || !b.Encryption.TPM2 {
+		return nil
+	}
+	return b.Encryption.TPM2Policy
+}
+
+// tpm2Policy returns the TPM2 policy recorded in the system config, if any
+func (u *SystemUpdater) tpm2Policy() *TPM2Policy {
+	if u.Encryption == nil || !u.Encryption.TPM2 {
+		return nil
+	}
+	return u.Encryption.TPM2Policy
+}
+
+// TPM2TokenUnseals reports whether the TPM2 token of a LUKS partition unseals
+// with the current PCR values, without activating the volume.
+func TPM2TokenUnseals(ctx context.Context, partition string) bool {
+	cmd := exec.CommandContext(ctx, "cryptsetup", "open", "--test-passphrase", "--token-only", partition)
+	return cmd.Run() == nil
+}
+
+// ResealTPM2 replaces the TPM2 key of a LUKS partition with one sealed to the
+// current values of the policy's PCRs, unlocking with passphrase. It is how
+// keys bound by value recover after firmware or Secure Boot database changes.
+func ResealTPM2(ctx context.Context, partition, passphrase string, policy *TPM2Policy, progress reporter.Reporter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	progress.Message("Re-sealing TPM2 key on %s (%s)", partition, policy)
+
+	keyFilePath, cleanup, err := writeEphemeralKeyFile(passphrase)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// The old TPM2 slot is wiped only after the new one is enrolled
+	args := append([]string{"--unlock-key-file=" + keyFilePath, "--wipe-slot=tpm2", "--tpm2-device=auto"}, policy.cryptenrollArgs()...)
+	cmd := exec.CommandContext(ctx, "systemd-cryptenroll", append(args, partition)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to re-seal TPM2 key on %s: %w\nOutput: %s", partition, err, string(output))
+	}
+	return nil
+}
+
+// resealTPM2 re-seals the TPM2 keys of the LUKS volumes whose keys no longer
+// unseal, so the new slot boots without a passphrase. Only keys sealed to PCR
+// values can go stale; a signed PCR 11 policy is kept valid by signing every
+// UKI an update builds. passphrase is the one entered earlier in the update,
+// if any; otherwise the user is asked for it when a key needs re-sealing. An
+// update without a terminal to ask on leaves the keys stale and warns.
+func (u *SystemUpdater) resealTPM2(ctx context.Context, passphrase string) error {
+	policy := u.tpm2Policy()
+	if policy == nil || len(policy.PCRs) == 0 {
+		return nil
+	}
+
+	if u.Config.DryRun {
+		u.Progress.MessagePlain("[DRY RUN] Would re-seal TPM2 keys that no longer unseal (%s)", policy)
+		return nil
+	}
+
+	var stale []string
+	for _, partition := range []string{u.Scheme.Root1Partition, u.Scheme.Root2Partition, u.Scheme.VarPartition} {
+		if partition != "" && !TPM2TokenUnseals(ctx, partition) {
+			stale = append(stale, partition)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	u.Progress.Warning("TPM2 keys on %s no longer unseal with the current PCR values", strings.Join(stale, ", "))
+	if passphrase == "" {
+		// Unattended updates have nobody to ask; the passphrase still unlocks
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			u.Progress.Warning("Not re-sealing TPM2 keys: no passphrase was given and stdin is not a terminal; boot will ask for the passphrase until they are re-sealed")
+			return nil
+		}
+		var err error
+		passphrase, err = readPassphrase("Enter LUKS passphrase to re-seal TPM2 keys: ")
+		if err != nil {
+			return fmt.Errorf("failed to read passphrase: %w", err)
+		}
+	}
+
+	var errs []error
+	for _, partition := range stale {
+		if err := ResealTPM2(ctx, partition, passphrase, policy, u.Progress); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTPM2PCRs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr string
+	}{
+		{"", nil, ""},
+		{"7", []int{7}, ""},
+		{"14+7", []int{7, 14}, ""},
+		{"0,7,7", []int{0, 7}, ""},
+		{"4", nil, "PCR 4 changes with every update"},
+		{"7+11", nil, "use a signed PCR 11 policy instead"},
+		{"24", nil, "invalid PCR"},
+		{"seven", nil, "invalid PCR"},
+	}
+	for _, tt := range tests {
+		got, err := ParseTPM2PCRs(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseTPM2PCRs(%q) error = %v, want error containing %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTPM2PCRs(%q) unexpected error: %v", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTPM2PCRs(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTPM2PolicyArgs(t *testing.T) {
+	var unbound *TPM2Policy
+	if got := unbound.cryptenrollArgs(); !reflect.DeepEqual(got, []string{"--tpm2-pcrs="}) {
+		t.Errorf("nil policy cryptenrollArgs() = %v", got)
+	}
+	if got := unbound.ukifyArgs(); got != nil {
+		t.Errorf("nil policy ukifyArgs() = %v, want none", got)
+	}
+	if got := unbound.String(); got != "no PCRs" {
+		t.Errorf("nil policy String() = %q", got)
+	}
+
+	policy := &TPM2Policy{PCRs: []int{7, 14}, PublicKey: "/k/pub.pem", PrivateKey: "/k/priv.pem"}
+	want := []string{"--tpm2-pcrs=7+14", "--tpm2-public-key=/k/pub.pem", "--tpm2-public-key-pcrs=11"}
+	if got := policy.cryptenrollArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("cryptenrollArgs() = %v, want %v", got, want)
+	}
+	if got := policy.String(); got != "PCRs 7+14 + signed PCR 11 policy" {
+		t.Errorf("String() = %q", got)
+	}
+
+	// Signed UKIs carry the PCR signature ahead of the output
+	inputs := &ukiInputs{Linux: "/b/vmlinuz"}
+	got := ukifyArgs(inputs, "6.18.3", "", []string{"ro"}, policy, "/b/out.efi")
+	want = []string{
+		"build", "--linux=/b/vmlinuz", "--cmdline=ro", "--uname=6.18.3",
+		"--pcr-private-key=/k/priv.pem", "--pcr-public-key=/k/pub.pem", "--output=/b/out.efi",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ukifyArgs() =\n%v\nwant\n%v", got, want)
+	}
+
+	resolved := policy.withKeysUnder("/mnt")
+	if resolved.PublicKey != "/mnt/k/pub.pem" || resolved.PrivateKey != "/mnt/k/priv.pem" || policy.PublicKey != "/k/pub.pem" {
+		t.Errorf("withKeysUnder() = %+v (original %+v)", resolved, policy)
+	}
+}
+
+func TestInstallPCRSigningKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "pcr-key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	varDir := t.TempDir()
+	policy, err := installPCRSigningKey(varDir, keyPath, []int{7})
+	if err != nil {
+		t.Fatalf("installPCRSigningKey() error = %v", err)
+	}
+	want := &TPM2Policy{
+		PCRs:       []int{7},
+		PublicKey:  "/var/lib/nbc/state/" + pcrPublicKeyFile,
+		PrivateKey: "/var/lib/nbc/state/" + pcrPrivateKeyFile,
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("installPCRSigningKey() = %+v, want %+v", policy, want)
+	}
+
+	info, err := os.Stat(filepath.Join(varDir, "lib", "nbc", "state", pcrPrivateKeyFile))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("installed private key: %v, mode %v", err, info)
+	}
+	pubPEM, err := os.ReadFile(filepath.Join(varDir, "lib", "nbc", "state", pcrPublicKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		t.Fatal("public key is not PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey() error = %v", err)
+	}
+	if !key.PublicKey.Equal(pub) {
+		t.Error("installed public key does not match the signing key")
+	}
+
+	if _, err := pcrPublicKeyPEM(filepath.Join(varDir, "lib", "nbc", "state", pcrPublicKeyFile)); err == nil {
+		t.Error("pcrPublicKeyPEM() should reject a public key")
+	}
+}
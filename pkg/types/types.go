@@ -67,6 +67,7 @@ type CachedImageMetadata struct {
 	ImageDigest         string            `json:"image_digest"`           // Image manifest digest (sha256:...)
 	DownloadDate        string            `json:"download_date"`          // When the image was downloaded
 	Architecture        string            `json:"architecture"`           // Image architecture (amd64, arm64, etc.)
+	Platform            string            `json:"platform,omitempty"`     // Platform the image was pulled for (linux/arm64, etc.)
 	Labels              map[string]string `json:"labels,omitzero"`        // Container image labels
 	OSReleasePrettyName string            `json:"os_release_pretty_name"` // PRETTY_NAME from os-release
 	OSReleaseVersionID  string            `json:"os_release_version_id"`  // VERSION_ID from os-release
@@ -92,6 +93,7 @@ type DownloadOutput struct {
 	CacheDir     string `json:"cache_dir"`
 	SizeBytes    int64  `json:"size_bytes"`
 	Architecture string `json:"architecture"`
+	Platform     string `json:"platform,omitempty"`
 	OSName       string `json:"os_name,omitempty"`
 }
 
@@ -123,6 +125,72 @@ type RebootPendingInfo struct {
 	TargetPartition    string `json:"target_partition"`
 }
 
+// LUKSKeyslotStatus describes a LUKS2 keyslot and its PBKDF parameters
+type LUKSKeyslotStatus struct {
+	ID         int    `json:"id"`
+	KDF        string `json:"kdf"`                 // pbkdf2, argon2i or argon2id
+	Hash       string `json:"hash,omitempty"`      // pbkdf2 only
+	Iterations int    `json:"iterations,omitzero"` // pbkdf2 only
+	Time       int    `json:"time,omitzero"`       // argon2 only
+	MemoryKiB  int    `json:"memory_kib,omitzero"` // argon2 only
+	CPUs       int    `json:"cpus,omitzero"`       // argon2 only
+	Token      string `json:"token,omitempty"`     // Type of the token using this keyslot (e.g. systemd-tpm2)
+}
+
+// LUKSVolumeStatus describes the LUKS2 header of an encrypted partition
+type LUKSVolumeStatus struct {
+	Name       string              `json:"name"` // root1, root2 or var
+	Partition  string              `json:"partition,omitempty"`
+	UUID       string              `json:"uuid,omitempty"`
+	Cipher     string              `json:"cipher,omitempty"`
+	SectorSize int                 `json:"sector_size,omitzero"`
+	Keyslots   []LUKSKeyslotStatus `json:"keyslots,omitzero"`
+	TPM2       bool                `json:"tpm2"` // Whether a systemd-tpm2 token is enrolled
+	TPM2PCRs   []int               `json:"tpm2_pcrs,omitzero"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// LUKSKeyOutput represents the JSON output of the nbc luks subcommands
+type LUKSKeyOutput struct {
+	Action      string   `json:"action"`     // passphrase-add, passphrase-remove, recovery-key, tpm2-wipe or tpm2-enroll
+	Partitions  []string `json:"partitions"` // Encrypted partitions the action applies to
+	RecoveryKey string   `json:"recovery_key,omitempty"`
+	DryRun      bool     `json:"dry_run,omitzero"`
+	Message     string   `json:"message"`
+}
+
+// VarSnapshotInfo describes a read-only btrfs snapshot of /var
+type VarSnapshotInfo struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"` // update, scheduled, manual or replaced
+	Created     string `json:"created"`
+	ImageRef    string `json:"image_ref,omitempty"` // Image running when the snapshot was taken
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+// VarSnapshotOutput represents the JSON output of the nbc snapshot subcommands
+type VarSnapshotOutput struct {
+	Action        string            `json:"action"`             // list, create, delete or retention
+	Snapshot      *VarSnapshotInfo  `json:"snapshot,omitempty"` // Snapshot created or deleted
+	Snapshots     []VarSnapshotInfo `json:"snapshots"`          // Snapshots kept, newest first
+	KeepUpdate    int               `json:"keep_update"`
+	KeepScheduled int               `json:"keep_scheduled"`
+	DryRun        bool              `json:"dry_run,omitzero"`
+	Message       string            `json:"message"`
+}
+
+// DeploymentStatus describes a deployment kept in a btrfs subvolume
+type DeploymentStatus struct {
+	ID            int    `json:"id"`
+	Subvolume     string `json:"subvolume"` // Path of the subvolume on the root filesystem (e.g. deployments/3)
+	ImageRef      string `json:"image_ref"`
+	ImageDigest   string `json:"image_digest,omitempty"`
+	KernelVersion string `json:"kernel_version,omitempty"`
+	Created       string `json:"created,omitempty"`
+	Booted        bool   `json:"booted"`  // Whether the running system was booted from it
+	Default       bool   `json:"default"` // Whether it is the newest deployment, booted by default
+}
+
 // StatusOutput represents the JSON output structure for the status command
 type StatusOutput struct {
 	Image          string             `json:"image"`
@@ -132,12 +200,39 @@ type StatusOutput struct {
 	ActiveSlot     string             `json:"active_slot,omitempty"`
 	RootMountMode  string             `json:"root_mount_mode,omitempty"`
 	BootloaderType string             `json:"bootloader_type"`
+	BootMode       string             `json:"boot_mode"` // Firmware interface booted (uefi, bios)
 	FilesystemType string             `json:"filesystem_type"`
 	InstallDate    string             `json:"install_date,omitempty"`
 	KernelArgs     []string           `json:"kernel_args,omitzero"`
 	UpdateCheck    *UpdateCheck       `json:"update_check,omitempty"`
 	StagedUpdate   *StagedUpdate      `json:"staged_update,omitempty"`
 	RebootPending  *RebootPendingInfo `json:"reboot_pending,omitempty"`
+	Encryption     []LUKSVolumeStatus `json:"encryption,omitzero"`
+	Deployments    []DeploymentStatus `json:"deployments,omitzero"` // Subvolume deployments, newest first
+	Composefs      *ComposefsStatus   `json:"composefs,omitempty"`
+	Images         []SlotImage        `json:"images,omitzero"` // Image recorded for each root slot or deployment
+}
+
+// SlotImage describes the image recorded for a root slot or deployment when
+// it was installed or updated. Only Slot and Booted are set for slots without
+// a record, such as those written by older versions of nbc.
+type SlotImage struct {
+	Slot         string            `json:"slot"`   // root1, root2 or deployment-<ID>
+	Booted       bool              `json:"booted"` // Whether the running system was booted from it
+	Digest       string            `json:"digest,omitempty"`
+	Created      string            `json:"created,omitempty"` // Build date of the image
+	Architecture string            `json:"architecture,omitempty"`
+	OS           string            `json:"os,omitempty"`
+	Version      string            `json:"version,omitempty"` // OS version, from the org.opencontainers.image.version label
+	Labels       map[string]string `json:"labels,omitzero"`
+	Layers       []string          `json:"layers,omitzero"` // Layer digests, base first
+	Error        string            `json:"error,omitempty"` // Set when the record cannot be read
+}
+
+// ComposefsStatus describes the composefs root images of the slots
+type ComposefsStatus struct {
+	Digests      map[string]string `json:"digests,omitzero"`        // fs-verity digest of each slot's image, by slot
+	BootedDigest string            `json:"booted_digest,omitempty"` // Digest of the image the running system booted ("" if booted without one)
 }
 
 // =============================================================================
@@ -159,6 +254,9 @@ type DiskOutput struct {
 	Size        uint64            `json:"size"`
 	SizeHuman   string            `json:"size_human"`
 	Model       string            `json:"model,omitempty"`
+	Serial      string            `json:"serial,omitempty"`
+	Transport   string            `json:"transport,omitempty"`
+	IDs         []string          `json:"ids,omitempty"`
 	IsRemovable bool              `json:"is_removable"`
 	Partitions  []PartitionOutput `json:"partitions"`
 }
@@ -182,6 +280,64 @@ type UpdateCheckOutput struct {
 	Message       string `json:"message,omitempty"`
 }
 
+// =============================================================================
+// Rollback Command Output
+// =============================================================================
+
+// RollbackOutput represents the JSON output structure for the rollback command
+type RollbackOutput struct {
+	Device          string `json:"device"`
+	BootloaderType  string `json:"bootloader_type"`
+	PreviousDefault string `json:"previous_default"` // Slot (root1/root2) that was the default boot entry
+	NewDefault      string `json:"new_default"`      // Slot (root1/root2) that is now the default boot entry
+	DefaultEntry    string `json:"default_entry"`    // GRUB menu entry title or systemd-boot entry ID
+	TargetPartition string `json:"target_partition"`
+	ImageRef        string `json:"image_ref,omitempty"`
+	ImageDigest     string `json:"image_digest,omitempty"`
+	RebootRequired  bool   `json:"reboot_required"`
+	RestoredVar     string `json:"restored_var_snapshot,omitempty"` // Snapshot of /var restored for the next boot
+	DryRun          bool   `json:"dry_run,omitempty"`
+	Message         string `json:"message,omitempty"`
+}
+
+// =============================================================================
+// Mark Boot Good Command Output
+// =============================================================================
+
+// MarkBootGoodOutput represents the JSON output structure for the mark-boot-good command
+type MarkBootGoodOutput struct {
+	BootloaderType string `json:"bootloader_type"`
+	Marked         bool   `json:"marked"`          // true if a pending boot counter was cleared
+	Entry          string `json:"entry,omitempty"` // GRUB menu entry title or systemd-boot entry ID
+	DryRun         bool   `json:"dry_run,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// =============================================================================
+// History Command Output
+// =============================================================================
+
+// DeploymentRecord is one entry in the append-only deployment journal
+type DeploymentRecord struct {
+	Timestamp       string  `json:"timestamp"`                  // When the deployment finished (RFC 3339, UTC)
+	Operation       string  `json:"operation"`                  // install or update
+	ImageRef        string  `json:"image_ref"`                  // Container image reference
+	ImageDigest     string  `json:"image_digest,omitempty"`     // Container image digest (sha256:...)
+	KernelVersion   string  `json:"kernel_version,omitempty"`   // Kernel version found in the deployed root
+	TargetSlot      string  `json:"target_slot"`                // Slot written (root1 or root2)
+	TargetPartition string  `json:"target_partition,omitempty"` // Partition written
+	VarSnapshot     string  `json:"var_snapshot,omitempty"`     // Snapshot of /var taken before the update
+	Outcome         string  `json:"outcome"`                    // success, failed or cancelled
+	Error           string  `json:"error,omitempty"`            // Error message if the deployment did not succeed
+	DurationSeconds float64 `json:"duration_seconds"`           // Wall-clock duration of the deployment
+	NBCVersion      string  `json:"nbc_version"`                // Version of nbc that performed the deployment
+}
+
+// HistoryOutput represents the JSON output structure for the history command
+type HistoryOutput struct {
+	Records []DeploymentRecord `json:"records"`
+}
+
 // =============================================================================
 // Validate Command Output
 // =============================================================================
@@ -0,0 +1,344 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"debug/pe"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/frostyard/std/reporter"
+)
+
+// ukiDir is where systemd-boot discovers Type #2 (UKI) boot entries, relative
+// to the ESP root.
+const ukiDir = "EFI/Linux"
+
+// ukiInputs are the files a UKI is assembled from
+type ukiInputs struct {
+	Linux     string // Kernel image
+	Initrd    string // Initramfs
+	Microcode string // Optional early microcode initrd
+	OSRelease string // os-release file naming the OS in the boot menu
+}
+
+// readPESection returns the contents of the named section of a PE binary,
+// without the zero padding up to the file alignment. found is false when
+// the binary has no such section.
+func readPESection(path, name string) (data []byte, found bool, err error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open PE binary %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	sec := f.Section(name)
+	if sec == nil {
+		return nil, false, nil
+	}
+	data, err = sec.Data()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s section of %s: %w", name, path, err)
+	}
+	if sec.VirtualSize > 0 && int(sec.VirtualSize) < len(data) {
+		data = data[:sec.VirtualSize]
+	}
+	return data, true, nil
+}
+
+// ukiCmdline returns the kernel command line embedded in a UKI
+func ukiCmdline(path string) ([]string, error) {
+	data, found, err := readPESection(path, ".cmdline")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no embedded command line", filepath.Base(path))
+	}
+	return strings.Fields(string(bytes.TrimRight(data, "\x00"))), nil
+}
+
+// findPrebuiltUKI returns a UKI shipped by the image in
+// /usr/lib/modules/$KVER/, or "" when there is none.
+func findPrebuiltUKI(rootDir, kernelVersion string) string {
+	matches, _ := filepath.Glob(filepath.Join(rootDir, "usr", "lib", "modules", kernelVersion, "*.efi"))
+	sort.Strings(matches)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// extractUKIInputs writes the kernel, initramfs, microcode and os-release of
+// a prebuilt UKI to dir, so it can be rebuilt with another command line.
+func extractUKIInputs(uki, dir string) (*ukiInputs, error) {
+	inputs := &ukiInputs{}
+	for _, sec := range []struct {
+		name     string
+		dest     *string
+		required bool
+	}{
+		{".linux", &inputs.Linux, true},
+		{".initrd", &inputs.Initrd, false},
+		{".ucode", &inputs.Microcode, false},
+		{".osrel", &inputs.OSRelease, false},
+	} {
+		data, found, err := readPESection(uki, sec.name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			if sec.required {
+				return nil, fmt.Errorf("%s has no %s section", filepath.Base(uki), sec.name)
+			}
+			continue
+		}
+		path := filepath.Join(dir, strings.TrimPrefix(sec.name, "."))
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to extract %s from %s: %w", sec.name, filepath.Base(uki), err)
+		}
+		*sec.dest = path
+	}
+	return inputs, nil
+}
+
+// resolveUKIInputs picks the inputs for a UKI of kernelVersion: the sections
+// of a prebuilt UKI in rootDir when the image ships one (extracted to tmpDir),
+// otherwise the kernel and initramfs on the boot partition at bootDir.
+func resolveUKIInputs(rootDir, bootDir, kernelVersion, tmpDir string) (*ukiInputs, error) {
+	if prebuilt := findPrebuiltUKI(rootDir, kernelVersion); prebuilt != "" {
+		inputs, err := extractUKIInputs(prebuilt, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		if inputs.OSRelease == "" {
+			inputs.OSRelease = findOSReleaseFile(rootDir)
+		}
+		return inputs, nil
+	}
+
+	kernel := filepath.Join(bootDir, "vmlinuz-"+kernelVersion)
+	if _, err := os.Stat(kernel); err != nil {
+		return nil, fmt.Errorf("kernel vmlinuz-%s not found on boot partition: %w", kernelVersion, err)
+	}
+	initrd, ok := findBootInitramfs(bootDir, kernelVersion)
+	if !ok {
+		return nil, fmt.Errorf("initramfs for kernel %s not found on boot partition", kernelVersion)
+	}
+	return &ukiInputs{Linux: kernel, Initrd: initrd, OSRelease: findOSReleaseFile(rootDir)}, nil
+}
+
+// findOSReleaseFile returns the os-release file of rootDir, or "" if missing
+func findOSReleaseFile(rootDir string) string {
+	for _, path := range []string{
+		filepath.Join(rootDir, "etc", "os-release"),
+		filepath.Join(rootDir, "usr", "lib", "os-release"),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// findUKIStub returns the systemd-stub shipped in rootDir, or "" to let ukify
+// use its default.
+func findUKIStub(rootDir string) string {
+	matches, _ := filepath.Glob(filepath.Join(rootDir, "usr", "lib", "systemd", "boot", "efi", "linux*.efi.stub"))
+	sort.Strings(matches)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// findUkify locates the ukify tool on the host
+func findUkify() (string, error) {
+	if path, err := exec.LookPath("ukify"); err == nil {
+		return path, nil
+	}
+	if _, err := os.Stat("/usr/lib/systemd/ukify"); err == nil {
+		return "/usr/lib/systemd/ukify", nil
+	}
+	return "", fmt.Errorf("ukify not found; install systemd-ukify to build unified kernel images")
+}
+
+// ukifyArgs builds the "ukify build" arguments for a UKI with cmdline embedded,
+// signing its PCR 11 values when the TPM2 policy has a signing key
+func ukifyArgs(inputs *ukiInputs, kernelVersion, stub string, cmdline []string, policy *TPM2Policy, output string) []string {
+	args := []string{"build", "--linux=" + inputs.Linux}
+	if inputs.Microcode != "" {
+		args = append(args, "--microcode="+inputs.Microcode)
+	}
+	if inputs.Initrd != "" {
+		args = append(args, "--initrd="+inputs.Initrd)
+	}
+	args = append(args, "--cmdline="+strings.Join(cmdline, " "), "--uname="+kernelVersion)
+	if inputs.OSRelease != "" {
+		args = append(args, "--os-release=@"+inputs.OSRelease)
+	}
+	if stub != "" {
+		args = append(args, "--stub="+stub)
+	}
+	args = append(args, policy.ukifyArgs()...)
+	return append(args, "--output="+output)
+}
+
+// buildUKI assembles a UKI for kernelVersion with cmdline embedded and writes
+// it to output. rootDir is the root filesystem the kernel belongs to and
+// bootDir the mounted boot partition.
+func buildUKI(ctx context.Context, rootDir, bootDir, kernelVersion string, cmdline []string, policy *TPM2Policy, output string) error {
+	ukify, err := findUkify()
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "nbc-uki-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	inputs, err := resolveUKIInputs(rootDir, bootDir, kernelVersion, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	args := ukifyArgs(inputs, kernelVersion, findUKIStub(rootDir), cmdline, policy, output)
+	if out, err := exec.CommandContext(ctx, ukify, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to build UKI: %w\nOutput: %s", err, string(out))
+	}
+	return nil
+}
+
+// writeSystemdBootUKI builds the UKI for entry id (e.g. "bootc.efi") into the
+// ESP's EFI/Linux directory, carrying a fresh "+TRIES" boot counter when tries
+// is positive. It is built next to its final name and renamed into place, then
+// any other file for the same entry is removed. policy is the TPM2 policy whose
+// key signs the UKI's PCR 11 values, if any.
+func writeSystemdBootUKI(ctx context.Context, bootDir, rootDir, kernelVersion, id string, tries int, cmdline []string, policy *TPM2Policy) error {
+	linuxDir := filepath.Join(bootDir, ukiDir)
+	if err := os.MkdirAll(linuxDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", ukiDir, err)
+	}
+
+	name := systemdBootEntryFileName(id, tries)
+	tmpPath := filepath.Join(linuxDir, "."+name+".tmp")
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	if err := buildUKI(ctx, rootDir, bootDir, kernelVersion, cmdline, policy, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(linuxDir, name)); err != nil {
+		return fmt.Errorf("failed to install UKI %s: %w", name, err)
+	}
+	return removeStaleSystemdBootEntries(linuxDir, id, name)
+}
+
+// keepPreviousUKI renames the UKI that boots root= argument rootArg to the
+// "bootc-previous" entry, so the slot being replaced keeps exactly the image
+// it last booted. found is false when no UKI boots rootArg.
+func keepPreviousUKI(bootDir, rootArg string) (found bool, err error) {
+	linuxDir := filepath.Join(bootDir, ukiDir)
+	const previousID = "bootc-previous.efi"
+
+	ukis, err := filepath.Glob(filepath.Join(linuxDir, "bootc*.efi"))
+	if err != nil {
+		return false, fmt.Errorf("failed to list UKIs: %w", err)
+	}
+	for _, path := range ukis {
+		cmdline, err := ukiCmdline(path)
+		if err != nil || !slices.Contains(cmdline, rootArg) {
+			continue
+		}
+		if filepath.Base(path) != previousID {
+			if err := os.Rename(path, filepath.Join(linuxDir, previousID)); err != nil {
+				return false, fmt.Errorf("failed to keep previous UKI: %w", err)
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// installSystemdBootUKI writes the UKI boot entry for a fresh install and
+// removes any Type #1 entries and other UKIs, so the new UKI is the only entry.
+func installSystemdBootUKI(ctx context.Context, bootDir, rootDir, kernelVersion string, cmdline []string, policy *TPM2Policy, progress reporter.Reporter) error {
+	progress.Message("Building unified kernel image for %s...", kernelVersion)
+	if err := writeSystemdBootUKI(ctx, bootDir, rootDir, kernelVersion, "bootc.efi", 0, cmdline, policy); err != nil {
+		return err
+	}
+
+	if ukis, err := filepath.Glob(filepath.Join(bootDir, ukiDir, "*.efi")); err == nil {
+		for _, existing := range ukis {
+			if filepath.Base(existing) != "bootc.efi" {
+				_ = os.Remove(existing)
+			}
+		}
+	}
+	if entries, err := filepath.Glob(filepath.Join(bootDir, "loader", "entries", "*.conf")); err == nil {
+		for _, existing := range entries {
+			_ = os.Remove(existing)
+		}
+	}
+
+	progress.Message("Installed UKI: %s/bootc.efi", ukiDir)
+	return nil
+}
+
+// updateSystemdBootUKIs is the UKI variant of updateSystemdBootBootloader. The
+// UKI that boots the active slot is kept as the "bootc-previous" entry (or
+// rebuilt from the kernel on the boot partition when there is none), and a new
+// counted "bootc" UKI is built for the target slot.
+func (u *SystemUpdater) updateSystemdBootUKIs(ctx context.Context, kernelVersion string, kernelCmdline []string, activeUUID, varUUID, fsType string) error {
+	bootDir := u.Config.BootMountPoint
+
+	previousCmdline, err := u.buildKernelCmdline(ctx, activeUUID, varUUID, fsType, false)
+	if err != nil {
+		return fmt.Errorf("failed to build previous kernel cmdline: %w", err)
+	}
+
+	kept, err := keepPreviousUKI(bootDir, cmdlineRootArg(strings.Join(previousCmdline, " ")))
+	if err != nil {
+		return err
+	}
+	if !kept {
+		previousKernelVersion, err := u.getActiveRootKernelVersion()
+		if err != nil {
+			u.Progress.Warning("failed to get previous kernel version, falling back to current kernel for rollback entry: %v", err)
+			previousKernelVersion = kernelVersion
+		}
+		// The running root is the active slot, so its prebuilt UKI (if any)
+		// is found under /
+		if err := writeSystemdBootUKI(ctx, bootDir, "/", previousKernelVersion, "bootc-previous.efi", 0, previousCmdline, u.tpm2Policy()); err != nil {
+			return fmt.Errorf("failed to build rollback UKI: %w", err)
+		}
+	}
+
+	u.Progress.Message("Building unified kernel image for %s...", kernelVersion)
+	if err := writeSystemdBootUKI(ctx, bootDir, u.Config.MountPoint, kernelVersion, "bootc.efi", u.bootTries(), kernelCmdline, u.tpm2Policy()); err != nil {
+		return fmt.Errorf("failed to build UKI: %w", err)
+	}
+
+	// Type #1 entries for the same slots would duplicate the menu
+	entriesDir := filepath.Join(bootDir, "loader", "entries")
+	if _, err := os.Stat(entriesDir); err == nil {
+		for _, id := range []string{"bootc", "bootc-previous"} {
+			if err := removeStaleSystemdBootEntries(entriesDir, id, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := setSystemdBootDefault(filepath.Join(bootDir, "loader", "loader.conf"), systemdBootDefaultPattern); err != nil {
+		return err
+	}
+
+	u.Progress.Message("Updated systemd-boot to boot from %s", u.Target)
+	return nil
+}
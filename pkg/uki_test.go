@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/frostyard/std/reporter"
+)
+
+type testPESection struct {
+	name string
+	data []byte
+}
+
+// writeTestPE writes a minimal PE32+ binary with the given sections, enough
+// for debug/pe to read them back. Raw data is padded to 512 bytes like a real
+// file alignment, so readers must honour VirtualSize.
+func writeTestPE(t *testing.T, path string, sections []testPESection) {
+	t.Helper()
+	const headerSize = 0x400
+
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	_ = binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:          pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections: uint16(len(sections)),
+	})
+
+	var raw bytes.Buffer
+	for i, sec := range sections {
+		padded := (len(sec.data) + 511) / 512 * 512
+		var name [8]uint8
+		copy(name[:], sec.name)
+		_ = binary.Write(&buf, binary.LittleEndian, pe.SectionHeader32{
+			Name:             name,
+			VirtualSize:      uint32(len(sec.data)),
+			VirtualAddress:   uint32(0x1000 * (i + 1)),
+			SizeOfRawData:    uint32(padded),
+			PointerToRawData: uint32(headerSize + raw.Len()),
+		})
+		raw.Write(sec.data)
+		raw.Write(make([]byte, padded-len(sec.data)))
+	}
+	buf.Write(make([]byte, headerSize-buf.Len()))
+	buf.Write(raw.Bytes())
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestUKI writes a UKI with cmdline embedded
+func writeTestUKI(t *testing.T, path, cmdline string) {
+	t.Helper()
+	writeTestPE(t, path, []testPESection{
+		{".osrel", []byte("NAME=Test Linux\n")},
+		{".cmdline", []byte(cmdline + "\x00")},
+		{".linux", []byte("kernel")},
+		{".initrd", []byte("initramfs")},
+	})
+}
+
+func TestUKISections(t *testing.T) {
+	uki := filepath.Join(t.TempDir(), "test.efi")
+	writeTestUKI(t, uki, "root=UUID=uuid-root1 ro quiet")
+
+	cmdline, err := ukiCmdline(uki)
+	if err != nil {
+		t.Fatalf("ukiCmdline() error = %v", err)
+	}
+	if want := []string{"root=UUID=uuid-root1", "ro", "quiet"}; !reflect.DeepEqual(cmdline, want) {
+		t.Errorf("ukiCmdline() = %v, want %v", cmdline, want)
+	}
+
+	dir := t.TempDir()
+	inputs, err := extractUKIInputs(uki, dir)
+	if err != nil {
+		t.Fatalf("extractUKIInputs() error = %v", err)
+	}
+	if inputs.Microcode != "" {
+		t.Errorf("Microcode = %q, want none", inputs.Microcode)
+	}
+	if data, _ := os.ReadFile(inputs.Linux); string(data) != "kernel" {
+		t.Errorf(".linux extracted as %q, want %q", data, "kernel")
+	}
+	if data, _ := os.ReadFile(inputs.OSRelease); string(data) != "NAME=Test Linux\n" {
+		t.Errorf(".osrel extracted as %q", data)
+	}
+
+	// A plain EFI binary has no command line to read
+	stub := filepath.Join(t.TempDir(), "stub.efi")
+	writeTestPE(t, stub, []testPESection{{".text", []byte{0xc3}}})
+	if _, err := ukiCmdline(stub); err == nil {
+		t.Error("ukiCmdline() should fail without a .cmdline section")
+	}
+	if _, err := extractUKIInputs(stub, dir); err == nil {
+		t.Error("extractUKIInputs() should fail without a .linux section")
+	}
+}
+
+func TestUkifyArgs(t *testing.T) {
+	inputs := &ukiInputs{Linux: "/b/vmlinuz-6.18.3", Initrd: "/b/initramfs-6.18.3.img", OSRelease: "/r/etc/os-release"}
+	got := ukifyArgs(inputs, "6.18.3", "/r/stub", []string{"root=UUID=r", "ro"}, nil, "/b/EFI/Linux/out.efi")
+	want := []string{
+		"build", "--linux=/b/vmlinuz-6.18.3", "--initrd=/b/initramfs-6.18.3.img",
+		"--cmdline=root=UUID=r ro", "--uname=6.18.3", "--os-release=@/r/etc/os-release",
+		"--stub=/r/stub", "--output=/b/EFI/Linux/out.efi",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ukifyArgs() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestKeepPreviousUKI(t *testing.T) {
+	bootDir := t.TempDir()
+	linuxDir := filepath.Join(bootDir, ukiDir)
+	writeTestUKI(t, filepath.Join(linuxDir, "bootc+1-2.efi"), "root=UUID=uuid-root2 ro")
+	writeTestUKI(t, filepath.Join(linuxDir, "bootc-previous.efi"), "root=UUID=uuid-root1 ro")
+
+	// Updating from root2: its UKI becomes the rollback entry
+	kept, err := keepPreviousUKI(bootDir, "root=UUID=uuid-root2")
+	if err != nil || !kept {
+		t.Fatalf("keepPreviousUKI() = %v, %v; want kept", kept, err)
+	}
+	cmdline, err := ukiCmdline(filepath.Join(linuxDir, "bootc-previous.efi"))
+	if err != nil || cmdline[0] != "root=UUID=uuid-root2" {
+		t.Errorf("bootc-previous.efi boots %v (%v), want root2", cmdline, err)
+	}
+	if _, err := os.Stat(filepath.Join(linuxDir, "bootc+1-2.efi")); !os.IsNotExist(err) {
+		t.Error("kept UKI should have been moved, not copied")
+	}
+
+	if kept, _ := keepPreviousUKI(bootDir, "root=UUID=uuid-other"); kept {
+		t.Error("keepPreviousUKI() should report no UKI for an unknown root")
+	}
+}
+
+func TestSystemdBootUKIRollbackAndMarkGood(t *testing.T) {
+	bootDir := t.TempDir()
+	linuxDir := filepath.Join(bootDir, ukiDir)
+	writeTestFile(t, filepath.Join(bootDir, "loader", "loader.conf"), "default bootc*\ntimeout 5\n")
+	writeTestUKI(t, filepath.Join(linuxDir, "bootc+2-1.efi"), "root=UUID=uuid-root2 ro")
+	writeTestUKI(t, filepath.Join(linuxDir, "bootc-previous.efi"), "root=UUID=uuid-root1 ro")
+
+	plan, err := planSystemdBootRollback(bootDir, testRootArgs)
+	if err != nil {
+		t.Fatalf("planSystemdBootRollback() error = %v", err)
+	}
+	if plan.FromSlot != "root2" || plan.ToSlot != "root1" || plan.ToEntry != "bootc-previous.efi" {
+		t.Errorf("plan = %s -> %s (%s), want root2 -> root1 (bootc-previous.efi)", plan.FromSlot, plan.ToSlot, plan.ToEntry)
+	}
+
+	output, err := markBootGood(bootDir, "root=UUID=uuid-root2", false, reporter.NoopReporter{})
+	if err != nil {
+		t.Fatalf("markBootGood() error = %v", err)
+	}
+	if !output.Marked || output.Entry != "bootc.efi" {
+		t.Errorf("output = %+v, want bootc.efi marked", output)
+	}
+	if _, err := os.Stat(filepath.Join(linuxDir, "bootc.efi")); err != nil {
+		t.Errorf("UKI should be renamed to bootc.efi: %v", err)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/frostyard/std/reporter"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
@@ -182,42 +183,6 @@ func GetInactiveRootPartition(scheme *PartitionScheme, progress reporter.Reporte
 	return scheme.Root2Partition, true, nil
 }
 
-// DetectExistingPartitionScheme detects the partition scheme of an existing installation
-func DetectExistingPartitionScheme(device string) (*PartitionScheme, error) {
-	deviceBase := filepath.Base(device)
-	var part1, part2, part3, part4 string
-
-	// Handle different device naming conventions
-	// nvme, mmcblk, and loop devices use "p" prefix for partitions
-	if strings.HasPrefix(deviceBase, "nvme") || strings.HasPrefix(deviceBase, "mmcblk") || strings.HasPrefix(deviceBase, "loop") {
-		part1 = device + "p1"
-		part2 = device + "p2"
-		part3 = device + "p3"
-		part4 = device + "p4"
-	} else {
-		part1 = device + "1"
-		part2 = device + "2"
-		part3 = device + "3"
-		part4 = device + "4"
-	}
-
-	// Verify partitions exist
-	for _, part := range []string{part1, part2, part3, part4} {
-		if _, err := os.Stat(part); os.IsNotExist(err) {
-			return nil, fmt.Errorf("partition %s does not exist", part)
-		}
-	}
-
-	scheme := &PartitionScheme{
-		BootPartition:  part1,
-		Root1Partition: part2,
-		Root2Partition: part3,
-		VarPartition:   part4,
-	}
-
-	return scheme, nil
-}
-
 // UpdaterConfig holds configuration for system updates
 type UpdaterConfig struct {
 	Device         string
@@ -231,8 +196,13 @@ type UpdaterConfig struct {
 	KernelArgs     []string
 	MountPoint     string
 	BootMountPoint string
-	SkipVerify     bool   // Skip cosign signature verification of the pulled image
-	CosignKeyPath  string // Override trusted cosign public key (empty = embedded)
+	SkipVerify     bool         // Skip cosign signature verification of the pulled image
+	CosignKeyPath  string       // Override trusted cosign public key (empty = embedded)
+	Delta          bool         // Only write changed paths when the target slot's contents are recorded
+	NoVarSnapshot  bool         // Skip the snapshot of /var taken before updating btrfs systems
+	Flatten        bool         // Write each path of the image once, reading layers concurrently
+	SELinuxRelabel bool         // Label the new root with its SELinux policy (also enabled by system config)
+	Platform       *v1.Platform // Image platform to pull, which must match the installed one (nil = the installed one)
 }
 
 // SystemUpdater handles A/B system updates
@@ -245,8 +215,20 @@ type SystemUpdater struct {
 	TargetMapperPath string // For encrypted systems: "/dev/mapper/root1" or "/dev/mapper/root2"
 	Progress         reporter.Reporter
 	Encryption       *EncryptionConfig    // Encryption configuration (loaded from system config)
+	Discoverable     *DiscoverableConfig  // Discoverable partition settings (loaded from system config)
+	UKI              bool                 // Boot unified kernel images (loaded from system config)
+	Subvolumes       *SubvolumeConfig     // Deployment subvolumes (loaded from system config)
+	Composefs        *ComposefsConfig     // Composefs images of the root slots (loaded from system config)
+	ActiveDeployment int                  // For subvolume layouts: the running deployment
+	TargetDeployment int                  // For subvolume layouts: the deployment being created
 	LocalLayoutPath  string               // Path to OCI layout directory for local image
 	LocalMetadata    *CachedImageMetadata // Metadata from cached image
+
+	// removedDeployments are the deployments dropped by the update, deleted
+	// once its boot entries no longer use them
+	removedDeployments []SubvolumeDeployment
+	// varSnapshot is the snapshot of /var taken before the update
+	varSnapshot string
 }
 
 // NewSystemUpdater creates a new SystemUpdater
@@ -308,9 +290,19 @@ func (u *SystemUpdater) SetLocalImage(layoutPath string, metadata *CachedImageMe
 // target vs the active/previous one) and delegates assembly to
 // assembleKernelCmdline, shared with the install flow so the two never diverge.
 func (u *SystemUpdater) buildKernelCmdline(ctx context.Context, rootUUID, varUUID, fsType string, isTarget bool) ([]string, error) {
+	params, err := u.kernelCmdlineParams(ctx, rootUUID, varUUID, fsType, isTarget)
+	if err != nil {
+		return nil, err
+	}
+	return assembleKernelCmdline(params), nil
+}
+
+// kernelCmdlineParams collects the kernel command line parameters of the
+// target (isTarget) or the active root
+func (u *SystemUpdater) kernelCmdlineParams(ctx context.Context, rootUUID, varUUID, fsType string, isTarget bool) (kernelCmdlineParams, error) {
 	bootUUID, err := GetPartitionUUID(ctx, u.Scheme.BootPartition)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get boot UUID: %w", err)
+		return kernelCmdlineParams{}, fmt.Errorf("failed to get boot UUID: %w", err)
 	}
 
 	params := kernelCmdlineParams{
@@ -319,9 +311,13 @@ func (u *SystemUpdater) buildKernelCmdline(ctx context.Context, rootUUID, varUUI
 		ExtraArgs:      u.Config.KernelArgs,
 	}
 
+	// Pick the root slot the cmdline is being built for (target = inactive).
+	mapperName, useRoot2 := updateRootSlot(isTarget, u.Active)
+	if u.Composefs != nil {
+		params.ComposefsDigest = u.Composefs.Digests[mapperName]
+	}
+
 	if u.Encryption != nil && u.Encryption.Enabled {
-		// Pick the root slot the cmdline is being built for (target = inactive).
-		mapperName, useRoot2 := updateRootSlot(isTarget, u.Active)
 		params.Encrypted = true
 		params.TPM2 = u.Encryption.TPM2
 		params.VarLUKSUUID = u.Encryption.VarLUKSUUID
@@ -334,9 +330,13 @@ func (u *SystemUpdater) buildKernelCmdline(ctx context.Context, rootUUID, varUUI
 	} else {
 		params.RootUUID = rootUUID
 		params.VarUUID = varUUID
+		if u.Discoverable != nil {
+			params.MachineID = u.Discoverable.MachineID
+			params.GPTAutoMount = u.detectBootloaderType() == BootloaderSystemdBoot
+		}
 	}
 
-	return assembleKernelCmdline(params), nil
+	return params, nil
 }
 
 // PrepareUpdate prepares for an update by detecting partitions and determining target
@@ -358,6 +358,18 @@ func (u *SystemUpdater) PrepareUpdate(ctx context.Context) error {
 			u.Encryption = sysConfig.Encryption
 			p.Message("Detected LUKS encryption configuration")
 		}
+		u.Discoverable = sysConfig.Discoverable
+		u.UKI = sysConfig.UKI
+		u.Subvolumes = sysConfig.Subvolumes
+		u.Composefs = sysConfig.Composefs
+		if sysConfig.SELinuxRelabel {
+			u.Config.SELinuxRelabel = true
+		}
+		platform, err := UpdatePlatform(sysConfig.Platform, u.Config.Platform)
+		if err != nil {
+			return err
+		}
+		u.Config.Platform = platform
 		// Load filesystem type if not already set
 		if u.Config.FilesystemType == "" && sysConfig.FilesystemType != "" {
 			u.Config.FilesystemType = sysConfig.FilesystemType
@@ -372,13 +384,31 @@ func (u *SystemUpdater) PrepareUpdate(ctx context.Context) error {
 		}
 	}
 
+	// A staged image must have been downloaded for the installed platform
+	if u.LocalMetadata != nil && u.LocalMetadata.Platform != "" {
+		staged, err := ParsePlatform(u.LocalMetadata.Platform)
+		if err != nil {
+			return fmt.Errorf("failed to parse platform of staged image: %w", err)
+		}
+		if want := targetPlatform(u.Config.Platform); !platformMatches(want, *staged) {
+			return fmt.Errorf("refusing to update a %s installation to a staged %s image", want.String(), staged.String())
+		}
+	}
+
 	// Detect existing partition scheme
-	scheme, err := DetectExistingPartitionScheme(u.Config.Device)
+	scheme, err := DetectInstalledPartitionScheme(u.Config.Device, sysConfig)
 	if err != nil {
 		return fmt.Errorf("failed to detect partition scheme: %w", err)
 	}
 	u.Scheme = scheme
 
+	if u.Subvolumes != nil {
+		return u.prepareDeployments()
+	}
+	if scheme.Subvolumes {
+		return fmt.Errorf("%s has a single root partition, but no deployments are recorded in the system config", u.Config.Device)
+	}
+
 	// Determine inactive partition
 	target, active, err := GetInactiveRootPartition(scheme, p)
 	if err != nil {
@@ -433,11 +463,21 @@ func (u *SystemUpdater) PullImage(ctx context.Context) error {
 	}
 
 	// Try to get image descriptor to verify it exists and is accessible
-	_, err = remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+	platform := targetPlatform(u.Config.Platform)
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx), remote.WithPlatform(platform))
 	if err != nil {
 		return fmt.Errorf("failed to access image: %w (check credentials if private registry)", err)
 	}
 
+	// Refuse an image for another platform before touching the target
+	img, err := desc.Image()
+	if err != nil {
+		return fmt.Errorf("failed to resolve image for %s: %w", platform.String(), err)
+	}
+	if err := checkImagePlatform(img, platform); err != nil {
+		return err
+	}
+
 	p.Message("Image reference is valid and accessible")
 	return nil
 }
@@ -514,8 +554,9 @@ func (u *SystemUpdater) IsUpdateNeeded(ctx context.Context, short bool) (bool, s
 	return true, remoteDigest, nil
 }
 
-// Update performs the system update
-func (u *SystemUpdater) Update(ctx context.Context) error {
+// Update performs the system update. Every attempt past the dry-run check,
+// successful or not, is appended to the deployment history.
+func (u *SystemUpdater) Update(ctx context.Context) (err error) {
 	p := u.Progress
 
 	if err := ctx.Err(); err != nil {
@@ -523,12 +564,33 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 	}
 
 	if u.Config.DryRun {
+		if !u.Config.NoVarSnapshot {
+			if config, err := ReadSystemConfig(); err == nil && config.FilesystemType == "btrfs" && varSnapshotConfig(config).KeepUpdate > 0 {
+				p.MessagePlain("[DRY RUN] Would snapshot /var")
+			}
+		}
+		if u.Subvolumes != nil {
+			p.MessagePlain("[DRY RUN] Would update to deployment %d (%s on %s)", u.TargetDeployment, deploymentSubvolume(u.TargetDeployment), u.Target)
+			return nil
+		}
 		p.MessagePlain("[DRY RUN] Would update to partition: %s", u.Target)
 		return nil
 	}
 
+	start := time.Now()
+	var kernelVersion string
+	defer func() { u.recordDeployment(start, kernelVersion, err) }()
+
 	p.MessagePlain("Starting system update...")
 
+	// /var is shared by both slots, so snapshot it while it still matches
+	// the running image
+	if !u.Config.NoVarSnapshot {
+		if err := u.snapshotVar(ctx); err != nil {
+			return fmt.Errorf("%w (use --no-var-snapshot to update without one)", err)
+		}
+	}
+
 	// Ensure critical files (SSH host keys, machine-id) are in overlay upper layer
 	// This must happen before we extract the new container image, so that these
 	// files persist even if the new container image has different versions
@@ -546,6 +608,9 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 	// Determine which device to mount
 	mountDevice := u.Target
 
+	// LUKS passphrase entered when TPM2 unlock fails, reused to re-seal TPM2 keys
+	var luksPassphrase string
+
 	// For encrypted systems, open the LUKS container first
 	if u.Encryption != nil && u.Encryption.Enabled {
 		p.Message("Opening LUKS container for %s...", u.TargetMapperName)
@@ -571,6 +636,7 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 				if err != nil {
 					return fmt.Errorf("failed to read passphrase: %w", err)
 				}
+				luksPassphrase = passphrase
 
 				_, err = OpenLUKS(ctx, u.Target, u.TargetMapperName, passphrase, p)
 				if err != nil {
@@ -593,7 +659,28 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 		}()
 	}
 
-	cmd := exec.CommandContext(ctx, "mount", mountDevice, u.Config.MountPoint)
+	previous := u.previousSlotFiles()
+
+	// A new deployment starts as a snapshot of the running one, which the
+	// delta update then turns into the new image
+	mountArgs := []string{mountDevice, u.Config.MountPoint}
+	committed := false
+	if u.Subvolumes != nil {
+		if err := u.createTargetDeployment(ctx, previous != nil); err != nil {
+			return fmt.Errorf("failed to create deployment subvolume: %w", err)
+		}
+		// Registered before the unmount below, so it runs after it
+		defer func() {
+			if err != nil && !committed {
+				if delErr := u.deleteDeployments(context.WithoutCancel(ctx), []SubvolumeDeployment{{ID: u.TargetDeployment}}); delErr != nil {
+					p.Warning("failed to remove unfinished deployment %d: %v", u.TargetDeployment, delErr)
+				}
+			}
+		}()
+		mountArgs = append([]string{"-o", "subvol=" + deploymentSubvolume(u.TargetDeployment)}, mountArgs...)
+	}
+
+	cmd := exec.CommandContext(ctx, "mount", mountArgs...)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to mount target partition: %w\nOutput: %s", err, string(output))
 	}
@@ -603,20 +690,24 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 		_ = os.RemoveAll(u.Config.MountPoint)
 	}()
 
-	// Step 2: Clear existing content
+	// Step 2: Clear existing content, unless it can be updated as a delta
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	p.Step(2, 7, "Clearing old content from target partition")
-	entries, err := os.ReadDir(u.Config.MountPoint)
-	if err != nil {
-		return fmt.Errorf("failed to read target directory: %w", err)
+	// Once the slot is modified its record no longer describes it
+	if err := os.Remove(slotFilesPath(u.targetSlot())); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove record of %s: %w", u.targetSlot(), err)
 	}
-	for _, entry := range entries {
-		path := filepath.Join(u.Config.MountPoint, entry.Name())
-		if err := os.RemoveAll(path); err != nil {
-			return fmt.Errorf("failed to remove %s: %w", path, err)
+	if err := removeImageRecord(imageRecordDir(u.targetSlot())); err != nil {
+		return err
+	}
+	if previous != nil {
+		p.Step(2, 7, "Keeping unchanged content on target partition (delta update)")
+	} else {
+		p.Step(2, 7, "Clearing old content from target partition")
+		if err := u.clearTarget(); err != nil {
+			return err
 		}
 	}
 
@@ -626,9 +717,10 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 	}
 
 	p.Step(3, 7, "Extracting new container filesystem")
-	if err := ExtractAndVerifyContainer(ctx, u.Config.ImageRef, u.LocalLayoutPath, u.Config.MountPoint, u.Config.Verbose, u.Config.SkipVerify, u.Config.CosignKeyPath, p); err != nil {
+	if err := u.extractTarget(ctx, previous); err != nil {
 		return fmt.Errorf("%w\n\nThe target partition may be in an inconsistent state.\nThe previous installation is still bootable - do NOT reboot.\nRe-run the update to try again", err)
 	}
+	kernelVersion, _ = u.getUpdatedRootKernelVersion()
 
 	// Step 4: Merge /etc configuration from active system
 	if err := ctx.Err(); err != nil {
@@ -692,6 +784,7 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 				if err != nil {
 					return fmt.Errorf("failed to read passphrase: %w", err)
 				}
+				luksPassphrase = passphrase
 
 				_, err = OpenLUKS(ctx, varLUKSDevice, "var", passphrase, p)
 				if err != nil {
@@ -731,6 +824,18 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 	if err := SetupTargetSystem(ctx, u.Config.MountPoint, u.Config.DryRun, u.Config.Verbose, p); err != nil {
 		return err
 	}
+	if u.Config.SELinuxRelabel {
+		if err := RelabelSELinux(ctx, u.Config.MountPoint, u.Config.DryRun, p); err != nil {
+			return fmt.Errorf("failed to relabel SELinux contexts: %w", err)
+		}
+	}
+	if u.Composefs != nil {
+		digest, err := SetupComposefs(ctx, u.Config.MountPoint, u.Config.DryRun, u.Config.Verbose, p)
+		if err != nil {
+			return fmt.Errorf("failed to set up composefs: %w", err)
+		}
+		u.Composefs.setDigest(u.targetSlot(), digest)
+	}
 
 	// Write updated system config to /var (which persists across updates)
 	if !u.Config.DryRun {
@@ -739,9 +844,23 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 		if err != nil {
 			p.Warning("failed to read existing config: %v", err)
 		} else {
+			// Keep the running slot's image as the rollback image. While a
+			// reboot is pending, the running slot's image is already recorded
+			// as the previous image by the earlier update or rollback.
+			if !IsRebootRequired() {
+				existingConfig.PreviousImageRef = existingConfig.ImageRef
+				existingConfig.PreviousImageDigest = existingConfig.ImageDigest
+			}
+
 			// Update the image reference and digest
 			existingConfig.ImageRef = u.Config.ImageRef
+			if u.Composefs != nil {
+				existingConfig.Composefs = u.Composefs
+			}
 			existingConfig.ImageDigest = u.Config.ImageDigest
+			if u.Config.Platform != nil {
+				existingConfig.Platform = u.Config.Platform.String()
+			}
 			// NOTE: Do NOT update Device field - device names can change between boots
 			// due to enumeration order. The disk_id field provides stable identification.
 
@@ -789,9 +908,13 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 	}
 
 	p.Step(7, 7, "Updating bootloader configuration")
+	if u.Subvolumes != nil {
+		u.addTargetDeployment(kernelVersion)
+	}
 	if err := u.UpdateBootloader(ctx); err != nil {
 		return fmt.Errorf("failed to update bootloader: %w", err)
 	}
+	committed = true
 
 	// Prune old kernels only after the bootloader entries reference the current
 	// and previous kernels, so a crash mid-update never leaves the rollback entry
@@ -800,6 +923,30 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 		return fmt.Errorf("failed to prune old boot kernels: %w", err)
 	}
 
+	// Point systemd-gpt-auto-generator at the new slot. root= on the cmdline
+	// still selects the slot, so a failure here does not fail the update.
+	if u.Discoverable != nil {
+		if err := SetDiscoverableRootSlot(ctx, u.Config.Device, u.Scheme, u.Target, u.Config.DryRun, p); err != nil {
+			p.Warning("failed to update discoverable partition flags: %v", err)
+		}
+	}
+
+	// Keys sealed to PCR values that changed since they were enrolled (e.g. by
+	// a firmware update) would make the new slot ask for the passphrase. The
+	// passphrase still unlocks, so a failure here does not fail the update.
+	if err := u.resealTPM2(ctx, luksPassphrase); err != nil {
+		p.Warning("failed to re-seal TPM2 keys: %v", err)
+	}
+
+	// Deployments beyond the retention count lost their boot entries above.
+	// Left over subvolumes only take space, so a failure here does not fail
+	// the update.
+	if u.Subvolumes != nil {
+		if err := u.removeOldDeployments(ctx); err != nil {
+			p.Warning("failed to remove old deployments: %v", err)
+		}
+	}
+
 	// Write reboot-required marker to /run (automatically cleared on reboot)
 	if !u.Config.DryRun {
 		rebootInfo := &types.RebootPendingInfo{
@@ -817,6 +964,22 @@ func (u *SystemUpdater) Update(ctx context.Context) error {
 	return nil
 }
 
+// recordDeployment appends the outcome of an update to the deployment history.
+// A failure to record is reported but never fails the update itself.
+func (u *SystemUpdater) recordDeployment(start time.Time, kernelVersion string, err error) {
+	record := newDeploymentRecord(DeploymentUpdate, start, err)
+	record.ImageRef = u.Config.ImageRef
+	record.ImageDigest = u.Config.ImageDigest
+	record.KernelVersion = kernelVersion
+	record.TargetSlot = u.targetSlot()
+	record.TargetPartition = u.Target
+	record.VarSnapshot = u.varSnapshot
+
+	if err := appendDeploymentRecord(HistoryFile, record); err != nil {
+		u.Progress.Warning("failed to record deployment history: %v", err)
+	}
+}
+
 // InstallKernelAndInitramfs checks for new kernel and initramfs in the updated root
 // and copies them to the boot partition (which is the combined EFI/boot partition)
 func (u *SystemUpdater) InstallKernelAndInitramfs(ctx context.Context) error {
@@ -995,7 +1158,16 @@ func (u *SystemUpdater) PruneOldBootKernels(ctx context.Context) error {
 	}
 	defer func() { _ = exec.Command("umount", bootMountPoint).Run() }()
 
-	if err := pruneBootKernelPairs(bootMountPoint, currentKernelVersion, previousKernelVersion, p); err != nil {
+	keep := []string{currentKernelVersion, previousKernelVersion}
+	// The boot entries of every kept deployment need their kernels
+	if u.Subvolumes != nil {
+		for _, d := range u.Subvolumes.Deployments {
+			if d.KernelVersion != "" {
+				keep = append(keep, d.KernelVersion)
+			}
+		}
+	}
+	if err := pruneBootKernels(bootMountPoint, keep, p); err != nil {
 		return fmt.Errorf("failed to prune old boot kernels: %w", err)
 	}
 	return nil
@@ -1064,17 +1236,25 @@ func listBootInitramfs(bootDir string) []string {
 }
 
 // pruneBootKernelPairs removes kernel and initramfs files whose version is
-// neither the current nor the previous kernel. It also removes orphans -- a
+// neither the current nor the previous kernel
+func pruneBootKernelPairs(bootDir, currentVersion, previousVersion string, progress reporter.Reporter) error {
+	return pruneBootKernels(bootDir, []string{currentVersion, previousVersion}, progress)
+}
+
+// pruneBootKernels removes kernel and initramfs files whose version is not
+// one of the keep versions. It also removes orphans -- a
 // kernel with no initramfs, or an initramfs with no kernel, is not bootable and
 // is only cruft (this is what leaves stale vmlinuz-* accumulating over update
 // cycles). A version's kernel and initramfs are removed independently so a
 // failure on one does not leave the other behind; the first error is returned
 // after attempting all removals. Non-kernel files (e.g. loader.conf) are never
 // touched.
-func pruneBootKernelPairs(bootDir, currentVersion, previousVersion string, progress reporter.Reporter) error {
-	keep := map[string]bool{currentVersion: true}
-	if previousVersion != "" {
-		keep[previousVersion] = true
+func pruneBootKernels(bootDir string, keepVersions []string, progress reporter.Reporter) error {
+	keep := map[string]bool{}
+	for _, version := range keepVersions {
+		if version != "" {
+			keep[version] = true
+		}
 	}
 
 	var firstErr error
@@ -1133,8 +1313,8 @@ func getBootInitramfsName(bootDir, version string) (string, error) {
 	return filepath.Base(initrd), nil
 }
 
-// detectBootloaderTypeFromMount detects bootloader from already-mounted boot partition
-func (u *SystemUpdater) detectBootloaderTypeFromMount(bootMount string) BootloaderType {
+// detectBootloaderTypeAt detects which bootloader is installed on a mounted boot partition
+func detectBootloaderTypeAt(bootMount string) BootloaderType {
 	// Check for systemd-boot loader directory
 	loaderDir := filepath.Join(bootMount, "loader")
 	if _, err := os.Stat(loaderDir); err == nil {
@@ -1156,6 +1336,11 @@ func (u *SystemUpdater) detectBootloaderTypeFromMount(bootMount string) Bootload
 	return BootloaderGRUB2
 }
 
+// detectBootloaderTypeFromMount detects bootloader from already-mounted boot partition
+func (u *SystemUpdater) detectBootloaderTypeFromMount(bootMount string) BootloaderType {
+	return detectBootloaderTypeAt(bootMount)
+}
+
 // UpdateBootloader updates the bootloader to boot from the new partition
 func (u *SystemUpdater) UpdateBootloader(ctx context.Context) error {
 	// Mount boot partition
@@ -1174,6 +1359,10 @@ func (u *SystemUpdater) UpdateBootloader(ctx context.Context) error {
 	u.Progress.Message("Detected bootloader: %s", bootloaderType)
 
 	// Update based on bootloader type
+	if u.Subvolumes != nil {
+		return u.updateDeploymentsBootloader(ctx, bootloaderType)
+	}
+
 	switch bootloaderType {
 	case BootloaderGRUB2:
 		return u.updateGRUBBootloader(ctx)
@@ -1186,25 +1375,7 @@ func (u *SystemUpdater) UpdateBootloader(ctx context.Context) error {
 
 // detectBootloaderType detects which bootloader is installed
 func (u *SystemUpdater) detectBootloaderType() BootloaderType {
-	// Check for systemd-boot loader directory
-	loaderDir := filepath.Join(u.Config.BootMountPoint, "loader")
-	if _, err := os.Stat(loaderDir); err == nil {
-		return BootloaderSystemdBoot
-	}
-
-	// Check for GRUB
-	grubDirs := []string{
-		filepath.Join(u.Config.BootMountPoint, "grub"),
-		filepath.Join(u.Config.BootMountPoint, "grub2"),
-	}
-	for _, dir := range grubDirs {
-		if _, err := os.Stat(dir); err == nil {
-			return BootloaderGRUB2
-		}
-	}
-
-	// Default to GRUB2
-	return BootloaderGRUB2
+	return detectBootloaderTypeAt(u.Config.BootMountPoint)
 }
 
 // getUpdatedRootKernelVersion finds the kernel version from the updated root's modules directory.
@@ -1342,32 +1513,61 @@ func (u *SystemUpdater) updateGRUBBootloader(ctx context.Context) error {
 		previousInitrd = initrd
 	}
 
-	grubCfg := buildGRUBConfig(osName, kernelVersion, initrd, kernelCmdline, previousKernelVersion, previousInitrd, previousCmdline)
+	bootTries := u.bootTries()
+	grubCfg := buildGRUBConfig(osName, kernelVersion, initrd, kernelCmdline, previousKernelVersion, previousInitrd, previousCmdline, bootTries)
 
 	grubCfgPath := filepath.Join(grubDir, "grub.cfg")
 	if err := atomicWriteFile(grubCfgPath, []byte(grubCfg), 0644); err != nil {
 		return fmt.Errorf("failed to write grub.cfg: %w", err)
 	}
 
+	// Arm (or clear) the boot counter for the new default entry
+	if err := setGRUBBootCounter(grubDir, bootTries); err != nil {
+		return err
+	}
+
 	u.Progress.Message("  Updated GRUB to boot from %s", u.Target)
 	return nil
 }
 
-func buildGRUBConfig(osName, currentKernelVersion, currentInitrd string, currentCmdline []string, previousKernelVersion, previousInitrd string, previousCmdline []string) string {
-	return fmt.Sprintf(`set timeout=5
-set default=0
+// bootTries returns how many boot attempts the updated slot gets before the
+// bootloader falls back to the previous slot, or 0 when boot counting cannot
+// be used because the new image has no nbc to mark the boot good.
+func (u *SystemUpdater) bootTries() int {
+	if !bootCountingSupported(u.Config.MountPoint) {
+		u.Progress.Warning("%s not found in the new image; boot counting and automatic fallback are disabled", targetNBCBinary)
+		return 0
+	}
+	return DefaultBootTries
+}
 
-menuentry '%s' {
-    linux /vmlinuz-%s %s
-    initrd /%s
+// buildGRUBConfig renders grub.cfg with the current entry as the default and
+// the previous slot as entry 1. A positive bootTries adds the grubenv boot
+// counter that falls back to entry 1 when the current entry is never marked good.
+func buildGRUBConfig(osName, currentKernelVersion, currentInitrd string, currentCmdline []string, previousKernelVersion, previousInitrd string, previousCmdline []string, bootTries int) string {
+	return buildGRUBEntriesConfig([]deploymentBootEntry{
+		{Title: osName, KernelVersion: currentKernelVersion, Initrd: currentInitrd, Cmdline: currentCmdline},
+		{Title: osName + " (Previous)", KernelVersion: previousKernelVersion, Initrd: previousInitrd, Cmdline: previousCmdline},
+	}, bootTries)
 }
 
-menuentry '%s (Previous)' {
+// buildGRUBEntriesConfig renders grub.cfg with a menu entry per boot entry,
+// the first one as the default. The boot counter falls back to entry 1.
+func buildGRUBEntriesConfig(entries []deploymentBootEntry, bootTries int) string {
+	var b strings.Builder
+	b.WriteString("set timeout=5\nset default=0\n")
+	if bootTries > 0 {
+		b.WriteString(grubBootCountingScript(bootTries))
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(&b, `
+menuentry '%s' {
     linux /vmlinuz-%s %s
     initrd /%s
 }
-`, osName, currentKernelVersion, strings.Join(currentCmdline, " "), currentInitrd,
-		osName, previousKernelVersion, strings.Join(previousCmdline, " "), previousInitrd)
+`, entry.Title, entry.KernelVersion, strings.Join(entry.Cmdline, " "), entry.Initrd)
+	}
+	return b.String()
 }
 
 // updateSystemdBootBootloader updates systemd-boot configuration
@@ -1423,6 +1623,10 @@ func (u *SystemUpdater) updateSystemdBootBootloader(ctx context.Context) error {
 		return fmt.Errorf("failed to build kernel cmdline: %w", err)
 	}
 
+	if u.UKI {
+		return u.updateSystemdBootUKIs(ctx, kernelVersion, kernelCmdline, activeUUID, varUUID, fsType)
+	}
+
 	// Get OS name from the updated system
 	osName := ParseOSRelease(u.Config.MountPoint)
 
@@ -1437,8 +1641,9 @@ func (u *SystemUpdater) updateSystemdBootBootloader(ctx context.Context) error {
 
 	mainEntry := buildSystemdBootEntry(osName, kernelVersion, initrd, kernelCmdline)
 
-	mainEntryPath := filepath.Join(entriesDir, "bootc.conf")
-	if err := atomicWriteFile(mainEntryPath, []byte(mainEntry), 0644); err != nil {
+	// The main entry carries a "+N" boot counter; systemd-boot counts it down
+	// on every boot until the boot is marked good.
+	if err := writeSystemdBootEntry(entriesDir, "bootc", u.bootTries(), mainEntry); err != nil {
 		return fmt.Errorf("failed to write main boot entry: %w", err)
 	}
 
@@ -1463,11 +1668,17 @@ func (u *SystemUpdater) updateSystemdBootBootloader(ctx context.Context) error {
 	// Create/update rollback boot entry (points to previous system)
 	previousEntry := buildSystemdBootEntry(osName+" (Previous)", previousKernelVersion, previousInitrd, previousCmdline)
 
-	previousEntryPath := filepath.Join(entriesDir, "bootc-previous.conf")
-	if err := atomicWriteFile(previousEntryPath, []byte(previousEntry), 0644); err != nil {
+	if err := writeSystemdBootEntry(entriesDir, "bootc-previous", 0, previousEntry); err != nil {
 		return fmt.Errorf("failed to write rollback boot entry: %w", err)
 	}
 
+	// A previous rollback may have pointed loader.conf at a single entry; the
+	// glob default makes the freshly updated slot the default again and lets
+	// systemd-boot fall back to the previous entry once its tries run out.
+	if err := setSystemdBootDefault(filepath.Join(loaderDir, "loader.conf"), systemdBootDefaultPattern); err != nil {
+		return err
+	}
+
 	u.Progress.Message("Updated systemd-boot to boot from %s", u.Target)
 	return nil
 }
@@ -1527,7 +1738,11 @@ func (u *SystemUpdater) PerformUpdate(ctx context.Context, skipPull bool) error
 	if !u.Config.DryRun && !u.Config.Force && !u.Config.JSONOutput {
 		fmt.Printf("\n%s\n", strings.Repeat("=", 60))
 		fmt.Printf("This will update the system to a new root filesystem.\n")
-		fmt.Printf("Target partition: %s\n", u.Target)
+		if u.Subvolumes != nil {
+			fmt.Printf("Target deployment: %d (%s on %s)\n", u.TargetDeployment, deploymentSubvolume(u.TargetDeployment), u.Target)
+		} else {
+			fmt.Printf("Target partition: %s\n", u.Target)
+		}
 		fmt.Printf("%s\n", strings.Repeat("=", 60))
 		fmt.Print("Type 'yes' to continue: ")
 		var response string
@@ -450,7 +450,7 @@ func TestBuildKernelCmdline_UpdaterWithBootMount(t *testing.T) {
 	}
 
 	// Create partitions
-	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), false, reporter.NoopReporter{})
+	scheme, err := CreatePartitions(t.Context(), disk.GetDevice(), nil, false, reporter.NoopReporter{})
 	if err != nil {
 		t.Fatalf("Failed to create partitions: %v", err)
 	}
@@ -637,6 +637,32 @@ func TestBuildKernelCmdline_UpdaterWithBootMount(t *testing.T) {
 				bootIdx, varIdx, cmdlineStr)
 		}
 	})
+
+	t.Run("composefs boots each slot's image", func(t *testing.T) {
+		updater := &SystemUpdater{
+			Config: UpdaterConfig{
+				Device: disk.GetDevice(),
+			},
+			Scheme:    scheme,
+			Active:    true, // root1 is active, target is root2
+			Composefs: &ComposefsConfig{Digests: map[string]string{"root1": "aaaa", "root2": "bbbb"}},
+		}
+
+		target, err := updater.buildKernelCmdline(t.Context(), root2UUID, varUUID, "ext4", true)
+		if err != nil {
+			t.Fatalf("buildKernelCmdline failed: %v", err)
+		}
+		if got := cmdlineComposefsDigest(target); got != "bbbb" {
+			t.Errorf("target cmdline boots composefs image %q, want bbbb", got)
+		}
+		previous, err := updater.buildKernelCmdline(t.Context(), root1UUID, varUUID, "ext4", false)
+		if err != nil {
+			t.Fatalf("buildKernelCmdline failed: %v", err)
+		}
+		if got := cmdlineComposefsDigest(previous); got != "aaaa" {
+			t.Errorf("previous cmdline boots composefs image %q, want aaaa", got)
+		}
+	})
 }
 
 // TestGetUpdatedRootKernelVersion tests the kernel version detection from the updated root
@@ -1120,6 +1146,7 @@ func TestBuildGRUBConfigUsesPreviousKernelForPreviousEntry(t *testing.T) {
 		"6.18.2-previous",
 		"initramfs-6.18.2-previous.img",
 		[]string{"root=UUID=previous", "ro"},
+		0,
 	)
 
 	if !strings.Contains(config, "menuentry 'Test Linux (Previous)'") {
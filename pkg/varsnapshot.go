@@ -0,0 +1,643 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/frostyard/nbc/pkg/types"
+	"github.com/frostyard/std/reporter"
+)
+
+// /var is shared between the root slots, so rolling back the root does not
+// undo what a bad image did to /var. On btrfs, updates therefore take a
+// read-only snapshot of /var first, and a rollback can restore it.
+//
+// Install creates /var as the subvolume var and makes it the default
+// subvolume, which is what /var mounts. Snapshots are subvolumes in
+// .nbc-snapshots at the top level of the var filesystem, next to it. A
+// restore makes a writable copy of a snapshot the default subvolume instead,
+// so /var mounts it on the next boot. The subvolume it replaces is recorded
+// like a snapshot, so the restore can be undone until retention removes it.
+
+const (
+	// DefaultVarSnapshotKeep is how many pre-update snapshots are kept by
+	// default. Scheduled snapshots are off by default.
+	DefaultVarSnapshotKeep = 3
+
+	// Kinds of /var snapshots. Retention applies to each kind separately;
+	// manual snapshots are kept until deleted. Replaced snapshots are the
+	// writable subvolumes /var mounted before a restore, kept as many as
+	// pre-update snapshots.
+	VarSnapshotUpdate    = "update"
+	VarSnapshotScheduled = "scheduled"
+	VarSnapshotManual    = "manual"
+	VarSnapshotReplaced  = "replaced"
+
+	// VarSnapshotTimer is the systemd timer taking scheduled snapshots
+	VarSnapshotTimer = "nbc-var-snapshot.timer"
+	// varSnapshotService is the service VarSnapshotTimer starts
+	varSnapshotService = "nbc-var-snapshot.service"
+
+	// varSnapshotsDir holds the snapshots at the top level of the var
+	// filesystem
+	varSnapshotsDir = ".nbc-snapshots"
+	// varSubvolume is the subvolume install creates for /var
+	varSubvolume = "var"
+	// varRestoredPrefix starts the name of the subvolume a restore creates
+	varRestoredPrefix = "var-restored-"
+)
+
+const varSnapshotServiceContent = `[Unit]
+Description=Take a scheduled nbc snapshot of /var
+Documentation=https://github.com/frostyard/nbc
+ConditionPathExists=/run/nbc-booted
+ConditionFileIsExecutable=/usr/bin/nbc
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/nbc snapshot create --scheduled
+`
+
+const varSnapshotTimerContent = `[Unit]
+Description=Scheduled nbc snapshots of /var
+Documentation=https://github.com/frostyard/nbc
+
+[Timer]
+OnCalendar=daily
+RandomizedDelaySec=1h
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+
+// CreateVarSubvolume creates the subvolume /var lives in on the freshly
+// formatted btrfs var partition, and makes it the default subvolume that
+// MountPartitions and the kernel command line mount. A restore can then swap
+// it for a copy of a snapshot, and retention can delete it later.
+func CreateVarSubvolume(ctx context.Context, scheme *PartitionScheme, dryRun bool, progress reporter.Reporter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would create subvolume %s on %s", varSubvolume, scheme.VarPartition)
+		return nil
+	}
+
+	progress.Message("Creating subvolume %s...", varSubvolume)
+	err := withTopLevel(ctx, scheme.GetVarDevice(), func(top string) error {
+		subvolume := filepath.Join(top, varSubvolume)
+		if err := btrfsSubvolume(ctx, "create", subvolume); err != nil {
+			return err
+		}
+		return setDefaultSubvolume(ctx, subvolume, top)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create var subvolume: %w", err)
+	}
+	return nil
+}
+
+// setDefaultSubvolume makes subvolume the default subvolume of the btrfs
+// filesystem whose top level is mounted at top
+func setDefaultSubvolume(ctx context.Context, subvolume, top string) error {
+	output, err := exec.CommandContext(ctx, "btrfs", "inspect-internal", "rootid", subvolume).Output()
+	if err != nil {
+		return fmt.Errorf("failed to get subvolume ID of %s: %w", filepath.Base(subvolume), err)
+	}
+	if output, err := exec.CommandContext(ctx, "btrfs", "subvolume", "set-default", strings.TrimSpace(string(output)), top).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set default subvolume: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// varMountedSubvolume returns the path of the subvolume mounted at /var below
+// the top level of its filesystem, or "" for the top level itself
+var varMountedSubvolume = func(ctx context.Context) (string, error) {
+	output, err := exec.CommandContext(ctx, "findmnt", "--noheadings", "--output", "FSROOT", "--mountpoint", "/var").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the /var mount: %w", err)
+	}
+	return strings.Trim(strings.TrimSpace(string(output)), "/"), nil
+}
+
+// varMount returns the device and filesystem type mounted at /var
+var varMount = func(ctx context.Context) (device, fsType string, err error) {
+	output, err := exec.CommandContext(ctx, "findmnt", "--noheadings", "--nofsroot", "--output", "SOURCE,FSTYPE", "--mountpoint", "/var").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find the /var mount: %w", err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("/var is not a separate mount")
+	}
+	return fields[0], fields[1], nil
+}
+
+// btrfsVarDevice returns the device mounted at /var, or an error when /var is
+// not on btrfs and cannot be snapshotted
+func btrfsVarDevice(ctx context.Context) (string, error) {
+	device, fsType, err := varMount(ctx)
+	if err != nil {
+		return "", err
+	}
+	if fsType != "btrfs" {
+		return "", fmt.Errorf("/var is on %s; snapshots require btrfs", fsType)
+	}
+	return device, nil
+}
+
+// varSnapshotConfig returns the snapshot config of config, with the defaults
+// filled in when there is none yet
+func varSnapshotConfig(config *SystemConfig) *VarSnapshotConfig {
+	if config.VarSnapshots == nil {
+		config.VarSnapshots = &VarSnapshotConfig{KeepUpdate: DefaultVarSnapshotKeep}
+	}
+	return config.VarSnapshots
+}
+
+// keep returns how many snapshots of kind are kept, or -1 for no limit
+func (c *VarSnapshotConfig) keep(kind string) int {
+	switch kind {
+	case VarSnapshotUpdate, VarSnapshotReplaced:
+		return c.KeepUpdate
+	case VarSnapshotScheduled:
+		return c.KeepScheduled
+	}
+	return -1
+}
+
+// newVarSnapshotName returns the name of a snapshot of kind taken at now
+func newVarSnapshotName(kind string, now time.Time) string {
+	return kind + "-" + now.UTC().Format("20060102T150405Z")
+}
+
+// planVarSnapshotPrune splits snapshots (newest first) into those to keep and
+// those beyond the retention of their kind. Both keep the order of snapshots.
+// The replaced subvolume named mounted is still /var and always kept.
+func planVarSnapshotPrune(c *VarSnapshotConfig, snapshots []VarSnapshot, mounted string) (kept, removed []VarSnapshot) {
+	seen := map[string]int{}
+	for _, s := range snapshots {
+		if s.Kind == VarSnapshotReplaced && s.Name == mounted {
+			kept = append(kept, s)
+			continue
+		}
+		seen[s.Kind]++
+		if keep := c.keep(s.Kind); keep >= 0 && seen[s.Kind] > keep {
+			removed = append(removed, s)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept, removed
+}
+
+// path returns the subvolume of s below the top level of the var filesystem
+// mounted at top
+func (s VarSnapshot) path(top string) string {
+	if s.Kind == VarSnapshotReplaced {
+		return filepath.Join(top, s.Name)
+	}
+	return filepath.Join(top, varSnapshotsDir, s.Name)
+}
+
+// parseBtrfsDefaultSubvolume returns the path of the default subvolume from
+// the output of "btrfs subvolume get-default", or "" for the top level
+func parseBtrfsDefaultSubvolume(output string) string {
+	_, path, found := strings.Cut(strings.TrimSpace(output), " path ")
+	if !found {
+		return ""
+	}
+	return path
+}
+
+// selectVarSnapshot returns the snapshot a rollback restores: the one named
+// name, or else the newest pre-update snapshot taken while imageDigest ran
+func selectVarSnapshot(snapshots []VarSnapshot, name, imageDigest string) (*VarSnapshot, error) {
+	for i, s := range snapshots {
+		if name != "" && s.Name == name {
+			return &snapshots[i], nil
+		}
+		if name == "" && s.Kind == VarSnapshotUpdate && imageDigest != "" && s.ImageDigest == imageDigest {
+			return &snapshots[i], nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("no snapshot of /var named %s", name)
+	}
+	return nil, fmt.Errorf("no snapshot of /var was taken before updating from %s; name one to restore", imageDigest)
+}
+
+// varSnapshotInfo converts a snapshot record to its JSON form
+func varSnapshotInfo(s VarSnapshot) types.VarSnapshotInfo {
+	return types.VarSnapshotInfo{
+		Name:        s.Name,
+		Kind:        s.Kind,
+		Created:     s.Created,
+		ImageRef:    s.ImageRef,
+		ImageDigest: s.ImageDigest,
+	}
+}
+
+// takeVarSnapshot snapshots /var, records the snapshot in config and deletes
+// the snapshots beyond the retention. The caller writes config.
+func takeVarSnapshot(ctx context.Context, config *SystemConfig, kind string, progress reporter.Reporter) (*VarSnapshot, error) {
+	device, err := btrfsVarDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapConfig := varSnapshotConfig(config)
+
+	now := time.Now()
+	snapshot := VarSnapshot{
+		Name:        newVarSnapshotName(kind, now),
+		Kind:        kind,
+		Created:     now.UTC().Format(time.RFC3339),
+		ImageRef:    config.ImageRef,
+		ImageDigest: config.ImageDigest,
+	}
+
+	progress.Message("Snapshotting /var as %s...", snapshot.Name)
+	err = withTopLevel(ctx, device, func(top string) error {
+		if err := os.MkdirAll(filepath.Join(top, varSnapshotsDir), 0700); err != nil {
+			return fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+		return btrfsSubvolume(ctx, "snapshot", "-r", "/var", filepath.Join(top, varSnapshotsDir, snapshot.Name))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot /var: %w", err)
+	}
+
+	mounted, err := varMountedSubvolume(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var removed []VarSnapshot
+	snapConfig.Snapshots, removed = planVarSnapshotPrune(snapConfig, append([]VarSnapshot{snapshot}, snapConfig.Snapshots...), mounted)
+	if err := deleteVarSnapshots(ctx, device, removed, progress); err != nil {
+		progress.Warning("failed to remove old snapshots of /var: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// deleteVarSnapshots deletes the snapshot subvolumes of snapshots. Snapshots
+// that are already gone are skipped. It tries all of them and returns the
+// first error.
+func deleteVarSnapshots(ctx context.Context, device string, snapshots []VarSnapshot, progress reporter.Reporter) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	return withTopLevel(ctx, device, func(top string) error {
+		return deleteVarSnapshotsAt(ctx, top, snapshots, progress)
+	})
+}
+
+// deleteVarSnapshotsAt is deleteVarSnapshots for the var filesystem whose top
+// level is mounted at top
+func deleteVarSnapshotsAt(ctx context.Context, top string, snapshots []VarSnapshot, progress reporter.Reporter) error {
+	var firstErr error
+	for _, s := range snapshots {
+		path := s.path(top)
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := btrfsSubvolume(ctx, "delete", path); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		progress.Message("Removed snapshot %s", s.Name)
+	}
+	return firstErr
+}
+
+// restoreVarSnapshot makes a writable copy of snapshot the default subvolume
+// of the var filesystem, so it is mounted at /var from the next boot on. The
+// nbc state of the running system replaces the snapshot's, since it describes
+// the root slots and boot entries as they are now. The subvolume that was the
+// default is recorded in config as a replaced snapshot, and config is written.
+func restoreVarSnapshot(ctx context.Context, config *SystemConfig, snapshot *VarSnapshot, progress reporter.Reporter) error {
+	device, err := btrfsVarDevice(ctx)
+	if err != nil {
+		return err
+	}
+	mounted, err := varMountedSubvolume(ctx)
+	if err != nil {
+		return err
+	}
+
+	return withTopLevel(ctx, device, func(top string) error {
+		restored := filepath.Join(top, varRestoredPrefix+snapshot.Name)
+		if _, err := os.Lstat(restored); err == nil {
+			progress.Message("Replacing %s from an earlier restore...", filepath.Base(restored))
+			if err := btrfsSubvolume(ctx, "delete", restored); err != nil {
+				return err
+			}
+		}
+		if err := btrfsSubvolume(ctx, "snapshot", snapshot.path(top), restored); err != nil {
+			return err
+		}
+
+		// Record the subvolume the restore replaces before copying the nbc
+		// state, so the restored /var knows about it too
+		output, err := exec.CommandContext(ctx, "btrfs", "subvolume", "get-default", top).Output()
+		if err != nil {
+			return fmt.Errorf("failed to get default subvolume: %w", err)
+		}
+		snapConfig := varSnapshotConfig(config)
+		if replaced := parseBtrfsDefaultSubvolume(string(output)); replaced == "" {
+			// Installed before /var got a subvolume of its own
+			progress.Warning("/var was the top level of its filesystem; the data the restore replaces stays there")
+		} else if replaced != filepath.Base(restored) {
+			snapConfig.Snapshots = slices.Insert(snapConfig.Snapshots, 0, VarSnapshot{
+				Name:    replaced,
+				Kind:    VarSnapshotReplaced,
+				Created: time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+		var removed []VarSnapshot
+		snapConfig.Snapshots, removed = planVarSnapshotPrune(snapConfig, snapConfig.Snapshots, mounted)
+		if err := deleteVarSnapshotsAt(ctx, top, removed, progress); err != nil {
+			progress.Warning("failed to remove old snapshots of /var: %v", err)
+		}
+		if err := WriteSystemConfig(ctx, config, false, reporter.NoopReporter{}); err != nil {
+			return fmt.Errorf("failed to record replaced /var: %w", err)
+		}
+
+		stateDir := filepath.Join(restored, strings.TrimPrefix(SystemConfigDir, "/var/"))
+		if err := os.RemoveAll(stateDir); err != nil {
+			return fmt.Errorf("failed to remove nbc state of the snapshot: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(stateDir), 0755); err != nil {
+			return fmt.Errorf("failed to create nbc state directory: %w", err)
+		}
+		if output, err := exec.CommandContext(ctx, "cp", "-a", SystemConfigDir, stateDir).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to copy nbc state: %w\nOutput: %s", err, string(output))
+		}
+
+		if err := setDefaultSubvolume(ctx, restored, top); err != nil {
+			return err
+		}
+		progress.Message("Restored snapshot %s; /var mounts it from the next boot on", snapshot.Name)
+		return nil
+	})
+}
+
+// snapshotVar takes the pre-update snapshot of /var and records it in the
+// system config
+func (u *SystemUpdater) snapshotVar(ctx context.Context) error {
+	config, err := ReadSystemConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read system config: %w", err)
+	}
+	if config.FilesystemType != "btrfs" || varSnapshotConfig(config).KeepUpdate == 0 {
+		return nil
+	}
+
+	snapshot, err := takeVarSnapshot(ctx, config, VarSnapshotUpdate, u.Progress)
+	if err != nil {
+		return err
+	}
+	if err := WriteSystemConfig(ctx, config, false, reporter.NoopReporter{}); err != nil {
+		return fmt.Errorf("failed to record snapshot of /var: %w", err)
+	}
+	u.varSnapshot = snapshot.Name
+	return nil
+}
+
+// VarSnapshotOptions configures the nbc snapshot subcommands
+type VarSnapshotOptions struct {
+	DryRun bool // Report what would change without changing anything
+}
+
+// varSnapshotOutput builds the output of a snapshot subcommand
+func varSnapshotOutput(action string, config *SystemConfig, dryRun bool) *types.VarSnapshotOutput {
+	snapConfig := varSnapshotConfig(config)
+	output := &types.VarSnapshotOutput{
+		Action:        action,
+		Snapshots:     []types.VarSnapshotInfo{},
+		KeepUpdate:    snapConfig.KeepUpdate,
+		KeepScheduled: snapConfig.KeepScheduled,
+		DryRun:        dryRun,
+	}
+	for _, s := range snapConfig.Snapshots {
+		output.Snapshots = append(output.Snapshots, varSnapshotInfo(s))
+	}
+	return output
+}
+
+// varSnapshotTargets locks the system and reads its config for a snapshot
+// subcommand that changes something
+func varSnapshotTargets() (*FileLock, *SystemConfig, error) {
+	lock, err := AcquireSystemLock()
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := ReadSystemConfig()
+	if err != nil {
+		_ = lock.Release()
+		return nil, nil, fmt.Errorf("failed to read system config: %w", err)
+	}
+	return lock, config, nil
+}
+
+// ListVarSnapshots lists the recorded snapshots of /var and their retention
+func ListVarSnapshots() (*types.VarSnapshotOutput, error) {
+	config, err := ReadSystemConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system config: %w", err)
+	}
+	output := varSnapshotOutput("list", config, false)
+	output.Message = fmt.Sprintf("%d snapshot(s) of /var", len(output.Snapshots))
+	return output, nil
+}
+
+// CreateVarSnapshot takes a snapshot of /var. A scheduled snapshot is only
+// taken when scheduled snapshots are kept, and counts towards their retention;
+// other snapshots are manual and kept until deleted.
+func CreateVarSnapshot(ctx context.Context, opts VarSnapshotOptions, scheduled bool, progress reporter.Reporter) (*types.VarSnapshotOutput, error) {
+	lock, config, err := varSnapshotTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	kind := VarSnapshotManual
+	if scheduled {
+		kind = VarSnapshotScheduled
+		if varSnapshotConfig(config).KeepScheduled == 0 {
+			output := varSnapshotOutput("create", config, opts.DryRun)
+			output.Message = "Scheduled snapshots of /var are disabled"
+			return output, nil
+		}
+	}
+
+	if opts.DryRun {
+		if _, err := btrfsVarDevice(ctx); err != nil {
+			return nil, err
+		}
+		output := varSnapshotOutput("create", config, true)
+		output.Message = fmt.Sprintf("Would take a %s snapshot of /var", kind)
+		return output, nil
+	}
+
+	snapshot, err := takeVarSnapshot(ctx, config, kind, progress)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteSystemConfig(ctx, config, false, progress); err != nil {
+		return nil, fmt.Errorf("failed to record snapshot of /var: %w", err)
+	}
+
+	output := varSnapshotOutput("create", config, false)
+	info := varSnapshotInfo(*snapshot)
+	output.Snapshot = &info
+	output.Message = fmt.Sprintf("Took snapshot %s of /var", snapshot.Name)
+	return output, nil
+}
+
+// DeleteVarSnapshot deletes the snapshot of /var named name
+func DeleteVarSnapshot(ctx context.Context, opts VarSnapshotOptions, name string, progress reporter.Reporter) (*types.VarSnapshotOutput, error) {
+	lock, config, err := varSnapshotTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	snapConfig := varSnapshotConfig(config)
+	i := slices.IndexFunc(snapConfig.Snapshots, func(s VarSnapshot) bool { return s.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("no snapshot of /var named %s", name)
+	}
+	snapshot := snapConfig.Snapshots[i]
+	info := varSnapshotInfo(snapshot)
+	if snapshot.Kind == VarSnapshotReplaced {
+		mounted, err := varMountedSubvolume(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if mounted == snapshot.Name {
+			return nil, fmt.Errorf("snapshot %s is still mounted at /var; delete it after a reboot", name)
+		}
+	}
+
+	if opts.DryRun {
+		output := varSnapshotOutput("delete", config, true)
+		output.Snapshot = &info
+		output.Message = fmt.Sprintf("Would delete snapshot %s of /var", name)
+		return output, nil
+	}
+
+	device, err := btrfsVarDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteVarSnapshots(ctx, device, []VarSnapshot{snapshot}, progress); err != nil {
+		return nil, err
+	}
+	snapConfig.Snapshots = slices.Delete(snapConfig.Snapshots, i, i+1)
+	if err := WriteSystemConfig(ctx, config, false, progress); err != nil {
+		return nil, fmt.Errorf("failed to update system config: %w", err)
+	}
+
+	output := varSnapshotOutput("delete", config, false)
+	output.Snapshot = &info
+	output.Message = fmt.Sprintf("Deleted snapshot %s of /var", name)
+	return output, nil
+}
+
+// SetVarSnapshotRetention sets how many pre-update and scheduled snapshots of
+// /var are kept (nil leaves a count unchanged, 0 stops taking that kind) and
+// deletes the snapshots beyond the new counts
+func SetVarSnapshotRetention(ctx context.Context, opts VarSnapshotOptions, keepUpdate, keepScheduled *int, progress reporter.Reporter) (*types.VarSnapshotOutput, error) {
+	for _, keep := range []*int{keepUpdate, keepScheduled} {
+		if keep != nil && *keep < 0 {
+			return nil, errors.New("snapshot counts cannot be negative")
+		}
+	}
+
+	lock, config, err := varSnapshotTargets()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Release() }()
+
+	snapConfig := varSnapshotConfig(config)
+	if keepUpdate != nil {
+		snapConfig.KeepUpdate = *keepUpdate
+	}
+	if keepScheduled != nil {
+		snapConfig.KeepScheduled = *keepScheduled
+	}
+	// Without a /var mount nothing is mounted, and nothing can be deleted
+	// below either
+	mounted, _ := varMountedSubvolume(ctx)
+	kept, removed := planVarSnapshotPrune(snapConfig, snapConfig.Snapshots, mounted)
+
+	if opts.DryRun {
+		output := varSnapshotOutput("retention", config, true)
+		output.Message = fmt.Sprintf("Would keep %d pre-update and %d scheduled snapshots of /var, deleting %d", snapConfig.KeepUpdate, snapConfig.KeepScheduled, len(removed))
+		return output, nil
+	}
+
+	if len(removed) > 0 {
+		device, err := btrfsVarDevice(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := deleteVarSnapshots(ctx, device, removed, progress); err != nil {
+			return nil, err
+		}
+	}
+	snapConfig.Snapshots = kept
+	if err := WriteSystemConfig(ctx, config, false, progress); err != nil {
+		return nil, fmt.Errorf("failed to update system config: %w", err)
+	}
+
+	output := varSnapshotOutput("retention", config, false)
+	output.Message = fmt.Sprintf("Keeping %d pre-update and %d scheduled snapshots of /var", snapConfig.KeepUpdate, snapConfig.KeepScheduled)
+	return output, nil
+}
+
+// InstallVarSnapshotTimer installs and enables the systemd timer that takes
+// scheduled snapshots of /var. It does nothing until scheduled snapshots are
+// enabled with "nbc snapshot retention --scheduled N".
+func InstallVarSnapshotTimer(ctx context.Context, targetDir string, dryRun bool, progress reporter.Reporter) error {
+	if dryRun {
+		progress.MessagePlain("[DRY RUN] Would install %s", VarSnapshotTimer)
+		return nil
+	}
+
+	unitDir := filepath.Join(targetDir, "usr", "lib", "systemd", "system")
+	wantsDir := filepath.Join(unitDir, "timers.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create systemd unit directory: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(unitDir, varSnapshotService), []byte(varSnapshotServiceContent), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", varSnapshotService, err)
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, VarSnapshotTimer), []byte(varSnapshotTimerContent), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", VarSnapshotTimer, err)
+	}
+
+	link := filepath.Join(wantsDir, VarSnapshotTimer)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace %s: %w", link, err)
+	}
+	if err := os.Symlink(filepath.Join("..", VarSnapshotTimer), link); err != nil {
+		return fmt.Errorf("failed to enable %s: %w", VarSnapshotTimer, err)
+	}
+
+	progress.Message("Installed %s", VarSnapshotTimer)
+	return nil
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frostyard/std/reporter"
+)
+
+func snapshotNames(snapshots []VarSnapshot) []string {
+	names := []string{}
+	for _, s := range snapshots {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestPlanVarSnapshotPrune(t *testing.T) {
+	snapshots := []VarSnapshot{
+		{Name: "u4", Kind: VarSnapshotUpdate},
+		{Name: "s2", Kind: VarSnapshotScheduled},
+		{Name: "m1", Kind: VarSnapshotManual},
+		{Name: "u3", Kind: VarSnapshotUpdate},
+		{Name: "s1", Kind: VarSnapshotScheduled},
+		{Name: "u2", Kind: VarSnapshotUpdate},
+		{Name: "m0", Kind: VarSnapshotManual},
+		{Name: "u1", Kind: VarSnapshotUpdate},
+	}
+
+	tests := []struct {
+		name          string
+		keepUpdate    int
+		keepScheduled int
+		wantKept      []string
+		wantRemoved   []string
+	}{
+		{"newest of each kind", 2, 1, []string{"u4", "s2", "m1", "u3", "m0"}, []string{"s1", "u2", "u1"}},
+		{"nothing beyond", 4, 2, []string{"u4", "s2", "m1", "u3", "s1", "u2", "m0", "u1"}, []string{}},
+		// Manual snapshots are never pruned
+		{"kinds disabled", 0, 0, []string{"m1", "m0"}, []string{"u4", "s2", "u3", "s1", "u2", "u1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &VarSnapshotConfig{KeepUpdate: tt.keepUpdate, KeepScheduled: tt.keepScheduled}
+			kept, removed := planVarSnapshotPrune(config, snapshots, "")
+			if got := snapshotNames(kept); !reflect.DeepEqual(got, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", got, tt.wantKept)
+			}
+			if got := snapshotNames(removed); !reflect.DeepEqual(got, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", got, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestPlanVarSnapshotPrune_Replaced(t *testing.T) {
+	snapshots := []VarSnapshot{
+		{Name: "var-restored-u3", Kind: VarSnapshotReplaced},
+		{Name: "u3", Kind: VarSnapshotUpdate},
+		{Name: "var-restored-u2", Kind: VarSnapshotReplaced},
+		{Name: "var-restored-u1", Kind: VarSnapshotReplaced},
+	}
+
+	// Replaced subvolumes are kept like pre-update snapshots, except the
+	// one /var still mounts, which does not count
+	config := &VarSnapshotConfig{KeepUpdate: 1}
+	kept, removed := planVarSnapshotPrune(config, snapshots, "var-restored-u2")
+	if got, want := snapshotNames(kept), []string{"var-restored-u3", "u3", "var-restored-u2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept = %v, want %v", got, want)
+	}
+	if got, want := snapshotNames(removed), []string{"var-restored-u1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removed = %v, want %v", got, want)
+	}
+}
+
+func TestParseBtrfsDefaultSubvolume(t *testing.T) {
+	tests := map[string]string{
+		"ID 5 (FS_TREE)\n": "",
+		"ID 258 gen 41 top level 5 path var-restored-update-20260101T120000Z\n": "var-restored-update-20260101T120000Z",
+	}
+	for output, want := range tests {
+		if got := parseBtrfsDefaultSubvolume(output); got != want {
+			t.Errorf("parseBtrfsDefaultSubvolume(%q) = %q, want %q", output, got, want)
+		}
+	}
+}
+
+func TestVarSnapshotPath(t *testing.T) {
+	if got := (VarSnapshot{Name: "update-20260101T120000Z", Kind: VarSnapshotUpdate}).path("/top"); got != "/top/.nbc-snapshots/update-20260101T120000Z" {
+		t.Errorf("snapshot path = %s", got)
+	}
+	if got := (VarSnapshot{Name: "var-restored-update-20260101T120000Z", Kind: VarSnapshotReplaced}).path("/top"); got != "/top/var-restored-update-20260101T120000Z" {
+		t.Errorf("replaced path = %s", got)
+	}
+}
+
+func TestSelectVarSnapshot(t *testing.T) {
+	snapshots := []VarSnapshot{
+		{Name: "update-3", Kind: VarSnapshotUpdate, ImageDigest: "sha256:b"},
+		{Name: "scheduled-1", Kind: VarSnapshotScheduled, ImageDigest: "sha256:a"},
+		{Name: "update-2", Kind: VarSnapshotUpdate, ImageDigest: "sha256:a"},
+		{Name: "update-1", Kind: VarSnapshotUpdate, ImageDigest: "sha256:a"},
+	}
+
+	tests := []struct {
+		name    string
+		snap    string
+		digest  string
+		want    string
+		wantErr bool
+	}{
+		{"newest update from the previous image", "", "sha256:a", "update-2", false},
+		{"named", "update-1", "sha256:b", "update-1", false},
+		{"named scheduled", "scheduled-1", "", "scheduled-1", false},
+		{"unknown name", "update-9", "sha256:a", "", true},
+		{"no update from the previous image", "", "sha256:c", "", true},
+		{"previous image unknown", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectVarSnapshot(snapshots, tt.snap, tt.digest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectVarSnapshot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Name != tt.want {
+				t.Errorf("selectVarSnapshot() = %s, want %s", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarSnapshotConfigDefaults(t *testing.T) {
+	config := &SystemConfig{}
+	snapConfig := varSnapshotConfig(config)
+	if snapConfig.KeepUpdate != DefaultVarSnapshotKeep || snapConfig.KeepScheduled != 0 {
+		t.Errorf("defaults = %+v, want %d pre-update and no scheduled snapshots", snapConfig, DefaultVarSnapshotKeep)
+	}
+	if config.VarSnapshots != snapConfig {
+		t.Error("varSnapshotConfig() did not store the defaults in the config")
+	}
+
+	name := newVarSnapshotName(VarSnapshotUpdate, time.Date(2026, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600)))
+	if name != "update-20260304T040607Z" {
+		t.Errorf("newVarSnapshotName() = %s, want update-20260304T040607Z", name)
+	}
+}
+
+func TestInstallVarSnapshotTimer(t *testing.T) {
+	root := t.TempDir()
+	if err := InstallVarSnapshotTimer(t.Context(), root, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("InstallVarSnapshotTimer() error = %v", err)
+	}
+
+	unitDir := filepath.Join(root, "usr", "lib", "systemd", "system")
+	service, err := os.ReadFile(filepath.Join(unitDir, varSnapshotService))
+	if err != nil {
+		t.Fatalf("service not written: %v", err)
+	}
+	if !strings.Contains(string(service), "ExecStart=/usr/bin/nbc snapshot create --scheduled") {
+		t.Errorf("service should take a scheduled snapshot, got:\n%s", service)
+	}
+
+	target, err := os.Readlink(filepath.Join(unitDir, "timers.target.wants", VarSnapshotTimer))
+	if err != nil {
+		t.Fatalf("timer not enabled: %v", err)
+	}
+	if target != "../"+VarSnapshotTimer {
+		t.Errorf("wants symlink = %q, want %q", target, "../"+VarSnapshotTimer)
+	}
+
+	// Installing again (update) must not fail on the existing symlink
+	if err := InstallVarSnapshotTimer(t.Context(), root, false, reporter.NoopReporter{}); err != nil {
+		t.Fatalf("second InstallVarSnapshotTimer() error = %v", err)
+	}
+}